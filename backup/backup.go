@@ -0,0 +1,1864 @@
+// backup/backup.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+// Package backup implements the representation of backups of directory
+// trees that bk stores in a storage.Backend, as well as making them,
+// finding their files, and restoring them, so that other programs can do
+// so as well. Backup and Restore are the simplest way to start; as with
+// the storage package, SetLogger must be called first. They return errors
+// for invalid arguments and for problems with the local files, which are
+// recorded in their results if they only affect particular files; errors
+// reading or writing the storage.Backend, and finding that a backup is
+// corrupt, are fatal, as they are in the storage package.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// Logging
+
+var log *u.Logger
+
+func SetLogger(l *u.Logger) {
+	log = l
+}
+
+///////////////////////////////////////////////////////////////////////////
+// BackupRoot
+
+// BackupRoot is where it all starts; one of these is serialized and
+// stored in the storage backend for each backup.
+type BackupRoot struct {
+	Dir  DirEntry
+	Time time.Time
+	// Files and directories that couldn't be backed up, e.g., due to
+	// permission errors.
+	Errors []BackupError
+	// For incremental backups, the hash of the BackupRoot of the backup
+	// given with --base; it's invalid for full backups and ones made by
+	// older versions of bk.
+	Base storage.Hash
+}
+
+// BackupError records a path that couldn't be backed up and why.
+type BackupError struct {
+	Path  string
+	Error string
+}
+
+// NewRoot creates a new BackupRoot (as is done when doing a new backup).
+func NewRoot(dirpath string) (BackupRoot, error) {
+	return newRoot(localSource{}, dirpath)
+}
+
+func newRoot(src FileSource, dirpath string) (BackupRoot, error) {
+	fi, err := src.Stat(dirpath)
+	if err != nil {
+		return BackupRoot{}, err
+	}
+	if !fi.IsDir() {
+		return BackupRoot{}, errors.New("not a directory")
+	}
+
+	root := BackupRoot{Time: time.Now()}
+	root.Dir, err = NewDirEntry(fi)
+	root.Dir.Name = "/" // TODO: unneeded?
+	return root, err
+}
+
+// Reads a BackupRoot from storage, given its hash.
+func ReadRoot(hash storage.Hash, backend storage.Backend) (BackupRoot, error) {
+	r, err := backend.Read(hash)
+	if err != nil {
+		return BackupRoot{}, err
+	}
+
+	d := gob.NewDecoder(r)
+	var root BackupRoot
+	if err = d.Decode(&root); err != nil {
+		return root, err
+	}
+	return root, r.Close()
+}
+
+func (br BackupRoot) Bytes() []byte {
+	var buf bytes.Buffer
+	e := gob.NewEncoder(&buf)
+	log.CheckError(e.Encode(br))
+	return buf.Bytes()
+}
+
+///////////////////////////////////////////////////////////////////////////
+// DirEntry
+
+// Each file or directory that is in the backup has an associated DirEntry.
+type DirEntry struct {
+	// Just the file name, not its full path.
+	Name string
+	// If non-nil, stores the file's contents. Empty files have nil
+	// contents and an invalid hash, so it's important to check the Size
+	// before trying to make use of either.  Symlink targets are always
+	// stored here.
+	//
+	// TODO: for directories with just a few files, is it worth serializing
+	// their children directly into this?
+	Contents []byte
+	// For a file, if Contents is nil, Hash points to its contents.  For a
+	// directory, it gives the serialized []DirEntry for the files in a
+	// directory.
+	Hash storage.MerkleHash
+	// For a file whose contents are stored using Hash, the hash of its
+	// contents, computed with storage.HashBytes, so that they can be
+	// verified when it's restored. It's zero for other files and for
+	// files backed up by older versions of bk.
+	Checksum storage.Hash
+	// For a file whose contents are stored in more than one chunk, the
+	// sizes of the chunks, as written by writeChunkSizes, so that a range
+	// of the file can be read without reading all of the chunks before
+	// it. It's nil for other files and for files backed up by older
+	// versions of bk.
+	Index *storage.MerkleHash
+	// Not used for directories or symlinks.
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	// Creation time, if available on the platform where the backup was
+	// made; the zero time otherwise.
+	BirthTime time.Time
+	// May be nil if ownership isn't available on the platform where the
+	// backup was made or for backups made by older versions of bk.
+	Owner *FileOwner
+}
+
+func NewDirEntry(fi os.FileInfo) (DirEntry, error) {
+	e := DirEntry{
+		Name:      fi.Name(),
+		Size:      fi.Size(),
+		ModTime:   fi.ModTime(),
+		BirthTime: fileBirthTime(fi),
+		Mode:      fi.Mode(),
+		Owner:     getFileOwner(fi),
+	}
+	if !e.IsDir() && !e.IsFile() && !e.IsSymLink() {
+		return DirEntry{}, errors.New("unhandled file type")
+	}
+	return e, nil
+}
+
+func (e *DirEntry) IsDir() bool {
+	return e.Mode.IsDir()
+}
+
+func (e *DirEntry) IsFile() bool {
+	return e.Mode&os.ModeType == 0
+}
+
+// IsFileMode reports whether the given mode is that of a regular file.
+func IsFileMode(mode os.FileMode) bool {
+	return mode&os.ModeType == 0
+}
+
+func (e *DirEntry) IsSymLink() bool {
+	return e.Mode&os.ModeSymlink != 0
+}
+
+// A directory's entries are stored in one of two encodings. Originally,
+// they were gob-encoded as a single []DirEntry. Since repository format
+// version 5, they may instead be a zero byte (which never starts the
+// encoding of a []DirEntry) followed by individually gob-encoded
+// DirEntry values, so that they can be written and read one at a time
+// without holding an entire directory's worth in memory. In both cases,
+// the entries are sorted by name.
+const dirEntryStreamMarker = 0
+
+// Directories with more entries than this are stored with the streamed
+// encoding, if it's allowed; smaller ones use the original encoding so
+// that older versions of bk can read them.
+var maxBufferedDirEntries = 1 << 16
+
+// dirEntryWriter stores the entries of a directory as they're provided.
+type dirEntryWriter struct {
+	backend   storage.Backend
+	splitBits uint
+	// Whether the streamed encoding may be used. Entries are accumulated
+	// until there are more than maxBufferedDirEntries of them.
+	stream  bool
+	entries []DirEntry
+	// Once they're streamed, entries are written to pw as they're added
+	// and a goroutine stores them and returns the resulting hash along
+	// done.
+	pw   *io.PipeWriter
+	enc  *gob.Encoder
+	done chan storage.MerkleHash
+}
+
+func newDirEntryWriter(backend storage.Backend, splitBits uint, stream bool) *dirEntryWriter {
+	return &dirEntryWriter{backend: backend, splitBits: splitBits, stream: stream}
+}
+
+// startStream switches to the streamed encoding, writing the entries that
+// have been accumulated so far.
+func (w *dirEntryWriter) startStream() {
+	// Older versions of bk can't read the streamed encoding.
+	storage.RequireFormat(w.backend, 5)
+
+	pr, pw := io.Pipe()
+	w.pw = pw
+	w.done = make(chan storage.MerkleHash)
+	go func() {
+		w.done <- storage.SplitAndStore(pr, w.backend, w.splitBits)
+	}()
+	_, err := pw.Write([]byte{dirEntryStreamMarker})
+	log.CheckError(err)
+	w.enc = gob.NewEncoder(pw)
+	for _, e := range w.entries {
+		log.CheckError(w.enc.Encode(e))
+	}
+	w.entries = nil
+}
+
+// Add adds the given entry; entries must be added in order of their names.
+func (w *dirEntryWriter) Add(e DirEntry) {
+	if w.enc == nil && w.stream && len(w.entries) == maxBufferedDirEntries {
+		w.startStream()
+	}
+	if w.enc != nil {
+		log.CheckError(w.enc.Encode(e))
+	} else {
+		w.entries = append(w.entries, e)
+	}
+}
+
+// Close finishes storing the entries, returning their hash.
+func (w *dirEntryWriter) Close() storage.MerkleHash {
+	if w.enc == nil {
+		var buf bytes.Buffer
+		e := gob.NewEncoder(&buf)
+		log.CheckError(e.Encode(w.entries))
+		return storage.SplitAndStore(&buf, w.backend, w.splitBits)
+	}
+	log.CheckError(w.pw.Close())
+	return <-w.done
+}
+
+// dirEntryReader returns the entries of a stored directory one at a time,
+// in either encoding.
+type dirEntryReader struct {
+	r   io.ReadCloser
+	dec *gob.Decoder
+	// With the original encoding, all of the entries are decoded up
+	// front.
+	entries []DirEntry
+	// The next entry to be returned, if next is true.
+	peeked DirEntry
+	next   bool
+}
+
+func newDirEntryReader(hash storage.MerkleHash, backend storage.Backend) *dirEntryReader {
+	r := hash.NewReader(nil, backend)
+	br := bufio.NewReader(r)
+	d := &dirEntryReader{r: r}
+	if b, err := br.Peek(1); err == nil && b[0] == dirEntryStreamMarker {
+		br.ReadByte()
+		d.dec = gob.NewDecoder(br)
+	} else {
+		log.CheckError(gob.NewDecoder(br).Decode(&d.entries))
+	}
+	d.advance()
+	return d
+}
+
+func (d *dirEntryReader) advance() {
+	if d.dec == nil {
+		d.next = len(d.entries) > 0
+		if d.next {
+			d.peeked = d.entries[0]
+			d.entries = d.entries[1:]
+		}
+		return
+	}
+
+	// Decode into a new value each time, since gob leaves fields that
+	// are zero in the encoded value unchanged.
+	var e DirEntry
+	err := d.dec.Decode(&e)
+	if err == io.EOF {
+		d.next = false
+		return
+	}
+	log.CheckError(err)
+	d.peeked, d.next = e, true
+}
+
+// Next returns the next entry; its second return value is false once
+// there are no more.
+func (d *dirEntryReader) Next() (DirEntry, bool) {
+	e, ok := d.peeked, d.next
+	if ok {
+		d.advance()
+	}
+	return e, ok
+}
+
+// Find skips past the entries with names that sort before the given one,
+// returning the entry with that name, if there is one. Since entries are
+// sorted, successive calls must be made with increasing names.
+func (d *dirEntryReader) Find(name string) *DirEntry {
+	for d.next && d.peeked.Name < name {
+		d.advance()
+	}
+	if d.next && d.peeked.Name == name {
+		e := d.peeked
+		return &e
+	}
+	return nil
+}
+
+func (d *dirEntryReader) Close() {
+	log.CheckError(d.r.Close())
+}
+
+// DecodeDirEntries decodes the given stored directory, in either
+// encoding. Unlike dirEntryReader, it returns the entries that were
+// decoded before any error is encountered rather than treating errors as
+// fatal, so that it can be used to examine damaged repositories.
+func DecodeDirEntries(b []byte) ([]DirEntry, error) {
+	if len(b) == 0 || b[0] != dirEntryStreamMarker {
+		var entries []DirEntry
+		err := gob.NewDecoder(bytes.NewReader(b)).Decode(&entries)
+		return entries, err
+	}
+
+	var entries []DirEntry
+	dec := gob.NewDecoder(bytes.NewReader(b[1:]))
+	for {
+		var e DirEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+// FindDirEntry returns the entry with the given name in the stored
+// directory with the given hash. With the streamed encoding, only as much
+// of the directory is read as is needed to find it, so that looking up a
+// path in a backup only requires reading the directories along it.
+func FindDirEntry(hash storage.MerkleHash, name string, backend storage.Backend) (DirEntry, bool) {
+	d := newDirEntryReader(hash, backend)
+	defer d.Close()
+	for {
+		e, ok := d.Next()
+		if !ok || e.Name == name {
+			return e, ok
+		}
+	}
+}
+
+// ReadDirEntries returns all of the entries of the directory with the
+// given hash.
+func ReadDirEntries(hash storage.MerkleHash, backend storage.Backend) []DirEntry {
+	d := newDirEntryReader(hash, backend)
+	defer d.Close()
+	var entries []DirEntry
+	for {
+		e, ok := d.Next()
+		if !ok {
+			return entries
+		}
+		entries = append(entries, e)
+	}
+}
+
+func (e *DirEntry) GetContentsReader(sem chan bool, backend storage.Backend) (io.ReadCloser, error) {
+	if !e.IsFile() {
+		return nil, errors.New("not a file")
+	}
+	if e.Size == 0 || e.Contents != nil {
+		// TODO: I believe that a nil byte slice is ok to pass to
+		// NewReader, but should check.
+		return ioutil.NopCloser(bytes.NewReader(e.Contents)), nil
+	}
+	return e.Hash.NewReader(sem, backend), nil
+}
+
+// GetRangeReader returns an io.ReadCloser that supplies length bytes of
+// the file's contents starting at the given offset, or all of them after
+// it if length is negative. If the file has a chunk index, only the
+// chunks that overlap the range are read.
+func (e *DirEntry) GetRangeReader(offset, length int64, sem chan bool,
+	backend storage.Backend) (io.ReadCloser, error) {
+	return e.GetRangeReaderWithChunkSizes(offset, length, e.ChunkSizes(backend), sem, backend)
+}
+
+// GetRangeReaderWithChunkSizes is like GetRangeReader, but uses the given
+// chunk sizes, as returned by ChunkSizes, rather than reading them.
+func (e *DirEntry) GetRangeReaderWithChunkSizes(offset, length int64, chunkSizes []int64,
+	sem chan bool, backend storage.Backend) (io.ReadCloser, error) {
+	if !e.IsFile() {
+		return nil, errors.New("not a file")
+	}
+	if offset < 0 {
+		return nil, errors.New("negative offset")
+	}
+	if offset > e.Size {
+		offset = e.Size
+	}
+	if e.Size == 0 || e.Contents != nil {
+		b := e.Contents[offset:]
+		if length >= 0 && length < int64(len(b)) {
+			b = b[:length]
+		}
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	return e.Hash.NewRangeReader(offset, length, chunkSizes, sem, backend)
+}
+
+// ChunkSizes returns the sizes of the chunks that the file's contents were
+// split into if it has a chunk index, or nil otherwise. Callers that read
+// many ranges of the same file can read them once and pass them to
+// GetRangeReaderWithChunkSizes.
+func (e *DirEntry) ChunkSizes(backend storage.Backend) []int64 {
+	if !e.IsFile() || e.Index == nil || e.Contents != nil {
+		return nil
+	}
+	return ReadChunkSizes(*e.Index, backend)
+}
+
+// WriteChunkSizes stores the given sizes of the chunks that a file's
+// contents were split into, returning the hash of the index for
+// DirEntry.Index.
+func WriteChunkSizes(sizes []int64, backend storage.Backend, splitBits uint) storage.MerkleHash {
+	var buf []byte
+	for _, s := range sizes {
+		var b [binary.MaxVarintLen64]byte
+		buf = append(buf, b[:binary.PutUvarint(b[:], uint64(s))]...)
+	}
+	return storage.SplitAndStore(bytes.NewReader(buf), backend, splitBits)
+}
+
+// ReadChunkSizes returns the chunk sizes stored by WriteChunkSizes.
+func ReadChunkSizes(index storage.MerkleHash, backend storage.Backend) []int64 {
+	r := index.NewReader(nil, backend)
+	defer r.Close()
+	br := bufio.NewReader(r)
+	var sizes []int64
+	for {
+		s, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return sizes
+		}
+		log.CheckError(err)
+		sizes = append(sizes, int64(s))
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+// BackupOptions specifies how Backup backs up a directory.
+type BackupOptions struct {
+	// Matching bits for the rolling checksum used to split files.
+	SplitBits uint
+	// Paths containing any of these strings aren't backed up.
+	ExcludedPaths []string
+	// Directories below the one being backed up that contain a file with
+	// any of these names (e.g., ".nobackup") aren't backed up.
+	ExcludeIfPresent []string
+	// If true, files and directories with the "nodump" attribute set
+	// aren't backed up; see IsNoDump. It's only checked when backing up
+	// the local filesystem, and not for files that Cache says are
+	// unchanged.
+	ExcludeNoDump bool
+	// If non-nil, files that are unchanged according to the cache aren't
+	// read; the cache is updated with the files that are.
+	Cache *FileCache
+	// If non-zero, the root hash of an earlier backup of the directory
+	// that the backup is made incrementally from: files that have the same
+	// size and modification time there aren't read again.
+	Base storage.Hash
+	// Where the files are read from; if nil, they're read from the local
+	// filesystem.
+	Source FileSource
+	// If true, the entries of huge directories are stored as they're
+	// backed up rather than all at once, which keeps memory use bounded.
+	// Older versions of bk can't read them, so the repository's format
+	// version is raised to 5 when the first such directory is stored;
+	// repositories without one are left as they are.
+	StreamDirEntries bool
+	// If true, the backup is made so that backups of identical copies of
+	// a directory tree made on different machines are identical: the
+	// backup's time isn't recorded and the entries' metadata is
+	// normalized by normalizeEntry. Cache should be nil, since entries
+	// from it may have been made by older versions of bk that didn't
+	// record the same information, and deterministic backups can't be
+	// incremental.
+	Deterministic bool
+	// If non-zero, the time that the backup is recorded as having been
+	// made, rather than the current time; it's ignored for deterministic
+	// backups.
+	Time time.Time
+}
+
+// FileSource provides access to the files being backed up.
+type FileSource interface {
+	// Stat returns information about the file at the given path,
+	// following symbolic links.
+	Stat(path string) (os.FileInfo, error)
+	// ReadDir returns information about the entries of the given
+	// directory, sorted by name, without following symbolic links.
+	ReadDir(path string) ([]os.FileInfo, error)
+	Readlink(path string) (string, error)
+	Open(path string) (SourceFile, error)
+	// Join joins path elements using the source's path separator.
+	Join(elem ...string) string
+}
+
+// SourceFile is a file that's open for reading from a FileSource.
+type SourceFile interface {
+	io.ReadCloser
+	Stat() (os.FileInfo, error)
+}
+
+// localSource is a FileSource for the local filesystem.
+type localSource struct{}
+
+func (localSource) Stat(path string) (os.FileInfo, error)      { return os.Stat(path) }
+func (localSource) ReadDir(path string) ([]os.FileInfo, error) { return ioutil.ReadDir(path) }
+func (localSource) Readlink(path string) (string, error)       { return os.Readlink(path) }
+func (localSource) Join(elem ...string) string                 { return filepath.Join(elem...) }
+
+func (localSource) Open(path string) (SourceFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// BackupResult describes a backup made by Backup.
+type BackupResult struct {
+	// Hash of the stored BackupRoot, which identifies the backup.
+	Hash storage.Hash
+	Root BackupRoot
+	// Files that were still changing after multiple attempts to read
+	// them.
+	ModifiedFiles []string
+	// Paths that were skipped due to errors; these are also recorded in
+	// Root.
+	Errors []BackupError
+	// The number of regular files found and how many of them were read,
+	// either because they weren't in the base backup or the file cache
+	// (NewFiles) or because they may have changed since (ChangedFiles),
+	// along with the total size of the files that were read.
+	Files, NewFiles, ChangedFiles int
+	BytesRead                     int64
+}
+
+// backupContext holds state that's used throughout a backup.
+type backupContext struct {
+	context  context.Context
+	backend  storage.Backend
+	opts     BackupOptions
+	src      FileSource
+	errors   []BackupError
+	modified []string
+	// Counts of files for the BackupResult.
+	files, newFiles, changedFiles int
+	bytesRead                     int64
+}
+
+func newBackupContext(ctx context.Context, backend storage.Backend,
+	opts BackupOptions) *backupContext {
+	bc := &backupContext{context: ctx, backend: backend, opts: opts, src: opts.Source}
+	if bc.src == nil {
+		bc.src = localSource{}
+	}
+	return bc
+}
+
+// fileError reports an error for the given path and records it so that
+// it's stored with the backup.  The backup continues without the path.
+func (ctx *backupContext) fileError(path string, err error) {
+	log.Error("%s: %s", path, err)
+	ctx.errors = append(ctx.errors, BackupError{Path: path, Error: err.Error()})
+}
+
+// writeRoot stores the given BackupRoot, along with the errors encountered
+// during the backup, and returns the result of the backup.
+func (ctx *backupContext) writeRoot(r BackupRoot) *BackupResult {
+	r.Errors = ctx.errors
+	return &BackupResult{Hash: ctx.backend.Write(r.Bytes()), Root: r,
+		ModifiedFiles: ctx.modified, Errors: ctx.errors, Files: ctx.files,
+		NewFiles: ctx.newFiles, ChangedFiles: ctx.changedFiles,
+		BytesRead: ctx.bytesRead}
+}
+
+// Backup backs up the directory at the given path, which is read from
+// opts.Source, to the given backend. If the path is a regular file
+// instead, the backup's root directory holds just that file, as it would
+// with BackupPaths. Files and directories that can't be
+// read are reported via the logger and recorded in the result, but they
+// don't cause the backup to fail. The backup's data isn't certain to be
+// stored until the backend's SyncWrites method has been called, and no
+// name is recorded for it; the bk command records the returned hash in
+// metadata named "backup-" followed by the backup's name and time. If ctx
+// is canceled, the backup stops and ctx's error is returned.
+func Backup(ctx context.Context, dirpath string, backend storage.Backend,
+	opts BackupOptions) (*BackupResult, error) {
+	if opts.Deterministic && opts.Base != (storage.Hash{}) {
+		return nil, errors.New("deterministic backups can't be incremental")
+	}
+	bc := newBackupContext(ctx, backend, opts)
+	if fi, err := bc.src.Stat(dirpath); err == nil && IsFileMode(fi.Mode()) {
+		return bc.backupSources([]string{dirpath})
+	}
+	r, err := newRoot(bc.src, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Time.IsZero() {
+		r.Time = opts.Time
+	}
+	if opts.Deterministic {
+		r.Time = time.Time{}
+		normalizeEntry(&r.Dir)
+	}
+
+	baseRootEntries, err := bc.readBaseRoot(&r)
+	if err != nil {
+		return nil, err
+	}
+	if baseRootEntries != nil {
+		defer baseRootEntries.Close()
+	}
+
+	r.Dir.Hash, err = bc.backupDirContents(dirpath, baseRootEntries)
+	if err != nil {
+		return nil, err
+	}
+	return bc.writeRoot(r), nil
+}
+
+// BackupPaths backs up the given directories and regular files together in
+// a single backup whose root directory has an entry for each one, named
+// with its last path element; those names must differ. Otherwise, it works
+// just like Backup, which is what it uses if it's given a single
+// directory, so that the directory's contents are then at the root.
+// Excluded paths are matched against the paths of the files as they're
+// found in the directories, so exclusions work the same as they do for
+// backups of each directory on its own.
+func BackupPaths(ctx context.Context, paths []string, backend storage.Backend,
+	opts BackupOptions) (*BackupResult, error) {
+	if len(paths) == 1 {
+		return Backup(ctx, paths[0], backend, opts)
+	}
+	if opts.Deterministic && opts.Base != (storage.Hash{}) {
+		return nil, errors.New("deterministic backups can't be incremental")
+	}
+	return newBackupContext(ctx, backend, opts).backupSources(paths)
+}
+
+// backupSources makes a backup as described for BackupPaths, even if
+// it's given a single path.
+func (bc *backupContext) backupSources(paths []string) (*BackupResult, error) {
+	opts, backend := bc.opts, bc.backend
+
+	// Check all of the paths before starting, so that a mistake in one of
+	// them doesn't leave a backup of just some of them.
+	type source struct {
+		path  string
+		info  os.FileInfo
+		entry DirEntry
+	}
+	var sources []source
+	for _, path := range paths {
+		fi, err := bc.src.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() && !IsFileMode(fi.Mode()) {
+			return nil, fmt.Errorf("%s: not a directory or regular file", path)
+		}
+		e, err := NewDirEntry(fi)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if e.Name == "/" || e.Name == "." || e.Name == ".." {
+			return nil, fmt.Errorf("%s: can't be backed up along with other "+
+				"paths, since it doesn't have a name", path)
+		}
+		sources = append(sources, source{path, fi, e})
+	}
+	// Entries are stored sorted by name.
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].entry.Name < sources[j].entry.Name
+	})
+	for i := 1; i < len(sources); i++ {
+		if sources[i].entry.Name == sources[i-1].entry.Name {
+			return nil, fmt.Errorf("%s, %s: paths backed up together must "+
+				"have different names", sources[i-1].path, sources[i].path)
+		}
+	}
+
+	// The root directory doesn't exist anywhere, so it's given the time
+	// of the backup.
+	r := BackupRoot{Time: time.Now()}
+	if !opts.Time.IsZero() {
+		r.Time = opts.Time
+	}
+	r.Dir = DirEntry{Name: "/", Mode: os.ModeDir | 0755, ModTime: r.Time}
+	if opts.Deterministic {
+		r.Time = time.Time{}
+		r.Dir.ModTime = time.Time{}
+		normalizeEntry(&r.Dir)
+	}
+
+	baseRootEntries, err := bc.readBaseRoot(&r)
+	if err != nil {
+		return nil, err
+	}
+	if baseRootEntries != nil {
+		defer baseRootEntries.Close()
+	}
+
+	entries := newDirEntryWriter(backend, opts.SplitBits, opts.StreamDirEntries)
+	for _, s := range sources {
+		var baseEntry *DirEntry
+		if baseRootEntries != nil {
+			if e := baseRootEntries.Find(s.entry.Name); e != nil && e.Mode == s.entry.Mode {
+				baseEntry = e
+			}
+		}
+		if bc.isNoDump(s.path, s.info) {
+			log.Verbose("%s: excluding from backup since it has the nodump attribute", s.path)
+			continue
+		}
+		if s.entry.IsFile() {
+			err = bc.backupFileEntry(s.path, s.info, baseEntry, &s.entry)
+		} else {
+			var childEntries *dirEntryReader
+			if baseEntry != nil {
+				childEntries = newDirEntryReader(baseEntry.Hash, backend)
+			}
+			s.entry.Hash, err = bc.backupDirContents(s.path, childEntries)
+			if childEntries != nil {
+				childEntries.Close()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if opts.Deterministic {
+			normalizeEntry(&s.entry)
+		}
+		entries.Add(s.entry)
+	}
+	r.Dir.Hash = entries.Close()
+	return bc.writeRoot(r), nil
+}
+
+// readBaseRoot returns a reader for the entries of the root directory of
+// the base backup given in the options, if there is one, recording it as
+// the base of the given root.
+func (ctx *backupContext) readBaseRoot(r *BackupRoot) (*dirEntryReader, error) {
+	if ctx.opts.Base == (storage.Hash{}) {
+		return nil, nil
+	}
+	baseRoot, err := ReadRoot(ctx.opts.Base, ctx.backend)
+	if err != nil {
+		return nil, err
+	}
+	r.Base = ctx.opts.Base
+	return newDirEntryReader(baseRoot.Dir.Hash, ctx.backend), nil
+}
+
+// normalizeEntry updates the given entry for a deterministic backup,
+// clearing or standardizing the parts of it that may differ between
+// identical copies of a file on different machines: times are recorded
+// in UTC, since their encoding includes the time zone, creation times
+// and the names of owners aren't recorded, since they depend on the
+// platform and the machine's users (owners' ids are kept), directories'
+// sizes, which depend on the filesystem, are zero, and symlinks'
+// permissions, which are only meaningful on some platforms, are all
+// 0777.
+func normalizeEntry(e *DirEntry) {
+	e.ModTime = e.ModTime.UTC()
+	e.BirthTime = time.Time{}
+	if e.Owner != nil {
+		e.Owner = &FileOwner{Uid: e.Owner.Uid, Gid: e.Owner.Gid}
+	}
+	switch {
+	case e.IsDir():
+		e.Size = 0
+	case e.IsSymLink():
+		e.Mode = os.ModeSymlink | 0777
+	}
+}
+
+// Back up the contents of the given directory (and subdirectories)
+// returning a MerkleHash that identifies the serialized []DirEntry for the
+// contents. If we're unable to backup various individual files or
+// directories along the way, an error is logged but a nil error is
+// returned from this function; we don't want to report failure if, for
+// example, we don't have permissions to read a file.
+func (ctx *backupContext) backupDirContents(dirpath string,
+	baseEntries *dirEntryReader) (storage.MerkleHash, error) {
+	backend := ctx.backend
+	var fileinfo []os.FileInfo
+	err := withRetries(dirpath, func() (err error) {
+		fileinfo, err = ctx.src.ReadDir(dirpath)
+		return err
+	})
+	if err != nil {
+		return storage.MerkleHash{}, err
+	}
+
+	entries := newDirEntryWriter(backend, ctx.opts.SplitBits, ctx.opts.StreamDirEntries)
+	for i, f := range fileinfo {
+		if err := ctx.context.Err(); err != nil {
+			return storage.MerkleHash{}, err
+		}
+
+		// Drop our reference to the os.FileInfo so that it can be
+		// garbage collected once it's been handled.
+		fileinfo[i] = nil
+
+		// Try to find a corresponding file/directory in the base backup, if
+		// one was provided. Both are sorted by name, so this is a linear
+		// scan through the base entries over the course of the loop.
+		var baseEntry *DirEntry
+		if baseEntries != nil {
+			if e := baseEntries.Find(f.Name()); e != nil && e.Mode == f.Mode() {
+				baseEntry = e
+			}
+		}
+
+		path := ctx.src.Join(dirpath, f.Name())
+		if IsExcluded(path, ctx.opts.ExcludedPaths) {
+			log.Verbose("%s: excluding from backup", path)
+			continue
+		}
+		if f.IsDir() && f.Name() == SnapshotDirName {
+			log.Verbose("%s: excluding snapshot from backup", path)
+			continue
+		}
+		if ctx.isNoDump(path, f) {
+			log.Verbose("%s: excluding from backup since it has the nodump attribute", path)
+			continue
+		}
+
+		log.Debug("%s: backing up", path)
+		e, err := NewDirEntry(f)
+		if err != nil {
+			ctx.fileError(path, err)
+			continue
+		}
+
+		switch {
+		case e.IsDir():
+			if m := ExclusionMarker(ctx.src, path, ctx.opts.ExcludeIfPresent); m != "" {
+				log.Verbose("%s: excluding from backup since it contains %s", path, m)
+				continue
+			}
+			var childEntries *dirEntryReader
+			if baseEntry != nil {
+				// Get the subdirectory's contents from the base backup
+				// before continuing recursively.
+				childEntries = newDirEntryReader(baseEntry.Hash, backend)
+			}
+			e.Hash, err = ctx.backupDirContents(path, childEntries)
+			if childEntries != nil {
+				childEntries.Close()
+			}
+			if err != nil && ctx.context.Err() != nil {
+				return storage.MerkleHash{}, err
+			} else if err != nil {
+				ctx.fileError(path, err)
+				continue
+			}
+		case e.IsFile():
+			if err := ctx.backupFileEntry(path, f, baseEntry, &e); err != nil {
+				ctx.fileError(path, err)
+				continue
+			}
+		case e.IsSymLink():
+			target, err := ctx.src.Readlink(path)
+			if err != nil {
+				ctx.fileError(path, err)
+				continue
+			}
+			e.Contents = []byte(target)
+		default:
+			ctx.fileError(path, errors.New("unexpected file type"))
+			continue
+		}
+
+		if ctx.opts.Deterministic {
+			normalizeEntry(&e)
+		}
+		entries.Add(e)
+	}
+
+	return entries.Close(), nil
+}
+
+// SnapshotDirName is the name of the btrfs snapshots that "bk backup
+// --snapshot" makes in the directory being backed up. Directories with
+// this name aren't backed up, so that other backups of the directory made
+// while one is present don't include a second copy of it.
+const SnapshotDirName = ".bk-snapshot"
+
+// isNoDump reports whether the file or directory at the given path is to
+// be excluded because it has the nodump attribute set. Setting the
+// attribute changes the file's status change time, so files that the file
+// cache says are unchanged aren't checked again.
+func (ctx *backupContext) isNoDump(path string, fi os.FileInfo) bool {
+	if _, local := ctx.src.(localSource); !local || !ctx.opts.ExcludeNoDump {
+		return false
+	}
+	if _, ok := ctx.opts.Cache.Unchanged(path, fi); ok && !fi.IsDir() {
+		return false
+	}
+	return IsNoDump(path, fi)
+}
+
+// backupFileEntry fills in the contents of the given entry for the
+// regular file at the given path, reusing those of the corresponding entry
+// in the base backup, if any, or of the file cache's entry for it if the
+// file hasn't changed; otherwise, the file is read.
+func (ctx *backupContext) backupFileEntry(path string, f os.FileInfo, baseEntry *DirEntry,
+	e *DirEntry) error {
+	ctx.files++
+	if baseEntry != nil && baseEntry.Size == f.Size() &&
+		baseEntry.ModTime == f.ModTime() {
+		// Things look good, so just reuse the hash/contents from
+		// the base file.
+		e.Hash = baseEntry.Hash
+		e.Checksum = baseEntry.Checksum
+		e.Index = baseEntry.Index
+		e.Contents = baseEntry.Contents
+		if e.Contents == nil {
+			ctx.opts.Cache.Add(path, f, *e)
+		}
+	} else if ce, ok := ctx.opts.Cache.Lookup(path, f, ctx.backend); ok {
+		// The file cache says it's unchanged since the last
+		// backup, so there's no need to read it.
+		log.Debug("%s: unchanged according to file cache", path)
+		e.Hash = ce.Hash
+		e.Checksum = ce.Checksum
+		e.Index = ce.Index
+	} else {
+		// The file may have changed (different mod time) or
+		// definitely did if the size changed, so go ahead and
+		// split and hash the contents. If the contents are in fact
+		// unchanged, we only pay for some I/O here; the dedupe
+		// stuff in the storage backend will recognize that we
+		// already have the data stored.
+		if err := ctx.backupFile(path, f, e); err != nil {
+			return err
+		}
+		if baseEntry == nil && !ctx.opts.Cache.contains(path) {
+			ctx.newFiles++
+		} else {
+			ctx.changedFiles++
+		}
+		ctx.bytesRead += e.Size
+	}
+	return nil
+}
+
+// IsExcluded reports whether the given path contains any of the given
+// excluded paths.
+func IsExcluded(path string, excludedPaths []string) bool {
+	for _, excl := range excludedPaths {
+		if strings.Contains(path, excl) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExclusionMarker returns the first of the given file names that's present
+// in the given directory, as read from src or, if it's nil, the local
+// filesystem, or "" if none are.
+func ExclusionMarker(src FileSource, dir string, markers []string) string {
+	if src == nil {
+		src = localSource{}
+	}
+	for _, m := range markers {
+		if _, err := src.Stat(src.Join(dir, m)); err == nil {
+			return m
+		}
+	}
+	return ""
+}
+
+func isChunkReuseUnlikely(f os.FileInfo) bool {
+	ext := strings.ToLower(filepath.Ext(f.Name()))
+	if len(ext) == 0 {
+		return false
+	}
+	for _, e := range []string{"arw", "avi", "flv", "gif", "gz", "jpeg", "jpg", "mkv",
+		"mov", "mp4", "mpeg", "mpg", "nef", "png", "raw", "wmv", "zip"} {
+		if ext[1:] == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of times that a file is read if it keeps changing while it's
+// being backed up.
+const maxFileReadAttempts = 3
+
+// backupFile stores the contents of the file at the given path, updating
+// the given DirEntry to refer to them.  If the file is modified while it's
+// being read, it's read again, up to maxFileReadAttempts times; if it's
+// still changing after that, the last version read is kept, but a warning
+// is issued and the file is recorded in the backup's result.
+func (ctx *backupContext) backupFile(path string, fi os.FileInfo, e *DirEntry) error {
+	for attempt := 1; ; attempt++ {
+		var fiStart os.FileInfo
+		var changed bool
+		err := withRetries(path, func() (err error) {
+			fiStart, changed, err = ctx.readFile(path, fi, e)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		// Record the size and modification time corresponding to the
+		// contents that were read, which may not match what was
+		// returned when the directory was read.
+		e.Size = fiStart.Size()
+		e.ModTime = fiStart.ModTime()
+		if !changed {
+			if e.Contents == nil {
+				ctx.opts.Cache.Add(path, fiStart, *e)
+			}
+			return nil
+		}
+
+		if attempt == maxFileReadAttempts {
+			log.Warning("%s: file changed while being backed up; the stored "+
+				"copy may be inconsistent", path)
+			ctx.modified = append(ctx.modified, path)
+			return nil
+		}
+		log.Verbose("%s: file changed while being backed up; reading it again", path)
+	}
+}
+
+// Number of times to retry reading a file or directory after errors that
+// may be transient and the delay before the first retry; the delay doubles
+// after each one.
+const (
+	maxTransientRetries = 4
+	transientRetryDelay = 500 * time.Millisecond
+)
+
+// isTransientError reports whether the given error may not recur if the
+// operation is retried, as is the case with flaky USB drives and network
+// filesystems.
+func isTransientError(err error) bool {
+	for _, e := range []error{syscall.EIO, syscall.EAGAIN, syscall.EINTR,
+		syscall.ETIMEDOUT} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetries calls f, retrying with exponential backoff if it returns an
+// error that may be transient. It returns the last error returned by f.
+func withRetries(path string, f func() error) error {
+	delay := transientRetryDelay
+	for retries := 0; ; retries++ {
+		err := f()
+		if err == nil || retries == maxTransientRetries || !isTransientError(err) {
+			return err
+		}
+		log.Warning("%s: %s; retrying in %s", path, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// errorCatchingReader wraps an io.Reader, returning io.EOF in place of
+// any errors that it returns. The error is available in Err.
+type errorCatchingReader struct {
+	R   io.Reader
+	Err error
+}
+
+func (r *errorCatchingReader) Read(b []byte) (int, error) {
+	if r.Err != nil {
+		return 0, io.EOF
+	}
+	n, err := r.R.Read(b)
+	if err != nil && err != io.EOF {
+		r.Err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readFile reads the file at the given path and stores its contents in the
+// DirEntry, either directly, for small files, or in the storage backend.
+// It returns the file's information from when it was opened and an
+// indication of whether it was modified while being read.
+func (ctx *backupContext) readFile(path string, fi os.FileInfo,
+	e *DirEntry) (os.FileInfo, bool, error) {
+	f, err := ctx.src.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	fiStart, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch {
+	case fiStart.Size() < 8192:
+		// Don't bother splitting small files; this gives the splitter
+		// more to work with when it gets the serialized array of
+		// DirEntries for this directory.
+		c, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, false, err
+		}
+		e.Contents = c
+		e.Hash = storage.MerkleHash{}
+		e.Checksum = storage.Hash{}
+		e.Index = nil
+	default:
+		// Files whose first bytes show that their contents are already
+		// compressed are stored without trying to compress any of their
+		// chunks again. (How they're split still only depends on their
+		// names, so that files in earlier backups are split the same
+		// way.)
+		br := bufio.NewReader(f)
+		head, _ := br.Peek(16)
+		backend := ctx.backend
+		if storage.IsCompressedFormat(head) {
+			backend = storage.NewUncompressed(backend)
+		}
+
+		sb := ctx.opts.SplitBits
+		if isChunkReuseUnlikely(fi) {
+			// For large media files and files that are already
+			// compressed, split into big chunks (on average 256k).  For
+			// these, we don't expect any reuse across changed versions of
+			// the files over multiple backups, so we might as well limit
+			// the number of hashes needed.
+			//
+			// Note that we don't want to not split at all and use a single
+			// huge chunk for the file, as that would end up causing the
+			// whole file to be read into memory both now and at restore
+			// time, which is nice to avoid.
+			sb = 18
+		}
+		// Read errors are fatal in SplitAndStore, so catch them here
+		// instead; they're then reported for just this file.
+		hasher := storage.NewHasher()
+		r := &errorCatchingReader{R: io.TeeReader(br, hasher)}
+		var chunkSizes []int64
+		e.Hash = storage.SplitAndStoreChunks(r, backend, sb, func(chunk storage.ChunkInfo) {
+			chunkSizes = append(chunkSizes, chunk.Size)
+		})
+		if r.Err != nil {
+			return nil, false, r.Err
+		}
+		e.Checksum = hasher.Sum()
+		e.Contents = nil
+		e.Index = nil
+		if len(chunkSizes) > 1 {
+			index := WriteChunkSizes(chunkSizes, ctx.backend, ctx.opts.SplitBits)
+			e.Index = &index
+		}
+	}
+
+	fiEnd, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	changed := fiEnd.Size() != fiStart.Size() || !fiEnd.ModTime().Equal(fiStart.ModTime())
+	return fiStart, changed, nil
+}
+
+///////////////////////////////////////////////////////////////////////////
+// BackupReader
+
+// BackupReader represents a backup that was created by Backup(). It
+// provides methods that make it possible to
+// access files, directories, and file contents in the backup.
+type BackupReader struct {
+	root    BackupRoot
+	backend storage.Backend
+}
+
+func NewBackupReader(hash storage.Hash, backend storage.Backend) (*BackupReader, error) {
+	br := &BackupReader{backend: backend}
+	var err error
+	br.root, err = ReadRoot(hash, backend)
+	return br, err
+}
+
+// NewDirReader returns a BackupReader for the directory tree under the
+// given entry, as if it were the root directory of a backup.
+func NewDirReader(e DirEntry, backend storage.Backend) *BackupReader {
+	return &BackupReader{root: BackupRoot{Dir: e}, backend: backend}
+}
+
+// Root returns the backup's BackupRoot.
+func (b *BackupReader) Root() BackupRoot {
+	return b.root
+}
+
+// Backend returns the storage.Backend that the backup is read from.
+func (b *BackupReader) Backend() storage.Backend {
+	return b.backend
+}
+
+func (b *BackupReader) GetEntry(path string) (DirEntry, error) {
+	// Split the path into components.
+	s := strings.Split(path, "/")
+	if len(s) > 1 && s[0] == "" {
+		// Absolute path.
+		s = s[1:]
+	}
+	return b.lookupEntry(b.root.Dir, s)
+}
+
+func (b *BackupReader) lookupEntry(e DirEntry, path []string) (DirEntry, error) {
+	if len(path) == 0 || path[0] == "" {
+		return e, nil
+	}
+
+	if !e.IsDir() {
+		return DirEntry{}, errors.New("not a directory")
+	}
+
+	// Look for an entry in the directory that matches the first component
+	// of the path.
+	if entry, ok := FindDirEntry(e.Hash, path[0], b.backend); ok {
+		// Success; onward to the next path component.
+		return b.lookupEntry(entry, path[1:])
+	}
+	return DirEntry{}, errors.New("path not found")
+}
+
+// Walk calls f for each file, directory, and symlink under backupPath in
+// the backup (including backupPath itself), in depth-first order with the
+// entries of each directory sorted by name. Paths passed to f are relative
+// to the root of the backup.
+func (b *BackupReader) Walk(backupPath string, f func(path string, e DirEntry)) error {
+	return b.WalkDepth(backupPath, 0, f)
+}
+
+// WalkDepth is the same as Walk, but only descends the given number of
+// levels of directories below backupPath, or all of them if depth is zero.
+// Only the directories that are descended into are read from storage.
+func (b *BackupReader) WalkDepth(backupPath string, depth int,
+	f func(path string, e DirEntry)) error {
+	entry, err := b.GetEntry(backupPath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", backupPath, err)
+	}
+	if depth == 0 {
+		depth = -1
+	}
+	b.walk(filepath.Clean("/"+backupPath), entry, depth, f)
+	return nil
+}
+
+// walk calls f for the given entry and then for the ones under it, up to
+// the given number of levels down; there's no limit if levels is negative.
+func (b *BackupReader) walk(path string, e DirEntry, levels int,
+	f func(path string, e DirEntry)) {
+	f(path, e)
+	if e.IsDir() && levels != 0 {
+		entries := ReadDirEntries(e.Hash, b.backend)
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		for _, child := range entries {
+			b.walk(filepath.Join(path, child.Name), child, levels-1, f)
+		}
+	}
+}
+
+func (b *BackupReader) ReadFileContents(path string) (io.ReadCloser, error) {
+	e, err := b.GetEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.GetContentsReader(nil, b.backend)
+}
+
+// ReadFileRange returns an io.ReadCloser for length bytes of the given
+// file's contents starting at offset, or all of them after it if length
+// is negative.
+func (b *BackupReader) ReadFileRange(path string, offset, length int64) (io.ReadCloser, error) {
+	e, err := b.GetEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.GetRangeReader(offset, length, nil, b.backend)
+}
+
+// ConflictPolicy specifies what Restore does when a file, directory, or
+// symlink that it's restoring already exists. Existing directories are
+// always restored into, regardless of the policy.
+type ConflictPolicy int
+
+const (
+	// Report an error and leave the existing one alone.
+	ConflictError ConflictPolicy = iota
+	// Replace the existing one.
+	ConflictOverwrite
+	// Leave the existing one alone.
+	ConflictSkipExisting
+	// Leave the existing one alone if it was modified more recently than
+	// the one in the backup; otherwise replace it.
+	ConflictKeepNewer
+	// Rename the existing one, adding a ".bk-orig" suffix.
+	ConflictBackupExisting
+	// Leave existing files alone if they have the same size and
+	// modification time as the ones in the backup, updating their
+	// permissions if needed, and replace them otherwise. Symlinks with
+	// the same target are left alone as well. Existing directories are
+	// only replaced if RestoreOptions.Delete is set.
+	ConflictInPlace
+)
+
+// RestoreOptions specifies how BackupReader.Restore restores backups.
+type RestoreOptions struct {
+	// Maximum number of files and directories to restore concurrently.
+	Jobs     int
+	Conflict ConflictPolicy
+	// How file ownership is restored and, optionally, how users and
+	// groups are mapped. Ownership is only restored when running as root.
+	Owner OwnerPolicy
+	IdMap *IdMap
+	// If true, files, directories, and symlinks in the restored
+	// directories that aren't in the backup are removed. Only allowed with
+	// ConflictInPlace.
+	Delete bool
+}
+
+// RestoreResult describes a restore made by Restore.
+type RestoreResult struct {
+	// Numbers of files, directories, and symlinks restored and the total
+	// size of the files.
+	Files, Dirs, SymLinks int64
+	Bytes                 int64
+	// Number of files, directories, and symlinks that were removed
+	// because they weren't in the backup, with RestoreOptions.Delete.
+	// The contents of removed directories aren't counted separately.
+	Removed int64
+	// Problems with individual files, directories, and symlinks, which
+	// weren't restored; these are also reported via the logger.
+	Errors []error
+}
+
+// Restore restores the backup with the given root hash from the given
+// backend to dest. It's equivalent to restoring "/" with
+// BackupReader.Restore.
+func Restore(ctx context.Context, root storage.Hash, dest string, backend storage.Backend,
+	opts RestoreOptions) (*RestoreResult, error) {
+	b, err := NewBackupReader(root, backend)
+	if err != nil {
+		return nil, err
+	}
+	return b.Restore(ctx, "/", dest, opts)
+}
+
+// Restore restores the file or directory at backupPath in the backup to
+// dest. Up to opts.Jobs files are restored concurrently; each of them may
+// have multiple chunk reads in flight as well. Problems with individual
+// files don't cause the restore to fail; they're recorded in the
+// result. If ctx is canceled, no more files are started and ctx's error
+// is returned along with the result of what was restored.
+func (b *BackupReader) Restore(ctx context.Context, backupPath string, dest string,
+	opts RestoreOptions) (*RestoreResult, error) {
+	entry, err := b.GetEntry(backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", backupPath, err.Error())
+	}
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// We want multiple storage accesses to be in flight during restore in
+	// case we're going over the network and would like to hide latency.
+	// Limit the number using the sem chans, though, so that we don't hit
+	// issues with rate limits or run out of file descriptors.
+	pc := &parallelContext{
+		context:      ctx,
+		sem:          make(chan bool, jobs),
+		fetchSem:     make(chan bool, 4*jobs),
+		conflict:     opts.Conflict,
+		delete:       opts.Delete,
+		owner:        opts.Owner,
+		idMap:        opts.IdMap,
+		restoredDirs: make(map[string]DirEntry)}
+	if pc.owner != OwnerSkip && os.Geteuid() != 0 {
+		log.Verbose("not running as root; file ownership won't be restored")
+		pc.owner = OwnerSkip
+	}
+	if opts.Delete && opts.Conflict != ConflictInPlace {
+		return nil, errors.New("deleting extra files is only supported for in-place restores")
+	}
+	if opts.Conflict < ConflictError || opts.Conflict > ConflictInPlace {
+		return nil, fmt.Errorf("%d: unexpected conflict policy", opts.Conflict)
+	}
+
+	switch {
+	case entry.IsDir():
+		pc.wg.Add(1)
+		go b.restoreDir(pc, entry, dest)
+		log.Debug("start wait")
+		pc.wg.Wait()
+		log.Debug("done wait")
+
+		// Set the directory mode and modification times only after all of
+		// the files have been restored. (Thus, if the mode is read-only,
+		// that won't inhibit creating files during the restore, and the
+		// modification times will be the stored ones, not the current
+		// time, due to files being written to the directory during
+		// restore.)
+		for name, entry := range pc.restoredDirs {
+			pc.restoreOwner(name, entry)
+			if err := os.Chmod(name, entry.Mode); err != nil {
+				pc.errorf("%s", err)
+			}
+			pc.restoreTimes(name, entry)
+		}
+	case entry.IsFile():
+		if pc.resolveConflict(entry, dest) {
+			pc.wg.Add(1)
+			b.restoreFile(pc, entry, dest)
+		}
+	case entry.IsSymLink():
+		if pc.resolveConflict(entry, dest) {
+			b.restoreSymLink(pc, entry, dest)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unexpected file type", backupPath)
+	}
+	return &pc.result, ctx.Err()
+}
+
+type parallelContext struct {
+	// If non-nil, no more files are started once it's canceled.
+	context context.Context
+	wg      sync.WaitGroup
+	// Limits the number of files and directories being processed
+	// concurrently.
+	sem chan bool
+	// Limits the number of additional chunk reads in flight across all of
+	// the files being restored. It's separate from sem so that files that
+	// are being written don't starve each other of chunk reads; if nil,
+	// sem is used.
+	fetchSem chan bool
+	// What to do about existing files when restoring and whether to
+	// remove ones that aren't in the backup.
+	conflict ConflictPolicy
+	delete   bool
+	owner    OwnerPolicy
+	idMap    *IdMap
+	// Protects restoredDirs and result.
+	mu           sync.Mutex
+	restoredDirs map[string]DirEntry
+	result       RestoreResult
+}
+
+// errorf reports a problem restoring a file, directory, or symlink and
+// records it in the result.
+func (ctx *parallelContext) errorf(format string, args ...interface{}) {
+	err := fmt.Errorf(format, args...)
+	log.Error("%s", err)
+	if ctx != nil {
+		ctx.mu.Lock()
+		ctx.result.Errors = append(ctx.result.Errors, err)
+		ctx.mu.Unlock()
+	}
+}
+
+// restored records that the given entry has been restored.
+func (ctx *parallelContext) restored(e DirEntry) {
+	if ctx == nil {
+		return
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	switch {
+	case e.IsFile():
+		ctx.result.Files++
+		ctx.result.Bytes += e.Size
+	case e.IsDir():
+		ctx.result.Dirs++
+	case e.IsSymLink():
+		ctx.result.SymLinks++
+	}
+}
+
+// canceled reports whether the restore has been canceled.
+func (ctx *parallelContext) canceled() bool {
+	return ctx != nil && ctx.context != nil && ctx.context.Err() != nil
+}
+
+// resolveConflict applies the conflict policy if something already exists
+// at the given path; it returns true if e should then be restored there.
+// Problems are reported via the logger.
+func (ctx *parallelContext) resolveConflict(e DirEntry, path string) bool {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return true
+	} else if err != nil {
+		ctx.errorf("%s: %s", path, err)
+		return false
+	}
+	if e.IsDir() && fi.IsDir() {
+		// Restore into the existing directory.
+		return true
+	}
+
+	policy := ctx.conflict
+	if policy == ConflictInPlace {
+		switch {
+		case e.IsFile() && fi.Mode().IsRegular() && fi.Size() == e.Size &&
+			fi.ModTime().Equal(e.ModTime):
+			log.Debug("%s: unchanged", path)
+			ctx.restoreOwner(path, e)
+			if fi.Mode() != e.Mode {
+				if err := os.Chmod(path, e.Mode); err != nil {
+					ctx.errorf("%s", err)
+				}
+			}
+			return false
+		case e.IsSymLink() && fi.Mode()&os.ModeSymlink != 0:
+			if target, err := os.Readlink(path); err == nil && target == string(e.Contents) {
+				return false
+			}
+		case fi.IsDir() && ctx.delete:
+			log.Verbose("%s: removing directory to restore %s", path, e.Name)
+			if err := os.RemoveAll(path); err != nil {
+				ctx.errorf("%s", err)
+				return false
+			}
+			return true
+		}
+		log.Verbose("%s: updating", path)
+		policy = ConflictOverwrite
+	}
+	if policy == ConflictKeepNewer {
+		if fi.ModTime().After(e.ModTime) {
+			log.Verbose("%s: existing file is newer; not restoring", path)
+			return false
+		}
+		policy = ConflictOverwrite
+	}
+
+	switch policy {
+	case ConflictError:
+		ctx.errorf("%s: already exists", path)
+		return false
+	case ConflictSkipExisting:
+		log.Verbose("%s: already exists; not restoring", path)
+		return false
+	case ConflictOverwrite:
+		if fi.IsDir() {
+			ctx.errorf("%s: is a directory; not replacing it", path)
+			return false
+		}
+		if err := os.Remove(path); err != nil {
+			ctx.errorf("%s", err)
+			return false
+		}
+		return true
+	case ConflictBackupExisting:
+		orig := path + ".bk-orig"
+		if _, err := os.Lstat(orig); err == nil {
+			ctx.errorf("%s: already exists; not restoring %s", orig, path)
+			return false
+		}
+		if err := os.Rename(path, orig); err != nil {
+			ctx.errorf("%s", err)
+			return false
+		}
+		return true
+	default:
+		log.Fatal("%d: unexpected conflict policy", policy)
+		return false
+	}
+}
+
+func (b *BackupReader) restoreDir(ctx *parallelContext, entry DirEntry, destdir string) {
+	// Limit parallelism to the number of elements buffered in the chan.  A
+	// non-nil ctx is required here, unlike restoreFile.
+	ctx.sem <- true
+	defer func() { <-ctx.sem; ctx.wg.Done() }()
+
+	if !ctx.resolveConflict(entry, destdir) {
+		return
+	}
+	if err := os.Mkdir(destdir, 0700); err != nil && !os.IsExist(err) {
+		ctx.errorf("%s", err)
+		return
+	}
+
+	log.Debug("%s: restoring directory", destdir)
+	ctx.restored(entry)
+
+	ctx.mu.Lock()
+	// Create a new DirEntry that only stores the information we need at
+	// the end; if we stored all of entry including the entries inside the
+	// directory and the contents, GC would be inhibited unnecessarily.
+	ctx.restoredDirs[destdir] = DirEntry{ModTime: entry.ModTime,
+		BirthTime: entry.BirthTime, Mode: entry.Mode, Owner: entry.Owner}
+	ctx.mu.Unlock()
+
+	entries := ReadDirEntries(entry.Hash, b.backend)
+
+	if ctx.delete {
+		b.deleteExtra(ctx, entries, destdir)
+	}
+
+	// The goroutines for the entries may have to wait for others to
+	// finish, so start reading their first chunks (for most files, all of
+	// their contents) in the meantime, if the backend supports it. Files
+	// whose contents are stored in their entries, and empty ones, have no
+	// chunks to read.
+	prefetch := func(e DirEntry) {}
+	if p, ok := b.backend.(storage.Prefetcher); ok {
+		prefetch = func(e DirEntry) {
+			if e.Contents == nil && (!e.IsFile() || e.Size > 0) {
+				p.Prefetch(e.Hash.Hash)
+			}
+		}
+	}
+
+	for _, e := range entries {
+		if ctx.canceled() {
+			return
+		}
+		path := filepath.Join(destdir, e.Name)
+		switch {
+		case e.IsFile():
+			if ctx.resolveConflict(e, path) {
+				prefetch(e)
+				ctx.wg.Add(1)
+				go b.restoreFile(ctx, e, path)
+			}
+		case e.IsDir():
+			prefetch(e)
+			ctx.wg.Add(1)
+			go b.restoreDir(ctx, e, path)
+		case e.IsSymLink():
+			if ctx.resolveConflict(e, path) {
+				b.restoreSymLink(ctx, e, path)
+			}
+		default:
+			ctx.errorf("%s: entry with invalid type was backed up: %+v", path, e)
+		}
+	}
+}
+
+// deleteExtra removes files, directories, and symlinks in dir that aren't
+// in the given entries.
+func (b *BackupReader) deleteExtra(ctx *parallelContext, entries []DirEntry, dir string) {
+	names := make(map[string]bool)
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	fileinfo, err := ioutil.ReadDir(dir)
+	if err != nil {
+		ctx.errorf("%s: %s", dir, err)
+		return
+	}
+	for _, fi := range fileinfo {
+		if !names[fi.Name()] {
+			path := filepath.Join(dir, fi.Name())
+			log.Verbose("%s: removing", path)
+			if err := os.RemoveAll(path); err != nil {
+				ctx.errorf("%s", err)
+			} else {
+				ctx.mu.Lock()
+				ctx.result.Removed++
+				ctx.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (b *BackupReader) restoreFile(ctx *parallelContext, e DirEntry, path string) {
+	// There are two limits to rate limit file restores: in addition to not
+	// hammering on the storage backend, we also want to limit the number
+	// of open files.
+	var sem chan bool
+	if ctx != nil {
+		sem = ctx.fetchSem
+		if sem == nil {
+			sem = ctx.sem
+		}
+		ctx.sem <- true
+		defer func() { <-ctx.sem; ctx.wg.Done() }()
+	}
+
+	log.Debug("%s: restoring file", path)
+
+	// Create the file and set its permissions.
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		ctx.errorf("%s", err)
+		return
+	}
+
+	// Each chunk's hash is checked as it's read; if the file's checksum
+	// was recorded, the restored contents are checked against it as well.
+	hasher := storage.NewHasher()
+	rc, err := e.GetContentsReader(sem, b.backend)
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(f, hasher), rc)
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Don't leave a partial file behind.
+		os.Remove(path)
+		ctx.errorf("%s: %s", path, err)
+		return
+	}
+
+	if e.Checksum != (storage.Hash{}) && hasher.Sum() != e.Checksum {
+		// Don't leave a corrupt file behind.
+		os.Remove(path)
+		ctx.errorf("%s: restored contents don't match the backed-up file's "+
+			"checksum; the backup is corrupt", path)
+		return
+	}
+
+	// Set the owner first, since chown may clear the setuid and setgid
+	// bits.
+	ctx.restoreOwner(path, e)
+	if err := os.Chmod(path, e.Mode); err != nil {
+		ctx.errorf("%s", err)
+	}
+	ctx.restoreTimes(path, e)
+	ctx.restored(e)
+}
+
+// restoreTimes sets the modification and access times of the file or
+// directory at the given path to the modification time in the given entry
+// and sets its creation time as well, if it's available and the platform
+// allows it.
+func (ctx *parallelContext) restoreTimes(path string, e DirEntry) {
+	if !e.BirthTime.IsZero() {
+		if err := setBirthTime(path, e.BirthTime); err != nil {
+			ctx.errorf("%s", err)
+		}
+	}
+	if err := os.Chtimes(path, e.ModTime, e.ModTime); err != nil {
+		ctx.errorf("%s", err)
+	}
+}
+
+func (b *BackupReader) restoreSymLink(ctx *parallelContext, e DirEntry, path string) {
+	// No need to rate-limit here.
+	log.Debug("%s: restoring symlink", path)
+	if err := os.Symlink(string(e.Contents), path); err != nil {
+		ctx.errorf("%s", err)
+		return
+	}
+	ctx.restoreOwner(path, e)
+	ctx.restored(e)
+}
+
+// restoreOwner sets the owner of the file at the given path according to
+// the ownership policy, if the owner was recorded in the backup.
+func (ctx *parallelContext) restoreOwner(path string, e DirEntry) {
+	if ctx == nil || ctx.owner == OwnerSkip || e.Owner == nil {
+		return
+	}
+	uid, gid := localIds(e.Owner, ctx.owner, ctx.idMap)
+	if err := os.Lchown(path, uid, gid); err != nil {
+		ctx.errorf("%s", err)
+	}
+}
+
+// Fsck checks that all of the blobs that the backup uses are present,
+// checking up to jobs files and directories concurrently. Progress is
+// reported using the given name.
+func (b *BackupReader) Fsck(jobs int, name string) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	// We don't need the restoredDirs map here.
+	ctx := &parallelContext{sem: make(chan bool, jobs)}
+	progress := &u.ProgressReporter{Msg: name + ": checked entries"}
+	ctx.wg.Add(1)
+	go b.fsck(ctx, progress, b.root.Dir)
+	ctx.wg.Wait()
+	progress.Finish()
+}
+
+func (b *BackupReader) fsck(ctx *parallelContext, progress *u.ProgressReporter,
+	entry DirEntry) {
+	ctx.sem <- true
+	defer func() { <-ctx.sem; ctx.wg.Done() }()
+	defer progress.Add(1)
+
+	switch {
+	case entry.IsFile():
+		if entry.Contents == nil && entry.Size > 0 {
+			// The file contents were stored via SplitAndStore();
+			// make sure we have blobs for all of the hashes that
+			// represent it.
+			entry.Hash.Fsck(b.backend)
+			if entry.Index != nil {
+				entry.Index.Fsck(b.backend)
+			}
+		}
+	case entry.IsDir():
+		entries := ReadDirEntries(entry.Hash, b.backend)
+		ctx.wg.Add(len(entries))
+		for _, e := range entries {
+			go b.fsck(ctx, progress, e)
+		}
+	case entry.IsSymLink():
+		// Do nothing.
+	default:
+		log.Fatal("unexpected entry type: %+v", entry)
+	}
+}
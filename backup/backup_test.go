@@ -0,0 +1,229 @@
+// backup/backup_test.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	l := u.NewLogger(false, false)
+	SetLogger(l)
+	storage.SetLogger(l)
+	os.Exit(m.Run())
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBackupRestore(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+	src, repo, dest := filepath.Join(tmp, "src"), filepath.Join(tmp, "repo"),
+		filepath.Join(tmp, "dest")
+	snapshot := filepath.Join(src, SnapshotDirName)
+	for _, d := range []string{src, filepath.Join(src, "sub"), snapshot, repo} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A file large enough to be split into many chunks, a small one, an
+	// empty one, and a symlink, as well as a snapshot directory, which
+	// isn't backed up.
+	large := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(large)
+	files := map[string][]byte{
+		"large":       large,
+		"sub/small":   []byte("hello, world\n"),
+		"sub/empty":   nil,
+		"sub/private": []byte("secret\n"),
+	}
+	mtime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for name, contents := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "sub", "private"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("small", filepath.Join(src, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(snapshot, "large"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := storage.NewDisk(repo)
+	result, err := Backup(context.Background(), src, backend, BackupOptions{SplitBits: 13})
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if len(result.Errors) != 0 || result.Files != len(files) {
+		t.Errorf("backup: %d errors and %d files; expected none and %d", len(result.Errors),
+			result.Files, len(files))
+	}
+	backend.SyncWrites()
+
+	// Restore from a new backend, so that everything is read from disk.
+	restored, err := Restore(context.Background(), result.Hash, dest, storage.NewDisk(repo),
+		RestoreOptions{Jobs: 4})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if len(restored.Errors) != 0 || restored.Files != int64(len(files)) ||
+		restored.SymLinks != 1 || restored.Bytes != int64(len(large)+20) {
+		t.Errorf("restore: got %+v", restored)
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dest, filepath.FromSlash(name))
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(b, contents) {
+			t.Errorf("%s: restored %d bytes that differ from the %d backed up", name,
+				len(b), len(contents))
+		}
+		orig, err := os.Stat(filepath.Join(src, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi, err := os.Stat(path); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if fi.Mode() != orig.Mode() || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: restored with mode %s and time %s; expected %s and %s", name,
+				fi.Mode(), fi.ModTime(), orig.Mode(), mtime)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "sub", "link")); err != nil ||
+		target != "small" {
+		t.Errorf("link: restored %q (%v); expected \"small\"", target, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, SnapshotDirName)); !os.IsNotExist(err) {
+		t.Errorf("%s: restored (%v)", SnapshotDirName, err)
+	}
+}
+
+// Problems restoring particular files are reported in the result rather
+// than ending the program.
+func TestRestoreFileErrors(t *testing.T) {
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+	src, repo := filepath.Join(tmp, "src"), filepath.Join(tmp, "repo")
+	for _, d := range []string{src, repo} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := storage.NewDisk(repo)
+	result, err := Backup(context.Background(), src, backend, BackupOptions{SplitBits: 13})
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	backend.SyncWrites()
+
+	b, err := NewBackupReader(result.Hash, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file's destination is in a directory that doesn't exist.
+	dest := filepath.Join(tmp, "missing", "file")
+	restored, err := b.Restore(context.Background(), "file", dest, RestoreOptions{})
+	if err != nil {
+		t.Errorf("restore: %v", err)
+	} else if len(restored.Errors) != 1 || restored.Files != 0 {
+		t.Errorf("restore: got %+v; expected one error", restored)
+	}
+
+	if _, err := b.Restore(context.Background(), "/", filepath.Join(tmp, "dest"),
+		RestoreOptions{Conflict: ConflictPolicy(100)}); err == nil {
+		t.Errorf("restore with an invalid conflict policy succeeded")
+	}
+}
+
+// Only directories with many entries are stored with the streamed
+// encoding, so that repositories without them can still be read by older
+// versions of bk.
+func TestStreamDirEntries(t *testing.T) {
+	defer func(n int) { maxBufferedDirEntries = n }(maxBufferedDirEntries)
+	maxBufferedDirEntries = 10
+
+	tmp := tempDir(t)
+	defer os.RemoveAll(tmp)
+	small, large := filepath.Join(tmp, "small"), filepath.Join(tmp, "large")
+	for dir, n := range map[string]int{small: 10, large: 25} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			path := filepath.Join(dir, fmt.Sprintf("file%02d", i))
+			if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	backend := storage.NewMemory()
+	opts := BackupOptions{SplitBits: 13, StreamDirEntries: true}
+	if _, err := Backup(context.Background(), small, backend, opts); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	if v := storage.RepositoryFormat(backend); v != 1 {
+		t.Errorf("format version %d after backing up a small directory", v)
+	}
+
+	result, err := Backup(context.Background(), large, backend, opts)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	backend.SyncWrites()
+	if v := storage.RepositoryFormat(backend); v != 5 {
+		t.Errorf("format version %d after backing up a large directory; expected 5", v)
+	}
+
+	dest := filepath.Join(tmp, "dest")
+	restored, err := Restore(context.Background(), result.Hash, dest, backend,
+		RestoreOptions{})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if restored.Files != 25 {
+		t.Errorf("restored %d files; expected 25", restored.Files)
+	}
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		b, err := ioutil.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(b) != filepath.Join(large, name) {
+			t.Errorf("%s: restored %q (%v)", name, b, err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// backup/compare.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Kinds of differences reported by BackupReader.Compare.
+const (
+	// The path is only present in the filesystem.
+	DiffAdded = 'A'
+	// The path is only present in the backup.
+	DiffDeleted = 'D'
+	// The path changed from one type (file, directory, symlink) to
+	// another.
+	DiffType = 'T'
+	// The file's contents or the symlink's target differ.
+	DiffContents = 'M'
+	// The modification time or permissions differ.
+	DiffMetadata = 'm'
+)
+
+// Compare walks the directory hierarchy at backupPath in the backup and
+// the directory dir in the filesystem together, calling report for each
+// difference that it finds. Paths passed to report are relative to dir.
+// Unless checkContents is true, files with matching sizes and modification
+// times are assumed to have the same contents, as is done for incremental
+// backups.  Paths in the filesystem that contain one of the given excluded
+// paths are ignored.
+func (b *BackupReader) Compare(backupPath, dir string, checkContents bool,
+	excludedPaths []string, report func(kind byte, path, detail string)) error {
+	entry, err := b.GetEntry(backupPath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", backupPath, err)
+	}
+	if !entry.IsDir() {
+		return fmt.Errorf("%s: not a directory", backupPath)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+
+	c := comparer{b: b, root: dir, checkContents: checkContents,
+		excludedPaths: excludedPaths, report: report}
+	c.compareDirs(entry, dir)
+	return nil
+}
+
+type comparer struct {
+	b             *BackupReader
+	root          string
+	checkContents bool
+	excludedPaths []string
+	report        func(kind byte, path, detail string)
+}
+
+func (c *comparer) relPath(path string) string {
+	if rel, err := filepath.Rel(c.root, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+func (c *comparer) isExcluded(path string) bool {
+	for _, excl := range c.excludedPaths {
+		if strings.Contains(path, excl) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *comparer) compareDirs(entry DirEntry, dir string) {
+	fileinfo, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Error("%s: %s", dir, err)
+		return
+	}
+	entries := ReadDirEntries(entry.Hash, c.b.backend)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	// Both lists are sorted by name, so we can merge them.
+	i, j := 0, 0
+	for i < len(entries) || j < len(fileinfo) {
+		switch {
+		case j == len(fileinfo) || (i < len(entries) && entries[i].Name < fileinfo[j].Name()):
+			path := filepath.Join(dir, entries[i].Name)
+			if !c.isExcluded(path) {
+				c.report(DiffDeleted, c.relPath(path), "")
+			}
+			i++
+		case i == len(entries) || fileinfo[j].Name() < entries[i].Name:
+			path := filepath.Join(dir, fileinfo[j].Name())
+			if !c.isExcluded(path) {
+				c.report(DiffAdded, c.relPath(path), "")
+			}
+			j++
+		default:
+			path := filepath.Join(dir, fileinfo[j].Name())
+			if !c.isExcluded(path) {
+				c.compareEntry(entries[i], fileinfo[j], path)
+			}
+			i++
+			j++
+		}
+	}
+}
+
+func (c *comparer) compareEntry(e DirEntry, fi os.FileInfo, path string) {
+	rel := c.relPath(path)
+	if e.Mode&os.ModeType != fi.Mode()&os.ModeType {
+		c.report(DiffType, rel, fmt.Sprintf("%s -> %s", e.Mode, fi.Mode()))
+		return
+	}
+
+	if e.Mode != fi.Mode() {
+		c.report(DiffMetadata, rel, fmt.Sprintf("mode %s -> %s", e.Mode, fi.Mode()))
+	}
+	if !e.IsSymLink() && !e.ModTime.Equal(fi.ModTime()) {
+		c.report(DiffMetadata, rel, fmt.Sprintf("modification time %s -> %s",
+			e.ModTime.Format(timeFormat), fi.ModTime().Format(timeFormat)))
+	}
+
+	switch {
+	case e.IsDir():
+		c.compareDirs(e, path)
+	case e.IsSymLink():
+		target, err := os.Readlink(path)
+		if err != nil {
+			log.Error("%s: %s", path, err)
+		} else if target != string(e.Contents) {
+			c.report(DiffContents, rel, fmt.Sprintf("target %s -> %s", e.Contents, target))
+		}
+	case e.IsFile():
+		if e.Size != fi.Size() {
+			c.report(DiffContents, rel, fmt.Sprintf("size %d -> %d", e.Size, fi.Size()))
+		} else if c.checkContents || !e.ModTime.Equal(fi.ModTime()) {
+			same, err := c.sameContents(e, path)
+			if err != nil {
+				log.Error("%s: %s", path, err)
+			} else if !same {
+				c.report(DiffContents, rel, "contents")
+			}
+		}
+	}
+}
+
+func (c *comparer) sameContents(e DirEntry, path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	rc, err := e.GetContentsReader(nil, c.b.backend)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	return readersEqual(rc, f)
+}
+
+// readersEqual reports whether the two readers return the same bytes.
+func readersEqual(a, b io.Reader) (bool, error) {
+	const bufSize = 64 * 1024
+	bufa, bufb := make([]byte, bufSize), make([]byte, bufSize)
+	for {
+		na, erra := io.ReadFull(a, bufa)
+		if erra != nil && erra != io.EOF && erra != io.ErrUnexpectedEOF {
+			return false, erra
+		}
+		nb, errb := io.ReadFull(b, bufb)
+		if errb != nil && errb != io.EOF && errb != io.ErrUnexpectedEOF {
+			return false, errb
+		}
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		if na < bufSize {
+			// Both readers are done, since the reads matched.
+			return true, nil
+		}
+	}
+}
+
+const timeFormat = "2006-01-02 15:04:05"
@@ -0,0 +1,233 @@
+// backup/filecache.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"github.com/mmp/bk/storage"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileCache records the size, modification time, and other identifying
+// information of files that were backed up, along with the hash of their
+// stored contents. On later backups of the same directory, files that
+// still match what's in the cache can be stored by reference without
+// being read again.
+//
+// A nil *FileCache may be used; it never reports a file as unchanged.
+type FileCache struct {
+	path string
+	// Entries from the previous backup and the ones for the current
+	// backup; only the latter are saved, so that entries for files that
+	// have been deleted are dropped.
+	old map[string]fileCacheEntry
+	mu  sync.Mutex
+	new map[string]fileCacheEntry
+	// Set by MapPaths.
+	from, to string
+}
+
+type fileCacheEntry struct {
+	Size    int64
+	ModTime time.Time
+	// Inode number and status change time (from the underlying stat
+	// structure), if available on the current platform.
+	Inode    uint64
+	Ctime    int64
+	Hash     storage.MerkleHash
+	Checksum storage.Hash
+	Index    *storage.MerkleHash
+}
+
+func newFileCacheEntry(fi os.FileInfo, hash storage.MerkleHash,
+	checksum storage.Hash, index *storage.MerkleHash) fileCacheEntry {
+	inode, ctime := fileIdentity(fi)
+	return fileCacheEntry{Size: fi.Size(), ModTime: fi.ModTime(), Inode: inode,
+		Ctime: ctime, Hash: hash, Checksum: checksum, Index: index}
+}
+
+// fileCachePath returns the path to the cache file for backups of the given
+// directory to the repository with the given identity. Directories given as
+// URLs, as for backups from other machines, are used as they are; others
+// are made absolute.
+func fileCachePath(repository, dir string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(dir, "://") {
+		if dir, err = filepath.Abs(dir); err != nil {
+			return "", err
+		}
+	}
+	h := sha256.Sum256([]byte(repository + "\x00" + dir))
+	return filepath.Join(cacheDir, "bk", hex.EncodeToString(h[:16])+".cache"), nil
+}
+
+// OpenFileCache returns the file cache for backups of the given directory
+// to the given repository, which should be identified by a string that's
+// unique to it, such as its storage.RepositoryID. Problems reading the
+// cache aren't fatal; an empty cache is returned in that case.
+func OpenFileCache(repository, dir string) *FileCache {
+	path, err := fileCachePath(repository, dir)
+	if err != nil {
+		log.Warning("%s: unable to find file cache: %s", dir, err)
+		return nil
+	}
+	fc := &FileCache{path: path, old: make(map[string]fileCacheEntry),
+		new: make(map[string]fileCacheEntry)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return fc
+	} else if err != nil {
+		log.Warning("%s: %s", path, err)
+		return fc
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&fc.old); err != nil {
+		log.Warning("%s: ignoring file cache: %s", path, err)
+		fc.old = make(map[string]fileCacheEntry)
+	}
+	log.Verbose("%s: read %d file cache entries", path, len(fc.old))
+	return fc
+}
+
+// Lookup returns the cache entry, which gives the stored hash, checksum,
+// and chunk index, for the file at the given path if it hasn't changed
+// since it was added to the cache and its contents are still present in
+// the backend.
+func (fc *FileCache) Lookup(path string, fi os.FileInfo,
+	backend storage.Backend) (fileCacheEntry, bool) {
+	e, ok := fc.lookup(path, fi)
+	if !ok || !backend.HashExists(e.Hash.Hash) ||
+		(e.Index != nil && !backend.HashExists(e.Index.Hash)) {
+		return fileCacheEntry{}, false
+	}
+
+	fc.mu.Lock()
+	fc.new[fc.key(path)] = e
+	fc.mu.Unlock()
+	return e, true
+}
+
+// Unchanged returns the hash recorded for the file at the given path if
+// the file hasn't changed since it was added to the cache. Unlike Lookup,
+// it doesn't check the repository and doesn't add an entry for the
+// current backup.
+func (fc *FileCache) Unchanged(path string, fi os.FileInfo) (storage.MerkleHash, bool) {
+	e, ok := fc.lookup(path, fi)
+	return e.Hash, ok
+}
+
+func (fc *FileCache) lookup(path string, fi os.FileInfo) (fileCacheEntry, bool) {
+	if fc == nil {
+		return fileCacheEntry{}, false
+	}
+	e, ok := fc.old[fc.key(path)]
+	if !ok || !e.matches(fi) {
+		return fileCacheEntry{}, false
+	}
+	return e, true
+}
+
+// matches reports whether the entry describes the given file as it is
+// now. Modification times are compared as instants, since ones decoded
+// from the cache have neither the monotonic clock reading nor,
+// necessarily, the location of the ones from os.Stat.
+func (e fileCacheEntry) matches(fi os.FileInfo) bool {
+	inode, ctime := fileIdentity(fi)
+	return e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime()) &&
+		e.Inode == inode && e.Ctime == ctime
+}
+
+// contains reports whether the cache has an entry for the given path,
+// whether or not the file has changed since.
+func (fc *FileCache) contains(path string) bool {
+	if fc == nil {
+		return false
+	}
+	_, ok := fc.old[fc.key(path)]
+	return ok
+}
+
+// Len returns the number of entries read from the cache file.
+func (fc *FileCache) Len() int {
+	if fc == nil {
+		return 0
+	}
+	return len(fc.old)
+}
+
+// Add records the hash, checksum, and chunk index of the contents of the
+// file at the given path, as given by its DirEntry.
+func (fc *FileCache) Add(path string, fi os.FileInfo, e DirEntry) {
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.new[fc.key(path)] = newFileCacheEntry(fi, e.Hash, e.Checksum, e.Index)
+}
+
+// MapPaths causes files in the directory from to be recorded in the cache
+// as if they were in the directory to instead. It's used when a directory
+// is backed up from a snapshot of it that may not be in the same place
+// each time.
+func (fc *FileCache) MapPaths(from, to string) {
+	if fc != nil {
+		fc.from, fc.to = from, to
+	}
+}
+
+// key returns the path that the file at the given path is recorded under.
+func (fc *FileCache) key(path string) string {
+	if fc.from != "" && (path == fc.from ||
+		strings.HasPrefix(path, fc.from+string(filepath.Separator))) {
+		return fc.to + strings.TrimPrefix(path, fc.from)
+	}
+	return path
+}
+
+// Save writes the entries added during the current backup to disk. It
+// should only be called after the backup has been successfully stored.
+func (fc *FileCache) Save() {
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(fc.path), 0700); err != nil {
+		log.Warning("%s: %s", fc.path, err)
+		return
+	}
+	tmpPath := fc.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Warning("%s: %s", tmpPath, err)
+		return
+	}
+	if err := gob.NewEncoder(f).Encode(fc.new); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		log.Warning("%s: %s", tmpPath, err)
+		return
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		log.Warning("%s: %s", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, fc.path); err != nil {
+		log.Warning("%s: %s", fc.path, err)
+	}
+}
@@ -0,0 +1,61 @@
+// backup/fileid_bsd.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package backup
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileIdentity returns the inode number and status change time of the
+// given file.
+func fileIdentity(fi os.FileInfo) (inode uint64, ctime int64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino), st.Ctimespec.Nano()
+	}
+	return 0, 0
+}
+
+// fileOwnerIds returns the numeric user and group ids of the given file's
+// owner.
+func fileOwnerIds(fi os.FileInfo) (uid, gid int, ok bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid), true
+	}
+	return 0, 0, false
+}
+
+// fileBirthTime returns the creation time of the given file.
+func fileBirthTime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Birthtimespec.Unix())
+	}
+	return time.Time{}
+}
+
+// setBirthTime sets the creation time of the file at the given path. There
+// isn't a system call for that, but the filesystem sets it to the
+// modification time if the latter is set to be earlier than it, so the
+// modification time (and access time) must be set afterward.
+func setBirthTime(path string, t time.Time) error {
+	return os.Chtimes(path, t, t)
+}
+
+// The UF_NODUMP file flag, from <sys/stat.h>.
+const ufNoDump = 0x1
+
+// IsNoDump reports whether the given file or directory has the "nodump"
+// flag set (as by "chflags nodump"), which dump(8) and some other backup
+// programs take as a request not to back it up.
+func IsNoDump(path string, fi os.FileInfo) bool {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Flags&ufNoDump != 0
+	}
+	return false
+}
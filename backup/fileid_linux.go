@@ -0,0 +1,72 @@
+// backup/fileid_linux.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package backup
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// fileIdentity returns the inode number and status change time of the
+// given file.
+func fileIdentity(fi os.FileInfo) (inode uint64, ctime int64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino), st.Ctim.Nano()
+	}
+	return 0, 0
+}
+
+// fileOwnerIds returns the numeric user and group ids of the given file's
+// owner.
+func fileOwnerIds(fi os.FileInfo) (uid, gid int, ok bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid), true
+	}
+	return 0, 0, false
+}
+
+// fileBirthTime returns the zero time, since file creation times are only
+// available on Linux via statx(2), which isn't supported by package
+// syscall.
+func fileBirthTime(fi os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+// setBirthTime does nothing, since Linux doesn't allow setting creation
+// times.
+func setBirthTime(path string, t time.Time) error {
+	return nil
+}
+
+// The FS_IOC_GETFLAGS ioctl and its FS_NODUMP_FL flag, from
+// <linux/fs.h>. The ioctl's number encodes the size of a long, though the
+// kernel only reads and writes an int; it's given for the architectures
+// that use the generic ioctl encoding, and the ioctl just fails on
+// others.
+const fsNoDumpFlag = 0x40
+
+var fsIocGetFlags = uintptr(0x80006601 | unsafe.Sizeof(uintptr(0))<<16)
+
+// IsNoDump reports whether the given file or directory has the "nodump"
+// attribute set (as by "chattr +d"), which dump(8) and some other backup
+// programs take as a request not to back it up. The file must be opened
+// to check, so it's only done for regular files and directories; false is
+// returned for anything that can't be checked.
+func IsNoDump(path string, fi os.FileInfo) bool {
+	if !fi.Mode().IsRegular() && !fi.IsDir() {
+		return false
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var flags int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocGetFlags,
+		uintptr(unsafe.Pointer(&flags)))
+	return errno == 0 && flags&fsNoDumpFlag != 0
+}
@@ -0,0 +1,41 @@
+// backup/fileid_other.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!windows
+
+package backup
+
+import (
+	"os"
+	"time"
+)
+
+// fileIdentity isn't available on this platform; the file cache uses just
+// the size and modification time in its place.
+func fileIdentity(fi os.FileInfo) (inode uint64, ctime int64) {
+	return 0, 0
+}
+
+// fileOwnerIds isn't available on this platform, so file ownership isn't
+// recorded in backups.
+func fileOwnerIds(fi os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// fileBirthTime isn't available on this platform.
+func fileBirthTime(fi os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+// setBirthTime isn't available on this platform and does nothing.
+func setBirthTime(path string, t time.Time) error {
+	return nil
+}
+
+// IsNoDump always returns false, since checking for the "nodump"
+// attribute isn't supported on this platform.
+func IsNoDump(path string, fi os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,58 @@
+// backup/fileid_windows.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package backup
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileIdentity isn't available on Windows; the file cache uses just the
+// size and modification time in its place.
+func fileIdentity(fi os.FileInfo) (inode uint64, ctime int64) {
+	return 0, 0
+}
+
+// fileOwnerIds isn't available on Windows, so file ownership isn't
+// recorded in backups.
+func fileOwnerIds(fi os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// fileBirthTime returns the creation time of the given file.
+func fileBirthTime(fi os.FileInfo) time.Time {
+	if d, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, d.CreationTime.Nanoseconds())
+	}
+	return time.Time{}
+}
+
+// setBirthTime sets the creation time of the file at the given path.
+func setBirthTime(path string, t time.Time) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	// FILE_FLAG_BACKUP_SEMANTICS is needed to open directories.
+	h, err := syscall.CreateFile(p, syscall.FILE_WRITE_ATTRIBUTES,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.CloseHandle(h)
+	ft := syscall.NsecToFiletime(t.UnixNano())
+	if err := syscall.SetFileTime(h, &ft, nil, nil); err != nil {
+		return &os.PathError{Op: "SetFileTime", Path: path, Err: err}
+	}
+	return nil
+}
+
+// IsNoDump always returns false, since Windows doesn't have a "nodump"
+// attribute.
+func IsNoDump(path string, fi os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,223 @@
+// backup/owner.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package backup
+
+// Recording and restoring the ownership of files.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileOwner records the user and group that own a file, both numerically
+// and by name, so that ownership can be restored on a machine with
+// different ids. The names are empty if they couldn't be found when the
+// backup was made.
+type FileOwner struct {
+	Uid, Gid    int
+	User, Group string
+}
+
+// idCache caches the results of looking up user and group names and ids,
+// which may be expensive (e.g., with LDAP).
+type idCache struct {
+	mu sync.Mutex
+	// Map from ids to names when backing up and from names to ids when
+	// restoring; names that weren't found map to "" and -1, respectively.
+	userNames, groupNames map[int]string
+	userIds, groupIds     map[string]int
+}
+
+var idNames = idCache{userNames: make(map[int]string), groupNames: make(map[int]string),
+	userIds: make(map[string]int), groupIds: make(map[string]int)}
+
+// getFileOwner returns the owner of the given file, or nil if ownership
+// isn't available on the current platform.
+func getFileOwner(fi os.FileInfo) *FileOwner {
+	// Files on other machines (see sshSource) report their owners
+	// themselves.
+	if r, ok := fi.(interface{ fileOwner() *FileOwner }); ok {
+		return r.fileOwner()
+	}
+
+	uid, gid, ok := fileOwnerIds(fi)
+	if !ok {
+		return nil
+	}
+
+	idNames.mu.Lock()
+	defer idNames.mu.Unlock()
+	name, ok := idNames.userNames[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			name = u.Username
+		}
+		idNames.userNames[uid] = name
+	}
+	group, ok := idNames.groupNames[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			group = g.Name
+		}
+		idNames.groupNames[gid] = group
+	}
+	return &FileOwner{Uid: uid, Gid: gid, User: name, Group: group}
+}
+
+// localUserId returns the id of the user with the given name on this
+// machine, or -1 if there is no such user.
+func localUserId(name string) int {
+	idNames.mu.Lock()
+	defer idNames.mu.Unlock()
+	id, ok := idNames.userIds[name]
+	if !ok {
+		id = -1
+		if u, err := user.Lookup(name); err == nil {
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		idNames.userIds[name] = id
+	}
+	return id
+}
+
+// localGroupId returns the id of the group with the given name on this
+// machine, or -1 if there is no such group.
+func localGroupId(name string) int {
+	idNames.mu.Lock()
+	defer idNames.mu.Unlock()
+	id, ok := idNames.groupIds[name]
+	if !ok {
+		id = -1
+		if g, err := user.LookupGroup(name); err == nil {
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		idNames.groupIds[name] = id
+	}
+	return id
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+// OwnerPolicy specifies how Restore restores file ownership.
+type OwnerPolicy int
+
+const (
+	// Use the ids of the users and groups on this machine with the names
+	// recorded in the backup, falling back to the recorded ids if a name
+	// isn't found.
+	OwnerByName OwnerPolicy = iota
+	// Use the recorded ids.
+	OwnerNumeric
+	// Don't restore ownership.
+	OwnerSkip
+)
+
+// IdMap maps users and groups recorded in backups to users and groups on
+// the machine that's being restored to, overriding the OwnerPolicy.
+type IdMap struct {
+	// Keys are names or ids as recorded in the backup and values are ids
+	// on this machine.
+	users, groups map[string]int
+}
+
+// ReadIdMap reads a file that maps users and groups. Each line has the
+// form "user <from> <to>" or "group <from> <to>", where <from> is a name
+// or id as recorded in backups and <to> is a name or id on this machine.
+// Blank lines and lines starting with '#' are ignored.
+func ReadIdMap(path string) (*IdMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &IdMap{users: make(map[string]int), groups: make(map[string]int)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 || (fields[0] != "user" && fields[0] != "group") {
+			return nil, fmt.Errorf("%s:%d: expected \"user\" or \"group\" "+
+				"followed by two names or ids", path, line)
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			if fields[0] == "user" {
+				id = localUserId(fields[2])
+			} else {
+				id = localGroupId(fields[2])
+			}
+			if id == -1 {
+				return nil, fmt.Errorf("%s:%d: %s: %s not found", path, line,
+					fields[2], fields[0])
+			}
+		}
+		if fields[0] == "user" {
+			m.users[fields[1]] = id
+		} else {
+			m.groups[fields[1]] = id
+		}
+	}
+	return m, scanner.Err()
+}
+
+// mapUser returns the id on this machine that the given user, as
+// recorded in a backup, maps to, if any.
+func (m *IdMap) mapUser(name string, id int) (int, bool) {
+	if m == nil {
+		return 0, false
+	}
+	return lookupMappedId(m.users, name, id)
+}
+
+// mapGroup is the equivalent of mapUser for groups.
+func (m *IdMap) mapGroup(name string, id int) (int, bool) {
+	if m == nil {
+		return 0, false
+	}
+	return lookupMappedId(m.groups, name, id)
+}
+
+func lookupMappedId(ids map[string]int, name string, id int) (int, bool) {
+	if name != "" {
+		if to, ok := ids[name]; ok {
+			return to, true
+		}
+	}
+	to, ok := ids[strconv.Itoa(id)]
+	return to, ok
+}
+
+// localIds returns the user and group ids to restore the given owner
+// with.
+func localIds(o *FileOwner, policy OwnerPolicy, m *IdMap) (uid, gid int) {
+	uid, gid = o.Uid, o.Gid
+	if policy == OwnerByName {
+		if o.User != "" {
+			if id := localUserId(o.User); id != -1 {
+				uid = id
+			}
+		}
+		if o.Group != "" {
+			if id := localGroupId(o.Group); id != -1 {
+				gid = id
+			}
+		}
+	}
+	if id, ok := m.mapUser(o.User, o.Uid); ok {
+		uid = id
+	}
+	if id, ok := m.mapGroup(o.Group, o.Gid); ok {
+		gid = id
+	}
+	return
+}
@@ -0,0 +1,383 @@
+// cmd/bk/api.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// HTTP API for managing bk remotely: listing backups, starting backups
+// and monitoring their progress, and getting repository statistics.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of lines of a job's output that are kept to report its
+// progress.
+const apiJobOutputLines = 20
+
+// apiServer implements the management API. Backups are run by separate
+// bk processes, so that fatal errors in them don't take down the server;
+// they report their results by POSTing a runSummary back to the server,
+// using the same mechanism as --notify-url.
+type apiServer struct {
+	token string
+	// Base URL the jobs use to reach the server.
+	selfURL string
+
+	mu sync.Mutex
+	// The storage backend is opened lazily and reopened after each backup
+	// completes, so that newly-added backups are included in results.
+	backend storage.Backend
+	jobs    []*apiJob
+}
+
+// apiJob records the state of a backup started via the API.
+type apiJob struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Dir        string     `json:"dir"`
+	State      string     `json:"state"` // "running", "succeeded", or "failed"
+	Start      time.Time  `json:"start"`
+	End        *time.Time `json:"end,omitempty"`
+	ExitStatus int        `json:"exit_status"`
+	// The most recent lines of output from the job.
+	Output  []string    `json:"output"`
+	Summary *runSummary `json:"summary,omitempty"`
+
+	// Secret included in the URL that the job sends its summary to.
+	key string
+}
+
+// apiBackupRequest is the body of a POST to /v1/backups; the fields
+// correspond to the options of "bk backup".
+type apiBackupRequest struct {
+	Name      string   `json:"name"`
+	Dir       string   `json:"dir"`
+	Base      string   `json:"base,omitempty"`
+	Exclude   []string `json:"exclude,omitempty"`
+	SplitBits uint     `json:"split_bits,omitempty"`
+}
+
+// apiSnapshot describes a backup or bitstream in the repository.
+type apiSnapshot struct {
+	Type     string    `json:"type"`
+	Name     string    `json:"name"`
+	FullName string    `json:"full_name"`
+	Time     time.Time `json:"time"`
+}
+
+// apiStats summarizes the contents of the repository.
+type apiStats struct {
+	Backups     int   `json:"backups"`
+	Bitstreams  int   `json:"bitstreams"`
+	Blobs       int   `json:"blobs"`
+	StoredBytes int64 `json:"stored_bytes"`
+}
+
+// serveAPI serves the management API on the given address until the
+// program is terminated. If token is non-empty, requests must provide it
+// as a bearer token.
+func serveAPI(addr, token string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		Error("%s: %s\n", addr, err)
+	}
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+	host := tcpAddr.IP.String()
+	if tcpAddr.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	s := &apiServer{token: token,
+		selfURL: "http://" + net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port))}
+	if token == "" && !tcpAddr.IP.IsLoopback() {
+		log.Warning("%s: serving the management API without authentication; "+
+			"set BK_API_TOKEN", ln.Addr())
+	}
+	// Open the backend at startup so that configuration problems are
+	// reported immediately.
+	s.getBackend()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/snapshots", s.authorized(s.handleSnapshots))
+	mux.HandleFunc("/v1/stats", s.authorized(s.handleStats))
+	mux.HandleFunc("/v1/backups", s.authorized(s.handleBackups))
+	mux.HandleFunc("/v1/jobs", s.authorized(s.handleJobs))
+	mux.HandleFunc("/v1/jobs/", s.handleJob)
+
+	log.Print("serving management API at %s", ln.Addr())
+	log.CheckError(http.Serve(ln, mux))
+}
+
+func (s *apiServer) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			auth := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		log.Verbose("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Warning("%s", err)
+	}
+}
+
+// getBackend returns the storage backend, opening it if necessary. s.mu
+// must be held.
+func (s *apiServer) getBackend() storage.Backend {
+	if s.backend == nil {
+		s.backend = GetStorageBackend()
+	}
+	return s.backend
+}
+
+func (s *apiServer) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	md := s.getBackend().ListMetadata()
+	s.mu.Unlock()
+
+	snapshots := []apiSnapshot{}
+	for n, t := range md {
+		var typ string
+		switch {
+		case strings.HasPrefix(n, "backup-"):
+			typ = "backup"
+		case strings.HasPrefix(n, "bits-"):
+			typ = "bits"
+		default:
+			continue
+		}
+		fullName := n[strings.Index(n, "-")+1:]
+		snapshots = append(snapshots, apiSnapshot{Type: typ, FullName: fullName,
+			Name: strings.SplitN(fullName, "@", 2)[0], Time: t})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Type != snapshots[j].Type {
+			return snapshots[i].Type < snapshots[j].Type
+		}
+		return snapshots[i].FullName < snapshots[j].FullName
+	})
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+func (s *apiServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backend := s.getBackend()
+
+	var stats apiStats
+	backend.ForMetadata("backup-", func(n string, created time.Time) error {
+		stats.Backups++
+		return nil
+	})
+	backend.ForMetadata("bits-", func(n string, created time.Time) error {
+		stats.Bitstreams++
+		return nil
+	})
+	for h := range backend.Hashes() {
+		stats.Blobs++
+		if n, err := backend.BlobSize(h); err == nil {
+			stats.StoredBytes += n
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleBackups starts a new backup. Only one may run at a time.
+func (s *apiServer) handleBackups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req apiBackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || req.Dir == "" {
+		http.Error(w, "\"name\" and \"dir\" must be specified", http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(req.Name, "-") || strings.Contains(req.Name, "/") {
+		http.Error(w, "\"name\" can't start with '-' or include '/'", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.State == "running" {
+			http.Error(w, fmt.Sprintf("job %d is already running", j.Id),
+				http.StatusConflict)
+			return
+		}
+	}
+
+	var key [16]byte
+	_, err := rand.Read(key[:])
+	log.CheckError(err)
+	job := &apiJob{Id: len(s.jobs) + 1, Name: req.Name, Dir: req.Dir,
+		State: "running", Start: time.Now(), Output: []string{},
+		key: hex.EncodeToString(key[:])}
+
+	args := []string{"backup", "--notify-url",
+		fmt.Sprintf("%s/v1/jobs/%d/summary?key=%s", s.selfURL, job.Id, job.key),
+		"--notify-fail-url", ""}
+	if req.Base != "" {
+		args = append(args, "--base", req.Base)
+	}
+	for _, e := range req.Exclude {
+		args = append(args, "--exclude", e)
+	}
+	if req.SplitBits != 0 {
+		args = append(args, "--split-bits", strconv.Itoa(int(req.SplitBits)))
+	}
+	// The name and directory follow "--" so that they aren't taken as
+	// options.
+	args = append(args, "--", req.Name, req.Dir)
+
+	exe, err := os.Executable()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cmd := exec.Command(exe, args...)
+	out, err := cmd.StderrPipe()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cmd.Stdout = cmd.Stderr
+	if err := cmd.Start(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Print("job %d: started backup of %s as %s", job.Id, req.Dir, req.Name)
+	s.jobs = append(s.jobs, job)
+
+	go func() {
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			s.mu.Lock()
+			job.Output = append(job.Output, scanner.Text())
+			if len(job.Output) > apiJobOutputLines {
+				job.Output = job.Output[len(job.Output)-apiJobOutputLines:]
+			}
+			s.mu.Unlock()
+		}
+		err := cmd.Wait()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		end := time.Now()
+		job.End = &end
+		job.ExitStatus = cmd.ProcessState.ExitCode()
+		if err == nil {
+			job.State = "succeeded"
+		} else {
+			job.State = "failed"
+		}
+		log.Print("job %d: %s (exit status %d)", job.Id, job.State, job.ExitStatus)
+		// Reopen the backend the next time it's needed to pick up the new
+		// backup.
+		s.backend = nil
+	}()
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (s *apiServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := s.jobs
+	if jobs == nil {
+		jobs = []*apiJob{}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleJob handles GET /v1/jobs/<id> and POST /v1/jobs/<id>/summary,
+// the latter from the job itself. The job authenticates with the key it
+// was given, so it doesn't need the API token.
+func (s *apiServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	s.mu.Lock()
+	if err != nil || id < 1 || id > len(s.jobs) || len(parts) > 2 ||
+		(len(parts) == 2 && parts[1] != "summary") {
+		s.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	job := s.jobs[id-1]
+	s.mu.Unlock()
+
+	if len(parts) == 1 {
+		s.authorized(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			writeJSON(w, http.StatusOK, job)
+		})(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(job.key)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var summary runSummary
+	if err := json.NewDecoder(r.Body).Decode(&summary); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	job.Summary = &summary
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
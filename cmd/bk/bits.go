@@ -0,0 +1,214 @@
+// cmd/bk/bits.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Metadata for bitstreams saved with "bk savebits".
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"io"
+	"os"
+	"strings"
+)
+
+// The metadata for a bitstream is the MerkleHash of its contents,
+// optionally followed by the MerkleHash of an index that gives the sizes
+// of the chunks they were split into, encoded as varints, and then a
+// gob-encoded BitsInfo. Bitstreams saved by older versions of bk have
+// neither the index nor the BitsInfo.
+type bitsMetadata struct {
+	Hash storage.MerkleHash
+	// Index and Info are nil if the bitstream doesn't have them.
+	Index *storage.MerkleHash
+	Info  *BitsInfo
+}
+
+// BitsInfo records information about where a bitstream came from so that
+// it can be checked before it's relied on.
+type BitsInfo struct {
+	// Number of bytes in the stream and their hash, computed using the
+	// repository's hash algorithm.
+	Size     int64
+	Checksum storage.Hash
+	// Host that the stream was saved on and the bk command line used to
+	// save it or, for streams saved with "savebits --input", the command
+	// that produced it.
+	Host    string
+	Command []string
+	// Hashes of the uncompressed and unencrypted contents of each of the
+	// chunks that the stream was split into, so that partially restored
+	// streams can be checked. Nil for bitstreams saved by older versions
+	// of bk.
+	ChunkChecksums *storage.MerkleHash
+	// If the stream was compressed before it was split into chunks, the
+	// compression used ("zstd") and its window size. Size and Checksum
+	// are those of the original stream; the chunks, their sizes, and
+	// their checksums are those of the compressed one.
+	Compression string
+	WindowSize  int
+}
+
+// CommandLine returns the command line used to save the bitstream as a
+// single string.
+func (bi *BitsInfo) CommandLine() string {
+	return strings.Join(bi.Command, " ")
+}
+
+func (bm bitsMetadata) Bytes() []byte {
+	b := bm.Hash.Bytes()
+	if bm.Index == nil {
+		return b
+	}
+	b = append(b, bm.Index.Bytes()...)
+	if bm.Info == nil {
+		return b
+	}
+	var buf bytes.Buffer
+	log.CheckError(gob.NewEncoder(&buf).Encode(bm.Info))
+	return append(b, buf.Bytes()...)
+}
+
+// parseBitsMetadata decodes the metadata for a bitstream.
+func parseBitsMetadata(md []byte) bitsMetadata {
+	const n = storage.HashSize + 1
+	bm := bitsMetadata{Hash: storage.NewMerkleHash(md)}
+	if len(md) < 2*n {
+		return bm
+	}
+	index := storage.NewMerkleHash(md[n:])
+	bm.Index = &index
+	if len(md) > 2*n {
+		var info BitsInfo
+		if err := gob.NewDecoder(bytes.NewReader(md[2*n:])).Decode(&info); err != nil {
+			log.Warning("unable to decode bitstream information: %s", err)
+		} else {
+			bm.Info = &info
+		}
+	}
+	return bm
+}
+
+func readChunkChecksums(h storage.MerkleHash, backend storage.Backend) []storage.Hash {
+	r := h.NewReader(nil, backend)
+	defer r.Close()
+	var hashes []storage.Hash
+	for {
+		var hash storage.Hash
+		_, err := io.ReadFull(r, hash[:])
+		if err == io.EOF {
+			return hashes
+		}
+		log.CheckError(err)
+		hashes = append(hashes, hash)
+	}
+}
+
+// resumeOffset checks the chunks of the bitstream that are already present
+// in the given file, which is being restored to, and returns the offset
+// after the last intact one, truncating the file there and positioning it
+// to write the rest of the bitstream. The intact chunks are written to
+// hasher.
+func resumeOffset(f *os.File, bm bitsMetadata, chunkSizes []int64, hasher storage.Hasher,
+	backend storage.Backend) int64 {
+	fi, err := f.Stat()
+	log.CheckError(err)
+
+	var offset int64
+	if fi.Size() > 0 && (chunkSizes == nil || bm.Info == nil || bm.Info.ChunkChecksums == nil) {
+		log.Warning("%s: bitstream was saved by an older version of bk, so the "+
+			"restored data can't be checked; starting over", f.Name())
+	} else if fi.Size() > 0 {
+		checksums := readChunkChecksums(*bm.Info.ChunkChecksums, backend)
+		log.Check(len(checksums) == len(chunkSizes), "%d chunk checksums for %d chunks",
+			len(checksums), len(chunkSizes))
+		br := bufio.NewReader(f)
+		for i, size := range chunkSizes {
+			if offset+size > fi.Size() {
+				break
+			}
+			chunk := make([]byte, size)
+			_, err := io.ReadFull(br, chunk)
+			log.CheckError(err)
+			if storage.HashBytes(chunk) != checksums[i] {
+				log.Warning("%s: data at offset %d doesn't match the bitstream",
+					f.Name(), offset)
+				break
+			}
+			_, err = hasher.Write(chunk)
+			log.CheckError(err)
+			offset += size
+		}
+		log.Print("%s: %s already restored; resuming", f.Name(), u.FmtBytes(offset))
+	}
+
+	log.CheckError(f.Truncate(offset))
+	_, err = f.Seek(offset, io.SeekStart)
+	log.CheckError(err)
+	return offset
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Compressed bitstreams
+
+// Window size used by "savebits --zstd-long"; it's the same as the
+// default for zstd's own --long option. Chunks are compressed
+// individually by the storage backend, which can't find redundancy
+// that's further apart than the size of a chunk; compressing the whole
+// stream with a large window finds the repeated data that's typical of
+// database dumps and tar archives, often megabytes apart.
+const zstdLongWindow = 128 << 20
+
+// newZstdReader returns an io.Reader that supplies the data read from r,
+// compressed with zstd using zstdLongWindow. Once it has returned io.EOF,
+// *n is the number of bytes that were read from r.
+func newZstdReader(r io.Reader, n *int64) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		zw, err := zstd.NewWriter(pw, zstd.WithWindowSize(zstdLongWindow),
+			zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+		if err == nil {
+			*n, err = io.Copy(zw, r)
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decompressBits returns an io.ReadCloser that decompresses the stored
+// contents of a bitstream, which are read from r, according to its
+// BitsInfo. r is closed when it is.
+func decompressBits(r io.ReadCloser, info *BitsInfo) (io.ReadCloser, error) {
+	if info.Compression != "zstd" {
+		return nil, fmt.Errorf("%s: unknown bitstream compression", info.Compression)
+	}
+	d, err := zstd.NewReader(r, zstd.WithDecoderMaxWindow(uint64(info.WindowSize)))
+	if err != nil {
+		return nil, err
+	}
+	return zstdReadCloser{d, r}, nil
+}
+
+type zstdReadCloser struct {
+	d *zstd.Decoder
+	r io.ReadCloser
+}
+
+func (z zstdReadCloser) Read(buf []byte) (int, error) {
+	return z.d.Read(buf)
+}
+
+func (z zstdReadCloser) Close() error {
+	z.d.Close()
+	return z.r.Close()
+}
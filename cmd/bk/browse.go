@@ -0,0 +1,141 @@
+// cmd/bk/browse.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Interactive browser for the contents of backups.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/mmp/bk/backup"
+	"github.com/mmp/bk/storage"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup is chosen from a list of all of them, unless one was given on
+// the command line; its tree is then shown by the same picker that
+// "restore --interactive" uses, and the selection is restored under a
+// directory that's asked for once the picker is closed.
+
+const chooserHelp = "up/down: move  enter: browse  q: quit"
+
+// backupChooser is a screen that lists the backups in a repository so that
+// one of them can be chosen.
+type backupChooser struct {
+	title string
+	// Full metadata names, sorted, and the times they were created.
+	names       []string
+	created     []time.Time
+	cursor, top int
+}
+
+func (c *backupChooser) key(k string) (more bool, accept bool) {
+	switch k {
+	case "\r", "\n":
+		return false, true
+	case "q", "\x1b", "\x03":
+		return false, false
+	case "\x1b[A", "k":
+		if c.cursor > 0 {
+			c.cursor--
+		}
+	case "\x1b[B", "j":
+		if c.cursor < len(c.names)-1 {
+			c.cursor++
+		}
+	}
+	return true, false
+}
+
+func (c *backupChooser) draw(out io.Writer, height int) {
+	// Leave room for the title and the status line.
+	lines := height - 2
+	if lines < 1 {
+		lines = 1
+	}
+	c.top = scroll(c.cursor, c.top, lines)
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&buf, "Backups in %s\r\n", c.title)
+	for i := c.top; i < len(c.names) && i < c.top+lines; i++ {
+		line := fmt.Sprintf("%-40s %s", strings.TrimPrefix(c.names[i], "backup-"),
+			c.created[i].Format(time.RFC1123))
+		if i == c.cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		buf.WriteString(line + "\r\n")
+	}
+	fmt.Fprintf(&buf, "\x1b[%d;1H%d backups  %s", height, len(c.names), chooserHelp)
+	out.Write(buf.Bytes())
+}
+
+// chooseBackup lets the user choose one of the backups in the given
+// repository, returning its full metadata name, or an empty string if
+// they quit without choosing one.
+func chooseBackup(backend storage.Backend) (string, error) {
+	c := &backupChooser{title: backend.String()}
+	md := backend.ListMetadata()
+	for n := range md {
+		if strings.HasPrefix(n, "backup-") {
+			c.names = append(c.names, n)
+		}
+	}
+	if len(c.names) == 0 {
+		return "", fmt.Errorf("%s: no backups", backend.String())
+	}
+	sort.Strings(c.names)
+	for _, n := range c.names {
+		c.created = append(c.created, md[n])
+	}
+
+	if accept, err := runScreen(c); err != nil || !accept {
+		return "", err
+	}
+	return c.names[c.cursor], nil
+}
+
+// browseBackups lets the user browse the most recent backup with the given
+// name, or one that they choose if name is empty, and restores the files
+// and directories that they select.
+func browseBackups(backend storage.Backend, name string, jobs int) error {
+	var fullName string
+	var err error
+	if name != "" {
+		if fullName, err = getLatest("backup-"+name, backend); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	} else {
+		fullName, err = chooseBackup(backend)
+	}
+	if err != nil || fullName == "" {
+		return err
+	}
+
+	r, err := backup.NewBackupReader(lookupHash(fullName, backend), backend)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fullName, err)
+	}
+	paths, err := pickPaths(r, strings.TrimPrefix(fullName, "backup-"))
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+
+	fmt.Printf("Directory to restore the selection to: ")
+	dest, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if dest = strings.TrimSpace(dest); dest == "" {
+		log.Print("not restoring anything")
+		return nil
+	}
+	return restorePaths(r, paths, dest, backup.RestoreOptions{Jobs: jobs})
+}
@@ -0,0 +1,161 @@
+// cmd/bk/catalog.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Export of the list of files in backups to a SQLite database.
+
+import (
+	"database/sql"
+	"github.com/mmp/bk/backup"
+	"github.com/mmp/bk/storage"
+	"os"
+	"sort"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+const catalogSchema = `
+CREATE TABLE backups (
+    id INTEGER PRIMARY KEY,
+    -- Name given to "bk backup" and the full name, including the time.
+    name TEXT NOT NULL,
+    full_name TEXT NOT NULL UNIQUE,
+    -- Seconds since the Unix epoch.
+    time INTEGER NOT NULL
+);
+CREATE TABLE files (
+    backup_id INTEGER NOT NULL REFERENCES backups(id),
+    -- Relative to the root of the backed-up directory, starting with "/".
+    path TEXT NOT NULL,
+    -- One of "file", "dir", or "symlink".
+    type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    -- Seconds since the Unix epoch.
+    mtime INTEGER NOT NULL,
+    mode INTEGER NOT NULL,
+    -- For files, the hash of their contents, computed with the
+    -- repository's hash algorithm; files with the same hash are
+    -- identical, though identical files split with different
+    -- --split-bits have different hashes. For symlinks, their target.
+    hash TEXT,
+    target TEXT
+);
+CREATE INDEX files_path ON files(path);
+CREATE INDEX files_hash ON files(hash);
+CREATE VIEW catalog AS
+    SELECT backups.name AS backup, backups.full_name, backups.time, files.*
+    FROM files JOIN backups ON files.backup_id = backups.id;
+`
+
+// writeCatalog writes a SQLite database to the given path that lists all
+// of the files, directories, and symlinks in the given backups. An
+// existing file at that path is replaced, but only once the new database
+// has been completely written.
+func writeCatalog(path string, names []string, backend storage.Backend) error {
+	tmpPath := path + ".tmp"
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := sql.Open("sqlite", tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := fillCatalog(db, names, backend); err != nil {
+		db.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func fillCatalog(db *sql.DB, names []string, backend storage.Backend) error {
+	if _, err := db.Exec(catalogSchema); err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+	for i, name := range names {
+		log.Verbose("%s: adding to catalog (%d of %d)", name, i+1, len(names))
+		hash := lookupHash(name, backend)
+		r, err := backup.NewBackupReader(hash, backend)
+		if err != nil {
+			return err
+		}
+
+		// Each backup is added in a single transaction; committing after
+		// each row would be much slower.
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		fullName := strings.TrimPrefix(name, "backup-")
+		res, err := tx.Exec(`INSERT INTO backups (name, full_name, time) VALUES (?, ?, ?)`,
+			strings.SplitN(fullName, "@", 2)[0], fullName, backupCreated(name, r.Root(), backend).Unix())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		stmt, err := tx.Prepare(`INSERT INTO files (backup_id, path, type, size, mtime, mode, hash, target)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		var insertErr error
+		err = r.Walk("/", func(path string, e backup.DirEntry) {
+			if insertErr != nil {
+				return
+			}
+			var typ string
+			var hash, target interface{}
+			switch {
+			case e.IsDir():
+				typ = "dir"
+			case e.IsSymLink():
+				typ = "symlink"
+				target = string(e.Contents)
+			default:
+				typ = "file"
+				if e.Contents != nil {
+					// Hash small files' contents with the repository's
+					// hash algorithm, as stored chunks are. Whether a
+					// file is stored this way only depends on its size,
+					// so identical files have the same hash as long as
+					// they were split with the same --split-bits.
+					hash = storage.HashBytes(e.Contents).String()
+				} else if e.Size > 0 {
+					hash = e.Hash.Hash.String()
+				}
+			}
+			_, insertErr = stmt.Exec(id, path, typ, e.Size, e.ModTime.Unix(),
+				int64(e.Mode), hash, target)
+		})
+		if err == nil {
+			err = insertErr
+		}
+		if err == nil {
+			err = stmt.Close()
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// cmd/bk/chain.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Relationships between incremental backups and the ones they were based
+// on.
+
+import (
+	"fmt"
+	"github.com/mmp/bk/backup"
+	"github.com/mmp/bk/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Each incremental backup records the hash of the BackupRoot of the backup
+// given with --base in BackupRoot.Base. The hash, rather than the name,
+// is recorded so that the relationship survives the base being renamed.
+// Note that an incremental backup still refers to all of its data
+// directly, so removing its base doesn't lose any of it; the chain is
+// just a record of where each backup came from.
+
+// backupChains records the relationships between all of the backups in
+// the repository.
+type backupChains struct {
+	// Full metadata name of each backup to the hash of its BackupRoot.
+	hashes map[string]storage.Hash
+	// Hash of each BackupRoot to the full metadata names that refer to it.
+	names map[storage.Hash][]string
+	// Hash of each incremental backup's BackupRoot to its base's.
+	bases map[storage.Hash]storage.Hash
+}
+
+// readBackupChains reads the roots of all of the backups in the
+// repository to find the bases of the incremental ones.
+func readBackupChains(backend storage.Backend) *backupChains {
+	var names []string
+	backend.ForMetadata("backup-", func(name string, created time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+	sort.Strings(names)
+
+	c := &backupChains{hashes: make(map[string]storage.Hash),
+		names: make(map[storage.Hash][]string),
+		bases: make(map[storage.Hash]storage.Hash)}
+	contents := backend.ReadMetadataBatch(names)
+	for _, name := range names {
+		hash := storage.NewHash(contents[name])
+		c.hashes[name] = hash
+		c.names[hash] = append(c.names[hash], name)
+	}
+	for hash, n := range c.names {
+		root, err := backup.ReadRoot(hash, backend)
+		if err != nil {
+			log.Warning("%s: %s", n[0], err)
+			continue
+		}
+		if root.Base != (storage.Hash{}) {
+			c.bases[hash] = root.Base
+		}
+	}
+	return c
+}
+
+// describe returns the names of the backups with the given root hash for
+// printing, or a note that there aren't any.
+func (c *backupChains) describe(hash storage.Hash) string {
+	n := c.names[hash]
+	if len(n) == 0 {
+		return fmt.Sprintf("%s (no longer in the repository)", hash)
+	}
+	var s []string
+	for _, name := range n {
+		s = append(s, strings.TrimPrefix(name, "backup-"))
+	}
+	return strings.Join(s, ", ")
+}
+
+// dependents returns the full metadata names of the backups that were
+// made using the given backup as their base.
+func (c *backupChains) dependents(name string) []string {
+	hash, ok := c.hashes[name]
+	if !ok {
+		return nil
+	}
+	var deps []string
+	for h, base := range c.bases {
+		if base == hash {
+			deps = append(deps, c.names[h]...)
+		}
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// warnDependents issues a warning for each of the given backups that's
+// the base of an incremental backup that isn't also in the list. It's
+// to be used before the given backups are removed, renamed, or replaced;
+// what's happening to them is given by action, e.g. "being removed".
+func warnDependents(backend storage.Backend, names []string, action string) {
+	if len(names) == 0 {
+		return
+	}
+	removed := make(map[string]bool)
+	for _, name := range names {
+		removed[name] = true
+	}
+
+	c := readBackupChains(backend)
+	for _, name := range names {
+		var kept []string
+		for _, dep := range c.dependents(name) {
+			if !removed[dep] {
+				kept = append(kept, strings.TrimPrefix(dep, "backup-"))
+			}
+		}
+		if len(kept) > 0 {
+			log.Warning("%s: %s, but it's the base of incremental backups: %s",
+				strings.TrimPrefix(name, "backup-"), action, strings.Join(kept, ", "))
+		}
+	}
+}
+
+func chain(args []string) {
+	if len(args) != 1 {
+		Error("usage: bk chain <backup name>\n")
+	}
+
+	backend := GetStorageBackend()
+	name, err := getLatest("backup-"+args[0], backend)
+	if err != nil {
+		Error("%s: %s\n", args[0], err)
+	}
+	c := readBackupChains(backend)
+
+	hash := c.hashes[name]
+	fmt.Printf("%s\n", strings.TrimPrefix(name, "backup-"))
+	seen := map[storage.Hash]bool{hash: true}
+	for {
+		base, ok := c.bases[hash]
+		if !ok || seen[base] {
+			break
+		}
+		fmt.Printf("  based on %s\n", c.describe(base))
+		hash = base
+		seen[base] = true
+	}
+
+	if deps := c.dependents(name); len(deps) > 0 {
+		fmt.Printf("Incremental backups based on it:\n")
+		for _, dep := range deps {
+			fmt.Printf("  %s\n", strings.TrimPrefix(dep, "backup-"))
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// cmd/bk/client.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Per-client namespaces for backups and bitstreams in shared repositories.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	"os"
+	"strings"
+)
+
+// When several machines back up to the same repository, each one can be
+// given a client name, either with the BK_CLIENT environment variable or
+// "client" in the configuration file. Backups and bitstreams are then
+// stored with names of the form "client+name" (e.g.,
+// "backup-laptop+home@20170102150405"), and names given on the command
+// line that don't include a client refer to the current client's. Chunks
+// are still shared by all of the clients, so data is deduplicated across
+// all of them.
+//
+// Snapshots made before client names existed may have names that include
+// '+' as well, so which client a snapshot belongs to is recorded
+// separately, in metadata named using ownerPrefix, the client, '+', and
+// the snapshot's full metadata name (e.g.,
+// "client-laptop+backup-laptop+home@20170102150405"). Client names can't
+// include '+', so these names are unambiguous. Snapshots without one
+// don't belong to any client.
+const ownerPrefix = "client-"
+
+// clientSeparator separates the client from the rest of a snapshot name.
+// It's one of the few characters that's valid in file names everywhere,
+// including Windows, and that doesn't already have a meaning in names
+// given on the command line (unlike the ':' in "foo:latest").
+const clientSeparator = "+"
+
+// currentClient returns the client name for this machine, or "" if none
+// has been configured.
+func currentClient() string {
+	if c := os.Getenv("BK_CLIENT"); c != "" {
+		return c
+	}
+	return config.Client
+}
+
+// checkClientName returns an error if the given client name can't be used.
+func checkClientName(client string) error {
+	if strings.ContainsAny(client, "@~:/\\"+clientSeparator) {
+		return fmt.Errorf("%s: client names can't include '@', '~', ':', '/', '\\', or '%s'",
+			client, clientSeparator)
+	}
+	return nil
+}
+
+// snapshotClient returns the client that the given snapshot name, as given
+// on the command line, specifies, along with the rest of the name. The name
+// may include a selector like ":latest" but no "backup-" or "bits-" prefix,
+// and the client is empty if it doesn't specify one. Which client a stored
+// snapshot belongs to is given by snapshotOwners instead.
+func snapshotClient(name string) (client, rest string) {
+	i := strings.Index(name, clientSeparator)
+	if i == -1 {
+		return "", name
+	}
+	return name[:i], name[i+len(clientSeparator):]
+}
+
+// qualifySnapshotName returns the given snapshot name qualified with the
+// current client, if there is one and the name doesn't already specify a
+// client.
+func qualifySnapshotName(name string) string {
+	if c, _ := snapshotClient(name); c != "" || currentClient() == "" {
+		return name
+	}
+	return currentClient() + clientSeparator + name
+}
+
+// splitSnapshotPrefix splits a full metadata name into its "backup-" or
+// "bits-" prefix and the rest of it.
+func splitSnapshotPrefix(name string) (prefix, rest string) {
+	for _, p := range []string{"backup-", "bits-"} {
+		if strings.HasPrefix(name, p) {
+			return p, strings.TrimPrefix(name, p)
+		}
+	}
+	return "", name
+}
+
+// ownerName returns the name of the metadata that records that the
+// snapshot with the given full metadata name belongs to the given client.
+func ownerName(client, name string) string {
+	return ownerPrefix + client + clientSeparator + name
+}
+
+// parseOwnerName returns the client and snapshot recorded by the given
+// metadata name, which starts with ownerPrefix. It's an error if the
+// snapshot isn't named with the client, as qualifySnapshotName does.
+func parseOwnerName(name string) (client, snapshot string, err error) {
+	rest := strings.TrimPrefix(name, ownerPrefix)
+	i := strings.Index(rest, clientSeparator)
+	if i <= 0 {
+		return "", "", fmt.Errorf("%s: no client name", name)
+	}
+	client, snapshot = rest[:i], rest[i+len(clientSeparator):]
+	prefix, s := splitSnapshotPrefix(snapshot)
+	if prefix == "" || !strings.HasPrefix(s, client+clientSeparator) {
+		return "", "", fmt.Errorf("%s: not a snapshot of client %s", name, client)
+	}
+	return client, snapshot, nil
+}
+
+// snapshotOwners returns a map from the full metadata names of snapshots
+// that belong to a client to the client.
+func snapshotOwners(backend storage.Backend) map[string]string {
+	owners := make(map[string]string)
+	for name := range backend.ListMetadata() {
+		if !strings.HasPrefix(name, ownerPrefix) {
+			continue
+		}
+		if client, snapshot, err := parseOwnerName(name); err != nil {
+			log.Warning("%s", err)
+		} else {
+			owners[snapshot] = client
+		}
+	}
+	return owners
+}
+
+// recordOwner records that the snapshot with the given full metadata
+// name, which has just been saved, belongs to the current client, if
+// there is one.
+func recordOwner(name string, backend storage.Backend) {
+	if currentClient() == "" {
+		return
+	}
+	// Snapshots replaced with --exact-name already have one.
+	if owner := ownerName(currentClient(), name); !backend.MetadataExists(owner) {
+		backend.WriteMetadata(owner, []byte(currentClient()+"\n"))
+		backend.SyncWrites()
+	}
+}
+
+// inCurrentClient reports whether the snapshot with the given full
+// metadata name belongs to the current client, according to the given
+// owners, as returned by snapshotOwners; all of them do if there's no
+// current client.
+func inCurrentClient(name string, owners map[string]string) bool {
+	return currentClient() == "" || owners[name] == currentClient()
+}
+
+// unqualifiedName returns the given snapshot's full metadata name without
+// its "backup-" or "bits-" prefix and the client it belongs to, if any,
+// according to the given owners.
+func unqualifiedName(name string, owners map[string]string) string {
+	_, rest := splitSnapshotPrefix(name)
+	if c := owners[name]; c != "" {
+		return strings.TrimPrefix(rest, c+clientSeparator)
+	}
+	return rest
+}
+
+// checkClientMetadata returns a function for HTTPToken.CheckMetadata that
+// only allows tokens for the given client, which may be empty, to add
+// snapshots, along with their ownership records, summaries, and
+// signatures, if they're named with that client, so that a client can't
+// add to another one's namespace. Pins are checked with checkPins.
+func checkClientMetadata(client string) func(name string, contents []byte) error {
+	return func(name string, contents []byte) error {
+		if err := checkPins(name, contents); err != nil || client == "" {
+			return err
+		}
+		snapshot := name
+		if strings.HasPrefix(name, ownerPrefix) {
+			c, s, err := parseOwnerName(name)
+			if err != nil {
+				return err
+			} else if c != client {
+				return fmt.Errorf("ownership records for this token must be for %s", client)
+			}
+			snapshot = s
+		} else if strings.HasPrefix(name, signaturePrefix) {
+			snapshot = strings.TrimPrefix(name, signaturePrefix)
+		} else if strings.HasPrefix(name, summaryPrefix) {
+			snapshot = strings.TrimPrefix(name, summaryPrefix)
+		}
+		if prefix, rest := splitSnapshotPrefix(snapshot); prefix != "" &&
+			!strings.HasPrefix(rest, client+clientSeparator) {
+			return errors.New("snapshots made with this token must belong to client " +
+				client)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,174 @@
+// cmd/bk/config.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// The (optional) bk configuration file holds settings that are awkward to
+// provide via environment variables or command-line flags.
+
+import (
+	"encoding/json"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Config stores the contents of the configuration file, which is JSON
+// encoded. It's found at the path given by the BK_CONFIG environment
+// variable, or, if that isn't set, at bk/config.json in the user's
+// configuration directory (e.g., ~/.config/bk/config.json on Linux).
+type Config struct {
+	// Name of this machine in a repository shared by several of them;
+	// see currentClient.
+	Client string       `json:"client"`
+	Email  *EmailConfig `json:"email"`
+	// Access tokens accepted by "bk serve".
+	Tokens []TokenConfig `json:"tokens"`
+	// Retention policies applied by "bk forget", keyed by prefixes of
+	// backup names; see policyFor.
+	Retention map[string]RetentionPolicy `json:"retention"`
+	// Maximum storage for the repository (e.g., "500GB"); if given, it's
+	// used in place of the one recorded in the repository. See
+	// repositoryQuota.
+	Quota string `json:"quota"`
+
+	// Commands for signing backups and verifying their signatures.
+	Signing *SigningConfig `json:"signing"`
+
+	// Quota, parsed.
+	quota int64
+}
+
+// SigningConfig gives the commands, run with the shell, that sign backups
+// and verify their signatures; see signBackup.
+type SigningConfig struct {
+	// Given the message to sign on its standard input, prints its
+	// signature to standard output (e.g., "gpg --detach-sign --armor").
+	// If it's empty, backups aren't signed.
+	Sign string `json:"sign"`
+	// Given the message on its standard input and the path to a file
+	// holding its signature in the BK_SIGNATURE environment variable,
+	// exits with status 0 if the signature is valid (e.g., "gpg --verify
+	// \"$BK_SIGNATURE\" -").
+	Verify string `json:"verify"`
+}
+
+// RetentionPolicy specifies which of the backups with a given name "bk
+// forget" keeps. A backup is kept if any of the rules selects it.
+type RetentionPolicy struct {
+	// If true, all of them are kept and the other rules are ignored.
+	All bool `json:"all"`
+	// Number of most recent backups to keep.
+	Last int `json:"last"`
+	// Number of days, weeks, months, and years for which the most recent
+	// backup made in each is kept, counting back from the most recent one
+	// and skipping ones without any.
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+	Yearly  int `json:"yearly"`
+}
+
+// TokenConfig describes an access token for a repository served with "bk
+// serve".
+type TokenConfig struct {
+	// Used to identify the token in error messages.
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// One of "read-only", "append-only", or "admin".
+	Role string `json:"role"`
+	// If set, backups and bitstreams made with an append-only token must
+	// belong to this client; see checkClientMetadata.
+	Client string `json:"client"`
+}
+
+// EmailConfig specifies how and when notification emails are sent after
+// backup and savebits runs.
+type EmailConfig struct {
+	// SMTP server, as "host:port".
+	Server string `json:"server"`
+	// If provided, PLAIN authentication is used with the server.
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// One of "failure" (the default), "success", or "always".
+	When string `json:"when"`
+}
+
+var config Config
+
+// loadConfig reads the configuration file, if it exists.  It's an error
+// if BK_CONFIG is set but the file it gives can't be read.
+func loadConfig() {
+	path := os.Getenv("BK_CONFIG")
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return
+		}
+		path = filepath.Join(dir, "bk", "config.json")
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return
+	} else if err != nil {
+		log.Fatal("%s: %s", path, err)
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		log.Fatal("%s: %s", path, err)
+	}
+
+	if e := config.Email; e != nil {
+		switch e.When {
+		case "":
+			e.When = "failure"
+		case "failure", "success", "always":
+		default:
+			log.Fatal("%s: %s: unknown \"when\" value for email; expected \"failure\", "+
+				"\"success\", or \"always\"", path, e.When)
+		}
+		if e.Server == "" || e.From == "" || len(e.To) == 0 {
+			log.Fatal("%s: \"server\", \"from\", and \"to\" must all be specified for email",
+				path)
+		}
+	}
+
+	for _, t := range config.Tokens {
+		if t.Token == "" {
+			log.Fatal("%s: %s: \"token\" must be specified", path, t.Name)
+		}
+		if _, err := storage.ParseRole(t.Role); err != nil {
+			log.Fatal("%s: %s: %s", path, t.Name, err)
+		}
+		if err := checkClientName(t.Client); err != nil {
+			log.Fatal("%s: %s: %s", path, t.Name, err)
+		}
+	}
+
+	if s := config.Signing; s != nil && s.Sign == "" && s.Verify == "" {
+		log.Fatal("%s: \"sign\" or \"verify\" must be specified for signing", path)
+	}
+
+	if config.Quota != "" {
+		if config.quota, err = u.ParseBytes(config.Quota); err != nil {
+			log.Fatal("%s: \"quota\": %s", path, err)
+		}
+	}
+
+	for prefix, p := range config.Retention {
+		if p.Last < 0 || p.Daily < 0 || p.Weekly < 0 || p.Monthly < 0 || p.Yearly < 0 {
+			log.Fatal("%s: %q: retention counts can't be negative", path, prefix)
+		}
+		// Otherwise "bk forget" would remove all of them.
+		if !p.All && p.Last+p.Daily+p.Weekly+p.Monthly+p.Yearly == 0 {
+			log.Fatal("%s: %q: retention policy doesn't keep any backups; use "+
+				"\"all\": true to keep all of them", path, prefix)
+		}
+	}
+}
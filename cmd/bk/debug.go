@@ -0,0 +1,493 @@
+// cmd/bk/debug.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Commands for examining the objects stored in a repository.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/mmp/bk/backup"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// These are meant for diagnosing damaged repositories, so problems with
+// the objects they print are reported along with the rest of the output
+// rather than ending the command.
+
+const debugUsage = "usage: bk debug cat-blob [--hex] <hash>\n" +
+	"       bk debug dump-tree [--level n [--dir]] <hash>\n" +
+	"       bk debug tree <backup or bits name>\n" +
+	"       bk debug list-blobs [--prefix hex]\n"
+
+func debugcmd(args []string) {
+	if len(args) == 0 {
+		Error(debugUsage)
+	}
+	switch args[0] {
+	case "cat-blob":
+		debugCatBlob(args[1:])
+	case "dump-tree":
+		debugDumpTree(args[1:])
+	case "tree":
+		debugTree(args[1:])
+	case "list-blobs":
+		debugListBlobs(args[1:])
+	default:
+		Error("%s: unknown debug command\n%s", args[0], debugUsage)
+	}
+}
+
+// parseHash parses a hash given on the command line.
+func parseHash(s string) (storage.Hash, error) {
+	var hash storage.Hash
+	h, err := hex.DecodeString(s)
+	if err != nil {
+		return hash, err
+	}
+	if len(h) != storage.HashSize {
+		return hash, fmt.Errorf("given %d bytes, expected %d", len(h), storage.HashSize)
+	}
+	copy(hash[:], h)
+	return hash, nil
+}
+
+// readBlob returns the contents of the given blob, after it's been
+// decrypted and decompressed.
+func readBlob(hash storage.Hash, backend storage.Backend) ([]byte, error) {
+	r, err := backend.Read(hash)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	return b, err
+}
+
+///////////////////////////////////////////////////////////////////////////
+// cat-blob
+
+func debugCatBlob(args []string) {
+	flags := flag.NewFlagSet("cat-blob", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk debug cat-blob [--hex] <hash>\n")
+	}
+	hexDump := flags.Bool("hex", false, "print a hex dump of the blob")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 1 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	hash, err := parseHash(flags.Arg(0))
+	if err != nil {
+		Error("%s: %s\n", flags.Arg(0), err)
+	}
+
+	backend := GetStorageBackend()
+	b, err := readBlob(hash, backend)
+	if err != nil {
+		Error("%s: %s\n", hash, err)
+	}
+
+	// Binary data is never written to a terminal as is.
+	if !*hexDump && !isTerminal(os.Stdout) {
+		os.Stdout.Write(b)
+		return
+	}
+	stored := "unknown"
+	if n, err := backend.BlobSize(hash); err == nil {
+		stored = u.FmtBytes(n)
+	}
+	fmt.Printf("%s: %d bytes (%s stored)\n", hash, len(b), stored)
+	d := hex.Dumper(os.Stdout)
+	d.Write(b)
+	d.Close()
+}
+
+///////////////////////////////////////////////////////////////////////////
+// list-blobs
+
+func debugListBlobs(args []string) {
+	flags := flag.NewFlagSet("list-blobs", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk debug list-blobs [--prefix hex]\n")
+	}
+	prefix := flags.String("prefix", "", "only list blobs whose hashes start with these hex digits")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	*prefix = strings.ToLower(*prefix)
+	if strings.Trim(*prefix, "0123456789abcdef") != "" {
+		Error("%s: --prefix must be hex digits\n", *prefix)
+	}
+
+	backend := GetStorageBackend()
+	var hashes []storage.Hash
+	for h := range backend.Hashes() {
+		if strings.HasPrefix(h.String(), *prefix) {
+			hashes = append(hashes, h)
+		}
+	}
+	// Sorted so that the listings of two repositories can be compared
+	// with diff(1).
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+
+	w := bufio.NewWriter(os.Stdout)
+	for _, h := range hashes {
+		n, err := backend.BlobSize(h)
+		if err != nil {
+			log.Error("%s: %s", h, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s %d\n", h, n)
+	}
+	log.CheckError(w.Flush())
+}
+
+///////////////////////////////////////////////////////////////////////////
+// dump-tree
+
+func debugDumpTree(args []string) {
+	flags := flag.NewFlagSet("dump-tree", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk debug dump-tree [--level n [--dir]] <hash>\n")
+	}
+	level := flags.Int("level", -1,
+		"treat the hash as the top of a Merkle tree with the given level")
+	dir := flags.Bool("dir", false, "decode the data stored by the tree as a directory")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 1 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if *dir && *level < 0 {
+		Error("--dir requires --level\n")
+	}
+	if *level > 255 {
+		Error("%d: --level must be less than 256\n", *level)
+	}
+	hash, err := parseHash(flags.Arg(0))
+	if err != nil {
+		Error("%s: %s\n", flags.Arg(0), err)
+	}
+
+	backend := GetStorageBackend()
+	if *level < 0 {
+		root, err := backup.ReadRoot(hash, backend)
+		if err != nil {
+			Error("%s: not a backup root (%s); use --level to dump a Merkle tree\n",
+				hash, err)
+		}
+		dumpRoot(hash, root)
+		return
+	}
+
+	data, ok := dumpMerkleTree(storage.MerkleHash{Hash: hash, Level: uint8(*level)},
+		"", *dir, backend)
+	if !*dir {
+		return
+	}
+	if !ok {
+		fmt.Printf("Some of the directory's data couldn't be read; decoding what could be.\n")
+	}
+	entries, err := backup.DecodeDirEntries(data)
+	fmt.Printf("Directory with %d entries:\n", len(entries))
+	for _, e := range entries {
+		dumpDirEntry(e)
+	}
+	if err != nil {
+		fmt.Printf("Error decoding entries: %s\n", err)
+	}
+}
+
+func dumpRoot(hash storage.Hash, root backup.BackupRoot) {
+	fmt.Printf("Backup root %s\n", hash)
+	fmt.Printf("  Time:   %s\n", root.Time.Format(time.RFC3339Nano))
+	if root.Base != (storage.Hash{}) {
+		fmt.Printf("  Base:   %s\n", root.Base)
+	}
+	fmt.Printf("  Errors: %d\n", len(root.Errors))
+	for _, e := range root.Errors {
+		fmt.Printf("    %s: %s\n", e.Path, e.Error)
+	}
+	fmt.Printf("  Dir:    %s level %d\n", root.Dir.Hash.Hash, root.Dir.Hash.Level)
+	fmt.Printf("Run \"bk debug dump-tree --level %d --dir %s\" to dump the root directory.\n",
+		root.Dir.Hash.Level, root.Dir.Hash.Hash)
+}
+
+// dumpMerkleTree prints the blobs that make up the given Merkle tree,
+// indenting each level below the first. If read is true, the data that the
+// tree stores is read and returned as well; the returned bool is false if
+// any of it couldn't be.
+func dumpMerkleTree(h storage.MerkleHash, indent string, read bool,
+	backend storage.Backend) ([]byte, bool) {
+	stored := "missing"
+	if n, err := backend.BlobSize(h.Hash); err == nil {
+		stored = u.FmtBytes(n) + " stored"
+	}
+
+	if h.Level == 0 {
+		if !read {
+			fmt.Printf("%s%s: data (%s)\n", indent, h.Hash, stored)
+			return nil, true
+		}
+		b, err := readBlob(h.Hash, backend)
+		if err != nil {
+			fmt.Printf("%s%s: data: %s\n", indent, h.Hash, err)
+			return nil, false
+		}
+		fmt.Printf("%s%s: data, %d bytes (%s)\n", indent, h.Hash, len(b), stored)
+		return b, true
+	}
+
+	b, err := readBlob(h.Hash, backend)
+	if err != nil {
+		fmt.Printf("%s%s: level %d: %s\n", indent, h.Hash, h.Level, err)
+		return nil, false
+	}
+	n := len(b) / storage.HashSize
+	fmt.Printf("%s%s: level %d, %d hashes (%s)\n", indent, h.Hash, h.Level, n, stored)
+	ok := true
+	if len(b)%storage.HashSize != 0 {
+		fmt.Printf("%s  %d extra bytes at the end\n", indent, len(b)%storage.HashSize)
+		ok = false
+	}
+
+	var data []byte
+	for i := 0; i < n; i++ {
+		var child storage.Hash
+		copy(child[:], b[i*storage.HashSize:])
+		d, cok := dumpMerkleTree(storage.MerkleHash{Hash: child, Level: h.Level - 1},
+			indent+"  ", read, backend)
+		data = append(data, d...)
+		ok = ok && cok
+	}
+	return data, ok
+}
+
+func dumpDirEntry(e backup.DirEntry) {
+	kind := "file"
+	switch {
+	case e.IsDir():
+		kind = "dir"
+	case e.IsSymLink():
+		kind = "symlink"
+	}
+	fmt.Printf("  %s %q: %s", kind, e.Name, e.Mode)
+	if !e.IsDir() {
+		fmt.Printf(", %d bytes", e.Size)
+	}
+	fmt.Printf(", modified %s\n", e.ModTime.Format(time.RFC3339Nano))
+
+	var details []string
+	switch {
+	case e.IsSymLink():
+		details = append(details, fmt.Sprintf("target %q", e.Contents))
+	case e.Contents != nil:
+		details = append(details, fmt.Sprintf("%d bytes stored inline", len(e.Contents)))
+	case e.IsDir() || e.Size > 0:
+		details = append(details, fmt.Sprintf("hash %s level %d", e.Hash.Hash, e.Hash.Level))
+	}
+	if e.Checksum != (storage.Hash{}) {
+		details = append(details, "checksum "+e.Checksum.String())
+	}
+	if e.Index != nil {
+		details = append(details, fmt.Sprintf("chunk sizes %s level %d", e.Index.Hash,
+			e.Index.Level))
+	}
+	if len(details) > 0 {
+		fmt.Printf("    %s\n", strings.Join(details, "; "))
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+// tree
+
+// treeStats accumulates statistics about a set of Merkle trees. Blobs
+// that are shared by several of them are only counted once.
+type treeStats struct {
+	what  string
+	trees int
+	// Indexed by level; level 0 holds the data itself.
+	levels []levelStats
+	// Number of data blobs with stored sizes in [2^i, 2^(i+1)).
+	sizes []int64
+	// The tree with the most levels.
+	deepest     int
+	deepestPath string
+	missing     int
+	seen        map[storage.Hash]bool
+}
+
+type levelStats struct {
+	blobs, stored int64
+}
+
+func newTreeStats(what string) *treeStats {
+	return &treeStats{what: what, deepest: -1, seen: make(map[storage.Hash]bool)}
+}
+
+// add adds the blobs of the Merkle tree for the given path, if any, to
+// the statistics.
+func (s *treeStats) add(h storage.MerkleHash, path string, backend storage.Backend) {
+	s.trees++
+	if int(h.Level) > s.deepest {
+		s.deepest, s.deepestPath = int(h.Level), path
+	}
+	s.addBlob(h, backend)
+}
+
+func (s *treeStats) addBlob(h storage.MerkleHash, backend storage.Backend) {
+	if s.seen[h.Hash] {
+		return
+	}
+	s.seen[h.Hash] = true
+	for len(s.levels) <= int(h.Level) {
+		s.levels = append(s.levels, levelStats{})
+	}
+
+	stored, err := backend.BlobSize(h.Hash)
+	if err != nil {
+		s.missing++
+		return
+	}
+	s.levels[h.Level].blobs++
+	s.levels[h.Level].stored += stored
+
+	if h.Level == 0 {
+		bucket := 0
+		for n := stored; n > 1; n >>= 1 {
+			bucket++
+		}
+		for len(s.sizes) <= bucket {
+			s.sizes = append(s.sizes, 0)
+		}
+		s.sizes[bucket]++
+		return
+	}
+
+	b, err := readBlob(h.Hash, backend)
+	if err != nil {
+		s.missing++
+		return
+	}
+	for i := 0; i+storage.HashSize <= len(b); i += storage.HashSize {
+		var child storage.Hash
+		copy(child[:], b[i:])
+		s.addBlob(storage.MerkleHash{Hash: child, Level: h.Level - 1}, backend)
+	}
+}
+
+func (s *treeStats) print() {
+	if s.trees == 0 {
+		return
+	}
+	deepest := ""
+	if s.deepestPath != "" {
+		deepest = " (" + s.deepestPath + ")"
+	}
+	fmt.Printf("%s: %d trees, up to level %d%s\n", s.what, s.trees, s.deepest, deepest)
+	t := newTable(1, 2, 3)
+	t.add("Level", "Blobs", "Stored", "Average")
+	for level, l := range s.levels {
+		avg := "-"
+		if l.blobs > 0 {
+			avg = u.FmtBytes(l.stored / l.blobs)
+		}
+		t.add(fmt.Sprintf("%d", level), fmt.Sprintf("%d", l.blobs), u.FmtBytes(l.stored), avg)
+	}
+	t.print(os.Stdout, "  ")
+
+	fmt.Printf("  Stored sizes of data blobs:\n")
+	t = newTable(0, 1)
+	for i, n := range s.sizes {
+		if n > 0 {
+			t.add(u.FmtBytes(1<<uint(i)), fmt.Sprintf("%d", n))
+		}
+	}
+	t.print(os.Stdout, "    ")
+	if s.missing > 0 {
+		fmt.Printf("  %d blobs are missing or couldn't be read\n", s.missing)
+	}
+}
+
+func debugTree(args []string) {
+	if len(args) != 1 {
+		Error("usage: bk debug tree <backup or bits name>\n")
+	}
+
+	backend := GetStorageBackend()
+	name, err := resolveSnapshot(args[0], backend)
+	if err != nil {
+		Error("%s: %s\n", args[0], err)
+	}
+
+	if strings.HasPrefix(name, "bits-") {
+		bm := parseBitsMetadata(backend.ReadMetadata(name))
+		fmt.Printf("Bitstream %s\n", strings.TrimPrefix(name, "bits-"))
+		data := newTreeStats("Data")
+		data.add(bm.Hash, "", backend)
+		data.print()
+		if bm.Index != nil {
+			index := newTreeStats("Chunk size index")
+			index.add(*bm.Index, "", backend)
+			index.print()
+		}
+		return
+	}
+
+	r, err := backup.NewBackupReader(lookupHash(name, backend), backend)
+	if err != nil {
+		Error("%s: %s\n", name, err)
+	}
+	files := newTreeStats("File contents")
+	dirs := newTreeStats("Directories")
+	indexes := newTreeStats("Chunk size indexes")
+	var nfiles, ndirs, size int64
+	err = r.Walk("/", func(path string, e backup.DirEntry) {
+		switch {
+		case e.IsDir():
+			ndirs++
+			dirs.add(e.Hash, path, backend)
+		case e.IsFile():
+			nfiles++
+			size += e.Size
+			if e.Contents == nil && e.Size > 0 {
+				files.add(e.Hash, path, backend)
+			}
+			if e.Index != nil {
+				indexes.add(*e.Index, path, backend)
+			}
+		}
+	})
+	if err != nil {
+		Error("%s\n", err)
+	}
+
+	fmt.Printf("Backup %s: %d files (%s), %d directories\n",
+		strings.TrimPrefix(name, "backup-"), nfiles, u.FmtBytes(size), ndirs)
+	files.print()
+	dirs.print()
+	indexes.print()
+	if n := nfiles - int64(files.trees); n > 0 {
+		fmt.Printf("%d files are empty or small enough to be stored in their directories.\n", n)
+	}
+}
@@ -0,0 +1,244 @@
+// cmd/bk/du.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+import (
+	"bytes"
+	"github.com/mmp/bk/backup"
+	"github.com/mmp/bk/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotUsage records how much storage a single backup or bitstream
+// uses.
+type snapshotUsage struct {
+	// Full metadata name of the snapshot (e.g., "backup-foo@20170102...").
+	Name string
+	// Total size of the files in a backup when restored; -1 for
+	// bitstreams, whose size isn't recorded.
+	Size int64
+	// Stored bytes used by blobs that aren't referenced by any other
+	// snapshot; this is what would be reclaimed if the snapshot was
+	// removed.
+	Unique int64
+	// Stored bytes used by blobs that are also referenced by other
+	// snapshots.
+	Shared int64
+
+	// All of the blobs that the snapshot refers to.
+	hashes map[storage.Hash]struct{}
+}
+
+// repositoryUsage summarizes the storage used by all of the snapshots in
+// a repository.
+type repositoryUsage struct {
+	Snapshots []snapshotUsage
+	// Number of blobs referenced by at least one snapshot and their
+	// stored bytes.
+	ReferencedBlobs int
+	Referenced      int64
+	// Stored bytes for the blobs that aren't referenced by any snapshot.
+	Unreferenced int64
+	// The blobs that aren't referenced by any snapshot, sorted. Blobs
+	// that the storage backends use themselves aren't included.
+	UnreferencedBlobs []storage.Hash
+	// Number of blobs and stored bytes used by the storage backends
+	// themselves.
+	InternalBlobs int
+	Internal      int64
+
+	// Number of snapshots that refer to each blob and its stored size.
+	refs  map[storage.Hash]int
+	sizes map[storage.Hash]int64
+}
+
+// diskUsage computes the storage used by each backup and bitstream in the
+// repository. Blobs referenced more than once by a snapshot are only
+// counted once for it.
+func diskUsage(backend storage.Backend) repositoryUsage {
+	var names []string
+	for _, prefix := range []string{"backup-", "bits-"} {
+		backend.ForMetadata(prefix, func(n string, created time.Time) error {
+			names = append(names, n)
+			return nil
+		})
+	}
+	sort.Strings(names)
+
+	var usage repositoryUsage
+	refs := make(map[storage.Hash]int)
+	// Chunks stored as deltas can't be read without the ones they're
+	// deltas from, so snapshots that use them use those as well.
+	bases := storage.DeltaBases(backend)
+	for _, name := range names {
+		s, err := newSnapshotUsage(name, backend)
+		if err != nil {
+			log.Error("%s: %s", name, err)
+			continue
+		}
+		for h := range s.hashes {
+			if b, ok := bases[h]; ok {
+				s.addHashes(b)
+			}
+		}
+		for h := range s.hashes {
+			refs[h]++
+		}
+		usage.Snapshots = append(usage.Snapshots, s)
+	}
+
+	usage.ReferencedBlobs = len(refs)
+	sizes := make(map[storage.Hash]int64)
+	for h := range refs {
+		n, err := backend.BlobSize(h)
+		if err != nil {
+			log.Error("%s: %s", h, err)
+		}
+		sizes[h] = n
+		usage.Referenced += n
+	}
+	for i := range usage.Snapshots {
+		s := &usage.Snapshots[i]
+		for h := range s.hashes {
+			if refs[h] == 1 {
+				s.Unique += sizes[h]
+			} else {
+				s.Shared += sizes[h]
+			}
+		}
+	}
+	usage.refs, usage.sizes = refs, sizes
+
+	internal := make(map[storage.Hash]bool)
+	for _, h := range storage.EncryptionLogHashes(backend) {
+		internal[h] = true
+	}
+	for _, h := range storage.DeltaLogHashes(backend) {
+		internal[h] = true
+	}
+	for h := range backend.Hashes() {
+		if _, ok := refs[h]; ok {
+			continue
+		}
+		n, err := backend.BlobSize(h)
+		log.CheckError(err)
+		if internal[h] {
+			usage.InternalBlobs++
+			usage.Internal += n
+		} else {
+			usage.UnreferencedBlobs = append(usage.UnreferencedBlobs, h)
+			usage.Unreferenced += n
+		}
+	}
+	sort.Slice(usage.UnreferencedBlobs, func(i, j int) bool {
+		return bytes.Compare(usage.UnreferencedBlobs[i][:], usage.UnreferencedBlobs[j][:]) < 0
+	})
+
+	return usage
+}
+
+// newSnapshotUsage finds the blobs used by the backup or bitstream with
+// the given full metadata name and the total size of its files. Only the
+// hashes and Size are initialized.
+func newSnapshotUsage(name string, backend storage.Backend) (snapshotUsage, error) {
+	s := snapshotUsage{Name: name, hashes: make(map[storage.Hash]struct{})}
+	if strings.HasPrefix(name, "backup-") {
+		hash := storage.NewHash(backend.ReadMetadata(name))
+		root, err := backup.ReadRoot(hash, backend)
+		if err != nil {
+			return s, err
+		}
+		s.addHashes(hash)
+		s.addEntry(root.Dir, backend)
+		return s, nil
+	}
+
+	s.Size = -1
+	bm := parseBitsMetadata(backend.ReadMetadata(name))
+	s.addHashes(bm.Hash.AllHashes(backend)...)
+	if bm.Index != nil {
+		s.addHashes(bm.Index.AllHashes(backend)...)
+	}
+	if bm.Info != nil && bm.Info.ChunkChecksums != nil {
+		s.addHashes(bm.Info.ChunkChecksums.AllHashes(backend)...)
+	}
+	return s, nil
+}
+
+func (s *snapshotUsage) addHashes(hashes ...storage.Hash) {
+	for _, h := range hashes {
+		s.hashes[h] = struct{}{}
+	}
+}
+
+// addEntry records the blobs used by the given DirEntry and, for
+// directories, recursively, by all of the entries it contains.
+func (s *snapshotUsage) addEntry(e backup.DirEntry, backend storage.Backend) {
+	switch {
+	case e.IsFile():
+		s.Size += e.Size
+		if e.Contents == nil && e.Size > 0 {
+			s.addHashes(e.Hash.AllHashes(backend)...)
+			if e.Index != nil {
+				s.addHashes(e.Index.AllHashes(backend)...)
+			}
+		}
+	case e.IsDir():
+		s.addHashes(e.Hash.AllHashes(backend)...)
+		for _, child := range backup.ReadDirEntries(e.Hash, backend) {
+			s.addEntry(child, backend)
+		}
+	}
+}
+
+// Reclaimable returns the stored bytes used by blobs that are only
+// referenced by the given snapshots, given by their full metadata names;
+// this is what removing all of them would reclaim. It's generally more
+// than the sum of their Unique sizes, since that doesn't include blobs
+// that they share with each other.
+func (u *repositoryUsage) Reclaimable(names []string) int64 {
+	selected := make(map[string]bool)
+	for _, n := range names {
+		selected[n] = true
+	}
+	r := u.newReclaimSet()
+	for _, s := range u.Snapshots {
+		if selected[s.Name] {
+			r.add(s)
+		}
+	}
+	return r.Freed
+}
+
+// reclaimSet tracks the storage that removing a growing set of snapshots
+// would reclaim.
+type reclaimSet struct {
+	usage *repositoryUsage
+	// Number of the snapshots in the set that refer to each blob.
+	counts map[storage.Hash]int
+	Freed  int64
+}
+
+func (u *repositoryUsage) newReclaimSet() *reclaimSet {
+	return &reclaimSet{usage: u, counts: make(map[storage.Hash]int)}
+}
+
+// add adds the given snapshot, which must not already be in the set.
+func (r *reclaimSet) add(s snapshotUsage) {
+	for h := range s.hashes {
+		r.counts[h]++
+		if r.counts[h] == r.usage.refs[h] {
+			r.Freed += r.usage.sizes[h]
+		}
+	}
+}
+
+// Total returns the stored bytes used by all of the blobs in the
+// repository.
+func (u *repositoryUsage) Total() int64 {
+	return u.Referenced + u.Unreferenced + u.Internal
+}
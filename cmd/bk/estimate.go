@@ -0,0 +1,79 @@
+// cmd/bk/estimate.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+import (
+	"github.com/mmp/bk/backup"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// backupEstimate summarizes how much of a directory would need to be read
+// and stored by a backup.
+type backupEstimate struct {
+	Dirs int64
+	// All of the files found, the ones that the file cache reports as
+	// unchanged since the last backup, and the ones that would be read.
+	Files, UnchangedFiles, ChangedFiles int64
+	Bytes, UnchangedBytes, ChangedBytes int64
+}
+
+// estimateBackup scans the given directory (or just the given file),
+// skipping what the exclusion options in opts exclude as backup.Backup
+// does, and uses the opts.Cache to determine which files would need to be
+// read by a backup. The repository isn't accessed, so files whose
+// contents are already stored for other reasons (e.g., because they were
+// moved or are duplicates) are counted as changed. Paths that can't be
+// read are logged and skipped.
+func estimateBackup(dir string, opts backup.BackupOptions) backupEstimate {
+	cache := opts.Cache
+	var est backupEstimate
+	addFile := func(path string, fi os.FileInfo) {
+		est.Files++
+		est.Bytes += fi.Size()
+		if _, ok := cache.Unchanged(path, fi); ok {
+			est.UnchangedFiles++
+			est.UnchangedBytes += fi.Size()
+		} else {
+			est.ChangedFiles++
+			est.ChangedBytes += fi.Size()
+		}
+	}
+	var scan func(dir string)
+	scan = func(dir string) {
+		fileinfo, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Error("%s: %s", dir, err)
+			return
+		}
+		est.Dirs++
+
+		for _, fi := range fileinfo {
+			path := filepath.Join(dir, fi.Name())
+			if backup.IsExcluded(path, opts.ExcludedPaths) ||
+				(fi.IsDir() && fi.Name() == backup.SnapshotDirName) ||
+				(opts.ExcludeNoDump && backup.IsNoDump(path, fi)) {
+				continue
+			}
+			switch {
+			case fi.IsDir():
+				if backup.ExclusionMarker(nil, path, opts.ExcludeIfPresent) == "" {
+					scan(path)
+				}
+			case backup.IsFileMode(fi.Mode()):
+				addFile(path, fi)
+			}
+		}
+	}
+
+	// A backup of a single file just reads that file.
+	if fi, err := os.Stat(dir); err == nil && backup.IsFileMode(fi.Mode()) {
+		addFile(dir, fi)
+	} else {
+		scan(dir)
+	}
+	return est
+}
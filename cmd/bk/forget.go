@@ -0,0 +1,205 @@
+// cmd/bk/forget.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Removing old backups according to retention policies.
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// policyFor returns the retention policy from the configuration file that
+// applies to backups with the given name, which doesn't include a client
+// or a timestamp. The policy with the longest key that's a prefix of the
+// name is used.
+func policyFor(name string) (RetentionPolicy, bool) {
+	var policy RetentionPolicy
+	best, found := -1, false
+	for prefix, p := range config.Retention {
+		if strings.HasPrefix(name, prefix) && len(prefix) > best {
+			policy, best, found = p, len(prefix), true
+		}
+	}
+	return policy, found
+}
+
+// keep returns which of the backups made at the given times, which must
+// be sorted with the most recent first, the policy keeps.
+func (p RetentionPolicy) keep(times []time.Time) []bool {
+	keep := make([]bool, len(times))
+	for i := range times {
+		keep[i] = p.All || i < p.Last
+	}
+
+	// For each kind of period, the most recent backup in each of the
+	// most recent ones is kept.
+	periods := []struct {
+		count  int
+		period func(t time.Time) int
+	}{
+		{p.Daily, func(t time.Time) int {
+			y, m, d := t.Date()
+			return y*10000 + int(m)*100 + d
+		}},
+		{p.Weekly, func(t time.Time) int {
+			y, w := t.ISOWeek()
+			return y*100 + w
+		}},
+		{p.Monthly, func(t time.Time) int {
+			y, m, _ := t.Date()
+			return y*100 + int(m)
+		}},
+		{p.Yearly, func(t time.Time) int { return t.Year() }},
+	}
+	for _, pd := range periods {
+		last, n := -1, 0
+		for i, t := range times {
+			if n == pd.count {
+				break
+			}
+			if k := pd.period(t.Local()); k != last {
+				keep[i] = true
+				last = k
+				n++
+			}
+		}
+	}
+	return keep
+}
+
+// forgetTargets returns the full metadata names of the backups that the
+// retention policies remove. If names is empty, the policies for all of
+// the current client's backups are applied; otherwise, just the ones for
+// the backups with the given names are.
+func forgetTargets(names []string, backend storage.Backend) ([]string, error) {
+	type snapshot struct {
+		name string
+		time time.Time
+	}
+	// Backups grouped by their full names without their timestamps.
+	series := make(map[string][]snapshot)
+	owners := snapshotOwners(backend)
+	backend.ForMetadata("backup-", func(name string, created time.Time) error {
+		if i := strings.LastIndex(name, "@"); i != -1 && inCurrentClient(name, owners) {
+			series[name[:i]] = append(series[name[:i]],
+				snapshot{name, snapshotTime(name, created)})
+		}
+		return nil
+	})
+
+	selected := make(map[string]bool)
+	for _, n := range names {
+		found := false
+		for _, s := range []string{"backup-" + qualifySnapshotName(n), "backup-" + n} {
+			if _, ok := series[s]; ok {
+				selected[s] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: no backups found", n)
+		}
+	}
+
+	pinned := pinnedSnapshots(backend)
+	var remove []string
+	for s, snapshots := range series {
+		if len(names) > 0 && !selected[s] {
+			continue
+		}
+		// Policies are given for names without the client.
+		name := strings.TrimPrefix(s, "backup-")
+		if c := owners[snapshots[0].name]; c != "" {
+			name = strings.TrimPrefix(name, c+clientSeparator)
+		}
+		policy, ok := policyFor(name)
+		if !ok {
+			if len(names) > 0 {
+				return nil, fmt.Errorf("%s: no retention policy in the configuration "+
+					"file applies", name)
+			}
+			log.Verbose("%s: no retention policy applies; keeping all backups", name)
+			continue
+		}
+
+		sort.Slice(snapshots, func(i, j int) bool {
+			return snapshots[i].time.After(snapshots[j].time)
+		})
+		var times []time.Time
+		for _, snap := range snapshots {
+			times = append(times, snap.time)
+		}
+		for i, keep := range policy.keep(times) {
+			if !keep && !pinned[snapshots[i].name] {
+				remove = append(remove, snapshots[i].name)
+			}
+		}
+	}
+	sort.Strings(remove)
+	return remove, nil
+}
+
+func forget(args []string) {
+	flags := flag.NewFlagSet("forget", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk forget [--dry-run] [--all | <backup name> ...]\n")
+	}
+	all := flags.Bool("all", false, "apply the retention policies to all backups")
+	dryRun := flags.Bool("dry-run", false, "list the backups that would be removed and the storage they use")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || *all == (flags.NArg() > 0) {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if len(config.Retention) == 0 {
+		Error("no retention policies are given in the configuration file\n")
+	}
+
+	backend := GetStorageBackend()
+	remove, err := forgetTargets(flags.Args(), backend)
+	if err != nil {
+		Error("%s\n", err)
+	}
+	warnDependents(backend, remove, "being removed")
+
+	owners := snapshotOwners(backend)
+	for _, name := range remove {
+		if *dryRun {
+			fmt.Printf("would remove %s\n", strings.TrimPrefix(name, "backup-"))
+		} else {
+			log.Verbose("%s: removing", name)
+			backend.DeleteMetadata(name)
+			if backend.MetadataExists(signaturePrefix + name) {
+				backend.DeleteMetadata(signaturePrefix + name)
+			}
+			if c := owners[name]; c != "" {
+				backend.DeleteMetadata(ownerName(c, name))
+			}
+		}
+	}
+	if *dryRun && len(remove) > 0 {
+		usage := diskUsage(backend)
+		freed := usage.Reclaimable(remove)
+		fmt.Printf("would leave %s of stored data unreferenced\n", u.FmtBytes(freed))
+		if quota, _ := repositoryQuota(backend); quota > 0 && usage.Total()-freed > quota {
+			over := usage.Total() - quota
+			fmt.Printf("the repository would still be %s over its quota of %s\n",
+				u.FmtBytes(over-freed), u.FmtBytes(quota))
+			suggestExpiry(os.Stdout, backend, &usage, remove, over)
+		}
+	} else if !*dryRun {
+		backend.SyncWrites()
+		log.Print("removed %d backups", len(remove))
+	}
+}
@@ -0,0 +1,81 @@
+// cmd/bk/forget_test.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyKeep(t *testing.T) {
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.Local)
+	}
+	for _, c := range []struct {
+		name   string
+		policy RetentionPolicy
+		// Most recent first, as keep requires.
+		times []time.Time
+		keep  []bool
+	}{
+		{"empty", RetentionPolicy{},
+			[]time.Time{at(2017, 1, 3, 0), at(2017, 1, 2, 0)},
+			[]bool{false, false}},
+		{"all", RetentionPolicy{All: true, Last: 1},
+			[]time.Time{at(2017, 1, 3, 0), at(2017, 1, 2, 0), at(2017, 1, 1, 0)},
+			[]bool{true, true, true}},
+		{"last", RetentionPolicy{Last: 2},
+			[]time.Time{at(2017, 1, 4, 0), at(2017, 1, 3, 0), at(2017, 1, 2, 0),
+				at(2017, 1, 1, 0)},
+			[]bool{true, true, false, false}},
+		{"last more than there are", RetentionPolicy{Last: 5},
+			[]time.Time{at(2017, 1, 2, 0), at(2017, 1, 1, 0)},
+			[]bool{true, true}},
+		{"daily", RetentionPolicy{Daily: 2},
+			[]time.Time{at(2017, 1, 3, 10), at(2017, 1, 3, 9), at(2017, 1, 2, 12),
+				at(2017, 1, 1, 12)},
+			[]bool{true, false, true, false}},
+		// Days without backups don't count.
+		{"daily with gaps", RetentionPolicy{Daily: 3},
+			[]time.Time{at(2017, 1, 10, 0), at(2017, 1, 7, 12), at(2017, 1, 7, 11),
+				at(2017, 1, 1, 0)},
+			[]bool{true, true, false, true}},
+		// January 2 and 8, 2017 are a Monday and a Sunday.
+		{"weekly", RetentionPolicy{Weekly: 1},
+			[]time.Time{at(2017, 1, 8, 0), at(2017, 1, 2, 0), at(2017, 1, 1, 0)},
+			[]bool{true, false, false}},
+		{"weekly across years", RetentionPolicy{Weekly: 2},
+			[]time.Time{at(2017, 1, 8, 0), at(2017, 1, 2, 0), at(2017, 1, 1, 0),
+				at(2016, 12, 26, 0)},
+			[]bool{true, false, true, false}},
+		{"monthly", RetentionPolicy{Monthly: 2},
+			[]time.Time{at(2017, 3, 5, 0), at(2017, 3, 1, 0), at(2017, 2, 20, 0),
+				at(2017, 1, 10, 0)},
+			[]bool{true, false, true, false}},
+		{"yearly", RetentionPolicy{Yearly: 2},
+			[]time.Time{at(2018, 6, 1, 0), at(2018, 1, 1, 0), at(2016, 12, 31, 0),
+				at(2016, 1, 1, 0)},
+			[]bool{true, false, true, false}},
+		// Each rule keeps backups independently of the others.
+		{"combined", RetentionPolicy{Last: 1, Daily: 1, Monthly: 3},
+			[]time.Time{at(2017, 3, 5, 10), at(2017, 3, 5, 9), at(2017, 3, 1, 0),
+				at(2017, 2, 20, 0), at(2017, 2, 10, 0), at(2017, 1, 10, 0),
+				at(2016, 12, 10, 0)},
+			[]bool{true, false, false, true, false, true, false}},
+		{"no backups", RetentionPolicy{Last: 2, Daily: 2}, nil, []bool{}},
+	} {
+		keep := c.policy.keep(c.times)
+		if len(keep) != len(c.keep) {
+			t.Errorf("%s: got %d results, expected %d", c.name, len(keep), len(c.keep))
+			continue
+		}
+		for i := range keep {
+			if keep[i] != c.keep[i] {
+				t.Errorf("%s: got %v, expected %v", c.name, keep, c.keep)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// cmd/bk/fssnapshot.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Backing up from read-only btrfs, ZFS, and LVM snapshots, so that a
+// directory that's in use is captured as it was at a single point in time.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mmp/bk/backup"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Name of the snapshots that "backup --snapshot" and "backup
+// --lvm-snapshot" make. It's always the same, so that ones left by
+// interrupted backups are found. A consequence is that only one backup of
+// a directory can use a snapshot at a time.
+const fsSnapshotName = "bk-snapshot"
+
+// fsSnapshot is a read-only snapshot of the filesystem a directory is on.
+type fsSnapshot struct {
+	// The directory and the path to it in the snapshot.
+	dir, path string
+	remove    func() error
+	once      sync.Once
+	// Interrupts are delivered here until the snapshot is removed.
+	sigchan chan os.Signal
+}
+
+// createFSSnapshot makes a snapshot of the given directory of the given
+// kind, "btrfs" or "zfs". For btrfs, the directory must be a subvolume;
+// the snapshot is made in it, named backup.SnapshotDirName. For ZFS, the directory
+// may be anywhere in a dataset; the dataset's snapshot is accessed via
+// its .zfs directory.
+func createFSSnapshot(kind, dir string) (*fsSnapshot, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "btrfs":
+		path := filepath.Join(abs, backup.SnapshotDirName)
+		if _, err := os.Lstat(path); err == nil {
+			return nil, fmt.Errorf("%s already exists; it may have been left by an "+
+				"interrupted backup (\"btrfs subvolume delete %s\" removes it)", path, path)
+		}
+		if _, err := runSnapshotCommand("btrfs", "subvolume", "snapshot", "-r", abs,
+			path); err != nil {
+			return nil, err
+		}
+		return &fsSnapshot{dir: abs, path: path, remove: func() error {
+			_, err := runSnapshotCommand("btrfs", "subvolume", "delete", path)
+			return err
+		}}, nil
+
+	case "zfs":
+		dataset, mountpoint, err := zfsDataset(abs)
+		if err != nil {
+			return nil, err
+		}
+		name := dataset + "@" + fsSnapshotName
+		if _, err := runSnapshotCommand("zfs", "list", "-H", "-t", "snapshot", name); err == nil {
+			return nil, fmt.Errorf("%s already exists; it may have been left by an "+
+				"interrupted backup (\"zfs destroy %s\" removes it)", name, name)
+		}
+		if _, err := runSnapshotCommand("zfs", "snapshot", name); err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(mountpoint, abs)
+		log.CheckError(err)
+		path := filepath.Join(mountpoint, ".zfs", "snapshot", fsSnapshotName, rel)
+		return &fsSnapshot{dir: abs, path: path, remove: func() error {
+			_, err := runSnapshotCommand("zfs", "destroy", name)
+			return err
+		}}, nil
+
+	default:
+		return nil, fmt.Errorf("%s: unknown snapshot type; \"btrfs\" and \"zfs\" "+
+			"are supported", kind)
+	}
+}
+
+// createLVMSnapshot makes a snapshot of an LVM logical volume, given as
+// "vg/lv:size", where size is the space to reserve for changes made while
+// the snapshot exists (e.g., "2G"), and mounts it read-only. The given
+// directory must be in the filesystem that the volume is mounted as.
+// Snapshots are named like the volume, with "-bk-snapshot" appended, and
+// are mounted in a new directory in the system's temporary directory.
+func createLVMSnapshot(spec, dir string) (*fsSnapshot, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var vg, lv, size string
+	if i := strings.LastIndex(spec, ":"); i != -1 {
+		size = spec[i+1:]
+		if f := strings.Split(spec[:i], "/"); len(f) == 2 {
+			vg, lv = f[0], f[1]
+		}
+	}
+	if vg == "" || lv == "" || size == "" {
+		return nil, fmt.Errorf("%s: expected a volume and a size, as \"vg/lv:size\"", spec)
+	}
+	device, mountpoint, fstype, err := lvmMount("/dev/" + vg + "/" + lv)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(mountpoint, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s: not in the filesystem on %s/%s, which is mounted on %s",
+			abs, vg, lv, mountpoint)
+	}
+
+	name := vg + "/" + lv + "-" + fsSnapshotName
+	if _, err := runSnapshotCommand("lvs", name); err == nil {
+		return nil, fmt.Errorf("%s already exists; it may have been left by an "+
+			"interrupted backup (\"lvremove %s\" removes it)", name, name)
+	}
+	// The directory is created afresh rather than being given a fixed
+	// name, since one that another user made in advance could then be
+	// used.
+	mnt, err := os.MkdirTemp("", "bk-snapshot-"+vg+"-"+lv+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	// Each step that succeeds adds a way to undo it; they're run in
+	// reverse order to tear the snapshot down, stopping at the first
+	// that fails, since the ones before it would then fail as well.
+	var undo []func() error
+	teardown := func() error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	fail := func(err error) (*fsSnapshot, error) {
+		if terr := teardown(); terr != nil {
+			log.Error("unable to remove snapshot: %s", terr)
+		}
+		return nil, err
+	}
+	undo = append(undo, func() error { return os.Remove(mnt) })
+
+	if _, err := runSnapshotCommand("lvcreate", "--snapshot", "--name",
+		lv+"-"+fsSnapshotName, "--size", size, device); err != nil {
+		return fail(err)
+	}
+	undo = append(undo, func() error {
+		_, err := runSnapshotCommand("lvremove", "--yes", name)
+		return err
+	})
+
+	// XFS refuses to mount a filesystem with the same UUID as one that's
+	// already mounted unless it's told not to check.
+	opts := "ro"
+	if fstype == "xfs" {
+		opts += ",nouuid"
+	}
+	if _, err := runSnapshotCommand("mount", "-t", fstype, "-o", opts,
+		"/dev/"+name, mnt); err != nil {
+		return fail(err)
+	}
+	undo = append(undo, func() error {
+		// Files in the snapshot may still be open for a moment if the
+		// backup was just stopped, so unmounting it is retried before
+		// it's detached lazily.
+		var err error
+		for i := 0; i < 5; i++ {
+			if _, err = runSnapshotCommand("umount", mnt); err == nil {
+				return nil
+			}
+			time.Sleep(time.Second)
+		}
+		log.Warning("%s; detaching it lazily", err)
+		_, err = runSnapshotCommand("umount", "-l", mnt)
+		return err
+	})
+
+	return &fsSnapshot{dir: abs, path: filepath.Join(mnt, rel), remove: teardown}, nil
+}
+
+// lvmMount returns the device that the given LVM device path refers to
+// and where and as what type of filesystem it's mounted.
+func lvmMount(path string) (string, string, string, error) {
+	device, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", "", "", err
+	}
+	mounts, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return "", "", "", err
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 {
+			continue
+		}
+		if d, err := filepath.EvalSymlinks(f[0]); err == nil && d == device {
+			// Spaces and the like in mountpoints are octal-escaped.
+			mountpoint, err := strconv.Unquote(`"` + f[1] + `"`)
+			if err != nil {
+				mountpoint = f[1]
+			}
+			return device, mountpoint, f[2], nil
+		}
+	}
+	return "", "", "", fmt.Errorf("%s: not mounted", path)
+}
+
+// zfsDataset returns the name and mountpoint of the ZFS dataset that the
+// given absolute path is in: the one with the longest mountpoint that
+// contains it.
+func zfsDataset(path string) (string, string, error) {
+	out, err := runSnapshotCommand("zfs", "list", "-H", "-o", "name,mountpoint",
+		"-t", "filesystem")
+	if err != nil {
+		return "", "", err
+	}
+	var dataset, mountpoint string
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Split(line, "\t")
+		if len(f) != 2 || !filepath.IsAbs(f[1]) || len(f[1]) <= len(mountpoint) {
+			continue
+		}
+		if path == f[1] || strings.HasPrefix(path, strings.TrimSuffix(f[1], "/")+"/") {
+			dataset, mountpoint = f[0], f[1]
+		}
+	}
+	if dataset == "" {
+		return "", "", fmt.Errorf("%s: not in a mounted ZFS dataset", path)
+	}
+	return dataset, mountpoint, nil
+}
+
+func runSnapshotCommand(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			err = errors.New(msg)
+		}
+		return "", fmt.Errorf("%s %s: %s", name, strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
+
+// Path returns the path to the given one, which must be in the snapshotted
+// directory, in the snapshot; others are returned as they are.
+func (s *fsSnapshot) Path(path string) string {
+	if path == s.dir {
+		return s.path
+	} else if strings.HasPrefix(path, s.dir+string(filepath.Separator)) {
+		return filepath.Join(s.path, strings.TrimPrefix(path, s.dir))
+	}
+	return path
+}
+
+// RemoveOnExit arranges for the snapshot to be removed if bk exits with a
+// fatal error. If bk is interrupted before the snapshot is removed, cancel
+// is called so that the backup stops and closes the files it has open in
+// the snapshot, which can then be removed as its error is reported. A
+// second interrupt exits right away.
+func (s *fsSnapshot) RemoveOnExit(cancel func()) {
+	log.AddFatalHook(func(string) { s.Remove() })
+	s.sigchan = make(chan os.Signal, 2)
+	signal.Notify(s.sigchan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-s.sigchan
+		if !ok {
+			return
+		}
+		log.Warning("%s: stopping the backup to remove the snapshot", sig)
+		cancel()
+		if sig, ok := <-s.sigchan; ok {
+			log.Fatal("%s: removing snapshot", sig)
+		}
+	}()
+}
+
+// Remove removes the snapshot. Only the first call does anything, so it
+// can be called both from a fatal hook and once the backup is done.
+// Interrupts after it's called are no longer handled by RemoveOnExit.
+func (s *fsSnapshot) Remove() {
+	s.once.Do(func() {
+		if s.sigchan != nil {
+			signal.Stop(s.sigchan)
+			close(s.sigchan)
+		}
+		if err := s.remove(); err != nil {
+			log.Error("unable to remove snapshot: %s", err)
+		} else {
+			log.Verbose("%s: removed snapshot", s.path)
+		}
+	})
+}
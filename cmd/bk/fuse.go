@@ -8,10 +8,12 @@ package main
 // Additional infrastructure to allow accessing backups via FUSE.
 
 import (
+	"github.com/mmp/bk/backup"
 	"github.com/mmp/bk/storage"
-	"io/ioutil"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"bazil.org/fuse"
@@ -23,7 +25,7 @@ import (
 type namedBackup struct {
 	name string
 	time time.Time
-	br   *BackupReader
+	br   *backup.BackupReader
 }
 
 // mountFUSE takes the given namedBackups and exports a FUSE filesystem
@@ -58,19 +60,28 @@ type pseudoDir struct {
 	// Each pseudoDir either has 1+ subdirectories in entries, or a non-nil
 	// *BackupReader (at the node before the actual backup starts).
 	entries []*pseudoDir
-	br      *BackupReader
+	br      *backup.BackupReader
 }
 
 // Given an array of named backups of the form "backup_name@yyyymmddhhmmss",
-// create the corresponding *pseudoDir hierarchy.
+// create the corresponding *pseudoDir hierarchy. Backups with timestamps
+// in other formats (see "backup --time-format") are in a single directory
+// named with the timestamp; any suffix after the time, such as the "Z" of
+// --utc, is kept in the name of the hhmmss directory. Backups made with
+// --exact-name are directly under their names.
 func createPseudoHierarchy(nb []namedBackup) *pseudoDir {
 	var root pseudoDir
 	for _, b := range nb {
-		comps := strings.Split(b.name, "@")
-		log.Check(len(comps) == 2)
-		log.Check(len(comps[1]) == 14) // yyyymmddhhmmss
-		dt := comps[1]
-		comps = []string{comps[0], dt[:4], dt[4:6], dt[6:8], dt[8:]}
+		i := strings.LastIndex(b.name, "@")
+		if i == -1 {
+			pseudoAddRecursive(&root, []string{b.name}, b)
+			continue
+		}
+		name, dt := b.name[:i], b.name[i+1:]
+		comps := []string{name, dt}
+		if len(dt) >= 14 && strings.Trim(dt[:14], "0123456789") == "" { // yyyymmddhhmmss
+			comps = []string{name, dt[:4], dt[4:6], dt[6:8], dt[8:]}
+		}
 		pseudoAddRecursive(&root, comps, b)
 	}
 	return &root
@@ -119,7 +130,8 @@ func (pd *pseudoDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		if entry.br != nil {
 			// Hand-off to dirEntryBackend for subsequent levels down the
 			// hierarchy.
-			return &dirEntryBackend{entry.br.root.Dir, entry.br.backend}, nil
+			return &dirEntryBackend{DirEntry: entry.br.Root().Dir,
+				backend: entry.br.Backend()}, nil
 		} else {
 			return entry, nil
 		}
@@ -141,8 +153,13 @@ func (pd *pseudoDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 // Helper class that agglomerates DirEntry and a storage backend that
 // can give us its children.
 type dirEntryBackend struct {
-	DirEntry
+	backup.DirEntry
 	backend storage.Backend
+
+	// For files, the sizes of their chunks, read when they're first
+	// opened so that each Read doesn't read them again.
+	chunkSizesOnce sync.Once
+	chunkSizes     []int64
 }
 
 func (e *dirEntryBackend) Attr(ctx context.Context, a *fuse.Attr) error {
@@ -157,11 +174,8 @@ func (e *dirEntryBackend) Attr(ctx context.Context, a *fuse.Attr) error {
 // Implements fuse.fs.NodeStringLookuper interface (OMGWTFBBQ naming)
 func (e *dirEntryBackend) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	log.Check(e.IsDir())
-	entries := readDirEntries(e.Hash, e.backend)
-	for _, entry := range entries {
-		if entry.Name == name {
-			return &dirEntryBackend{entry, e.backend}, nil
-		}
+	if entry, ok := backup.FindDirEntry(e.Hash, name, e.backend); ok {
+		return &dirEntryBackend{DirEntry: entry, backend: e.backend}, nil
 	}
 	return nil, fuse.ENOENT
 }
@@ -169,35 +183,55 @@ func (e *dirEntryBackend) Lookup(ctx context.Context, name string) (fs.Node, err
 // Implements fuse.fs.HandleReadDirAller
 func (e *dirEntryBackend) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	var dirents []fuse.Dirent
-	for _, entry := range readDirEntries(e.Hash, e.backend) {
+	for _, entry := range backup.ReadDirEntries(e.Hash, e.backend) {
 		de := fuse.Dirent{Name: entry.Name}
 		switch {
-		case e.IsDir():
+		case entry.IsDir():
 			de.Type = fuse.DT_Dir
-		case e.IsFile():
+		case entry.IsFile():
 			de.Type = fuse.DT_File
-		case e.IsSymLink():
+		case entry.IsSymLink():
 			de.Type = fuse.DT_Link
 		default:
-			log.Fatal("Unhandled DirEntry type: %+v", e)
+			log.Fatal("Unhandled DirEntry type: %+v", entry)
 		}
 		dirents = append(dirents, de)
 	}
 	return dirents, nil
 }
 
-// Implements fuse.fs.HandleReadAller
-func (e *dirEntryBackend) ReadAll(ctx context.Context) ([]byte, error) {
-	r, err := e.GetContentsReader(nil, e.backend)
+// Implements fuse.fs.NodeOpener. The node serves as its own handle.
+func (e *dirEntryBackend) Open(ctx context.Context, req *fuse.OpenRequest,
+	resp *fuse.OpenResponse) (fs.Handle, error) {
+	e.readChunkSizes()
+	return e, nil
+}
+
+func (e *dirEntryBackend) readChunkSizes() {
+	e.chunkSizesOnce.Do(func() { e.chunkSizes = e.ChunkSizes(e.backend) })
+}
+
+// Implements fuse.fs.HandleReader. Only the requested range of the file is
+// read, so that reading part of a large file doesn't require fetching all
+// of it.
+func (e *dirEntryBackend) Read(ctx context.Context, req *fuse.ReadRequest,
+	resp *fuse.ReadResponse) error {
+	e.readChunkSizes()
+	r, err := e.GetRangeReaderWithChunkSizes(req.Offset, int64(req.Size), e.chunkSizes,
+		nil, e.backend)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer r.Close()
 
-	b, err := ioutil.ReadAll(r)
-	if err != nil {
-		return b, err
+	b := make([]byte, req.Size)
+	n, err := io.ReadFull(r, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Reads at the end of the file are short.
+		err = nil
 	}
-	return b, r.Close()
+	resp.Data = b[:n]
+	return err
 }
 
 ///////////////////////////////////////////////////////////////////////////
@@ -206,17 +240,16 @@ func mountImpl(dir string) {
 	backend := GetStorageBackend()
 
 	var nb []namedBackup
-	for name, time := range backend.ListMetadata() {
-		if strings.HasPrefix(name, "backup-") {
-			b := backend.ReadMetadata(name)
-			r, err := NewBackupReader(storage.NewHash(b), backend)
-			if err != nil {
-				log.Error("%s\n", err)
-			}
-			n := strings.TrimPrefix(name, "backup-")
-			nb = append(nb, namedBackup{n, time, r})
+	backend.ForMetadata("backup-", func(name string, created time.Time) error {
+		b := backend.ReadMetadata(name)
+		r, err := backup.NewBackupReader(storage.NewHash(b), backend)
+		if err != nil {
+			log.Error("%s\n", err)
 		}
-	}
+		n := strings.TrimPrefix(name, "backup-")
+		nb = append(nb, namedBackup{n, created, r})
+		return nil
+	})
 
 	mountFUSE(dir, nb)
 }
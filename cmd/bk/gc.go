@@ -0,0 +1,61 @@
+// cmd/bk/gc.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Finding the blobs that no backup or bitstream refers to.
+
+import (
+	"flag"
+	"fmt"
+	u "github.com/mmp/bk/util"
+)
+
+// Removing backups and bitstreams only removes their metadata; the blobs
+// they refer to are left in storage, since others may refer to them as
+// well. "bk gc --report-only" reports how much storage is used by blobs
+// that nothing refers to any more. bk doesn't remove them yet.
+
+func gc(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk gc --report-only [--list]\n")
+	}
+	reportOnly := flags.Bool("report-only", false,
+		"report the unreferenced blobs without removing them")
+	list := flags.Bool("list", false, "print the hash and stored size of each unreferenced blob")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if !*reportOnly {
+		Error("removing unreferenced blobs isn't supported yet; use --report-only " +
+			"to see how much storage they use\n")
+	}
+
+	backend := GetStorageBackend()
+	usage := diskUsage(backend)
+	if log.NErrors > 0 {
+		log.Warning("some backups or bitstreams couldn't be read; blobs that only " +
+			"they refer to are counted as unreferenced")
+	}
+
+	if *list {
+		for _, h := range usage.UnreferencedBlobs {
+			n, err := backend.BlobSize(h)
+			log.CheckError(err)
+			fmt.Printf("%s %d\n", h, n)
+		}
+	}
+	fmt.Printf("Referenced:   %d blobs, %s, by %d backups and bitstreams\n",
+		usage.ReferencedBlobs, u.FmtBytes(usage.Referenced), len(usage.Snapshots))
+	if usage.InternalBlobs > 0 {
+		fmt.Printf("Internal:     %d blobs, %s, used by the storage backend\n",
+			usage.InternalBlobs, u.FmtBytes(usage.Internal))
+	}
+	fmt.Printf("Unreferenced: %d blobs, %s\n", len(usage.UnreferencedBlobs),
+		u.FmtBytes(usage.Unreferenced))
+}
@@ -0,0 +1,128 @@
+// cmd/bk/history.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Keeping summaries of past backup and savebits runs in the repository so
+// that their growth can be tracked over time.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"os"
+	"sort"
+	"time"
+)
+
+// At the end of each backup or savebits run that completes, its runSummary
+// is stored, encoded as JSON, in metadata named with summaryPrefix, its
+// type, and the full name of the snapshot it saved, e.g.
+// "summary-backup-home@20170824193602". Summaries are kept when the
+// snapshots they describe are removed, so the history covers those as
+// well; a run with --exact-name replaces the summary of the one before
+// it, though, just as it replaces the snapshot.
+const summaryPrefix = "summary-"
+
+func saveSummary(s runSummary, backend storage.Backend) {
+	b, err := json.Marshal(s)
+	log.CheckError(err)
+	name := summaryPrefix + s.Type + "-" + s.FullName
+	if backend.MetadataExists(name) {
+		backend.DeleteMetadata(name)
+	}
+	backend.WriteMetadata(name, b)
+	backend.SyncWrites()
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func history(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk history [name prefix]\n")
+	}
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() > 1 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	backend := GetStorageBackend()
+	prefix := qualifySnapshotName(flags.Arg(0))
+	var names []string
+	for _, typ := range []string{"backup-", "bits-"} {
+		backend.ForMetadata(summaryPrefix+typ+prefix, func(name string, created time.Time) error {
+			names = append(names, name)
+			return nil
+		})
+	}
+	if len(names) == 0 {
+		Error("%s: no run summaries found\n", flags.Arg(0))
+	}
+
+	var summaries []runSummary
+	contents := backend.ReadMetadataBatch(names)
+	for _, name := range names {
+		var s runSummary
+		if err := json.Unmarshal(contents[name], &s); err != nil {
+			log.Error("%s: %s", name, err)
+			continue
+		}
+		summaries = append(summaries, s)
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return summaries[i].Start.Before(summaries[j].Start)
+	})
+
+	// As with "list", the current client's name is omitted.
+	owners := snapshotOwners(backend)
+	display := func(s runSummary) string {
+		name := s.FullName
+		if currentClient() != "" {
+			name = unqualifiedName(s.Type+"-"+s.FullName, owners)
+		}
+		if s.Type == "bits" {
+			name += " (bits)"
+		}
+		return name
+	}
+	// Bitstreams don't have files, so their counts are left blank.
+	counts := func(s runSummary) []string {
+		if s.Type == "bits" {
+			return []string{"-", "-", "-", "-"}
+		}
+		return []string{fmt.Sprintf("%d", s.Files), fmt.Sprintf("%d", s.NewFiles),
+			fmt.Sprintf("%d", s.ChangedFiles), u.FmtBytes(s.BytesRead)}
+	}
+
+	if humanOutput {
+		t := newTable(2, 3, 4, 5, 6, 7, 8)
+		t.add("Started", "Name", "Files", "New", "Changed", "Read", "Uploaded",
+			"Duration", "Errors")
+		for _, s := range summaries {
+			errors := fmt.Sprintf("%d", s.Errors)
+			if s.Errors > 0 {
+				errors = colored(errors, colorRed)
+			}
+			row := []string{s.Start.Local().Format(humanTimeLayout),
+				colored(display(s), colorBold)}
+			row = append(row, counts(s)...)
+			row = append(row, u.FmtBytes(s.Stats.BytesStored),
+				s.Duration.Round(time.Second).String(), errors)
+			t.add(row...)
+		}
+		t.print(os.Stdout, "")
+	} else {
+		for _, s := range summaries {
+			c := counts(s)
+			fmt.Printf("%s %-30s %8s %8s %8s %10s %10s %10s %d\n",
+				s.Start.Format(time.RFC3339), display(s), c[0], c[1], c[2], c[3],
+				u.FmtBytes(s.Stats.BytesStored), s.Duration.Round(time.Second), s.Errors)
+		}
+	}
+}
@@ -5,27 +5,43 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/mmp/bk/backup"
 	"github.com/mmp/bk/storage"
 	u "github.com/mmp/bk/util"
+	"golang.org/x/net/context"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
-	"os/signal"
-	"runtime/pprof"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var log *u.Logger
 
+// errorExitStatus is the exit status used if any errors were reported.
+// Commands may change it to indicate that the errors were of a particular
+// kind.
+var errorExitStatus = 1
+
+// The exit status for backups that completed, but skipped some files due
+// to errors.
+const skippedFilesExitStatus = 3
+
 func usage() {
 	fmt.Printf(`usage: bk [bk flags...] <command> [command args...]
-where <command> is: backup, cat, fsck, help, init, list` + iif(optionFuse, `, mount`) + `, restore, restorebits, savebits.
+where <command> is: api, backup, browse, cat, chain, compare, debug, du, dups, estimate, forget, fsck, gc, help, history, index, info, init, list, ls, migrate, mirror` + iif(optionFuse, `, mount`) + `, pin, quota, rekey, rename, restore, restorebits, savebits, scrub, selftest, serve, unpin, upgrade, watch.
 Run "bk help" for more detailed help.
 `)
 	os.Exit(1)
@@ -42,53 +58,748 @@ backups and/or is repeated within a single backup.
 
 Environment variables:
 - BK_DIR: Directory where backups are stored. If prefixed with "gs://", is taken
-  to refer to a Google Cloud Storage bucket.
+  to refer to a Google Cloud Storage bucket. If it's an http:// or https://
+  URL, it refers to a repository served by "bk serve". If it's of the form
+  "plugin:/path/to/helper", the given program stores the files; see
+  storage/plugin.go for the protocol it implements. Builds of bk that
+  include packages providing other storage backends (which register them
+  with storage.Register) support the URL schemes they register as well.
 - BK_GCS_PROJECT_ID: If Google Cloud Storage is being used, the name of the
   project you're using for billing. (Create using the Google Cloud console).
 - BK_PASSPHRASE: if encryption is being used, the encryption passphrase.
+- BK_NOTIFY_URL, BK_NOTIFY_FAIL_URL: defaults for the --notify-url and
+  --notify-fail-url options.
+- BK_API_TOKEN: if set, the token that clients of "bk api" must provide.
+- BK_TOKEN: the access token to use with a repository served by "bk serve".
+- BK_VERIFY_READS: if set, equivalent to the --verify-reads flag.
+- BK_CACHE_MB: size in megabytes of the in-memory cache of chunks that have
+  been read, which saves fetching, decrypting, and decompressing chunks
+  that are needed repeatedly (e.g., when restoring or browsing files that
+  share data). The default is 64; 0 disables it.
+- BK_CACHE_DIR: if set, chunks that have been read are also cached in this
+  directory, up to BK_CACHE_DIR_MB megabytes (by default, 1024), so that
+  they're available to later runs of bk. Chunks from encrypted
+  repositories are cached as they're stored, still encrypted. With
+  repositories served by "bk serve" or stored in Google Cloud Storage,
+  listings of the repository's files are cached there as well and only
+  downloaded again when they change. (Repositories in Google Cloud Storage
+  are then upgraded to format version 9, which older versions of bk can't
+  use, since they don't record their changes.)
+- BK_CONFIG: path to the bk configuration file. If not set, the file
+  bk/config.json in the user's configuration directory is used if present.
+- BK_CLIENT: the name of this machine in a repository that's shared by
+  several of them; overrides "client" in the configuration file.
+
+The configuration file is JSON encoded. It is used to set the client
+name, to configure email notifications for the "backup" and "savebits"
+commands, to give the access tokens accepted by "bk serve", to give the
+retention policies applied by "bk forget", and to give commands to sign
+backups with:
+  {
+    "client": "laptop",
+    "tokens": [
+      { "name": "laptop", "token": "secret1", "role": "append-only",
+        "client": "laptop" },
+      { "name": "restore", "token": "secret2", "role": "read-only" }
+    ],
+    "email": {
+      "server": "smtp.example.com:587",
+      "username": "user", "password": "secret",
+      "from": "bk@example.com", "to": [ "me@example.com" ],
+      "when": "failure"
+    },
+    "retention": {
+      "laptop-home": { "last": 3, "daily": 30, "monthly": 12 },
+      "server-etc": { "all": true }
+    },
+    "quota": "500GB",
+    "signing": {
+      "sign": "gpg --detach-sign --armor",
+      "verify": "gpg --verify \"$BK_SIGNATURE\" -"
+    }
+  }
+"when" may be "failure" (the default), "success", or "always". The roles
+of tokens are described with "serve", the retention policies with
+"forget", and the quota with "quota".
+
+If "sign" is given, "backup" runs it with a message that gives the new
+backup's name and root hash on its standard input; whatever it prints is
+stored as the backup's signature. "verify" is run by "restore" and "fsck"
+with --verify-signature, with the same message on its standard input
+and the path to a file holding the signature in the BK_SIGNATURE
+environment variable; it must exit with status 0 if the signature is
+valid. Backups are signed again when they're renamed.
 
 usage: bk [bk flags...] <command> [command_options ...]
 
-General bk flags are: [--verbose] [--debug] [--profile] [--memprofile]
+General bk flags are: [--verbose] [--debug] [--verify-reads] [--fast-sync]
+    [--no-color] [--syslog[=tag]] [--profile[=path]] [--memprofile[=path]]
+    [--blockprofile[=path]] [--mutexprofile[=path]] [--trace[=path]]
+    [--pprof-addr[=address]]
+  When standard output is a terminal, "list", "ls", "compare", and "du"
+  print their results in aligned columns, with local times and colors;
+  warnings and errors are colored as well when standard error is a
+  terminal. --no-color (or setting the NO_COLOR environment variable)
+  disables colors. When output goes to a file or pipe, the plain format
+  is always used.
+  --syslog sends errors, warnings, progress reports, and other messages
+  to the system log (and so to the systemd journal, where there is one)
+  with the given tag ("bk" by default) rather than to standard error, so
+  that unattended backups don't produce mail from cron. Fatal errors,
+  errors, and warnings are logged with the corresponding priorities,
+  other messages as notices, and --verbose and --debug output with info
+  and debug priority. Command output, such as that of "list", still goes
+  to standard output.
+  --verify-reads recomputes the hash of every chunk of data that's read
+  from the repository (e.g., by "restore", "mount", and "fsck") and fails
+  if it doesn't match, independently of the checks made by the storage
+  backend itself.
+  With repositories on local disk, bk waits for each file that it writes
+  to reach the disk before going on, so that once a command such as
+  "backup" reports success, what it saved survives a crash or power
+  loss. --fast-sync skips that, which can be much faster on slow disks,
+  but an interruption may then leave recently written data missing or
+  damaged; it also applies to the repository served by "bk serve".
+  The profiling flags write CPU, heap, goroutine blocking, and mutex
+  contention profiles respectively, when bk exits or receives SIGINT. By
+  default, they're written to bk.prof, bk.memprof, bk.blockprof, and
+  bk.mutexprof in the current directory. --trace similarly records an
+  execution trace (bk.trace by default), which shows when goroutines run
+  and what they're blocked on, for understanding why, for example, a
+  backup or restore isn't keeping the disk or network busy; view it with
+  "go tool trace bk.trace". --pprof-addr serves live profiles over HTTP
+  at the given address (localhost:6060 by default) while bk runs, so
+  that the memory use and goroutines of a long backup can be inspected
+  with "go tool pprof http://localhost:6060/debug/pprof/heap" or a web
+  browser. Anyone who can connect to the address can see them,
+  so ":6060", which listens on all interfaces, should be used with care.
+
+Backups and bitstreams are stored with the name they're given plus the
+time they were made, as in "foo@20170102150405". Commands that take the
+name of an existing one also accept:
+  foo, foo:latest      the most recent backup named "foo"
+  foo~2                the one two before the most recent one
+  foo@2017-01-02       the most recent one made at or before the given date
+                       and (optionally) local time, given as
+                       2017-01-02T15:04 or 2017-01-02T15:04:05
+  3f9a2c1e             the backup whose ID, as printed by "list --ids",
+                       starts with the given hex digits (at least 4 of
+                       them); IDs are derived from the backup's contents,
+                       so they don't change if it's renamed
+
+If a client name is set (see BK_CLIENT), backups and bitstreams are stored
+as "client+foo@20170102150405", so that machines sharing a repository each
+have their own names; data is still deduplicated across all of them. Names
+without a client refer to the current client's backups, falling back to
+ones made without a client name; "other+foo" refers to another client's.
+Names given to new backups and bitstreams can't include '+'. Which client
+a backup belongs to is recorded in metadata of its own, so backups made
+before client names were set aren't taken to be any client's, even if
+their names include '+'.
 
 Commands and their options are:
-  backup [--split-bits count] [--base base] [--exclude path] <backup name> <directory>
+  api [--listen address]
+      Serve an HTTP API for managing bk at the given address (by default,
+      localhost:8467). If the BK_API_TOKEN environment variable is set,
+      requests must include an "Authorization: Bearer <token>" header with
+      its value. Results are returned as JSON. The endpoints are:
+        GET /v1/snapshots  list all backups and bitstreams
+        GET /v1/stats      number of backups, blobs, and bytes stored
+        POST /v1/backups   start a backup, given a JSON object with "name"
+                           and "dir" and, optionally, "base", "exclude"
+                           (a list), and "split_bits"; only one backup can
+                           run at a time
+        GET /v1/jobs       list the backups started via the API
+        GET /v1/jobs/<id>  status, recent output, and, once finished, the
+                           summary of a backup (as with --notify-url)
+      Backups are run using the bk executable that's serving the API, with
+      the same environment variables.
+
+  backup [--split-bits count] [--base base] [--exclude path]
+         [--exclude-if-present name] [--exclude-nodump] [--no-file-cache]
+         [--deterministic] [--snapshot btrfs|zfs] [--lvm-snapshot vg/lv:size]
+         [--exact-name] [--utc] [--time-format layout] [--timestamp time]
+         [--metrics-file path] [--summary-file path] [--notify-url url]
+         [--notify-fail-url url]
+         <backup name> <directory> [<directory> ...]
+  backup [options] --from ssh://[user@]host[:port]/path <backup name>
       Make a back up of <directory>, including the contents of all
       subdirectories, with the given name in the given bk repository.  The
       --split-bits option can be used to control how large the blobs
       generated by the splitting algorithm are, and --base can be used to
-      specify a base backup for incremental backups. The --exclude option
-      (which may be used multiple times) specifies paths to exclude from
-      backups.
+      specify a base backup for incremental backups. If more than one
+      directory is given, they're all stored in the one backup, which
+      holds an entry for each of them named with its last path element
+      (e.g., "etc" and "app" for /etc and /var/lib/app), so that they're
+      saved together as a single snapshot; the names must differ. Regular
+      files may be given in place of directories; a backup of a single
+      file (e.g., a disk image) holds just that file, with its name,
+      permissions, and times. The --exclude option (which may be used
+      multiple times) specifies paths to exclude from backups.
+      --exclude-if-present (which may also be used multiple times)
+      excludes the directories below <directory> that contain a file with
+      the given name, such as ".nobackup", so that directories can be
+      excluded without listing them. --exclude-nodump excludes files and
+      directories with the "nodump" attribute set (by "chattr +d" on Linux
+      or "chflags nodump" on BSD and macOS), as dump(8) does; it can't be
+      used with --from. Files whose size, modification time, inode number,
+      and status change time are unchanged since the last backup of
+      <directory> aren't read again; this information is stored in a cache
+      in the user's cache directory (e.g., ~/.cache/bk). --no-file-cache
+      causes all files to be read. Since setting the nodump attribute
+      changes a file's status change time, files found in the cache aren't
+      checked for it; use --no-file-cache the first time --exclude-nodump
+      is given so that all of them are. Files and directories that can't be
+      read (e.g., due to permissions) are skipped and recorded in the
+      backup; see "bk info". In that case, bk exits with status 3. If
+      --metrics-file is given, statistics about the backup are written to
+      that file in the Prometheus text format (e.g., for node_exporter's
+      textfile collector). If --notify-url is given, a JSON summary of the
+      run is POSTed to that URL when it finishes, whether or not it
+      succeeded; if --notify-fail-url is also given, failed runs are
+      reported there instead. (For healthchecks.io, use the check's ping
+      URL and the ping URL with "/fail" appended, respectively.)
+      --summary-file writes the same JSON summary to the given file when
+      the run finishes, for wrapper scripts to read.
+      --from backs up a directory on another machine instead, reading it
+      over SFTP. The connection is made by running "ssh -s sftp", so the
+      usual SSH configuration, keys, and agent are used; the other machine
+      doesn't need bk or access to the repository. File ownership is
+      recorded by numeric id only. If the repository has a quota (see
+      "quota") and is already at it, the backup isn't started. If a
+      signing command is configured, the backup is signed; if signing
+      fails, the error is reported, but the backup is saved regardless.
+      With --deterministic, backups of identical directory trees have the
+      same hash, even if they're made on different machines and into
+      different repositories, so that copies of a tree on mirrors can be
+      cross-checked by comparing their backups' hashes. The time of the
+      backup isn't recorded in it (other than in its name), entries are
+      stored in sorted order with modification times in UTC, and owners
+      are recorded by numeric id only. How files are split into blobs only
+      depends on their contents. The hashes only match if the backups are
+      made by the same version of bk with the same --split-bits into
+      repositories with the same hash algorithm and format; the
+      repositories can't be encrypted. --deterministic can't be used with
+      --base and implies --no-file-cache.
+      --snapshot backs up a single directory from a read-only snapshot of
+      it, so that one that's in use is captured as it was at one point in
+      time; the snapshot is removed once the files have been backed up.
+      With "btrfs", the directory must be a subvolume, and the snapshot is
+      made in it, named .bk-snapshot; directories with that name are never
+      backed up, so other backups and "bk watch" of it ignore the
+      snapshot. With "zfs", the dataset the directory is in is
+      snapshotted, named @bk-snapshot. Neither includes other datasets or
+      subvolumes below <directory>; they appear as empty directories in
+      the snapshot. bk needs permission to make and remove snapshots
+      (e.g., by running as root).
+      If a snapshot with that name is already present, as may be if an
+      earlier backup was interrupted, it's reported rather than removed.
+      --lvm-snapshot does the same with a snapshot of the LVM logical
+      volume lv in volume group vg, which must be mounted and hold
+      <directory>; size is the space to set aside for changes made to the
+      volume during the backup (e.g., "2G"). The snapshot is named
+      lv-bk-snapshot and mounted read-only in a new directory in the
+      system's temporary directory; filesystems mounted below <directory>
+      aren't included. If making or mounting the snapshot fails, whatever
+      was done is undone. If bk is interrupted during the backup, it stops
+      and the snapshot is removed; a second interrupt exits right away,
+      which may leave the snapshot in place.
+      The name of the backup has the time it was made appended to it, as
+      in "mybackup@20170824193602", in local time. With --utc, the time is
+      in UTC and followed by "Z", so that the names of backups made in
+      different time zones sort in the order they were made. --time-format
+      gives a different format for it, as a Go time layout (see
+      https://golang.org/pkg/time/#pkg-constants); bk only determines the
+      time from names in the default format or ones with a "Z0700" zone,
+      and otherwise uses the time the backup was saved to the repository.
+      --timestamp gives the time, in RFC 3339 format (e.g.,
+      "2009-11-10T23:00:00Z"), to use in place of the current time, both
+      in the name and as the time the backup was made, e.g. for imports of
+      historical data. With --exact-name, no time is appended, and an
+      existing backup with the name is replaced, unless it's pinned; this
+      is for scripts that manage their own naming and rotation of backups.
+      Retention policies (see "forget") don't apply to such backups. If
+      two runs of bk save backups with the same name at once, only the
+      first one to finish is saved; the other reports an error rather
+      than replacing it. Backups can't be replaced in repositories stored
+      by helper programs ("plugin:").
            
+  browse [--jobs n] [backup name]
+      Interactively browse the contents of the most recent backup with the
+      given name or, if none is given, of one chosen from a list of all of
+      them. Its files and directories are shown as with "restore
+      --interactive", along with the details of the current one; the ones
+      that are selected when enter is pressed are restored under a
+      directory that's asked for then. --jobs is as with "restore".
+
   cat <hash ...>
       Prints the contents of the given hash(es) to standard output.
 
-  fsck
-      Check integrity of the bk repository.
+  cat [--offset n] [--length n] <backup name> <path>
+      Prints the contents of the file at <path> in the most recent backup
+      with the given name to standard output. --offset and --length print
+      just the given range of bytes from it; for large files backed up by
+      recent versions of bk, only the chunks that store that range are
+      read from the repository.
+
+  chain <backup name>
+      Print the chain of incremental backups that led to the most recent
+      backup with the given name: the backup given with --base when it was
+      made, the one that backup was based on, and so forth, followed by
+      the incremental backups that were based on it. Backups made by older
+      versions of bk don't record their bases.
+
+  compare [--contents] [--exclude path] <backup name> <directory>
+      Compare the most recent backup with the given name to <directory>,
+      printing a line for each difference found: "A" for paths that are
+      only in <directory>, "D" for paths that are only in the backup, "T"
+      for paths whose type changed, "M" for files whose contents differ, and
+      "m" for changed modification times or permissions.  Files with the
+      same size and modification time are assumed to be unchanged unless
+      --contents is given. Exits with status 1 if differences were found.
+
+  debug cat-blob [--hex] <hash>
+  debug dump-tree [--level n [--dir]] <hash>
+  debug tree <backup or bits name>
+  debug list-blobs [--prefix hex]
+      Print objects stored in the repository, after they've been decrypted
+      and decompressed, for diagnosing problems with it. "cat-blob" prints
+      the blob with the given hash, as a hex dump if --hex is given or
+      standard output is a terminal. "dump-tree" prints the backup root
+      with the given hash (the one printed by "info"), or, with --level,
+      the blobs that make up the Merkle tree with the given hash and level,
+      indented by level; --dir also decodes the data stored by the tree as
+      a directory and prints its entries. "tree" summarizes the Merkle
+      trees that store the most recent backup or bitstream with the given
+      name: for each level, the number of blobs and their stored size
+      (after compression), along with the distribution of the stored sizes
+      of the data blobs, which helps with choosing --split-bits. Blobs that
+      are shared are counted once. "list-blobs" prints the hash and stored
+      size of every blob in the repository (or just the ones whose hashes
+      start with --prefix), sorted by hash, so that mirrored repositories
+      can be compared. Problems found along the way are printed rather than
+      ending the command.
+
+  du [<backup or bits name> ...]
+      Report the storage used by each backup and bitstream: the total size
+      of its files when restored, the stored bytes (after compression and
+      deduplication) used only by it, which is what removing it would
+      reclaim, and the stored bytes it shares with other backups and
+      bitstreams. If backups or bitstreams are given, also report how much
+      removing all of them would reclaim; that includes the blobs they
+      only share with each other, so it's generally more than the sum of
+      their unique sizes. (bk doesn't remove blobs yet, so removing backups
+      doesn't actually reclaim the space; "gc --report-only" reports how
+      much is used by blobs that are no longer referenced.)
+
+  dups [--min-size bytes] <backup name> [path]
+      List sets of identical files in the most recent backup with the given
+      name (or just under <path> in it), along with how much space
+      removing all but one of each set would save in the source directory,
+      largest first. Files smaller than --min-size (1 byte by default)
+      aren't reported. Files are compared using the hashes of their stored
+      contents, so their data isn't read.
+
+  estimate [--exclude path] [--exclude-if-present name] [--exclude-nodump]
+           <directory>
+      Estimate how much data a backup of <directory> would store, without
+      accessing the repository. Files that the file cache (see "backup")
+      reports as unchanged since the last backup are assumed to be stored
+      already; all others are counted as new or changed. Small files are
+      always counted, since they aren't recorded in the cache. The
+      directory should be given the same way as for "backup", with the
+      same exclusion options.
+
+  forget [--dry-run] --all
+  forget [--dry-run] <backup name> ...
+      Remove backups according to the retention policies in the
+      configuration file: with --all, the policy for each name that the
+      current client's backups have been made with is applied; otherwise,
+      just the policies for the given names are. Each policy applies to the
+      backups whose names start with its key; if several keys match, the
+      longest one is used, and names that none match are left alone. For
+      each name, the "last" most recent backups are kept, as is the most
+      recent one made on each of the "daily" most recent days that have
+      one, and likewise with "weekly", "monthly", and "yearly" for weeks,
+      months, and years. With "all", all of them are kept. Pinned backups
+      are never removed. A warning is issued if a backup that's removed is
+      the base of an incremental backup that's kept (see "chain"). Only
+      the backups' names are removed; the data they refer to stays in the
+      repository, since bk doesn't remove blobs yet (see "gc"). --dry-run
+      lists the backups that would be removed without removing them, along
+      with how much of the stored data would no longer be referenced (see
+      "du").
+
+  fsck [--metadata-only] [--subset n/count] [--jobs n] [--repair]
+       [--verify-signature]
+      Check integrity of the bk repository, checking up to <jobs> items
+      (16 by default) concurrently. With --metadata-only, the
+      structure of all backups is checked and the existence of all blobs
+      they use is verified, but blob contents aren't read and verified
+      (other than the few storing directory entries and lists of hashes);
+      this is much less expensive with cloud storage. --subset divides the
+      stored data into <count> slices and only reads and verifies the n'th
+      of them, so that, for example, a weekly job can run with
+      "--subset $(( $(date +%V) % 52 + 1 ))/52" to check all of the data
+      over the course of a year.
+
+      Repositories on local disk store a Reed-Solomon encoding of each of
+      their files, which fsck checks them against. With --repair, corrupted
+      files are reconstructed from their encodings rather than just
+      reported. (Blobs that are found to be corrupted when they're read,
+      e.g. during a restore, are repaired automatically in the same way.)
+      Corruption in a handful of places can be repaired, but files that
+      are missing altogether can't be.
+
+      All repositories also store two copies of each backup's root and
+      other metadata (e.g., the encryption key), and fsck makes sure that
+      they match. With --repair, a missing or damaged copy is replaced
+      with the other one, and second copies are added for metadata written
+      by older versions of bk.
+
+      Repositories on local disk write metadata through a journal, so
+      that a crash while it's being written leaves either the old or the
+      new version in place; fsck completes or rolls back any writes that
+      were interrupted, once they've gone a minute without being updated
+      by the run of bk making them.
+
+      --verify-signature verifies the signature of each backup with the
+      configured "verify" command as well; backups that aren't signed are
+      reported as errors.
 
   help
       Prints this help message.
 
-  init [--encrypt]
+  gc --report-only [--list]
+      Report how many blobs in the repository aren't referenced by any
+      backup or bitstream and how much storage they use; this is what
+      would be reclaimed by removing them. Blobs are left behind when
+      backups and bitstreams are removed, since others may refer to them
+      as well, and by interrupted backups. --list prints the hash and
+      stored size of each one. bk doesn't remove them yet, so --report-only
+      is required.
+
+  history [name prefix]
+      Print the summaries stored by past backup and savebits runs, oldest
+      first, for the backups and bitstreams whose names start with the
+      given prefix (or all of them): when each started, how many files
+      it found and how many of them were new or changed since the last
+      backup and so were read, the bytes read and uploaded, how long it
+      took, and the number of errors. Summaries remain after the backups
+      and bitstreams they describe are removed, so this shows how the
+      repository has grown.
+
+  index --output <file> [backup name ...]
+      Write a SQLite database to <file> that lists the path, type, size,
+      modification time, permissions, and content hash of every file,
+      directory, and symlink in all backups (or all instances of the given
+      backups). The "catalog" view joins each file with the backup it's in,
+      so that, for example, every stored version of a file can be found
+      with:
+        SELECT full_name, size, datetime(mtime, 'unixepoch'), hash
+          FROM catalog WHERE path LIKE '%/report.xlsx';
+
+  info <backup name>
+      Print information about the most recent backup with the given name,
+      including any files or directories that couldn't be backed up. For
+      bitstreams, the size and checksum of the stream, the host it was
+      saved on, and the command line used to save it are printed.
+
+  init [--encrypt [--pad] [--kdf algorithm] [--kdf-iterations n]
+       [--kdf-memory size] [--kdf-threads n]] [--hash algorithm] [--delta]
+       [--quota size]
       Initialize a new backup repository in the given directory. If backups
       in this repository should be encrypted, the --encrypt option should
-      be given.
-
-  list
-      List names of all backups and archived bitstreams.
+      be given. The names of backups aren't encrypted, but the metadata
+      that records them is authenticated, so that someone who can modify
+      the stored data without the passphrase can't, for example, make a
+      backup's name refer to a different backup without bk reporting an
+      error. (Encrypted repositories created by versions of bk before
+      format version 6 don't have this.) With --pad, encrypted chunks are
+      padded so that their sizes don't reveal what's stored: otherwise,
+      the sizes of the chunks that a file is split into can identify it to
+      anyone who can see the stored data and has a copy of the file.
+      Padding costs a few percent in storage.
+
+      The key that encrypts the repository's encryption key is derived
+      from the passphrase using the function given by --kdf: "argon2id"
+      (the default) or "pbkdf2-sha256". Its cost is recorded in the
+      repository, so that new repositories can be made more resistant to
+      guessing the passphrase without affecting existing ones. By default,
+      argon2id uses 64 MiB of memory (--kdf-memory) and up to 4 threads
+      (--kdf-threads), and the number of iterations (--kdf-iterations) is
+      as many as take about half a second on this machine (but at least 3
+      for argon2id and 600000 for pbkdf2-sha256); opening the repository
+      on slower machines takes longer. Repositories created before format
+      version 7 use pbkdf2-sha256 with 65536 iterations; "rekey" changes
+      the function and its cost later.
+
+      --hash selects the hash algorithm used to identify chunks
+      of data: "shake256" (the default), "sha256", or "blake3", which is
+      significantly faster. These can't be changed later. --quota records
+      the repository's quota (see "quota").
+
+      With --delta, new chunks that are similar to ones already stored, as
+      happens when a large file like a mailbox, database, or disk image
+      changes slightly between backups, are stored as the differences from
+      them, which can greatly reduce the storage that repeated backups of
+      such files use. Storing a chunk as a delta requires reading the one
+      it's similar to, and reading it again requires reading both, so
+      backups and restores are somewhat slower; a little memory is also
+      used for each chunk in the repository. Only chunks stored in full
+      are used as the basis of deltas. Deltas can't be enabled for
+      existing repositories, and backups in repositories with them can't
+      use --deterministic.
+
+  list [--long] [--ids] [--all-clients]
+      List names of all backups and archived bitstreams, marking the ones
+      that are pinned. With --long, the size of each bitstream, the host it
+      was saved on, and the command line used to save it are printed as
+      well. With --ids, each backup's ID is printed before its name. If a
+      client name is set, only the current client's are listed unless
+      --all-clients is given.
+
+  ls [--sort name|size|time] [--top n] [--depth n] <backup name> [path]
+      List the files and symbolic links in the most recent backup with the
+      given name (or just the ones under <path> in it), along with their
+      sizes and modification times. By default, they're listed in order of
+      their paths; "--sort size" lists the largest first and "--sort time"
+      the most recently modified first. --top limits the listing to the
+      first <n> of them. --depth limits the listing to <n> levels of
+      directories below <path>, listing the directories themselves as well;
+      "--depth 1" lists just the contents of <path>. Only the directories
+      that are listed are read from the repository, so this is much faster
+      than listing everything with large backups.
+
+  migrate [--jobs n] <destination>
+      Copy all of the data in the bk repository to <destination>, which is
+      specified in the same way as BK_DIR (and, if it's a directory, must
+      already exist). Encrypted data is copied without being decrypted.
+      If the migration is interrupted, running the same command again
+      resumes it; metadata that has changed since it was copied, as when a
+      backup is replaced with --exact-name, is replaced. Up to <jobs> blobs
+      (16 by default) are read concurrently.
+
+  mirror [--jobs n] [--from source] [--delete] <destination>
+      Bring <destination> up to date with the bk repository (or with
+      <source>, if given; both are specified in the same way as BK_DIR).
+      Blobs and metadata that are missing from <destination> are copied,
+      and metadata that has changed is replaced, as with "migrate".
+      Metadata that's no longer in the source (e.g., for backups that were
+      forgotten or renamed) is listed and, with --delete, deleted from
+      <destination>, so running it regularly (e.g., from cron) keeps an
+      independent second copy of the whole repository. <destination>
+      must either be empty or have been created by an earlier mirror or
+      migration of the same repository, which is checked using the
+      identifier recorded in repositories when they're created (or
+      upgraded, for ones created by older versions of bk).
 ` + iif(optionFuse, `
   mount <dir>
       Mounts all available backups at the provided directory.
 `) + `
-  restore <backup name> <target dir>
-      Restore the named backup to the specified target directory.
-
-  restorebits <bits name>
+  pin [<backup name> ...]
+      Pin the given backups or bitstreams (by default, the most recent
+      ones with the given names), so that they're kept regardless of any
+      retention policy. With no arguments, the pinned ones are listed.
+
+  quota [--set size]
+      Report the repository's quota and how much storage it uses. The quota
+      is recorded in the repository by "init --quota" or with --set, where
+      0 removes it; a "quota" in the configuration file (e.g., "500GB"; "0"
+      for none) is used in its place. Sizes may be given in bytes or with
+      units like "MB" or "GiB". All stored blobs count against it,
+      including ones that nothing refers to any more. "backup" and
+      "savebits" don't start if the repository is at its quota, and warn if
+      they leave it over. If it's over, the backups that "forget --all"
+      would remove are reported, along with further old backups whose
+      removal would bring it under; pinned backups and the most recent
+      backup with each name aren't suggested. "forget --dry-run" makes the
+      same suggestions if what it removes isn't enough.
+
+  rekey [--kdf algorithm] [--kdf-iterations n] [--kdf-memory size]
+        [--kdf-threads n]
+      Change the key derivation function, and its cost, used for the
+      passphrase of the encrypted repository, as given to "init". Only the
+      repository's encryption key is re-encrypted, so nothing else is
+      changed or copied; running it periodically keeps up with faster
+      hardware. If it's interrupted, the repository can still be used, and
+      running it again finishes the job. Versions of bk before format
+      version 7 can no longer open the repository afterward.
+
+  rename <old name> <new name>
+      Rename backups or bitstreams without copying any of their data. If
+      <old name> is a name as given to "backup" or "savebits", all of the
+      backups (or bitstreams) with that name are renamed; otherwise it may
+      select a single one in any of the ways described above. Timestamps
+      and pins are preserved.
+
+  restore [--jobs n] [--interactive] [--overwrite | --skip-existing |
+          --keep-newer | --backup-existing | --in-place [--delete]]
+          [--numeric-ids | --no-owner] [--id-map file] [--verify-signature]
+          <backup name> <target dir>
+      Restore the named backup to the specified target directory. The
+      --jobs option controls how many files are restored concurrently
+      (default 16); higher values help hide latency with cloud storage.
+      Each chunk of data read from the repository is checked against its
+      hash, and restoring stops if one doesn't match. For backups made by
+      this version of bk or later, each file's contents as a whole are
+      checked as well; files that don't match are reported as errors and
+      removed.
+
+      If the target directory already exists, the backup is restored into
+      it. By default, files, directories, and symlinks that already exist
+      there are reported as errors and left alone; --overwrite replaces
+      them, --skip-existing leaves them alone without an error,
+      --keep-newer leaves them alone only if they were modified more
+      recently than the ones in the backup, and --backup-existing renames
+      them with a ".bk-orig" suffix first. Existing directories are never
+      replaced, but are restored into. --in-place efficiently rolls a
+      directory back to the state in the backup: existing files with the
+      same size and modification time as the backed-up ones are assumed to
+      be unchanged and aren't rewritten, though their permissions are
+      updated. With --delete, files and directories that aren't in the
+      backup are removed as well.
+
+      When running as root, the owners of restored files are restored as
+      well, using the users and groups on this machine with the same names
+      as the ones recorded in the backup (or the recorded ids if there are
+      no such users or groups). --numeric-ids uses the recorded ids
+      instead and --no-owner leaves restored files owned by root. --id-map
+      gives a file that maps users and groups, with lines of the form
+      "user <from> <to>" or "group <from> <to>", where <from> is a name or
+      id as recorded in the backup and <to> is a name or id on this
+      machine.
+
+      Modification times are restored with their full precision. Files'
+      creation times are recorded on macOS, FreeBSD, NetBSD, and Windows and
+      are restored there as well, where the filesystem allows it.
+
+      --interactive shows the backup's files and directories in the
+      terminal with a checkbox for each, so that just some of them can be
+      selected and restored. The arrow keys move around and expand and
+      collapse directories, space selects or deselects the current file or
+      directory (and everything under it), and enter restores the selected
+      ones under the target directory, recreating their paths relative to
+      the backup's root; "q" quits without restoring anything. Directories
+      are only read from the repository when they're expanded.
+
+      --verify-signature verifies the backup's signature with the
+      configured "verify" command before anything is restored and fails
+      if it isn't valid.
+
+  restorebits [--offset n] [--length n] <bits name>
       Restore the named bitstream, printing its contents to standard output.
-
-  savebits [--split-bits bits] <bits name>
-      Save the bitstream given in standard input to the given name.
+      --offset and --length restore just the given range of bytes from it;
+      only the chunks of data that cover the range are read, with the
+      exception of bitstreams saved by older versions of bk, where all of
+      the data before the range must be read as well. When a whole
+      bitstream is restored, its size and checksum are checked against the
+      ones recorded when it was saved.
+      --output writes the bitstream to the given file. If --resume is given
+      as well and the file exists, the chunks of data that are already
+      present in it are checked and the restore continues after the last
+      intact one.
+
+  savebits [--split-bits bits] [--exec command] [--input name=command]
+           [--zstd-long] [--exact-name] [--utc] [--time-format layout]
+           [--timestamp time] [--metrics-file path] [--summary-file path]
+           [--notify-url url] [--notify-fail-url url] <bits name>
+      Save the bitstream given in standard input to the given name. If it's
+      a tar archive, it's split into chunks at the start of each file so
+      that files that are unchanged from earlier archives are deduplicated.
+      --exec runs the given command with the shell and saves its output
+      instead; the bitstream is only saved if the command succeeds.
+      --input (which may be used multiple times) does the same for a
+      number of commands, saving the output of each as a separate
+      bitstream named with <bits name>, a hyphen, and the given name,
+      e.g., "db-users" and "db-orders" for --input users="pg_dump users"
+      --input orders="pg_dump orders" with the name "db". The commands are
+      run one after the other, and all of the bitstreams' names have the
+      same timestamp; they're only saved if all of the commands succeed,
+      though if another run of bk saves a bitstream with one of the names
+      first, the ones named before it are still saved. Each one records
+      its command, rather than the bk command line, as shown by "bk info".
+      With --zstd-long, the whole stream is compressed with zstd using a
+      128 MiB window before it's split into chunks. This finds redundancy
+      that's too far apart for the compression of individual chunks to,
+      which can greatly reduce the storage used by database dumps and tar
+      archives, but since a change to the stream affects all of the
+      compressed data after it, successive saves of a stream share few
+      chunks. Restoring a range of a compressed stream requires reading
+      all of the data before it, and --resume can't be used with
+      "restorebits"; versions of bk before this option was added restore
+      the compressed data.
+      --exact-name, --utc, --time-format, --timestamp, --metrics-file,
+      --summary-file, --notify-url, and --notify-fail-url are as with
+      "backup", as is the handling of the repository's quota.
+
+  scrub [--time duration] [--jobs n] [--status] [--restart]
+      Read and verify stored blobs, <jobs> (16 by default) at a time, for
+      at most the given time (30m by default), continuing from where the
+      last run stopped. Blobs are verified in order of their hashes, and
+      progress is recorded in the repository, so that, for example,
+      running "bk scrub --time 30m" each night eventually covers all of
+      the stored data, after which a new pass starts. Corrupted blobs are
+      repaired as they are when they're read otherwise (see "fsck"). The
+      passphrase isn't needed for encrypted repositories. --status reports
+      the progress of the current pass and when the last one finished,
+      and --restart starts a new pass.
+
+  selftest
+      Check that this build of bk works correctly on this platform before
+      trusting it with data, without using a repository. The hash
+      algorithms, the splitting of data into chunks, decompression, and
+      the ciphers used for encryption are checked against known test
+      vectors, data is written to and read back from the compression and
+      encryption layers, and a small directory tree is backed up to a
+      repository in memory, restored, and compared to the original. Exits
+      with status 1 if any of the tests fail.
+
+  serve [--listen address] [--cert file --key file]
+      Serve the repository in BK_DIR, which must be a local directory, at
+      the given address (by default, localhost:8468), so that other
+      machines can use it by setting BK_DIR to its http:// URL. With
+      --cert and --key, which give the PEM-encoded TLS certificate and
+      private key files, it's served over HTTPS instead, and clients use
+      its https:// URL. (On Linux, clients can be made to trust a
+      self-signed certificate by setting SSL_CERT_FILE to its file.) The data
+      stays encrypted if the repository is, and the passphrase isn't needed
+      to serve it. Clients authenticate with the access tokens given in the
+      configuration file, which have one of three roles:
+        read-only    backups and bitstreams can be listed and restored
+        append-only  new ones can be added as well, but nothing in the
+                     repository can be removed or overwritten, so a client
+                     that's compromised can't destroy existing backups
+        admin        all operations are allowed, including renaming,
+                     unpinning, and replacing backups with --exact-name
+      If an append-only token is given a "client", backups and bitstreams
+      can only be added with it if BK_CLIENT or the client's configuration
+      file gives that client name. If no tokens are configured, no
+      authentication is required.
+
+  unpin <backup name> ...
+      Unpin the given backups or bitstreams. With a repository served by
+      "bk serve", this requires an admin token.
+
+  upgrade
+      Update the bk repository to the current repository format, if it was
+      created by an older version of bk. Upgrading is never required:
+      repositories are only marked with a newer format when a feature
+      that needs it is used, and marking one prevents older versions of bk
+      from accessing it. Repositories created by older versions of bk are
+      also given an identifier, which distinguishes their file caches
+      from those of other repositories.
+
+  watch [--quiet duration] [--max-delay duration] [--split-bits bits]
+        [--exclude path] [--exclude-if-present name] [--exclude-nodump]
+        <backup name> <directory>
+      Back up <directory> with the given name and then watch it for changes,
+      making a new backup once there have been none for --quiet (default
+      30s), or after --max-delay (default 10m) if changes are made
+      continuously. Each backup is a complete backup as made by "backup";
+      thanks to the file cache, only the files that have changed are read.
+      If changes may have been missed (e.g., because too many were made at
+      once), a backup is made right away. Runs until it's interrupted.
 
 `)
 	os.Exit(0)
@@ -105,22 +816,65 @@ func lookupHash(name string, backend storage.Backend) (hash storage.Hash) {
 }
 
 func Error(s string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, s, args...)
+	msg := fmt.Sprintf(s, args...)
+	fmt.Fprint(os.Stderr, msg)
+	// Failed runs are reported and snapshots removed just as they are
+	// after fatal errors.
+	log.RunFatalHooks(strings.TrimSuffix(msg, "\n"))
 	os.Exit(1)
 }
 
-func InitStorage(encrypt bool) {
+func InitStorage(encrypt, pad, delta bool, kdf storage.KDFParams, hashAlgorithm string,
+	quota int64) {
 	backend := getBaseBackend()
+	if backend.MetadataExists("readme_bk.txt") {
+		Error("%s: repository has already been initialized.\n", backend.String())
+	}
+	if err := storage.SetHashAlgorithm(hashAlgorithm); err != nil {
+		Error("%s\n", err)
+	}
+	storage.SetRepositoryHashAlgorithm(backend, hashAlgorithm)
+	storage.SetRepositoryID(backend)
+
+	if pad {
+		storage.SetRepositoryPadding(backend)
+	}
 	if encrypt {
 		passphrase := os.Getenv("BK_PASSPHRASE")
 		if passphrase == "" {
 			Error("BK_PASSPHRASE environment variable not set.\n")
 		}
+		storage.SetRepositoryKDF(backend, kdf)
 		backend = storage.NewEncrypted(backend, passphrase)
 	}
 	backend = storage.NewCompressed(backend)
+	if delta {
+		storage.SetRepositoryDelta(backend)
+	}
 
+	// The repository is marked with the oldest format version that has
+	// all of the features it uses, so that older versions of bk can use it
+	// if they support them; later ones are recorded when they're used.
+	version := 2
+	if hashAlgorithm != storage.DefaultHashAlgorithm {
+		version = 3
+	}
+	if pad {
+		version = 4
+	}
+	if encrypt {
+		// New encrypted repositories' metadata is authenticated, and their
+		// key derivation parameters are recorded in kdf.txt.
+		version = 7
+	}
+	if delta {
+		version = 8
+	}
 	backend.WriteMetadata("readme_bk.txt", []byte(readmeText))
+	storage.SetRepositoryFormat(backend, version)
+	if quota > 0 {
+		setRepositoryQuota(backend, quota)
+	}
 	backend.SyncWrites()
 }
 
@@ -129,61 +883,456 @@ func getBaseBackend() storage.Backend {
 	if path == "" {
 		Error("BK_DIR: environment variable not set.\n")
 	}
+	return openBaseBackend(path)
+}
+
+// Set by --verify-reads or BK_VERIFY_READS.
+var verifyReads bool
+
+// openBaseBackend returns the storage backend for the given path, which
+// is specified in the same way as BK_DIR.
+func openBaseBackend(path string) storage.Backend {
+	backend := openStorage(path)
+	if verifyReads {
+		backend = storage.NewVerified(backend)
+	}
+	return backend
+}
+
+// Storage backends that need to be closed before bk exits, e.g. to wait
+// for helper programs to finish.
+var openedStorage []io.Closer
+
+func openStorage(path string) storage.Backend {
+	configureStorage()
+	backend, err := storage.Open(path)
+	if err == storage.ErrNoGCSProject {
+		Error("BK_GCS_PROJECT_ID environment variable not set.\n")
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if c, ok := backend.(io.Closer); ok {
+		openedStorage = append(openedStorage, c)
+	}
+	return backend
+}
 
-	if strings.HasPrefix(path, "gs://") {
-		projectId := os.Getenv("BK_GCS_PROJECT_ID")
-		if projectId == "" {
-			Error("BK_GCS_PROJECT_ID environment variable not set.\n")
+// closeStorage closes the storage backends that have been opened,
+// reporting any problems as errors.
+func closeStorage() {
+	for _, c := range openedStorage {
+		if err := c.Close(); err != nil {
+			log.Error("%s", err)
 		}
-		return storage.NewGCS(storage.GCSOptions{
-			BucketName: strings.TrimPrefix(path, "gs://"),
-			ProjectId:  projectId,
-			// TODO: make it possible to specify these via command-line
-			// args.
-			MaxUploadBytesPerSecond:   900 * 1024,
-			MaxDownloadBytesPerSecond: 5 * 1024 * 1024,
-		})
 	}
-	return storage.NewDisk(path)
+	openedStorage = nil
+}
+
+// configureStorage sets the options for the storage backends that bk
+// provides for URLs from the environment variables that specify them.
+func configureStorage() {
+	var listings string
+	if dir := os.Getenv("BK_CACHE_DIR"); dir != "" {
+		listings = filepath.Join(dir, "listings")
+	}
+	storage.SetHTTPOptions(storage.HTTPOptions{Token: os.Getenv("BK_TOKEN"),
+		CacheDir: listings})
+	storage.SetGCSOptions(storage.GCSOptions{
+		ProjectId: os.Getenv("BK_GCS_PROJECT_ID"),
+		// TODO: make it possible to specify these via command-line
+		// args.
+		MaxUploadBytesPerSecond:   900 * 1024,
+		MaxDownloadBytesPerSecond: 5 * 1024 * 1024,
+		CacheDir:                  listings,
+	})
 }
 
 func GetStorageBackend() storage.Backend {
 	backend := getBaseBackend()
+	useRepositoryHash(backend)
+	opts := cacheOptions()
 	if backend.MetadataExists("encrypt.txt") {
 		passphrase := os.Getenv("BK_PASSPHRASE")
 		if passphrase == "" {
 			Error("BK_PASSPHRASE environment variable not set.\n")
 		}
+		// Chunks are cached on disk before they're decrypted so that
+		// the cache doesn't hold the repository's contents in the
+		// clear.
+		if opts.Dir != "" {
+			backend = storage.NewCached(backend, storage.CacheOptions{Dir: opts.Dir,
+				DiskBytes: opts.DiskBytes})
+			opts.Dir = ""
+		}
 		backend = storage.NewEncrypted(backend, passphrase)
 	}
 	backend = storage.NewCompressed(backend)
+	if storage.RepositoryDelta(backend) {
+		backend = storage.NewDelta(backend)
+	}
+	if opts.MemoryBytes != 0 || opts.Dir != "" {
+		backend = storage.NewCached(backend, opts)
+	}
 
 	if !backend.MetadataExists("readme_bk.txt") {
 		Error("%s: destination hasn't been initialized. Run 'bk init'.\n",
 			backend.String())
 	}
+	checkFormat(backend)
+	// Cached listings of buckets are only used once older versions of bk,
+	// which don't record changes to them, can't modify the repository.
+	if os.Getenv("BK_CACHE_DIR") != "" && strings.HasPrefix(os.Getenv("BK_DIR"), "gs://") {
+		storage.RequireFormat(backend, 9)
+	}
 
 	return backend
 }
 
+// cacheOptions returns the options for caching the chunks read from the
+// repository, as specified by BK_CACHE_MB, BK_CACHE_DIR, and
+// BK_CACHE_DIR_MB.
+func cacheOptions() storage.CacheOptions {
+	mb := func(env string, def int64) int64 {
+		v := os.Getenv(env)
+		if v == "" {
+			return def
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			Error("%s: %s: expected a non-negative number of megabytes\n", env, v)
+		}
+		return n
+	}
+	return storage.CacheOptions{
+		MemoryBytes: mb("BK_CACHE_MB", 64) << 20,
+		Dir:         os.Getenv("BK_CACHE_DIR"),
+		DiskBytes:   mb("BK_CACHE_DIR_MB", 1024) << 20,
+		// Enough to keep a high-latency connection busy.
+		PrefetchJobs: 8,
+	}
+}
+
+// fileCacheRepository returns the string that identifies the given
+// repository in BK_DIR in the names of file caches: its identifier, if it
+// has one, or else its absolute path, so that caches for different
+// repositories aren't confused when BK_DIR is relative.
+func fileCacheRepository(backend storage.Backend) string {
+	if id := storage.RepositoryID(backend); id != "" {
+		return "id:" + id
+	}
+	path := os.Getenv("BK_DIR")
+	if !strings.Contains(path, "://") {
+		abs, err := filepath.Abs(path)
+		log.CheckError(err)
+		path = abs
+	}
+	return path
+}
+
+// Layouts accepted for the dates and times in "name@date" selectors,
+// along with the precision of each one.
+var selectorTimeLayouts = []struct {
+	layout    string
+	precision time.Duration
+}{
+	{"2006-01-02", 24 * time.Hour},
+	{"2006-01-02T15:04", time.Minute},
+	{"2006-01-02T15:04:05", time.Second},
+}
+
+// Layouts of the timestamps in the names of backups and bitstreams that
+// snapshotTime recognizes. The first is the default, in local time; the
+// second is used with --utc and for timestamps with other offsets.
+var snapshotTimeLayouts = []string{"20060102150405", "20060102150405Z0700"}
+
+// snapshotTime returns the time that the backup or bitstream with the
+// given full metadata name was made. The timestamp in the name is used if
+// possible, since the metadata's creation time changes if the snapshot is
+// renamed or copied to another repository.
+func snapshotTime(name string, created time.Time) time.Time {
+	if i := strings.LastIndex(name, "@"); i != -1 {
+		for _, l := range snapshotTimeLayouts {
+			if t, err := time.ParseInLocation(l, name[i+1:], time.Local); err == nil {
+				return t
+			}
+		}
+	}
+	return created
+}
+
+// snapshotNamer holds the command-line flags that control the timestamps
+// appended to the names of new backups and bitstreams.
+type snapshotNamer struct {
+	exact     *bool
+	utc       *bool
+	format    *string
+	timestamp *string
+}
+
+func addSnapshotNameFlags(flags *flag.FlagSet) *snapshotNamer {
+	return &snapshotNamer{
+		exact: flags.Bool("exact-name", false,
+			"use the name as given, without a timestamp, replacing any existing one"),
+		utc: flags.Bool("utc", false,
+			"use UTC for the timestamp in the name, rather than local time"),
+		format: flags.String("time-format", "",
+			"Go time layout for the timestamp in the name (default \"20060102150405\")"),
+		timestamp: flags.String("timestamp", "",
+			"RFC 3339 time to record rather than the current time"),
+	}
+}
+
+// Name returns the full name, without the "backup-" or "bits-" prefix,
+// for a new snapshot with the given name that was started at the given
+// time, along with the time that it's to be recorded as having been made;
+// they're different if --timestamp was given. Invalid flags are an error.
+func (n *snapshotNamer) Name(name string, start time.Time) (string, time.Time) {
+	if strings.Contains(name, clientSeparator) {
+		Error("%s: names can't include '%s', which separates the client name\n",
+			name, clientSeparator)
+	}
+	t := start
+	if *n.timestamp != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339, *n.timestamp); err != nil {
+			Error("--timestamp: %s\n", err)
+		}
+	}
+	if *n.exact {
+		if *n.utc || *n.format != "" {
+			Error("--utc and --time-format can't be used with --exact-name\n")
+		}
+		if strings.ContainsAny(name, "@~") {
+			Error("%s: names given with --exact-name can't include '@' or '~'\n", name)
+		}
+		return qualifySnapshotName(name), t
+	}
+	layout := *n.format
+	if *n.utc {
+		t = t.UTC()
+		if layout == "" {
+			layout = snapshotTimeLayouts[1]
+		}
+	} else {
+		t = t.Local()
+		if layout == "" {
+			layout = snapshotTimeLayouts[0]
+		}
+	}
+
+	ts := t.Format(layout)
+	if ts == "" || strings.ContainsAny(ts, "@:/\\~ \t\n") {
+		Error("--time-format: %s: timestamps must be non-empty and can't include "+
+			"spaces or any of \"@:/\\~\" (formats as %q)\n", layout, ts)
+	}
+	full := qualifySnapshotName(name) + "@" + ts
+	if !snapshotTime(full, time.Time{}).Equal(t.Truncate(time.Second)) {
+		log.Warning("--time-format: %s: bk can't determine the time from timestamps in "+
+			"this format, so it uses the time that the snapshot was saved to the repository",
+			layout)
+	}
+	return full, t
+}
+
+// CheckExisting should be called before a new snapshot with the given
+// full metadata name is made. It's a fatal error if there's already one
+// with that name, unless --exact-name was given, in which case it will be
+// replaced by writeSnapshot, as long as it isn't pinned. In that case,
+// a warning is issued if it's the base of incremental backups, and the
+// existing snapshot's metadata is returned, to be passed to
+// writeSnapshot; otherwise, nil is.
+func (n *snapshotNamer) CheckExisting(name string, backend storage.Backend) []byte {
+	if !backend.MetadataExists(name) {
+		return nil
+	}
+	_, rest := splitSnapshotPrefix(name)
+	if !*n.exact {
+		log.Fatal("%s: a snapshot with this name already exists", rest)
+	}
+	if pinnedSnapshots(backend)[name] {
+		log.Fatal("%s: can't be replaced since it's pinned; run \"bk unpin\" first", rest)
+	}
+	if strings.HasPrefix(name, "backup-") {
+		warnDependents(backend, []string{name}, "being replaced")
+	}
+	log.Verbose("%s: will be replaced", rest)
+	return backend.ReadMetadata(name)
+}
+
+// writeSnapshot saves the metadata for the backup or bitstream with the
+// given full metadata name. If old is nil, there must not already be one
+// with that name; otherwise, the existing one, which must still have the
+// contents old, is replaced, as with --exact-name. (The replacement is
+// atomic; repositories in storage that can't do that, such as helper
+// programs, can't have snapshots replaced.) It's a fatal error if another
+// run of bk has saved or replaced a snapshot with the name since this one
+// started, so that concurrent runs never silently replace each other's
+// snapshots.
+func writeSnapshot(name string, old, contents []byte, backend storage.Backend) {
+	// The owner is recorded first so that the snapshot never appears
+	// without it.
+	recordOwner(name, backend)
+	var err error
+	if old == nil {
+		err = backend.CreateMetadata(name, contents)
+	} else {
+		err = backend.ReplaceMetadata(name, old, contents)
+	}
+	_, rest := splitSnapshotPrefix(name)
+	switch err {
+	case nil:
+	case storage.ErrMetadataExists, storage.ErrMetadataChanged:
+		log.Fatal("%s: another run of bk saved a snapshot with this name first; the "+
+			"data that was backed up is stored, but it isn't saved under any name", rest)
+	default:
+		log.Fatal("%s: %s", rest, err)
+	}
+}
+
+// backupCreated returns when the backup with the given full metadata name
+// and root was made. Deterministic backups don't record the time in their
+// roots, so the time in their names is used.
+func backupCreated(name string, root backup.BackupRoot, backend storage.Backend) time.Time {
+	if !root.Time.IsZero() {
+		return root.Time
+	}
+	return snapshotTime(name, backend.ListMetadata()[name])
+}
+
+// getLatest returns the full metadata name of the backup or bitstream
+// selected by the given name, which includes the "backup-" or "bits-"
+// prefix. The name may be a full name, including its timestamp, or one
+// of the following, where "foo" is the name that was given when the
+// backups were made:
+//   - "foo" or "foo:latest": the most recent one
+//   - "foo~n": the one n before the most recent one
+//   - "foo@2006-01-02", "foo@2006-01-02T15:04", or "foo@2006-01-02T15:04:05":
+//     the most recent one made at or before the given local time; a date
+//     alone refers to the end of that day.
+//
+// If a client name is set, names that don't specify a client refer to the
+// current client's snapshots first.
 func getLatest(name string, backend storage.Backend) (string, error) {
+	prefix, rest := splitSnapshotPrefix(name)
+	if prefix != "" {
+		if q := qualifySnapshotName(rest); q != rest {
+			if n, err := getLatestName(prefix+q, backend); err == nil {
+				return n, nil
+			}
+		}
+	}
+	n, err := getLatestName(name, backend)
+	if err != nil && prefix == "backup-" && isShortID(rest) {
+		return lookupShortID(rest, backend)
+	}
+	return n, err
+}
+
+// Backups are also identified by the first few hex digits of the hash of
+// their BackupRoot, as with git commits. Names take precedence over IDs
+// that happen to be the same.
+const (
+	shortIDLength    = 8
+	minShortIDLength = 4
+)
+
+// shortID returns the ID printed for the backup with the given root hash.
+func shortID(hash storage.Hash) string {
+	return hash.String()[:shortIDLength]
+}
+
+// isShortID reports whether the given string could be a prefix of a
+// backup's ID.
+func isShortID(s string) bool {
+	if len(s) < minShortIDLength || len(s) > 2*len(storage.Hash{}) {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupShortID returns the full metadata name of the backup whose root
+// hash starts with the given hex digits. If several names refer to the
+// same backup, the first one in sorted order is returned.
+func lookupShortID(id string, backend storage.Backend) (string, error) {
+	var names []string
+	backend.ForMetadata("backup-", func(name string, created time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+	sort.Strings(names)
+
+	contents := backend.ReadMetadataBatch(names)
+	match := ""
+	var matchHash storage.Hash
+	for _, name := range names {
+		hash := storage.NewHash(contents[name])
+		if !strings.HasPrefix(hash.String(), id) {
+			continue
+		}
+		if match != "" && hash != matchHash {
+			return "", fmt.Errorf("%s: ID matches more than one backup, including %s and %s",
+				id, strings.TrimPrefix(match, "backup-"), strings.TrimPrefix(name, "backup-"))
+		}
+		if match == "" {
+			match, matchHash = name, hash
+		}
+	}
+	if match == "" {
+		return "", errors.New("metadata not found")
+	}
+	return match, nil
+}
+
+func getLatestName(name string, backend storage.Backend) (string, error) {
 	if backend.MetadataExists(name) {
 		return name, nil
-	} else if !strings.Contains(name, "@") {
-		// Find the most recent instance with this name.
-		var latestName string
-		var latestTime time.Time
-		for n, t := range backend.ListMetadata() {
-			if strings.HasPrefix(n, name) && t.After(latestTime) {
-				latestName = n
-				latestTime = t
+	}
+
+	base, skip := name, 0
+	var before time.Time
+	if i := strings.LastIndex(name, "~"); i != -1 {
+		n, err := strconv.Atoi(name[i+1:])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("%s: invalid count after \"~\"", name[i+1:])
+		}
+		base, skip = name[:i], n
+	} else if strings.HasSuffix(name, ":latest") {
+		base = strings.TrimSuffix(name, ":latest")
+	} else if i := strings.Index(name, "@"); i != -1 {
+		base = name[:i]
+		for _, l := range selectorTimeLayouts {
+			if t, err := time.ParseInLocation(l.layout, name[i+1:], time.Local); err == nil {
+				before = t.Add(l.precision)
+				break
 			}
 		}
-		if latestName != "" {
-			return latestName, nil
+		if before.IsZero() {
+			return "", errors.New("metadata not found")
 		}
 	}
 
+	// Find the instances with this name, most recent first.
+	type instance struct {
+		name string
+		time time.Time
+	}
+	var matches []instance
+	backend.ForMetadata(base+"@", func(n string, t time.Time) error {
+		t = snapshotTime(n, t)
+		if before.IsZero() || t.Before(before) {
+			matches = append(matches, instance{n, t})
+		}
+		return nil
+	})
+	sort.Slice(matches, func(i, j int) bool { return matches[i].time.After(matches[j].time) })
+	if skip < len(matches) {
+		return matches[skip].name, nil
+	}
 	return "", errors.New("metadata not found")
 }
 
@@ -196,93 +1345,162 @@ func main() {
 
 	debug := false
 	verbose := false
-	profile := false
-	memprofile := false
+	noColor := false
+	syslogTag := ""
+	verifyReads = os.Getenv("BK_VERIFY_READS") != ""
 	idx := 1
-	for os.Args[idx][0] == '-' {
-		switch os.Args[idx] {
+	for idx < len(os.Args) && strings.HasPrefix(os.Args[idx], "-") {
+		// Profiling flags may optionally be given as --flag=path to
+		// specify where the profile is written.
+		arg, value := os.Args[idx], ""
+		if i := strings.Index(arg, "="); i != -1 {
+			arg, value = arg[:i], arg[i+1:]
+		}
+		orDefault := func(def string) string {
+			if value != "" {
+				return value
+			}
+			return def
+		}
+
+		switch arg {
 		case "--debug":
 			debug = true
 			verbose = true
-			idx++
 		case "--verbose":
 			verbose = true
-			idx++
+		case "--verify-reads":
+			verifyReads = true
+		case "--fast-sync":
+			storage.SetFastSync(true)
+		case "--no-color":
+			noColor = true
+		case "--syslog":
+			syslogTag = orDefault("bk")
 		case "--memprofile":
-			memprofile = true
-			idx++
+			profiling.mem = orDefault("bk.memprof")
+		case "--blockprofile":
+			profiling.block = orDefault("bk.blockprof")
+		case "--mutexprofile":
+			profiling.mutex = orDefault("bk.mutexprof")
 		case "--profile":
-			profile = true
-			idx++
+			profiling.cpu = orDefault("bk.prof")
+		case "--trace":
+			profiling.trace = orDefault("bk.trace")
+		case "--pprof-addr":
+			profiling.addr = orDefault("localhost:6060")
 		default:
 			usage()
 		}
+		idx++
+	}
+	if idx == len(os.Args) {
+		usage()
 	}
 	log = u.NewLogger(verbose, debug)
+	if syslogTag != "" {
+		if err := log.EnableSyslog(syslogTag); err != nil {
+			Error("syslog: %s\n", err)
+		}
+	}
 	storage.SetLogger(log)
+	backup.SetLogger(log)
+	initOutput(noColor)
+	loadConfig()
+	if err := checkClientName(currentClient()); err != nil {
+		Error("%s\n", err)
+	}
 
 	cmd := os.Args[idx]
 	idx++
 
-	if profile {
-		log.Print("Starting profiling.")
-		f, err := os.Create("bk.prof")
-		log.CheckError(err)
-		pprof.StartCPUProfile(f)
-
-		go func() {
-			sigchan := make(chan os.Signal, 10)
-			signal.Notify(sigchan, os.Interrupt)
-			<-sigchan
-			pprof.StopCPUProfile()
-			os.Exit(0)
-		}()
-	} else if memprofile {
-		go func() {
-			log.Print("Will write memory profile when SIGINT is received.")
-			sigchan := make(chan os.Signal, 10)
-			signal.Notify(sigchan, os.Interrupt)
-			<-sigchan
-			f, err := os.Create("bk.memprof")
-			if err != nil {
-				log.Fatal("%s", err)
-			}
-			pprof.WriteHeapProfile(f)
-			os.Exit(0)
-		}()
-	}
+	startProfiling()
 
 	// Dispatch to the appropriate command.
 	switch cmd {
 	case "help":
 		help()
+	case "api":
+		api(os.Args[idx:])
 	case "backup":
-		backup(os.Args[idx:])
+		backupcmd(os.Args[idx:])
+	case "browse":
+		browse(os.Args[idx:])
 	case "cat":
 		cat(os.Args[idx:])
+	case "chain":
+		chain(os.Args[idx:])
+	case "compare":
+		compare(os.Args[idx:])
+	case "debug":
+		debugcmd(os.Args[idx:])
+	case "du":
+		du(os.Args[idx:])
+	case "dups":
+		dups(os.Args[idx:])
+	case "estimate":
+		estimate(os.Args[idx:])
+	case "forget":
+		forget(os.Args[idx:])
 	case "fsck":
 		fsck(os.Args[idx:])
+	case "gc":
+		gc(os.Args[idx:])
+	case "history":
+		history(os.Args[idx:])
+	case "index":
+		indexcmd(os.Args[idx:])
+	case "info":
+		info(os.Args[idx:])
 	case "init":
 		initcmd(os.Args[idx:])
 	case "list":
 		list(os.Args[idx:])
+	case "ls":
+		ls(os.Args[idx:])
+	case "migrate":
+		migrate(os.Args[idx:])
+	case "mirror":
+		mirror(os.Args[idx:])
 	case "mount":
 		mount(os.Args[idx:])
+	case "pin":
+		pin(os.Args[idx:], true)
+	case "quota":
+		quota(os.Args[idx:])
+	case "rekey":
+		rekey(os.Args[idx:])
+	case "rename":
+		rename(os.Args[idx:])
 	case "restore":
 		restore(os.Args[idx:])
 	case "restorebits":
 		restorebits(os.Args[idx:])
 	case "savebits":
 		savebits(os.Args[idx:])
+	case "scrub":
+		scrub(os.Args[idx:])
+	case "selftest":
+		selftest(os.Args[idx:])
+	case "serve":
+		serve(os.Args[idx:])
+	case "unpin":
+		pin(os.Args[idx:], false)
+	case "upgrade":
+		upgrade(os.Args[idx:])
+	case "watch":
+		watch(os.Args[idx:])
 	default:
 		usage()
 	}
 
-	if profile {
-		pprof.StopCPUProfile()
-	}
+	closeStorage()
+	stopProfiling()
 
-	os.Exit(log.NErrors)
+	if log.NErrors > 0 {
+		os.Exit(errorExitStatus)
+	}
+	os.Exit(0)
 }
 
 ///////////////////////////////////////////////////////////////////////////
@@ -304,59 +1522,333 @@ func (s *stringSlice) Set(value string) error {
 	return nil
 }
 
-func backup(args []string) {
+func api(args []string) {
+	flags := flag.NewFlagSet("api", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk api [--listen address]\n")
+	}
+	listen := flags.String("listen", "localhost:8467", "address to serve the API at")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	serveAPI(*listen, os.Getenv("BK_API_TOKEN"))
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk serve [--listen address] [--cert file --key file]\n")
+	}
+	listen := flags.String("listen", "localhost:8468", "address to serve the repository at")
+	cert := flags.String("cert", "", "TLS certificate file, to serve over HTTPS")
+	key := flags.String("key", "", "TLS private key file for --cert")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if (*cert == "") != (*key == "") {
+		Error("--cert and --key must be given together\n")
+	}
+
+	dir := os.Getenv("BK_DIR")
+	if dir == "" {
+		Error("BK_DIR: environment variable not set.\n")
+	} else if strings.Contains(dir, "://") {
+		Error("%s: only repositories in local directories can be served.\n", dir)
+	}
+
+	tokens := make(map[string]storage.HTTPToken)
+	for _, t := range config.Tokens {
+		// The roles were checked when the configuration was loaded.
+		role, _ := storage.ParseRole(t.Role)
+		tokens[t.Token] = storage.HTTPToken{Role: role,
+			CheckMetadata: checkClientMetadata(t.Client)}
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		Error("%s: %s\n", *listen, err)
+	}
+	if !ln.Addr().(*net.TCPAddr).IP.IsLoopback() {
+		if len(tokens) == 0 {
+			log.Warning("%s: serving the repository without authentication; "+
+				"add access tokens to the configuration file", ln.Addr())
+		}
+		if *cert == "" {
+			log.Warning("%s: serving the repository without TLS; access tokens "+
+				"are sent unencrypted (use --cert and --key)", ln.Addr())
+		}
+	}
+	h := storage.NewHTTPHandler(dir, tokens)
+	if *cert != "" {
+		log.Print("serving %s at https://%s", dir, ln.Addr())
+		log.CheckError(http.ServeTLS(ln, h, *cert, *key))
+	} else {
+		log.Print("serving %s at http://%s", dir, ln.Addr())
+		log.CheckError(http.Serve(ln, h))
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func backupcmd(args []string) {
 	// Parse args
 	flags := flag.NewFlagSet("backup", flag.ExitOnError)
 	flags.Usage = func() {
-		Error("usage: bk backup [--base name] [--split-bits count] [--exclude name] <name> <dir>\n")
+		Error("usage: bk backup [--base name] [--split-bits count] [--exclude name]\n\t[--exclude-if-present name] [--exclude-nodump] [--no-file-cache] [--deterministic] [--snapshot btrfs|zfs]\n\t[--lvm-snapshot vg/lv:size] [--exact-name] [--utc] [--time-format layout] [--timestamp time] [--metrics-file path] [--summary-file path] [--notify-url url] [--notify-fail-url url] <name> <dir> [<dir> ...]\n" +
+			"       bk backup [options] --from ssh://[user@]host[:port]/path <name>\n")
 	}
 	base := flags.String("base", "", "base backup (for incremental backups)")
+	from := flags.String("from", "", "ssh:// URL of a directory on another machine to back up")
+	report := addRunReporterFlags(flags)
+	namer := addSnapshotNameFlags(flags)
 	splitBits := flags.Uint("split-bits", 14,
 		"matching bits for rolling checksum")
 	var excludedPaths stringSlice
 	flags.Var(&excludedPaths, "exclude", "Paths to exclude from backups")
+	var markers stringSlice
+	flags.Var(&markers, "exclude-if-present",
+		"Exclude directories that contain a file with this name")
+	noDump := flags.Bool("exclude-nodump", false,
+		"Exclude files and directories with the nodump attribute")
+	noCache := flags.Bool("no-file-cache", false,
+		"read all files, rather than skipping ones that the file cache reports as unchanged")
+	deterministic := flags.Bool("deterministic", false,
+		"make the backup identical to ones of identical copies of the directory made elsewhere")
+	snapshot := flags.String("snapshot", "",
+		"back up from a read-only snapshot of the directory (\"btrfs\" or \"zfs\")")
+	lvmSnapshot := flags.String("lvm-snapshot", "",
+		"back up from a read-only snapshot of the LVM volume the directory is on (\"vg/lv:size\")")
 	err := flags.Parse(args)
-	if err == flag.ErrHelp || flags.NArg() != 2 {
+	if err == flag.ErrHelp || (*from == "" && flags.NArg() < 2) ||
+		(*from != "" && flags.NArg() != 1) {
 		flags.Usage()
 	} else if err != nil {
 		Error("%s\n", err)
 	}
+	if *noDump && *from != "" {
+		Error("--exclude-nodump can't be used with --from\n")
+	}
+	if *snapshot != "" && *lvmSnapshot != "" {
+		Error("only one of --snapshot and --lvm-snapshot may be given\n")
+	}
+	if (*snapshot != "" || *lvmSnapshot != "") && (*from != "" || flags.NArg() != 2) {
+		Error("snapshots can only be used to back up a single local directory\n")
+	}
 
+	start := time.Now()
+	name, created := namer.Name(flags.Arg(0), start)
+	report.Begin("backup", flags.Arg(0), name, start)
 	backend := GetStorageBackend()
-	name := flags.Arg(0) + "@" + time.Now().Format("20060102150405")
+	report.backend = backend
 	dir := flags.Arg(1)
+	dirs := flags.Args()[1:]
+
+	old := namer.CheckExisting("backup-"+name, backend)
+
+	if *deterministic {
+		if *base != "" {
+			Error("--base can't be used with --deterministic\n")
+		}
+		if backend.MetadataExists("encrypt.txt") {
+			Error("--deterministic: %s: backups in encrypted repositories can't be "+
+				"deterministic, since each chunk is encrypted differently\n", backend.String())
+		}
+		if storage.RepositoryDelta(backend) {
+			Error("--deterministic: %s: backups in repositories that store deltas "+
+				"can't be deterministic, since which chunks are deltas depends on "+
+				"what's already stored\n", backend.String())
+		}
+		*noCache = true
+	}
+
+	opts := backup.BackupOptions{SplitBits: *splitBits, ExcludedPaths: excludedPaths,
+		ExcludeIfPresent: markers, ExcludeNoDump: *noDump, StreamDirEntries: true, Deterministic: *deterministic,
+		Time: created}
+	if *from != "" {
+		src, remoteDir, err := newSSHSource(*from)
+		if err != nil {
+			log.Fatal("%s", err)
+		}
+		defer src.Close()
+		opts.Source = src
+		dir = remoteDir
+		dirs = []string{remoteDir}
+	}
+	if !*noCache {
+		cacheDir := dir
+		if *from != "" {
+			cacheDir = *from
+		} else if len(dirs) > 1 {
+			// Directories that are backed up together share a cache.
+			var abs []string
+			for _, d := range dirs {
+				a, err := filepath.Abs(d)
+				log.CheckError(err)
+				abs = append(abs, a)
+			}
+			sort.Strings(abs)
+			cacheDir = strings.Join(abs, string(filepath.ListSeparator))
+		}
+		opts.Cache = backup.OpenFileCache(fileCacheRepository(backend), cacheDir)
+	}
 
-	log.Check(!backend.MetadataExists("backup-" + name))
+	// The estimate requires scanning the directories, so checkQuota only
+	// asks for it if the repository is getting close to its quota.
+	var estimate func() int64
+	if *from == "" {
+		estimate = func() int64 {
+			var n int64
+			for _, d := range dirs {
+				n += estimateBackup(d, opts).ChangedBytes
+			}
+			return n
+		}
+	}
+	checkQuota(backend, estimate)
 
-	var hash storage.Hash
 	if *base != "" {
 		*base, err = getLatest("backup-"+*base, backend)
 		if err != nil {
 			Error("--base: %s\n", err)
 		}
-		baseHash := lookupHash(*base, backend)
-		hash, err = BackupDirIncremental(dir, baseHash, backend, *splitBits, excludedPaths)
-		log.CheckError(err)
-	} else {
-		hash, err = BackupDir(dir, backend, *splitBits, excludedPaths)
-		log.CheckError(err)
+		opts.Base = lookupHash(*base, backend)
+	}
+	var snap *fsSnapshot
+	if *snapshot != "" {
+		if snap, err = createFSSnapshot(*snapshot, dir); err != nil {
+			log.Fatal("--snapshot: %s", err)
+		}
+	} else if *lvmSnapshot != "" {
+		if snap, err = createLVMSnapshot(*lvmSnapshot, dir); err != nil {
+			log.Fatal("--lvm-snapshot: %s", err)
+		}
+	}
+	bctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if snap != nil {
+		snap.RemoveOnExit(cancel)
+		log.Verbose("%s: backing up from snapshot %s", dir, snap.path)
+		// Paths in the directory that are excluded are excluded from its
+		// copy in the snapshot as well.
+		for _, e := range opts.ExcludedPaths {
+			if p := snap.Path(filepath.Clean(e)); filepath.IsAbs(e) && p != filepath.Clean(e) {
+				opts.ExcludedPaths = append(opts.ExcludedPaths, p)
+			}
+		}
+		// The files' paths in the snapshot differ from run to run with
+		// LVM, so they're recorded in the file cache with their paths in
+		// the directory. (The snapshots preserve files' inode numbers and
+		// status change times, so the cache's entries still match them.)
+		opts.Cache.MapPaths(snap.path, snap.dir)
+		dirs = []string{snap.path}
+	}
+	result, err := backup.BackupPaths(bctx, dirs, backend, opts)
+	if err != nil {
+		log.Fatal("%s: %s", name, err)
 	}
+	if snap != nil {
+		snap.Remove()
+		if bctx.Err() != nil {
+			// It was interrupted just as the backup finished.
+			log.Fatal("%s: interrupted; not saving the backup", name)
+		}
+	}
+	hash := result.Hash
 
 	// Get all of the data on disk before we save the named hash.
 	backend.SyncWrites()
 
-	backend.WriteMetadata("backup-"+name, hash[:])
+	// The backup is only signed once it's been saved, so that a run that
+	// loses a race to save a backup with the same name never touches the
+	// winner's signature. Until then, the backup is seen as unsigned.
+	writeSnapshot("backup-"+name, old, hash[:], backend)
+	backend.SyncWrites()
+	updateSignature("backup-"+name, hash, backend)
 	backend.SyncWrites()
 
 	log.Print("%s: successfully saved backup: %s", name, hash)
+	warnQuota(backend)
+	if n := len(result.Errors); n > 0 {
+		log.Warning("%s: %d files or directories couldn't be backed up; "+
+			"run \"bk info %s\" for details", name, n, name)
+		if n == log.NErrors {
+			errorExitStatus = skippedFilesExitStatus
+		}
+	}
+	if n := len(result.ModifiedFiles); n > 0 {
+		log.Warning("%s: %d files were modified while being backed up and may be "+
+			"inconsistent", name, n)
+	}
 	backend.LogStats()
+	report.summary.ModifiedFiles = result.ModifiedFiles
+	report.summary.Files = result.Files
+	report.summary.NewFiles = result.NewFiles
+	report.summary.ChangedFiles = result.ChangedFiles
+	report.summary.BytesRead = result.BytesRead
+
+	// Only update the file cache once we know that everything it refers
+	// to has landed in storage.
+	opts.Cache.Save()
+	report.End()
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func browse(args []string) {
+	flags := flag.NewFlagSet("browse", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk browse [--jobs n] [name]\n")
+	}
+	jobs := flags.Int("jobs", 16, "number of files to restore concurrently")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() > 1 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	backend := GetStorageBackend()
+	if err := browseBackups(backend, flags.Arg(0), *jobs); err != nil {
+		log.Fatal("%s", err)
+	}
 }
 
 ///////////////////////////////////////////////////////////////////////////
 
 func cat(args []string) {
-	if len(args) == 0 {
-		Error("usage: bk cat <hash ...>\n")
+	flags := flag.NewFlagSet("cat", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk cat <hash ...>\n" +
+			"       bk cat [--offset n] [--length n] <backup name> <path>\n")
+	}
+	offset := flags.Int64("offset", 0, "offset of the first byte to print")
+	length := flags.Int64("length", -1, "number of bytes to print (-1 for all)")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() == 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	args = flags.Args()
+
+	// Arguments that aren't hashes give a file in a backup.
+	if h, err := hex.DecodeString(args[0]); err != nil || len(h) != storage.HashSize {
+		if len(args) != 2 {
+			flags.Usage()
+		}
+		catFile(args[0], args[1], *offset, *length)
+		return
+	} else if *offset != 0 || *length != -1 {
+		Error("--offset and --length can only be used with files in backups\n")
 	}
 
 	backend := GetStorageBackend()
@@ -387,62 +1879,515 @@ func cat(args []string) {
 	backend.LogStats()
 }
 
-///////////////////////////////////////////////////////////////////////////
-
-func fsck(args []string) {
-	if len(args) != 0 {
-		Error("usage: bk fsck <bk dir>\n")
+// catFile prints the given range of the file at the given path in the most
+// recent backup with the given name.
+func catFile(backupName, path string, offset, length int64) {
+	if offset < 0 {
+		Error("%d: --offset must not be negative\n", offset)
 	}
 
 	backend := GetStorageBackend()
-
-	for name := range backend.ListMetadata() {
-		if strings.HasPrefix(name, "bits-") {
-			log.Debug("Checking %s", name)
-			b := backend.ReadMetadata(name)
-			sh := storage.NewMerkleHash(b)
-			sh.Fsck(backend)
-		} else if strings.HasPrefix(name, "backup-") {
-			h := lookupHash(name, backend)
-			log.Debug("Checking %s. Hash %s", name, h)
-			r, err := NewBackupReader(h, backend)
-			if err != nil {
-				log.Error("%s\n", err)
-			}
-			r.Fsck()
-		}
+	name, err := getLatest("backup-"+backupName, backend)
+	if err != nil {
+		Error("%s: %s\n", backupName, err)
+	}
+	br, err := backup.NewBackupReader(lookupHash(name, backend), backend)
+	if err != nil {
+		Error("%s: %s\n", name, err)
+	}
+	r, err := br.ReadFileRange(path, offset, length)
+	if err != nil {
+		Error("%s: %s\n", path, err)
 	}
+	_, err = io.Copy(os.Stdout, r)
+	log.CheckError(err)
+	log.CheckError(r.Close())
 
-	// Let the storage do its thing.
-	backend.Fsck()
+	backend.LogStats()
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+// Colors used for each kind of difference reported by "compare".
+var compareColors = map[byte]string{'A': colorGreen, 'D': colorRed, 'T': colorMagenta,
+	'M': colorYellow, 'm': colorYellow}
+
+func compare(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk compare [--contents] [--exclude name] <name> <dir>\n")
+	}
+	contents := flags.Bool("contents", false,
+		"compare the contents of all files, not just ones whose size or modification time differ")
+	var excludedPaths stringSlice
+	flags.Var(&excludedPaths, "exclude", "Paths to ignore in the filesystem")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 2 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	backend := GetStorageBackend()
+	name, err := getLatest("backup-"+flags.Arg(0), backend)
+	if err != nil {
+		Error("%s: %s\n", flags.Arg(0), err)
+	}
+
+	r, err := backup.NewBackupReader(lookupHash(name, backend), backend)
+	if err != nil {
+		Error("%s: %s\n", name, err)
+	}
+
+	ndiffs := 0
+	err = r.Compare("/", flags.Arg(1), *contents, excludedPaths,
+		func(kind byte, path, detail string) {
+			ndiffs++
+			if humanOutput {
+				path = colored(path, compareColors[kind])
+			}
+			if detail != "" {
+				fmt.Printf("%c %s (%s)\n", kind, path, detail)
+			} else {
+				fmt.Printf("%c %s\n", kind, path)
+			}
+		})
+	if err != nil {
+		Error("%s\n", err)
+	}
+
+	if ndiffs > 0 && log.NErrors == 0 {
+		// As with diff(1), exit with status 1 if there were differences.
+		os.Exit(1)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func du(args []string) {
+	backend := GetStorageBackend()
+	var selected []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			Error("usage: bk du [<backup or bits name> ...]\n")
+		}
+		name, err := resolveSnapshot(arg, backend)
+		if err != nil {
+			Error("%s: %s\n", arg, err)
+		}
+		selected = append(selected, name)
+	}
+
+	usage := diskUsage(backend)
+
+	t := newTable(1, 2, 3)
+	if humanOutput {
+		t.add(colored("Name", colorBold), colored("Size", colorBold),
+			colored("Unique", colorBold), colored("Shared", colorBold))
+	}
+	for _, s := range usage.Snapshots {
+		size := "-"
+		if s.Size >= 0 {
+			size = u.FmtBytes(s.Size)
+		}
+		t.add(s.Name, size, u.FmtBytes(s.Unique), u.FmtBytes(s.Shared))
+	}
+	if humanOutput {
+		t.print(os.Stdout, "")
+	} else {
+		fmt.Printf("%-40s %12s %12s %12s\n", "Name", "Size", "Unique", "Shared")
+		for _, row := range t.rows {
+			fmt.Printf("%-40s %12s %12s %12s\n", row[0], row[1], row[2], row[3])
+		}
+	}
+	fmt.Printf("Total stored: %s referenced, %s unreferenced\n",
+		u.FmtBytes(usage.Referenced), u.FmtBytes(usage.Unreferenced))
+	if len(selected) > 0 {
+		fmt.Printf("Removing the %d given would free %s\n", len(selected),
+			u.FmtBytes(usage.Reclaimable(selected)))
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func dups(args []string) {
+	flags := flag.NewFlagSet("dups", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk dups [--min-size bytes] <backup name> [path]\n")
+	}
+	minSize := flags.Int64("min-size", 1, "size of the smallest files to report")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	backend := GetStorageBackend()
+	name, err := getLatest("backup-"+flags.Arg(0), backend)
+	if err != nil {
+		Error("%s: %s\n", flags.Arg(0), err)
+	}
+	r, err := backup.NewBackupReader(lookupHash(name, backend), backend)
+	if err != nil {
+		Error("%s: %s\n", name, err)
+	}
+
+	path := "/"
+	if flags.NArg() == 2 {
+		path = flags.Arg(1)
+	}
+	// Files with identical contents have the same Merkle hash, computed
+	// with the repository's hash algorithm, as long as they were split
+	// with the same --split-bits. Small files that are stored in their
+	// DirEntry are hashed here with the same algorithm; whether a file is
+	// stored that way only depends on its size, so small files are only
+	// compared with other small files.
+	type contentKey struct {
+		size int64
+		hash storage.MerkleHash
+	}
+	paths := make(map[contentKey][]string)
+	err = r.Walk(path, func(path string, e backup.DirEntry) {
+		if !e.IsFile() || e.Size == 0 || e.Size < *minSize {
+			return
+		}
+		key := contentKey{e.Size, e.Hash}
+		if e.Contents != nil {
+			key.hash = storage.MerkleFromSingle(storage.HashBytes(e.Contents))
+		}
+		paths[key] = append(paths[key], path)
+	})
+	if err != nil {
+		Error("%s\n", err)
+	}
+
+	var keys []contentKey
+	for k, p := range paths {
+		if len(p) > 1 {
+			keys = append(keys, k)
+		}
+	}
+	wasted := func(k contentKey) int64 { return k.size * int64(len(paths[k])-1) }
+	sort.Slice(keys, func(i, j int) bool {
+		if wasted(keys[i]) != wasted(keys[j]) {
+			return wasted(keys[i]) > wasted(keys[j])
+		}
+		return paths[keys[i]][0] < paths[keys[j]][0]
+	})
+
+	var total int64
+	for _, k := range keys {
+		fmt.Printf("%d files of %s (%s duplicated):\n", len(paths[k]),
+			u.FmtBytes(k.size), u.FmtBytes(wasted(k)))
+		for _, p := range paths[k] {
+			fmt.Printf("  %s\n", p)
+		}
+		total += wasted(k)
+	}
+	fmt.Printf("Total of %d sets of identical files; %s duplicated\n", len(keys),
+		u.FmtBytes(total))
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func estimate(args []string) {
+	flags := flag.NewFlagSet("estimate", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk estimate [--exclude name] [--exclude-if-present name] [--exclude-nodump] <dir>\n")
+	}
+	var excludedPaths stringSlice
+	flags.Var(&excludedPaths, "exclude", "Paths to exclude from the backup")
+	var markers stringSlice
+	flags.Var(&markers, "exclude-if-present",
+		"Exclude directories that contain a file with this name")
+	noDump := flags.Bool("exclude-nodump", false,
+		"Exclude files and directories with the nodump attribute")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 1 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	// The repository is only needed to find the file cache, so the
+	// passphrase isn't.
+	dir := flags.Arg(0)
+	cache := backup.OpenFileCache(fileCacheRepository(getBaseBackend()), dir)
+	if cache.Len() == 0 {
+		log.Warning("%s: no file cache for this directory; all files will be "+
+			"counted as new", dir)
+	}
+
+	est := estimateBackup(dir, backup.BackupOptions{ExcludedPaths: excludedPaths,
+		ExcludeIfPresent: markers, ExcludeNoDump: *noDump, Cache: cache})
+	fmt.Printf("Scanned:        %d files (%s) in %d directories\n", est.Files,
+		u.FmtBytes(est.Bytes), est.Dirs)
+	fmt.Printf("Unchanged:      %d files (%s)\n", est.UnchangedFiles,
+		u.FmtBytes(est.UnchangedBytes))
+	fmt.Printf("New or changed: %d files (%s)\n", est.ChangedFiles,
+		u.FmtBytes(est.ChangedBytes))
+	fmt.Printf("Estimated upload: at most %s, before deduplication and compression\n",
+		u.FmtBytes(est.ChangedBytes))
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk fsck [--metadata-only] [--subset n/count] [--jobs n] [--repair]\n\t[--verify-signature]\n")
+	}
+	var opts storage.FsckOptions
+	flags.BoolVar(&opts.MetadataOnly, "metadata-only", false,
+		"check the structure of backups and the existence of blobs without reading their contents")
+	subset := flags.String("subset", "", "only read and verify the n'th of count slices of the data")
+	flags.IntVar(&opts.Jobs, "jobs", 16, "number of blobs to check concurrently")
+	flags.BoolVar(&opts.Repair, "repair", false,
+		"repair corrupted files using their Reed-Solomon encodings (disk repositories only)")
+	verifySig := flags.Bool("verify-signature", false, "verify the signature of each backup")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if *subset != "" {
+		n, err := fmt.Sscanf(*subset, "%d/%d", &opts.SubsetIndex, &opts.SubsetCount)
+		if n != 2 || err != nil || opts.SubsetCount < 1 || opts.SubsetIndex < 1 ||
+			opts.SubsetIndex > opts.SubsetCount {
+			Error("%s: --subset must be of the form n/count, with 1 <= n <= count\n",
+				*subset)
+		}
+	}
+
+	backend := GetStorageBackend()
+
+	var names []string
+	for _, prefix := range []string{"bits-", "backup-"} {
+		backend.ForMetadata(prefix, func(name string, created time.Time) error {
+			names = append(names, name)
+			return nil
+		})
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		log.Verbose("Checking %s (%d of %d)", name, i+1, len(names))
+		if strings.HasPrefix(name, "bits-") {
+			bm := parseBitsMetadata(backend.ReadMetadata(name))
+			bm.Hash.Fsck(backend)
+			if bm.Index != nil {
+				bm.Index.Fsck(backend)
+			}
+		} else {
+			h := lookupHash(name, backend)
+			log.Debug("Checking %s. Hash %s", name, h)
+			if *verifySig {
+				if err := verifySignature(name, h, backend); err != nil {
+					log.Error("%s: %s", strings.TrimPrefix(name, "backup-"), err)
+				}
+			}
+			r, err := backup.NewBackupReader(h, backend)
+			if err != nil {
+				log.Error("%s: %s\n", name, err)
+				continue
+			}
+			r.Fsck(opts.Jobs, strings.TrimPrefix(name, "backup-"))
+		}
+	}
+
+	// Let the storage do its thing.
+	backend.Fsck(opts)
 
 	backend.LogStats()
 }
 
 ///////////////////////////////////////////////////////////////////////////
 
-func initcmd(args []string) {
-	if len(args) == 1 && args[0] == "--encrypt" {
-		InitStorage(true)
-	} else if len(args) == 0 {
-		InitStorage(false)
+func indexcmd(args []string) {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk index --output <file> [backup name ...]\n")
+	}
+	output := flags.String("output", "", "path of the SQLite database to write")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || *output == "" {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	backend := GetStorageBackend()
+	var names []string
+	backend.ForMetadata("backup-", func(n string, created time.Time) error {
+		if flags.NArg() == 0 {
+			names = append(names, n)
+		}
+		for _, arg := range flags.Args() {
+			if n == "backup-"+arg || strings.HasPrefix(n, "backup-"+arg+"@") {
+				names = append(names, n)
+				break
+			}
+		}
+		return nil
+	})
+	if len(names) == 0 {
+		Error("no matching backups found\n")
+	}
+
+	if err := writeCatalog(*output, names, backend); err != nil {
+		Error("%s: %s\n", *output, err)
+	}
+	log.Print("%s: wrote catalog of %d backups", *output, len(names))
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func info(args []string) {
+	if len(args) != 1 {
+		Error("usage: bk info <backup name>\n")
+	}
+
+	backend := GetStorageBackend()
+	name, err := resolveSnapshot(args[0], backend)
+	if err != nil {
+		Error("%s: %s\n", args[0], err)
+	}
+
+	if strings.HasPrefix(name, "bits-") {
+		bm := parseBitsMetadata(backend.ReadMetadata(name))
+		fmt.Printf("Name:     %s\n", strings.TrimPrefix(name, "bits-"))
+		fmt.Printf("Hash:     %s\n", bm.Hash.Hash)
+		fmt.Printf("Created:  %s\n", backend.ListMetadata()[name].Format(time.RFC1123))
+		if bm.Info == nil {
+			fmt.Printf("Saved by an older version of bk; no other information is available.\n")
+			return
+		}
+		fmt.Printf("Size:     %s (%d bytes)\n", u.FmtBytes(bm.Info.Size), bm.Info.Size)
+		fmt.Printf("Checksum: %s\n", bm.Info.Checksum)
+		if bm.Info.Compression != "" {
+			fmt.Printf("Stored:   %s-compressed, %s window\n", bm.Info.Compression,
+				u.FmtBytes(int64(bm.Info.WindowSize)))
+		}
+		fmt.Printf("Host:     %s\n", bm.Info.Host)
+		fmt.Printf("Command:  %s\n", bm.Info.CommandLine())
+		return
+	}
+
+	hash := lookupHash(name, backend)
+	root, err := backup.ReadRoot(hash, backend)
+	if err != nil {
+		Error("%s: %s\n", name, err)
+	}
+
+	fmt.Printf("Name:    %s\n", strings.TrimPrefix(name, "backup-"))
+	fmt.Printf("Hash:    %s\n", hash)
+	fmt.Printf("Created: %s\n", backupCreated(name, root, backend).Format(time.RFC1123))
+	if root.Base != (storage.Hash{}) {
+		fmt.Printf("Base:    %s\n", readBackupChains(backend).describe(root.Base))
+	}
+	if len(root.Errors) == 0 {
+		fmt.Printf("Errors:  none\n")
 	} else {
-		Error("usage: bk init [--encrypt]\n")
+		fmt.Printf("Errors:  %d paths couldn't be backed up:\n", len(root.Errors))
+		for _, e := range root.Errors {
+			fmt.Printf("  %s: %s\n", e.Path, e.Error)
+		}
 	}
 }
 
 ///////////////////////////////////////////////////////////////////////////
 
+func initcmd(args []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk init [--encrypt [--pad] [--kdf algorithm] [--kdf-iterations n]\n" +
+			"\t[--kdf-memory size] [--kdf-threads n]] [--hash algorithm] [--delta]\n" +
+			"\t[--quota size]\n")
+	}
+	encrypt := flags.Bool("encrypt", false, "encrypt the repository's contents")
+	pad := flags.Bool("pad", false, "pad encrypted chunks to obscure their sizes")
+	kdf := addKDFFlags(flags)
+	hash := flags.String("hash", storage.DefaultHashAlgorithm,
+		"hash algorithm for chunks: "+strings.Join(storage.HashAlgorithms(), ", "))
+	delta := flags.Bool("delta", false, "store chunks that are similar to stored ones as deltas")
+	quotaSize := flags.String("quota", "", "maximum storage for the repository (e.g., 500GB)")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	if *pad && !*encrypt {
+		Error("--pad can only be used with --encrypt\n")
+	}
+
+	var params storage.KDFParams
+	flags.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "kdf") && !*encrypt {
+			Error("--%s can only be used with --encrypt\n", f.Name)
+		}
+	})
+	if *encrypt {
+		params = kdf.Params()
+	}
+
+	var quota int64
+	if *quotaSize != "" {
+		if quota, err = u.ParseBytes(*quotaSize); err != nil {
+			Error("--quota: %s\n", err)
+		}
+	}
+
+	InitStorage(*encrypt, *pad, *delta, params, *hash, quota)
+}
+
+///////////////////////////////////////////////////////////////////////////
+
 func list(args []string) {
-	if len(args) != 0 {
-		Error("usage: bk list\n")
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk list [--long] [--ids] [--all-clients]\n")
+	}
+	long := flags.Bool("long", false, "print the sizes and sources of bitstreams")
+	ids := flags.Bool("ids", false, "print the IDs of backups")
+	allClients := flags.Bool("all-clients", false,
+		"list the backups and bitstreams of all clients, not just the current one")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
 	}
 
 	backend := GetStorageBackend()
 	md := backend.ListMetadata()
+	pinned := pinnedSnapshots(backend)
+	pinMark := func(name string) string {
+		if pinned[name] {
+			return " (pinned)"
+		}
+		return ""
+	}
+
+	// Unless all clients are listed, the current client's name is
+	// omitted.
+	owners := snapshotOwners(backend)
+	display := func(name string) string {
+		if !*allClients && currentClient() != "" {
+			return unqualifiedName(name, owners)
+		}
+		_, rest := splitSnapshotPrefix(name)
+		return rest
+	}
 
 	var backups, bits []string
 	for n := range md {
+		if !*allClients && !inCurrentClient(n, owners) {
+			continue
+		}
 		if strings.HasPrefix(n, "bits-") {
 			bits = append(bits, n)
 		} else if strings.HasPrefix(n, "backup-") {
@@ -450,22 +2395,256 @@ func list(args []string) {
 		}
 	}
 
+	if humanOutput {
+		pinMark = func(name string) string {
+			if pinned[name] {
+				return colored("pinned", colorGreen)
+			}
+			return ""
+		}
+	}
+
 	if len(backups) > 0 {
 		sort.Strings(backups)
+		var roots map[string][]byte
+		if *ids {
+			roots = backend.ReadMetadataBatch(backups)
+		}
+		id := func(name string) string { return shortID(storage.NewHash(roots[name])) }
 		fmt.Printf("Total of %d backups:\n", len(backups))
-		for _, name := range backups {
-			fmt.Printf("  %-30s %s\n",
-				strings.TrimPrefix(name, "backup-"), md[name].String())
+		if humanOutput {
+			t := newTable()
+			for _, name := range backups {
+				cols := []string{colored(display(name), colorBold),
+					md[name].Local().Format(humanTimeLayout), pinMark(name)}
+				if *ids {
+					cols = append([]string{colored(id(name), colorYellow)}, cols...)
+				}
+				t.add(cols...)
+			}
+			t.print(os.Stdout, "  ")
+		} else {
+			for _, name := range backups {
+				prefix := ""
+				if *ids {
+					prefix = id(name) + " "
+				}
+				fmt.Printf("  %s%-30s %s%s\n", prefix, display(name), md[name].String(),
+					pinMark(name))
+			}
 		}
 	}
 	if len(bits) > 0 {
 		sort.Strings(bits)
+		var contents map[string][]byte
+		if *long {
+			contents = backend.ReadMetadataBatch(bits)
+		}
 		fmt.Printf("Total of %d bitstreams:\n", len(bits))
+		if humanOutput {
+			// With --long, the sizes are aligned on the right.
+			t := newTable()
+			if *long {
+				t = newTable(2)
+			}
+			for _, name := range bits {
+				row := []string{colored(display(name), colorBold),
+					md[name].Local().Format(humanTimeLayout)}
+				if *long {
+					if bm := parseBitsMetadata(contents[name]); bm.Info == nil {
+						row = append(row, "-", "", "(saved by an older version of bk)")
+					} else {
+						row = append(row, u.FmtBytes(bm.Info.Size), bm.Info.Host,
+							bm.Info.CommandLine())
+					}
+				}
+				t.add(append(row, pinMark(name))...)
+			}
+			t.print(os.Stdout, "  ")
+			return
+		}
 		for _, name := range bits {
-			fmt.Printf("  %-30s %s\n",
-				strings.TrimPrefix(name, "bits-"), md[name].String())
+			fmt.Printf("  %-30s %s%s\n", display(name), md[name].String(), pinMark(name))
+			if !*long {
+				continue
+			}
+			if bm := parseBitsMetadata(contents[name]); bm.Info == nil {
+				fmt.Printf("      (saved by an older version of bk)\n")
+			} else {
+				fmt.Printf("      %s from %s: %s\n", u.FmtBytes(bm.Info.Size),
+					bm.Info.Host, bm.Info.CommandLine())
+			}
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func ls(args []string) {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk ls [--sort name|size|time] [--top n] [--depth n] <backup name> [path]\n")
+	}
+	sortBy := flags.String("sort", "name", "order to list files in: name, size, or time")
+	top := flags.Int("top", 0, "maximum number of files to list (0 for all)")
+	depth := flags.Int("depth", 0, "levels of directories to list (0 for all)")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	type file struct {
+		path  string
+		entry backup.DirEntry
+	}
+	var less func(a, b file) bool
+	switch *sortBy {
+	case "name":
+	case "size":
+		less = func(a, b file) bool { return a.entry.Size > b.entry.Size }
+	case "time":
+		less = func(a, b file) bool { return a.entry.ModTime.After(b.entry.ModTime) }
+	default:
+		Error("%s: unknown --sort order; must be name, size, or time\n", *sortBy)
+	}
+
+	backend := GetStorageBackend()
+	name, err := getLatest("backup-"+flags.Arg(0), backend)
+	if err != nil {
+		Error("%s: %s\n", flags.Arg(0), err)
+	}
+	r, err := backup.NewBackupReader(lookupHash(name, backend), backend)
+	if err != nil {
+		Error("%s: %s\n", name, err)
+	}
+
+	path := "/"
+	if flags.NArg() == 2 {
+		path = flags.Arg(1)
+	}
+	if *depth < 0 {
+		Error("%d: --depth must not be negative\n", *depth)
+	}
+	root := filepath.Clean("/" + path)
+	var files []file
+	err = r.WalkDepth(path, *depth, func(path string, e backup.DirEntry) {
+		// When the depth is limited, directories are listed too so that
+		// it's possible to see what's below them.
+		if !e.IsDir() || (*depth > 0 && path != root) {
+			files = append(files, file{path, e})
+		}
+	})
+	if err != nil {
+		Error("%s\n", err)
+	}
+
+	if less != nil {
+		// Paths break ties so that the output is deterministic.
+		sort.SliceStable(files, func(i, j int) bool { return less(files[i], files[j]) })
+	}
+	if *top > 0 && len(files) > *top {
+		files = files[:*top]
+	}
+	if humanOutput {
+		t := newTable(0)
+		for _, f := range files {
+			p := f.path
+			switch {
+			case f.entry.IsSymLink():
+				p = colored(p, colorCyan) + " -> " + string(f.entry.Contents)
+			case f.entry.IsDir():
+				p = colored(p+"/", colorBlue)
+			}
+			t.add(u.FmtBytes(f.entry.Size), f.entry.ModTime.Format("2006-01-02 15:04"), p)
+		}
+		t.print(os.Stdout, "")
+		return
+	}
+	for _, f := range files {
+		target := ""
+		if f.entry.IsSymLink() {
+			target = " -> " + string(f.entry.Contents)
+		} else if f.entry.IsDir() {
+			target = "/"
 		}
+		fmt.Printf("%12s  %s  %s%s\n", u.FmtBytes(f.entry.Size),
+			f.entry.ModTime.Format("2006-01-02 15:04"), f.path, target)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk migrate [--jobs n] <destination>\n")
+	}
+	jobs := flags.Int("jobs", 16, "number of blobs to read concurrently")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 1 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if *jobs < 1 {
+		*jobs = 1
+	}
+
+	// There's no need for the passphrase for encrypted repositories, since
+	// the stored chunks are copied without being decrypted.
+	src := getBaseBackend()
+	if !src.MetadataExists("readme_bk.txt") {
+		Error("%s: source hasn't been initialized.\n", src.String())
+	}
+	checkFormat(src)
+	// Blob hashes are verified when they're written to the destination,
+	// so the same hash algorithm must be used.
+	useRepositoryHash(src)
+
+	dst := openBaseBackend(flags.Arg(0))
+	migrateRepository(src, dst, *jobs)
+	dst.LogStats()
+}
+
+func mirror(args []string) {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk mirror [--jobs n] [--from source] [--delete] <destination>\n")
+	}
+	jobs := flags.Int("jobs", 16, "number of blobs to read concurrently")
+	from := flags.String("from", "", "repository to mirror, rather than BK_DIR")
+	del := flags.Bool("delete", false, "delete metadata that isn't in the source")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 1 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if *jobs < 1 {
+		*jobs = 1
+	}
+
+	var src storage.Backend
+	if *from != "" {
+		src = openBaseBackend(*from)
+	} else {
+		src = getBaseBackend()
+	}
+	if !src.MetadataExists("readme_bk.txt") {
+		Error("%s: source hasn't been initialized.\n", src.String())
 	}
+	checkFormat(src)
+	useRepositoryHash(src)
+
+	dst := openBaseBackend(flags.Arg(0))
+	if err := checkMirror(src, dst); err != nil {
+		Error("%s\n", err)
+	}
+	migrateRepository(src, dst, *jobs)
+	mirrorDeletions(src, dst, !*del)
+	dst.LogStats()
 }
 
 ///////////////////////////////////////////////////////////////////////////
@@ -480,24 +2659,173 @@ func mount(args []string) {
 
 ///////////////////////////////////////////////////////////////////////////
 
-func restore(args []string) {
+// pin implements both "pin" and "unpin".
+func pin(args []string, pin bool) {
+	if !pin && len(args) == 0 {
+		Error("usage: bk unpin <backup name> ...\n")
+	}
+
+	backend := GetStorageBackend()
+	pinned := pinnedSnapshots(backend)
+	if len(args) == 0 {
+		var names []string
+		for name := range pinned {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s\n", strings.TrimPrefix(strings.TrimPrefix(name, "backup-"),
+				"bits-"))
+		}
+		return
+	}
+
+	var names []string
+	for _, arg := range args {
+		name, err := resolveSnapshot(arg, backend)
+		if err != nil {
+			Error("%s: %s\n", arg, err)
+		}
+		if pinned[name] == pin {
+			state := "pinned"
+			if !pin {
+				state = "not pinned"
+			}
+			log.Warning("%s: already %s", name, state)
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		setPinned(backend, names, pin)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func rename(args []string) {
 	if len(args) != 2 {
-		Error("usage: bk restore <name> <dir>\n")
+		Error("usage: bk rename <old name> <new name>\n")
 	}
 
 	backend := GetStorageBackend()
-	name, err := getLatest("backup-"+args[0], backend)
+	targets, err := renameTargets(args[0], args[1], backend)
+	if err != nil {
+		Error("%s\n", err)
+	}
+	var olds []string
+	for old := range targets {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+	warnDependents(backend, olds, "being renamed")
+	renameSnapshots(targets, backend)
+	log.Print("Renamed %d snapshots.", len(targets))
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk restore [--jobs n] [--interactive] [--overwrite | --skip-existing |\n\t--keep-newer | --backup-existing | --in-place [--delete]]\n\t[--numeric-ids | --no-owner] [--id-map file] [--verify-signature]\n\t<name> <dir>\n")
+	}
+	jobs := flags.Int("jobs", 16, "number of files to restore concurrently")
+	policies := []struct {
+		flag   *bool
+		policy backup.ConflictPolicy
+	}{
+		{flags.Bool("overwrite", false, "replace existing files"), backup.ConflictOverwrite},
+		{flags.Bool("skip-existing", false, "don't restore files that already exist"),
+			backup.ConflictSkipExisting},
+		{flags.Bool("keep-newer", false,
+			"don't restore files that already exist and are newer than the backed-up ones"),
+			backup.ConflictKeepNewer},
+		{flags.Bool("backup-existing", false,
+			"rename existing files with a .bk-orig suffix before restoring"),
+			backup.ConflictBackupExisting},
+		{flags.Bool("in-place", false,
+			"only rewrite files whose size or modification time differ"),
+			backup.ConflictInPlace},
+	}
+	del := flags.Bool("delete", false,
+		"with --in-place, remove files that aren't in the backup")
+	numericIds := flags.Bool("numeric-ids", false,
+		"restore file owners using the recorded user and group ids, not names")
+	noOwner := flags.Bool("no-owner", false, "don't restore file owners")
+	idMapFile := flags.String("id-map", "", "file that maps users and groups")
+	interactive := flags.Bool("interactive", false, "choose the files and directories to restore")
+	verifySig := flags.Bool("verify-signature", false,
+		"verify the backup's signature before restoring it")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 2 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	opts := backup.RestoreOptions{Jobs: *jobs, Conflict: backup.ConflictError, Delete: *del}
+	npolicies := 0
+	for _, p := range policies {
+		if *p.flag {
+			opts.Conflict = p.policy
+			npolicies++
+		}
+	}
+	if npolicies > 1 {
+		Error("only one of --overwrite, --skip-existing, --keep-newer, " +
+			"--backup-existing, and --in-place may be given\n")
+	}
+	if *del && opts.Conflict != backup.ConflictInPlace {
+		Error("--delete can only be used with --in-place\n")
+	}
+	switch {
+	case *numericIds && *noOwner:
+		Error("only one of --numeric-ids and --no-owner may be given\n")
+	case *numericIds:
+		opts.Owner = backup.OwnerNumeric
+	case *noOwner:
+		opts.Owner = backup.OwnerSkip
+	}
+	if *idMapFile != "" {
+		if opts.IdMap, err = backup.ReadIdMap(*idMapFile); err != nil {
+			Error("%s\n", err)
+		}
+	}
+
+	backend := GetStorageBackend()
+	name, err := getLatest("backup-"+flags.Arg(0), backend)
 	if err != nil {
 		log.Error("%s\n", err)
 	}
 
 	b := backend.ReadMetadata(name)
-	r, err := NewBackupReader(storage.NewHash(b), backend)
+	if *verifySig {
+		if err := verifySignature(name, storage.NewHash(b), backend); err != nil {
+			log.Fatal("%s: %s", strings.TrimPrefix(name, "backup-"), err)
+		}
+		log.Verbose("%s: signature verified", name)
+	}
+	r, err := backup.NewBackupReader(storage.NewHash(b), backend)
 	if err != nil {
 		log.Error("%s\n", err)
 	}
 
-	if err = r.Restore("/", args[1]); err != nil {
+	if *interactive {
+		err = restoreInteractive(r, name, flags.Arg(1), opts)
+	} else {
+		var res *backup.RestoreResult
+		res, err = r.Restore(context.Background(), "/", flags.Arg(1), opts)
+		if res != nil {
+			log.Verbose("restored %d files (%s), %d directories, and %d symlinks",
+				res.Files, u.FmtBytes(res.Bytes), res.Dirs, res.SymLinks)
+			if res.Removed > 0 {
+				log.Verbose("removed %d files, directories, and symlinks that "+
+					"aren't in the backup", res.Removed)
+			}
+		}
+	}
+	if err != nil {
 		log.Error("%s\n", err)
 	}
 	backend.LogStats()
@@ -506,28 +2834,113 @@ func restore(args []string) {
 ///////////////////////////////////////////////////////////////////////////
 
 func restorebits(args []string) {
-	if len(args) != 1 {
-		Error("usage: bk restorebits <backup name>\n")
+	flags := flag.NewFlagSet("restorebits", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk restorebits [--offset n] [--length n] [--output file [--resume]] <backup name>\n")
+	}
+	offset := flags.Int64("offset", 0, "offset of the first byte to restore")
+	length := flags.Int64("length", -1, "number of bytes to restore (all if negative)")
+	output := flags.String("output", "", "file to write the bitstream to, rather than standard output")
+	resume := flags.Bool("resume", false, "continue an interrupted restore to the --output file")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 1 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if *offset < 0 {
+		Error("%d: --offset must not be negative\n", *offset)
+	}
+	whole := *offset == 0 && *length < 0
+	if *resume && (*output == "" || !whole) {
+		Error("--resume requires --output and can't be used with --offset or --length\n")
 	}
 
 	backend := GetStorageBackend()
 
-	name, err := getLatest("bits-"+args[0], backend)
+	name, err := getLatest("bits-"+flags.Arg(0), backend)
 	if err != nil {
 		Error("%s: %s\n", name, err)
 	}
 
-	hash := storage.NewMerkleHash(backend.ReadMetadata(name))
+	bm := parseBitsMetadata(backend.ReadMetadata(name))
+	// The chunk index and checksums of compressed streams are of the
+	// compressed data, so they can't be used to find ranges or check data
+	// that's already been restored.
+	compressed := bm.Info != nil && bm.Info.Compression != ""
+	if compressed && *resume {
+		Error("%s: --resume can't be used with compressed bitstreams\n", name)
+	}
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *output != "" {
+		mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if *resume {
+			mode = os.O_RDWR | os.O_CREATE
+		}
+		if f, err = os.OpenFile(*output, mode, 0666); err != nil {
+			Error("%s\n", err)
+		}
+		w = f
+	}
+
+	// The restored data is checked against the recorded checksum if it's
+	// all being restored.
+	hasher := storage.NewHasher()
+	var chunkSizes []int64
+	if bm.Index != nil && (!whole || *resume) && !compressed {
+		chunkSizes = backup.ReadChunkSizes(*bm.Index, backend)
+	}
+	if *resume {
+		*offset = resumeOffset(f, bm, chunkSizes, hasher, backend)
+	}
 
-	r := hash.NewReader(nil, backend)
-	// Write the blob contents to stdout.
+	var r io.ReadCloser
+	if compressed {
+		if r, err = decompressBits(bm.Hash.NewReader(nil, backend), bm.Info); err != nil {
+			Error("%s: %s\n", name, err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, *offset); err != nil && err != io.EOF {
+			Error("%s: %s\n", name, err)
+		}
+		if *length >= 0 {
+			r = struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(r, *length), r}
+		}
+	} else if *offset == 0 && *length < 0 {
+		r = bm.Hash.NewReader(nil, backend)
+	} else {
+		if chunkSizes == nil {
+			log.Verbose("%s: no chunk index; reading all of the data before "+
+				"the range", name)
+		}
+		if r, err = bm.Hash.NewRangeReader(*offset, *length, chunkSizes, nil, backend); err != nil {
+			Error("%s: %s\n", name, err)
+		}
+	}
 	rr := &u.ReportingReader{R: r, Msg: "Restored"}
-	if _, err := io.Copy(os.Stdout, rr); err != nil {
+	n, err := io.Copy(io.MultiWriter(w, hasher), rr)
+	if err != nil {
 		Error("%s: %s\n", name, err)
 	}
 	if err = rr.Close(); err != nil {
 		Error("%s: %s\n", name, err)
 	}
+	if f != nil {
+		if err = f.Close(); err != nil {
+			Error("%s\n", err)
+		}
+	}
+	if whole && bm.Info != nil {
+		if n += *offset; n != bm.Info.Size {
+			log.Error("%s: restored %d bytes but %d were saved", name, n, bm.Info.Size)
+		} else if hasher.Sum() != bm.Info.Checksum {
+			log.Error("%s: checksum of restored data doesn't match the saved stream", name)
+		}
+	}
 
 	backend.LogStats()
 }
@@ -538,33 +2951,211 @@ func savebits(args []string) {
 	// Parse args
 	flags := flag.NewFlagSet("savebits", flag.ExitOnError)
 	flags.Usage = func() {
-		Error("usage: bk savebits [--split-bits bits] <backup name>\n")
+		Error("usage: bk savebits [--split-bits bits] [--exec command] [--input name=command] [--zstd-long]\n\t[--exact-name] [--utc] [--time-format layout] [--timestamp time] [--metrics-file path] [--summary-file path] [--notify-url url]\n\t[--notify-fail-url url] <backup name>\n")
 	}
 	splitBits := flags.Uint("split-bits", 14,
 		"matching bits for rolling checksum")
+	execCmd := flags.String("exec", "",
+		"command to run and save the output of, rather than reading standard input")
+	zstdLong := flags.Bool("zstd-long", false,
+		"compress the stream with zstd using a large window before storing it")
+	var inputFlags stringSlice
+	flags.Var(&inputFlags, "input",
+		"name=command: save the output of the command as a stream with the given name")
+	report := addRunReporterFlags(flags)
+	namer := addSnapshotNameFlags(flags)
 	err := flags.Parse(args)
 	if err == flag.ErrHelp || flags.NArg() != 1 {
 		flags.Usage()
 	} else if err != nil {
 		Error("%s\n", err)
 	}
+	if *execCmd != "" && len(inputFlags) > 0 {
+		Error("--exec and --input can't both be given\n")
+	}
 
+	start := time.Now()
+	name, _ := namer.Name(flags.Arg(0), start)
+	report.Begin("bits", flags.Arg(0), name, start)
 	backend := GetStorageBackend()
-	name := flags.Arg(0) + "@" + time.Now().Format("20060102150405")
-	log.Check(!backend.MetadataExists("bits-" + name))
-
-	r := &u.ReportingReader{R: os.Stdin, Msg: "Read"}
-	backupHash := storage.SplitAndStore(r, backend, *splitBits)
-	r.Close()
+	report.backend = backend
+	// With --input, each stream's name is the given one with its own
+	// appended, ahead of the timestamp that they share.
+	var inputs []bitsInput
+	for _, in := range inputFlags {
+		i := strings.Index(in, "=")
+		if i <= 0 || i == len(in)-1 {
+			Error("--input: %s: expected \"name=command\"\n", in)
+		}
+		if strings.ContainsAny(in[:i], "@~:/"+clientSeparator) {
+			Error("--input: %s: stream names can't include '@', '~', ':', '/', or '%s'\n",
+				in[:i], clientSeparator)
+		}
+		n, _ := namer.Name(flags.Arg(0)+"-"+in[:i], start)
+		for _, prev := range inputs {
+			if prev.name == n {
+				Error("--input: %s: given more than once\n", in[:i])
+			}
+		}
+		inputs = append(inputs, bitsInput{name: n, command: in[i+1:],
+			args: []string{in[i+1:]}})
+	}
+	if len(inputs) == 0 {
+		inputs = []bitsInput{{name: name, command: *execCmd, args: os.Args}}
+	}
+	var olds [][]byte
+	for _, in := range inputs {
+		olds = append(olds, namer.CheckExisting("bits-"+in.name, backend))
+	}
+	checkQuota(backend, nil)
+
+	// Each stream is stored before any of them are named, so that if one
+	// fails, none are saved. Naming them isn't atomic, though: if another
+	// run of bk saves a stream with one of the names first, the ones
+	// before it have already been named.
+	var bms []bitsMetadata
+	for _, in := range inputs {
+		bms = append(bms, saveBitsStream(in, backend, *splitBits, *zstdLong))
+	}
 
-	// Sync before saving the named hash.
+	// Sync before saving the named hashes.
 	backend.SyncWrites()
 
-	backend.WriteMetadata("bits-"+name, backupHash.Bytes())
+	for i, in := range inputs {
+		writeSnapshot("bits-"+in.name, olds[i], bms[i].Bytes(), backend)
+	}
 	backend.SyncWrites()
 
-	log.Print("%s: successfully saved bits", name)
+	for _, in := range inputs {
+		log.Print("%s: successfully saved bits", in.name)
+	}
+	warnQuota(backend)
 	backend.LogStats()
+	report.End()
+}
+
+// bitsInput is a stream for savebits to save: the output of the given
+// command, or standard input if it's empty, under the given full name.
+// args is recorded as the command line that saved it.
+type bitsInput struct {
+	name, command string
+	args          []string
+}
+
+// saveBitsStream stores the given bitstream, returning its metadata.
+func saveBitsStream(in bitsInput, backend storage.Backend, splitBits uint,
+	zstdLong bool) bitsMetadata {
+	info := &BitsInfo{Command: in.args}
+	var err error
+	if info.Host, err = os.Hostname(); err != nil {
+		log.Warning("unable to get host name: %s", err)
+	}
+	var input io.Reader = os.Stdin
+	var cmd *exec.Cmd
+	if in.command != "" {
+		cmd = shellCommand(in.command)
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		log.CheckError(err)
+		if err := cmd.Start(); err != nil {
+			log.Fatal("%s: %s", in.command, err)
+		}
+		input = stdout
+	}
+
+	hasher := storage.NewHasher()
+	r := &u.ReportingReader{R: io.TeeReader(input, hasher), Msg: "Read"}
+	// Tar archives' file boundaries aren't visible in compressed streams,
+	// so those are split using the rolling checksum alone.
+	var stream io.Reader
+	if zstdLong {
+		stream = newZstdReader(r, &info.Size)
+		info.Compression, info.WindowSize = "zstd", zstdLongWindow
+	} else {
+		stream = newTarBoundaryReader(r)
+	}
+	var chunkSizes []int64
+	var chunkChecksums []byte
+	backupHash := storage.SplitAndStoreChunks(stream, backend, splitBits,
+		func(chunk storage.ChunkInfo) {
+			chunkSizes = append(chunkSizes, chunk.Size)
+			h := chunk.Hash()
+			chunkChecksums = append(chunkChecksums, h[:]...)
+			if !zstdLong {
+				info.Size += chunk.Size
+			}
+		})
+	r.Close()
+	if cmd != nil {
+		// Only save the bitstream if the command succeeded; otherwise its
+		// output is likely incomplete.
+		if err := cmd.Wait(); err != nil {
+			log.Fatal("%s: %s; not saving %s", in.command, err, in.name)
+		}
+	}
+	info.Checksum = hasher.Sum()
+	indexHash := backup.WriteChunkSizes(chunkSizes, backend, splitBits)
+	checksumsHash := storage.SplitAndStore(bytes.NewReader(chunkChecksums), backend, splitBits)
+	info.ChunkChecksums = &checksumsHash
+
+	return bitsMetadata{Hash: backupHash, Index: &indexHash, Info: info}
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func watch(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk watch [--quiet duration] [--max-delay duration] [--split-bits bits]\n\t[--exclude path] [--exclude-if-present name] [--exclude-nodump] <name> <dir>\n")
+	}
+	var opts WatchOptions
+	flags.DurationVar(&opts.Quiet, "quiet", 30*time.Second,
+		"how long to wait after the last change before backing up")
+	flags.DurationVar(&opts.MaxDelay, "max-delay", 10*time.Minute,
+		"maximum time to wait after a change before backing up")
+	flags.UintVar(&opts.SplitBits, "split-bits", 14, "matching bits for rolling checksum")
+	var excludedPaths stringSlice
+	flags.Var(&excludedPaths, "exclude", "Paths to exclude from backups")
+	var markers stringSlice
+	flags.Var(&markers, "exclude-if-present",
+		"Exclude directories that contain a file with this name")
+	flags.BoolVar(&opts.ExcludeNoDump, "exclude-nodump", false,
+		"Exclude files and directories with the nodump attribute")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 2 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	opts.ExcludedPaths, opts.ExcludeIfPresent = excludedPaths, markers
+	if opts.Quiet <= 0 || opts.MaxDelay <= 0 {
+		Error("--quiet and --max-delay must be positive\n")
+	}
+
+	// Make sure that the repository is accessible before starting.
+	GetStorageBackend()
+
+	log.CheckError(watchDir(flags.Arg(0), flags.Arg(1), opts))
+}
+
+// shellCommand returns a command that runs the given command line using
+// the system's shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+func upgrade(args []string) {
+	if len(args) != 0 {
+		Error("usage: bk upgrade\n")
+	}
+
+	backend := GetStorageBackend()
+	upgradeRepository(backend)
 }
 
 ///////////////////////////////////////////////////////////////////////////
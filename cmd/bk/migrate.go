@@ -0,0 +1,237 @@
+// cmd/bk/migrate.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// Number of bytes of blobs to copy between calls to SyncWrites, so that
+// not too much work is lost if a migration is interrupted.
+const migrateSyncBytes = 256 * 1024 * 1024
+
+// migrateRepository copies all of the blobs and metadata from src to dst.
+// Both should be base backends (i.e., not compressed or encrypted) so
+// that the stored bytes, and thus their hashes, are copied as is.  Blobs
+// and metadata already present in dst are skipped, so an interrupted
+// migration can be resumed by running it again, though metadata whose
+// contents differ from src's, as happens when backups are replaced with
+// --exact-name or signatures are rewritten, is replaced.
+func migrateRepository(src, dst storage.Backend, jobs int) {
+	// Copy the blobs first, so that by the time the metadata that refers
+	// to them is present in dst, they're all there.
+	var hashes []storage.Hash
+	for hash := range src.Hashes() {
+		if !dst.HashExists(hash) {
+			hashes = append(hashes, hash)
+		}
+	}
+	log.Verbose("%d blobs to copy", len(hashes))
+
+	type chunk struct {
+		hash storage.Hash
+		data []byte
+	}
+	hashChan := make(chan storage.Hash, jobs)
+	chunkChan := make(chan chunk, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range hashChan {
+				r, err := src.Read(hash)
+				if err != nil {
+					log.Error("%s: %s", hash, err)
+					continue
+				}
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					log.Error("%s: %s", hash, err)
+				} else {
+					chunkChan <- chunk{hash, b}
+				}
+				r.Close()
+			}
+		}()
+	}
+	go func() {
+		for _, h := range hashes {
+			hashChan <- h
+		}
+		close(hashChan)
+		wg.Wait()
+		close(chunkChan)
+	}()
+
+	// Writes to the destination all happen here, in a single goroutine.
+	progress := &u.ProgressReporter{Msg: "Copied blobs", Total: int64(len(hashes))}
+	var unsynced int64
+	for c := range chunkChan {
+		if h := dst.Write(c.data); h != c.hash {
+			log.Fatal("%s: hash changed to %s when copied", c.hash, h)
+		}
+		progress.Add(1)
+
+		unsynced += int64(len(c.data))
+		if unsynced > migrateSyncBytes {
+			dst.SyncWrites()
+			unsynced = 0
+		}
+	}
+	dst.SyncWrites()
+	progress.Finish()
+
+	if log.NErrors > 0 {
+		log.Fatal("Errors reading blobs; not copying metadata.")
+	}
+
+	// Now the metadata. It's copied in the order it was originally
+	// created so that the most recent backup with a given name in the
+	// source is also the most recent one in the destination.
+	srcMetadata := src.ListMetadata()
+	dstMetadata := dst.ListMetadata()
+	var names, common []string
+	for name := range srcMetadata {
+		if _, ok := dstMetadata[name]; ok {
+			common = append(common, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return srcMetadata[names[i]].Before(srcMetadata[names[j]])
+	})
+	// The reads can all be done at once, but the writes are done one at a
+	// time to preserve their order.
+	contents := src.ReadMetadataBatch(names)
+	for _, name := range names {
+		log.Debug("%s: copying metadata", name)
+		dst.WriteMetadata(name, contents[name])
+	}
+	dst.SyncWrites()
+
+	replaced := replaceChangedMetadata(src, dst, common)
+
+	log.Print("Copied %d blobs and %d metadata files and replaced %d from %s to %s.",
+		len(hashes), len(names), replaced, src.String(), dst.String())
+}
+
+// replaceChangedMetadata replaces the metadata with the given names in dst
+// with src's if their contents differ, returning how many were replaced.
+func replaceChangedMetadata(src, dst storage.Backend, names []string) int {
+	sort.Strings(names)
+	srcContents := src.ReadMetadataBatch(names)
+	dstContents := dst.ReadMetadataBatch(names)
+	n := 0
+	for _, name := range names {
+		if bytes.Equal(srcContents[name], dstContents[name]) {
+			continue
+		}
+		log.Debug("%s: replacing metadata", name)
+		err := dst.ReplaceMetadata(name, dstContents[name], srcContents[name])
+		if err == storage.ErrReplaceUnsupported {
+			// Since it's a copy, it's fine if an interruption leaves dst
+			// without it; the next migration copies it again.
+			dst.DeleteMetadata(name)
+			dst.SyncWrites()
+			dst.WriteMetadata(name, srcContents[name])
+		} else if err != nil {
+			log.Fatal("%s: %s", name, err)
+		}
+		n++
+	}
+	dst.SyncWrites()
+	return n
+}
+
+// Metadata that identifies repositories that don't have a
+// storage.RepositoryID, as ones created by older versions of bk don't:
+// each repository's encrypt.txt holds its own randomly-generated keys, and
+// hash.txt records the hash algorithm used for its chunks. If either is
+// present in src or dst, it must be present in both, with the same
+// contents, for dst to be a mirror of src. (Unencrypted repositories that
+// use the default hash algorithm can't be told apart this way.)
+var repositoryIdentityMetadata = []string{"encrypt.txt", "hash.txt"}
+
+// checkMirror returns an error if dst can't be made into a mirror of src
+// because it's a different repository. An empty dst is fine, as is one
+// that an earlier mirror didn't finish copying the metadata to.
+func checkMirror(src, dst storage.Backend) error {
+	if len(dst.ListMetadata()) == 0 {
+		return nil
+	}
+	if !dst.MetadataExists("readme_bk.txt") {
+		return fmt.Errorf("%s: not empty, but not a bk repository", dst.String())
+	}
+	srcID, dstID := storage.RepositoryID(src), storage.RepositoryID(dst)
+	if srcID != "" && dstID != "" {
+		if srcID != dstID {
+			return fmt.Errorf("%s: repository identifier doesn't match %s's; the "+
+				"repositories are different", dst.String(), src.String())
+		}
+		return nil
+	}
+	// Mirrors made before the source was upgraded don't have its
+	// identifier until it's copied to them.
+	if srcID == "" {
+		log.Warning("%s: no repository identifier, so mirrors of it can't be "+
+			"fully checked; run \"bk upgrade\" to record one", src.String())
+	} else {
+		log.Warning("%s: no repository identifier, so it can't be fully "+
+			"checked that it's a mirror of %s", dst.String(), src.String())
+	}
+	for _, name := range repositoryIdentityMetadata {
+		srcHas, dstHas := src.MetadataExists(name), dst.MetadataExists(name)
+		if srcHas != dstHas || (srcHas &&
+			!bytes.Equal(src.ReadMetadata(name), dst.ReadMetadata(name))) {
+			return fmt.Errorf("%s: %s doesn't match the one in %s; the "+
+				"repositories are different", dst.String(), name, src.String())
+		}
+	}
+	return nil
+}
+
+// mirrorDeletions removes the metadata in dst that isn't in src, as is
+// left behind when backups in src are forgotten or renamed. It must be
+// called after the metadata has been copied (and synced) by
+// migrateRepository, so that renamed metadata is never missing from dst.
+// If dryRun is true, the metadata is listed but not removed.
+func mirrorDeletions(src, dst storage.Backend, dryRun bool) {
+	srcMetadata := src.ListMetadata()
+	var names []string
+	for name := range dst.ListMetadata() {
+		if _, ok := srcMetadata[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if dryRun {
+		for _, name := range names {
+			fmt.Printf("%s\n", name)
+		}
+		if len(names) > 0 {
+			log.Print("%d metadata files in %s aren't in %s; run with --delete "+
+				"to remove them.", len(names), dst.String(), src.String())
+		}
+		return
+	}
+	for _, name := range names {
+		log.Debug("%s: deleting metadata", name)
+		dst.DeleteMetadata(name)
+	}
+	dst.SyncWrites()
+
+	if len(names) > 0 {
+		log.Print("Deleted %d metadata files from %s that aren't in %s.",
+			len(names), dst.String(), src.String())
+	}
+}
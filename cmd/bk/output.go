@@ -0,0 +1,127 @@
+// cmd/bk/output.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Formatting of listings for people reading them in a terminal.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// When standard output is a terminal, "list", "ls", "compare", and "du"
+// print their results in columns sized to fit them, with local times and
+// colors to distinguish the kinds of things listed. Otherwise, their
+// output is left in the fixed format that scripts may depend on.
+var (
+	humanOutput bool
+	colorOutput bool
+)
+
+// ANSI color codes.
+const (
+	colorBold    = "1"
+	colorRed     = "31"
+	colorGreen   = "32"
+	colorYellow  = "33"
+	colorBlue    = "34"
+	colorMagenta = "35"
+	colorCyan    = "36"
+)
+
+const humanTimeLayout = "2006-01-02 15:04:05"
+
+// isTerminal reports whether the given file is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// initOutput sets up the output modes based on where standard output and
+// standard error go; noColor disables colors regardless. The NO_COLOR
+// environment variable is respected as well.
+func initOutput(noColor bool) {
+	noColor = noColor || os.Getenv("NO_COLOR") != ""
+	humanOutput = isTerminal(os.Stdout)
+	colorOutput = humanOutput && !noColor
+	log.SetColor(!noColor && isTerminal(os.Stderr))
+}
+
+// colored returns the given string with the given color, if colors are
+// enabled.
+func colored(s, color string) string {
+	if !colorOutput || s == "" {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// displayWidth returns the number of columns the given string takes when
+// printed, not counting color escapes.
+func displayWidth(s string) int {
+	return utf8.RuneCountInString(ansiEscape.ReplaceAllString(s, ""))
+}
+
+// table accumulates rows of cells and prints them with each column as
+// wide as its widest cell.
+type table struct {
+	// Columns that are aligned on the right rather than the left.
+	right map[int]bool
+	rows  [][]string
+}
+
+func newTable(rightAligned ...int) *table {
+	t := &table{right: make(map[int]bool)}
+	for _, c := range rightAligned {
+		t.right[c] = true
+	}
+	return t
+}
+
+func (t *table) add(cells ...string) {
+	t.rows = append(t.rows, cells)
+}
+
+// print writes the table, indenting each row with the given prefix. The
+// last column isn't padded.
+func (t *table) print(w io.Writer, indent string) {
+	var widths []int
+	for _, row := range t.rows {
+		for i, c := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := displayWidth(c); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	for _, row := range t.rows {
+		var line strings.Builder
+		line.WriteString(indent)
+		for i, c := range row {
+			pad := strings.Repeat(" ", widths[i]-displayWidth(c))
+			switch {
+			case t.right[i]:
+				line.WriteString(pad + c)
+			case i < len(row)-1:
+				line.WriteString(c + pad)
+			default:
+				line.WriteString(c)
+			}
+			if i < len(row)-1 {
+				line.WriteString("  ")
+			}
+		}
+		fmt.Fprintln(w, strings.TrimRight(line.String(), " "))
+	}
+}
@@ -0,0 +1,401 @@
+// cmd/bk/picker.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Full-screen picker for selecting the files and directories to restore,
+// used by "restore --interactive" and "browse".
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mmp/bk/backup"
+	u "github.com/mmp/bk/util"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The picker shows the backup's tree with a checkbox for each file and
+// directory. Directories are read from the repository only when they're
+// expanded. Selecting a directory selects everything under it; selections
+// are kept as a set of paths, none under another, so that each can be
+// restored with a single call to BackupReader.Restore. The details of the
+// current file or directory are shown above the status line.
+
+const pickerHelp = "space: select  right/left: expand/collapse  enter: restore  q: quit"
+
+type pickerNode struct {
+	path     string
+	entry    backup.DirEntry
+	depth    int
+	expanded bool
+	// Sorted by name; nil until the directory is first expanded.
+	children []*pickerNode
+}
+
+type picker struct {
+	reader   *backup.BackupReader
+	title    string
+	root     *pickerNode
+	selected map[string]bool
+	// The nodes that are currently visible, in order, and the index of
+	// the current one and of the one shown at the top of the screen.
+	rows        []*pickerNode
+	cursor, top int
+}
+
+func newPicker(r *backup.BackupReader, title string) *picker {
+	p := &picker{reader: r, title: title, selected: make(map[string]bool),
+		root: &pickerNode{path: "/", entry: r.Root().Dir, depth: -1}}
+	p.expand(p.root)
+	return p
+}
+
+func (p *picker) expand(n *pickerNode) {
+	if !n.entry.IsDir() {
+		return
+	}
+	if n.children == nil {
+		entries := backup.ReadDirEntries(n.entry.Hash, p.reader.Backend())
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		n.children = []*pickerNode{}
+		for _, e := range entries {
+			n.children = append(n.children, &pickerNode{path: path.Join(n.path, e.Name),
+				entry: e, depth: n.depth + 1})
+		}
+	}
+	n.expanded = true
+	p.updateRows()
+}
+
+func (p *picker) collapse(n *pickerNode) {
+	n.expanded = false
+	p.updateRows()
+}
+
+func (p *picker) updateRows() {
+	p.rows = p.rows[:0]
+	var add func(n *pickerNode)
+	add = func(n *pickerNode) {
+		for _, c := range n.children {
+			p.rows = append(p.rows, c)
+			if c.expanded {
+				add(c)
+			}
+		}
+	}
+	add(p.root)
+	if p.cursor >= len(p.rows) {
+		p.cursor = len(p.rows) - 1
+	}
+	if p.cursor < 0 {
+		p.cursor = 0
+	}
+}
+
+// isUnder reports whether the path p is dir or is under it.
+func isUnder(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// selectedAncestor returns the selected path that the given one is under,
+// if there is one.
+func (p *picker) selectedAncestor(q string) (string, bool) {
+	for s := range p.selected {
+		if isUnder(q, s) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// checkbox returns the checkbox for the given node: "[x]" if it's
+// selected, "[-]" if only some of its contents are, and "[ ]" otherwise.
+func (p *picker) checkbox(n *pickerNode) string {
+	if _, ok := p.selectedAncestor(n.path); ok {
+		return "[x]"
+	}
+	for s := range p.selected {
+		if isUnder(s, n.path) {
+			return "[-]"
+		}
+	}
+	return "[ ]"
+}
+
+// toggle selects the given node if it isn't selected and deselects it
+// otherwise.
+func (p *picker) toggle(n *pickerNode) {
+	a, ok := p.selectedAncestor(n.path)
+	if !ok {
+		for s := range p.selected {
+			if isUnder(s, n.path) {
+				delete(p.selected, s)
+			}
+		}
+		p.selected[n.path] = true
+		return
+	}
+
+	// Replace the selected ancestor with everything under it other than
+	// the given node. All of the directories between them have been
+	// expanded, since the node is visible.
+	delete(p.selected, a)
+	dir := p.find(a)
+	for dir != n {
+		var next *pickerNode
+		for _, c := range dir.children {
+			if isUnder(n.path, c.path) {
+				next = c
+			} else {
+				p.selected[c.path] = true
+			}
+		}
+		dir = next
+	}
+}
+
+// find returns the visible node with the given path.
+func (p *picker) find(q string) *pickerNode {
+	if q == "/" {
+		return p.root
+	}
+	for _, n := range p.rows {
+		if n.path == q {
+			return n
+		}
+	}
+	return nil
+}
+
+// selection returns the selected paths, sorted.
+func (p *picker) selection() []string {
+	var paths []string
+	for s := range p.selected {
+		paths = append(paths, s)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// key handles the given key press. It returns false once the picker is
+// done, along with whether the selection should be restored.
+func (p *picker) key(k string) (more bool, accept bool) {
+	switch k {
+	case "\r", "\n":
+		return false, true
+	case "q", "\x1b", "\x03":
+		return false, false
+	}
+	if len(p.rows) == 0 {
+		return true, false
+	}
+
+	n := p.rows[p.cursor]
+	switch k {
+	case "\x1b[A", "k":
+		if p.cursor > 0 {
+			p.cursor--
+		}
+	case "\x1b[B", "j":
+		if p.cursor < len(p.rows)-1 {
+			p.cursor++
+		}
+	case "\x1b[C", "l":
+		p.expand(n)
+	case "\x1b[D", "h":
+		if n.expanded {
+			p.collapse(n)
+		} else if parent := p.find(path.Dir(n.path)); parent != p.root {
+			// Move to the parent directory and collapse it.
+			for i, r := range p.rows {
+				if r == parent {
+					p.cursor = i
+				}
+			}
+			p.collapse(parent)
+		}
+	case " ":
+		p.toggle(n)
+		if p.cursor < len(p.rows)-1 {
+			p.cursor++
+		}
+	}
+	return true, false
+}
+
+// details returns a summary of the given node's entry.
+func (p *picker) details(n *pickerNode) string {
+	e := n.entry
+	s := fmt.Sprintf("%s  %s", e.Mode, e.ModTime.Format("2006-01-02 15:04"))
+	switch {
+	case e.IsDir():
+	case e.IsSymLink():
+		s += "  -> " + string(e.Contents)
+	default:
+		s += "  " + u.FmtBytes(e.Size)
+	}
+	return s
+}
+
+// scroll returns the index of the row to show at the top of a screen that
+// has room for the given number of rows, so that the cursor is visible.
+func scroll(cursor, top, lines int) int {
+	if cursor < top {
+		return cursor
+	} else if cursor >= top+lines {
+		return cursor - lines + 1
+	}
+	return top
+}
+
+// draw redraws the screen, which has the given number of lines.
+func (p *picker) draw(out io.Writer, height int) {
+	// Leave room for the title, the details, and the status line.
+	lines := height - 3
+	if lines < 1 {
+		lines = 1
+	}
+	p.top = scroll(p.cursor, p.top, lines)
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&buf, "Restore from %s\r\n", p.title)
+	for i := p.top; i < len(p.rows) && i < p.top+lines; i++ {
+		n := p.rows[i]
+		name := n.entry.Name
+		switch {
+		case n.entry.IsDir() && n.expanded:
+			name = "- " + name + "/"
+		case n.entry.IsDir():
+			name = "+ " + name + "/"
+		default:
+			name = "  " + name
+		}
+		line := fmt.Sprintf("%s%s %s", strings.Repeat("  ", n.depth), p.checkbox(n), name)
+		if i == p.cursor {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		buf.WriteString(line + "\r\n")
+	}
+	if len(p.rows) > 0 {
+		fmt.Fprintf(&buf, "\x1b[%d;1H%s", height-1, p.details(p.rows[p.cursor]))
+	}
+	fmt.Fprintf(&buf, "\x1b[%d;1H%d selected  %s", height, len(p.selected), pickerHelp)
+	out.Write(buf.Bytes())
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Terminal handling
+
+// stty runs stty with the given arguments on the terminal that's standard
+// input and returns its output.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// terminalHeight returns the number of lines in the terminal.
+func terminalHeight() int {
+	if s, err := stty("size"); err == nil {
+		if f := strings.Fields(s); len(f) == 2 {
+			if h, err := strconv.Atoi(f[0]); err == nil && h > 0 {
+				return h
+			}
+		}
+	}
+	return 24
+}
+
+// screen is implemented by the full-screen views that runScreen shows.
+type screen interface {
+	// draw redraws the screen, which has the given number of lines.
+	draw(out io.Writer, height int)
+	// key handles the given key press. It returns false once the user is
+	// done, along with whether they accepted the screen's choice.
+	key(k string) (more bool, accept bool)
+}
+
+// runScreen shows the given screen on the terminal until the user is done
+// with it, returning whether they accepted its choice.
+func runScreen(s screen) (bool, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return false, errors.New("standard input isn't a terminal")
+	}
+	// Read keys as they're pressed; control-C is handled as a key so that
+	// the terminal is always restored.
+	if _, err := stty("-icanon", "-echo", "-isig", "min", "1"); err != nil {
+		return false, err
+	}
+	defer stty(saved)
+
+	// Use the terminal's alternate screen so that the screen doesn't
+	// leave its output behind.
+	fmt.Fprintf(os.Stdout, "\x1b[?1049h")
+	defer fmt.Fprintf(os.Stdout, "\x1b[?1049l")
+
+	buf := make([]byte, 16)
+	for {
+		s.draw(os.Stdout, terminalHeight())
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return false, err
+		}
+		if more, accept := s.key(string(buf[:n])); !more {
+			return accept, nil
+		}
+	}
+}
+
+// pickPaths runs the picker on the terminal and returns the selected
+// paths in the backup, or nil if the user quit without restoring.
+func pickPaths(r *backup.BackupReader, title string) ([]string, error) {
+	p := newPicker(r, title)
+	if accept, err := runScreen(p); err != nil || !accept {
+		return nil, err
+	}
+	return p.selection(), nil
+}
+
+// restoreInteractive lets the user pick paths from the given backup and
+// restores them under dest.
+func restoreInteractive(r *backup.BackupReader, name, dest string, opts backup.RestoreOptions) error {
+	paths, err := pickPaths(r, strings.TrimPrefix(name, "backup-"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		log.Print("not restoring anything")
+		return nil
+	}
+	return restorePaths(r, paths, dest, opts)
+}
+
+// restorePaths restores the given paths in the backup under dest,
+// recreating their paths relative to the backup's root.
+func restorePaths(r *backup.BackupReader, paths []string, dest string,
+	opts backup.RestoreOptions) error {
+	for _, p := range paths {
+		target := filepath.Join(dest, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		log.Verbose("restoring %s to %s", p, target)
+		if _, err := r.Restore(context.Background(), p, target, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
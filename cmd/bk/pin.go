@@ -0,0 +1,104 @@
+// cmd/bk/pin.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Pinning backups and bitstreams so that they're always kept.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pins are recorded in a series of metadata items rather than a single one
+// that's replaced, so that clients with append-only access to a served
+// repository can add them. Each is named using pinPrefix and the time it
+// was written, and has one line for each backup or bitstream it pins or
+// unpins, of the form "pin <name>" or "unpin <name>", where <name> is the
+// full metadata name (e.g., "backup-foo@20170102150405"). Only admin
+// tokens may unpin; see checkPins.
+const pinPrefix = "pin-"
+
+const pinTimeLayout = "20060102150405.000000000"
+
+// pinnedSnapshots returns the full metadata names of the backups and
+// bitstreams that are currently pinned. Retention policies must never
+// remove them.
+func pinnedSnapshots(backend storage.Backend) map[string]bool {
+	var names []string
+	backend.ForMetadata(pinPrefix, func(name string, created time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+	// The fixed-width timestamps sort in the order they were written.
+	sort.Strings(names)
+
+	pinned := make(map[string]bool)
+	contents := backend.ReadMetadataBatch(names)
+	for _, name := range names {
+		scanner := bufio.NewScanner(bytes.NewReader(contents[name]))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			switch {
+			case len(fields) == 2 && fields[0] == "pin":
+				pinned[fields[1]] = true
+			case len(fields) == 2 && fields[0] == "unpin":
+				delete(pinned, fields[1])
+			case len(fields) > 0:
+				log.Warning("%s: ignoring unexpected line %q", name, scanner.Text())
+			}
+		}
+	}
+	return pinned
+}
+
+// checkPins returns an error if the given metadata, as it's stored in the
+// repository, is a pin record that unpins anything. "bk serve" rejects
+// these for tokens other than admin ones, since unpinning a backup lets
+// retention policies remove it.
+func checkPins(name string, contents []byte) error {
+	if !strings.HasPrefix(name, pinPrefix) {
+		return nil
+	}
+	// In encrypted repositories, the contents end with a MAC, which
+	// pinnedSnapshots never sees; it's checked as part of the last line,
+	// which can only make this stricter than pinnedSnapshots.
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		if fields := strings.Fields(string(line)); len(fields) > 0 && fields[0] == "unpin" {
+			return errors.New("unpinning requires an admin token")
+		}
+	}
+	return nil
+}
+
+// setPinned pins or unpins the given backups and bitstreams, which are
+// given by their full metadata names.
+func setPinned(backend storage.Backend, names []string, pin bool) {
+	var buf bytes.Buffer
+	for _, name := range names {
+		if pin {
+			fmt.Fprintf(&buf, "pin %s\n", name)
+		} else {
+			fmt.Fprintf(&buf, "unpin %s\n", name)
+		}
+	}
+	backend.WriteMetadata(pinPrefix+time.Now().UTC().Format(pinTimeLayout), buf.Bytes())
+	backend.SyncWrites()
+}
+
+// resolveSnapshot returns the full metadata name of the backup or
+// bitstream selected by the given name, which may be any of the forms
+// accepted by getLatest.
+func resolveSnapshot(name string, backend storage.Backend) (string, error) {
+	if n, err := getLatest("backup-"+name, backend); err == nil {
+		return n, nil
+	}
+	return getLatest("bits-"+name, backend)
+}
@@ -0,0 +1,136 @@
+// cmd/bk/profile.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Support for the --profile, --memprofile, --blockprofile, --mutexprofile,
+// --trace, and --pprof-addr options.
+
+import (
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// Paths to write the various profiles to; empty strings indicate that the
+// corresponding profile shouldn't be collected.
+type profileOptions struct {
+	cpu, mem, block, mutex, trace string
+	// If non-empty, the address to serve live profiles at.
+	addr string
+}
+
+var profiling profileOptions
+
+func (p profileOptions) enabled() bool {
+	return p.cpu != "" || p.mem != "" || p.block != "" || p.mutex != "" ||
+		p.trace != ""
+}
+
+// startProfiling starts collecting all of the requested profiles. They're
+// written out when stopProfiling is called at exit or when SIGINT is
+// received, whichever comes first.
+func startProfiling() {
+	if profiling.addr != "" {
+		servePprof(profiling.addr)
+	}
+	if !profiling.enabled() {
+		return
+	}
+
+	if profiling.cpu != "" {
+		log.Print("Starting profiling.")
+		f, err := os.Create(profiling.cpu)
+		log.CheckError(err)
+		log.CheckError(pprof.StartCPUProfile(f))
+	}
+	if profiling.trace != "" {
+		log.Print("Starting execution trace.")
+		f, err := os.Create(profiling.trace)
+		log.CheckError(err)
+		log.CheckError(trace.Start(f))
+	}
+	if profiling.block != "" {
+		// Record every blocking event.
+		runtime.SetBlockProfileRate(1)
+	}
+	if profiling.mutex != "" {
+		runtime.SetMutexProfileFraction(1)
+	}
+	if profiling.mem != "" {
+		log.Print("Will write memory profile at exit or when SIGINT is received.")
+	}
+
+	go func() {
+		sigchan := make(chan os.Signal, 10)
+		signal.Notify(sigchan, os.Interrupt)
+		<-sigchan
+		stopProfiling()
+		os.Exit(0)
+	}()
+}
+
+// stopProfiling finishes the CPU profile and execution trace, if any, and
+// writes out the memory, block, and mutex profiles that were requested.
+func stopProfiling() {
+	if profiling.cpu != "" {
+		pprof.StopCPUProfile()
+	}
+	if profiling.trace != "" {
+		trace.Stop()
+	}
+	if profiling.mem != "" {
+		// Make sure the statistics about what's live are up to date.
+		runtime.GC()
+		writeProfile("heap", profiling.mem)
+	}
+	if profiling.block != "" {
+		writeProfile("block", profiling.block)
+	}
+	if profiling.mutex != "" {
+		writeProfile("mutex", profiling.mutex)
+	}
+}
+
+func writeProfile(name, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Error("%s: %s", path, err)
+		return
+	}
+	if err = pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		log.Error("%s: %s", path, err)
+	}
+	if err = f.Close(); err != nil {
+		log.Error("%s: %s", path, err)
+	}
+}
+
+// servePprof starts serving the profiles provided by net/http/pprof at
+// the given address, so that a long-running command can be inspected
+// while it runs. The handlers are registered with their own ServeMux so
+// that they're never exposed by the other servers bk runs.
+func servePprof(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("%s: %s", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+	log.Print("Serving profiles at http://%s/debug/pprof/", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Error("%s: %s", addr, err)
+		}
+	}()
+}
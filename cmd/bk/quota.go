@@ -0,0 +1,244 @@
+// cmd/bk/quota.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Limits on how much storage a repository may use.
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A repository's quota is recorded in the metadata named quotaName when
+// it's created with "bk init --quota" or set with "bk quota --set"; the
+// "quota" setting in the configuration file takes precedence over it.
+// The quota is compared to the stored size of all of the blobs in the
+// repository, including ones that nothing refers to any more, since
+// they're still being stored (and paid for).
+const quotaName = "quota.txt"
+
+// repositoryQuota returns the maximum number of stored bytes that the
+// repository may use, or zero if it doesn't have a quota, along with
+// where the quota was specified.
+func repositoryQuota(backend storage.Backend) (int64, string) {
+	if config.Quota != "" {
+		return config.quota, "configuration file"
+	}
+	if !backend.MetadataExists(quotaName) {
+		return 0, ""
+	}
+	q := strings.TrimSpace(string(backend.ReadMetadata(quotaName)))
+	n, err := strconv.ParseInt(q, 10, 64)
+	if err != nil {
+		log.Warning("%s: %s: invalid quota; ignoring it", quotaName, q)
+		return 0, ""
+	}
+	return n, "repository"
+}
+
+// setRepositoryQuota records the given quota in the repository; zero
+// removes it.
+func setRepositoryQuota(backend storage.Backend, quota int64) {
+	if backend.MetadataExists(quotaName) {
+		backend.DeleteMetadata(quotaName)
+	}
+	if quota > 0 {
+		backend.WriteMetadata(quotaName, []byte(fmt.Sprintf("%d\n", quota)))
+	}
+	backend.SyncWrites()
+}
+
+// storedSize returns the stored bytes used by all of the blobs in the
+// repository.
+func storedSize(backend storage.Backend) int64 {
+	var total int64
+	for h := range backend.Hashes() {
+		n, err := backend.BlobSize(h)
+		log.CheckError(err)
+		total += n
+	}
+	return total
+}
+
+// The fraction of its quota that a repository must use before backups
+// estimate how much they may add to it; below it, the new data is
+// unlikely to exceed the quota, and the estimate is only used for a
+// warning, so the scan that it requires isn't worth it.
+const quotaEstimateFraction = 0.5
+
+// checkQuota should be called before a backup or bitstream is saved; it's
+// a fatal error if the repository is already at or over its quota. If
+// it's non-nil, estimate returns the most that the new one may add,
+// before deduplication and compression; it's only called if the
+// repository uses enough of its quota for that to matter.
+func checkQuota(backend storage.Backend, estimate func() int64) {
+	quota, _ := repositoryQuota(backend)
+	if quota == 0 {
+		return
+	}
+	stored := storedSize(backend)
+	if stored >= quota {
+		log.Fatal("repository uses %s, which is at or over its quota of %s; not "+
+			"starting; run \"bk quota\" for backups that could be removed",
+			u.FmtBytes(stored), u.FmtBytes(quota))
+	}
+	if estimate == nil || float64(stored) < quotaEstimateFraction*float64(quota) {
+		return
+	}
+	if estimate := estimate(); stored+estimate > quota {
+		log.Warning("repository uses %s of its %s quota and up to %s may be added, "+
+			"which may exceed it", u.FmtBytes(stored), u.FmtBytes(quota),
+			u.FmtBytes(estimate))
+	}
+}
+
+// warnQuota issues a warning if the repository is over its quota. It's
+// to be used after a backup or bitstream has been saved.
+func warnQuota(backend storage.Backend) {
+	quota, _ := repositoryQuota(backend)
+	if quota == 0 {
+		return
+	}
+	if stored := storedSize(backend); stored > quota {
+		log.Warning("repository now uses %s, which is over its quota of %s; run "+
+			"\"bk quota\" for backups that could be removed", u.FmtBytes(stored),
+			u.FmtBytes(quota))
+	}
+}
+
+// suggestExpiry prints the current client's backups that, along with the
+// ones given in expired, would need to be removed to reclaim at least
+// need bytes. The oldest ones are suggested first; pinned backups and
+// the most recent backup with each name aren't suggested.
+func suggestExpiry(w io.Writer, backend storage.Backend, usage *repositoryUsage,
+	expired []string, need int64) {
+	md := backend.ListMetadata()
+	pinned := pinnedSnapshots(backend)
+	owners := snapshotOwners(backend)
+	removed := make(map[string]bool)
+	for _, name := range expired {
+		removed[name] = true
+	}
+
+	r := usage.newReclaimSet()
+	latest := make(map[string]string)
+	var candidates []snapshotUsage
+	for _, s := range usage.Snapshots {
+		if removed[s.Name] {
+			r.add(s)
+			continue
+		}
+		i := strings.LastIndex(s.Name, "@")
+		if !strings.HasPrefix(s.Name, "backup-") || i == -1 || !inCurrentClient(s.Name, owners) {
+			continue
+		}
+		// Names sort in the order of their timestamps.
+		if series := s.Name[:i]; s.Name > latest[series] {
+			latest[series] = s.Name
+		}
+		if !pinned[s.Name] {
+			candidates = append(candidates, s)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return snapshotTime(candidates[i].Name, md[candidates[i].Name]).Before(
+			snapshotTime(candidates[j].Name, md[candidates[j].Name]))
+	})
+
+	t := newTable(1)
+	for _, s := range candidates {
+		if r.Freed >= need {
+			break
+		}
+		if latest[s.Name[:strings.LastIndex(s.Name, "@")]] == s.Name {
+			continue
+		}
+		r.add(s)
+		t.add(strings.TrimPrefix(s.Name, "backup-"), u.FmtBytes(r.Freed))
+	}
+	if len(t.rows) == 0 {
+		fmt.Fprintf(w, "No other backups can be suggested for removal\n")
+		return
+	}
+	also := ""
+	if len(expired) > 0 {
+		also = " as well"
+	}
+	fmt.Fprintf(w, "Removing these backups%s, oldest first, would free (running total):\n", also)
+	t.print(w, "  ")
+	if r.Freed < need {
+		fmt.Fprintf(w, "That's %s short; the others are pinned or the most "+
+			"recent with their names\n", u.FmtBytes(need-r.Freed))
+	}
+}
+
+func quota(args []string) {
+	flags := flag.NewFlagSet("quota", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk quota [--set size]\n")
+	}
+	set := flags.String("set", "", "record the given quota in the repository; 0 removes it")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	backend := GetStorageBackend()
+	if *set != "" {
+		n, err := u.ParseBytes(*set)
+		if err != nil {
+			Error("--set: %s\n", err)
+		}
+		setRepositoryQuota(backend, n)
+		if config.Quota != "" {
+			log.Warning("the quota in the configuration file is used in place of the " +
+				"repository's")
+		}
+		return
+	}
+
+	quota, from := repositoryQuota(backend)
+	if quota == 0 {
+		fmt.Printf("Quota:  none\n")
+		fmt.Printf("Stored: %s\n", u.FmtBytes(storedSize(backend)))
+		return
+	}
+	usage := diskUsage(backend)
+	stored := usage.Total()
+	fmt.Printf("Quota:  %s (from the %s)\n", u.FmtBytes(quota), from)
+	fmt.Printf("Stored: %s (%.1f%%)\n", u.FmtBytes(stored), 100*float64(stored)/float64(quota))
+	if stored <= quota {
+		return
+	}
+
+	over := stored - quota
+	fmt.Printf("Over by %s\n", u.FmtBytes(over))
+	if usage.Unreferenced > 0 {
+		fmt.Printf("%s is used by blobs that nothing refers to (see \"gc\")\n",
+			u.FmtBytes(usage.Unreferenced))
+	}
+	var expired []string
+	if len(config.Retention) > 0 {
+		if expired, err = forgetTargets(nil, backend); err != nil {
+			Error("%s\n", err)
+		}
+		if len(expired) > 0 {
+			fmt.Printf("\"bk forget --all\" would remove %d backups and free %s\n",
+				len(expired), u.FmtBytes(usage.Reclaimable(expired)))
+		}
+	}
+	if usage.Reclaimable(expired) < over {
+		suggestExpiry(os.Stdout, backend, &usage, expired, over)
+	}
+}
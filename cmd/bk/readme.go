@@ -15,9 +15,9 @@ backup-specific representations built on top of them.
 # Storage Format (both on-disk and GCS)
 
 The main task of the bk storage systems is to take chunks of data, store
-them safely, and return hashes that identify them. bk uses SHAKE256 to hash
-chunks (though that doesn't matter for restoring) and then uses 32 bytes
-worth of hash for each chunk.
+them safely, and return hashes that identify them. bk uses SHAKE256 by
+default to hash chunks (though that doesn't matter for restoring; see below
+for other options) and then uses 32 bytes worth of hash for each chunk.
 
 The packs/ directory stores pack files, which store a series of blobs.
 Each blob is stored starting with the 4-byte string "BL0B". Next is the
@@ -37,6 +37,28 @@ binary.PutVaring).
 Note that the index files can be reconstructed from the pack file contents
 alone.
 
+If the file metadata/hash.txt is present, it gives the name of the hash
+algorithm used for chunks: "shake256", "sha256", or "blake3" (using 32
+bytes of output in all cases). Otherwise, SHAKE256 is used.
+
+The version of the repository format is recorded in metadata files named
+metadata/format-v<N>, where <N> is the version number; if there is more
+than one, the largest <N> gives the current version.  Repositories without
+any such files are version 1.
+
+In GCS, the object changes/<dir> is rewritten after each change to the
+files in the <dir>/ directory; its contents don't matter. Listings of a
+directory are cached locally along with the object's generation, and are
+only used again as long as the generation is unchanged.
+
+On disk, metadata files are written through the journal/ directory. A
+subdirectory there holds a change to metadata files that was interrupted:
+its "plan" file is JSON giving the "create" and "remove" lists of file
+names, the new contents of the i'th file being created are in "create-i",
+and the i'th file being removed is moved to "remove-i". If a file named
+"committed" is present, the new files are the current ones; otherwise the
+old ones are.
+
 # Reed-Solomon encoding
 
 All files stored on disk are coded with Reed-Solomon encoding. The
@@ -78,10 +100,23 @@ Given the passphrase from the user, a 64-byte derived key is computed using
 
 	derivedKey := pbkdf2.Key([]byte(passphrase), salt, 65536, 64, sha256.New)
 
+unless the file metadata/kdf.txt is present, in which case it gives the key
+derivation function and its parameters on a single line, either
+"pbkdf2-sha256 iterations=<n>", giving the number of rounds of pbkdf2 to
+use in place of 65536, or "argon2id iterations=<n> memory=<KiB>
+threads=<n>", for which the derived key is computed using:
+
+	derivedKey := argon2.IDKey([]byte(passphrase), salt, iterations, memory, threads, 64)
+
 The first 32 bytes of the result should match the passphrase hash in
 encrypt.txt.  The last 32 bytes give the decryption key to use to decrypt
 the encrypted key from encrypt.txt. (Again, using go's AES implementation.)
 
+If the file metadata/encrypt-canary.txt is present, it has two hex-encoded
+values: an IV and the encryption of the text "bk encryption canary"
+(followed by a newline) with the decrypted key and that IV. Decrypting it
+confirms that the key was decrypted correctly.
+
 # Backing up bistreams
 
 Each bitstream backup (as done using "bk savebits") has an associated file
@@ -102,6 +137,11 @@ represented as
 type BackupRoot struct {
 	Dir  DirEntry
 	Time time.Time
+	// Files and directories that couldn't be backed up.
+	Errors []struct {
+		Path  string
+		Error string
+	}
 }
 
 and encoded using go's "gob" encode. Dir refers to the root of the
@@ -119,10 +159,20 @@ type DirEntry struct {
 	// directory, it gives the serialized []DirEntry for the files in a
 	// directory.
 	Hash storage.MerkleHash
+	// For files stored using Hash, the hash of their contents; zero
+	// otherwise.
+	Checksum storage.Hash
 	// Not used for directories or symlinks.
 	Size    int64
 	ModTime time.Time
 	Mode    os.FileMode
+	// Creation time, if available; otherwise the zero time.
+	BirthTime time.Time
+	// May be nil if ownership wasn't recorded.
+	Owner *struct {
+		Uid, Gid    int
+		User, Group string
+	}
 }
 
 The MerkleHash values are encoded as described in "Backing up bitstreams."
@@ -0,0 +1,103 @@
+// cmd/bk/rekey.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Changing the key derivation parameters of encrypted repositories.
+
+import (
+	"flag"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"os"
+)
+
+// kdfFlags holds the command-line flags that specify the key derivation
+// function for the passphrase of an encrypted repository.
+type kdfFlags struct {
+	algorithm  *string
+	iterations *int
+	memory     *string
+	threads    *int
+}
+
+func addKDFFlags(flags *flag.FlagSet) *kdfFlags {
+	return &kdfFlags{
+		algorithm: flags.String("kdf", storage.KDFArgon2id,
+			"key derivation function for the passphrase: "+storage.KDFArgon2id+" or "+
+				storage.KDFPBKDF2),
+		iterations: flags.Int("kdf-iterations", 0,
+			"iterations of the key derivation function (by default, as many as take about half a second)"),
+		memory:  flags.String("kdf-memory", "", "memory used by argon2id (by default, 64MiB)"),
+		threads: flags.Int("kdf-threads", 0, "threads used by argon2id (by default, up to 4)"),
+	}
+}
+
+// Params returns the key derivation parameters given by the flags. Invalid
+// flags are an error.
+func (k *kdfFlags) Params() storage.KDFParams {
+	params, err := storage.NewKDFParams(*k.algorithm)
+	if err != nil {
+		Error("--kdf: %s\n", err)
+	}
+	if *k.memory != "" || *k.threads != 0 {
+		if params.Algorithm != storage.KDFArgon2id {
+			Error("--kdf-memory and --kdf-threads can only be used with %s\n",
+				storage.KDFArgon2id)
+		}
+		if *k.memory != "" {
+			n, err := u.ParseBytes(*k.memory)
+			if err != nil {
+				Error("--kdf-memory: %s\n", err)
+			}
+			params.Memory = int(n >> 10)
+		}
+		if *k.threads != 0 {
+			params.Threads = *k.threads
+		}
+	}
+	if *k.iterations != 0 {
+		params.Iterations = *k.iterations
+	} else {
+		params = params.Calibrate()
+	}
+	if err := params.Validate(); err != nil {
+		Error("%s\n", err)
+	}
+	log.Verbose("passphrase key derivation: %s", params)
+	return params
+}
+
+func rekey(args []string) {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk rekey [--kdf algorithm] [--kdf-iterations n] [--kdf-memory size]\n" +
+			"\t[--kdf-threads n]\n")
+	}
+	kdf := addKDFFlags(flags)
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	backend := getBaseBackend()
+	if !backend.MetadataExists("readme_bk.txt") {
+		Error("%s: repository hasn't been initialized.\n", backend.String())
+	}
+	checkFormat(backend)
+	passphrase := os.Getenv("BK_PASSPHRASE")
+	if passphrase == "" {
+		Error("BK_PASSPHRASE environment variable not set.\n")
+	}
+
+	params := kdf.Params()
+	old := storage.RepositoryKDF(backend)
+	if err := storage.Rekey(backend, passphrase, params); err != nil {
+		Error("%s: %s\n", backend.String(), err)
+	}
+	log.Print("%s: passphrase key derivation changed from %s to %s", backend.String(),
+		old, params)
+}
@@ -0,0 +1,141 @@
+// cmd/bk/rename.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Renaming backups and bitstreams.
+
+import (
+	"fmt"
+	"github.com/mmp/bk/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+// renameTargets returns a map from the full metadata names of the
+// snapshots selected by old to the names they should be renamed to so
+// that they're named new. If old is just a name, as given to "bk backup"
+// or "bk savebits", all of the snapshots with that name are renamed;
+// otherwise, it may select a single one in any of the ways accepted by
+// getLatest. Snapshots keep the timestamps in their names.
+func renameTargets(old, new string, backend storage.Backend) (map[string]string, error) {
+	if new == "" || strings.ContainsAny(new, "@~:/"+clientSeparator) {
+		return nil, fmt.Errorf("%s: new names can't include '@', '~', ':', '/', or '%s'",
+			new, clientSeparator)
+	}
+
+	// Snapshots stay with the client they belong to.
+	owners := snapshotOwners(backend)
+	renamed := func(name string) string {
+		if c := owners[name]; c != "" {
+			return c + clientSeparator + new
+		}
+		return new
+	}
+
+	targets := make(map[string]string)
+	client, rest := snapshotClient(old)
+	single := strings.ContainsAny(rest, "@~:")
+	if !single {
+		// Unless a client was given, the current client's snapshots are
+		// tried before any that were made without a client name.
+		names := []string{qualifySnapshotName(old)}
+		if client == "" && names[0] != old {
+			names = append(names, old)
+		}
+	search:
+		for _, n := range names {
+			for _, prefix := range []string{"backup-", "bits-"} {
+				backend.ForMetadata(prefix+n, func(name string, created time.Time) error {
+					if name == prefix+n || strings.HasPrefix(name, prefix+n+"@") {
+						targets[name] = prefix + renamed(name) + strings.TrimPrefix(name, prefix+n)
+					}
+					return nil
+				})
+				if len(targets) > 0 {
+					break search
+				}
+			}
+		}
+	}
+	// Otherwise it selects a single snapshot; a name that doesn't match
+	// any may still be a backup's ID.
+	if single || (len(targets) == 0 && isShortID(old)) {
+		name, err := resolveSnapshot(old, backend)
+		if err != nil {
+			return nil, err
+		}
+		prefix, _ := splitSnapshotPrefix(name)
+		targets[name] = prefix + renamed(name)
+		if i := strings.LastIndex(name, "@"); i != -1 {
+			targets[name] += name[i:]
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s: no backups or bitstreams found", old)
+	}
+
+	var tos []string
+	for _, to := range targets {
+		tos = append(tos, to)
+	}
+	for to, exists := range backend.MetadataExistsBatch(tos) {
+		if exists {
+			return nil, fmt.Errorf("%s: already exists", to)
+		}
+	}
+	return targets, nil
+}
+
+// renameSnapshots renames the given snapshots, updating their pins,
+// signatures, and ownership records as well. All of the new names are
+// written before any of the old ones are removed, so if it's interrupted,
+// no snapshot is lost, though some may be present under both names.
+func renameSnapshots(targets map[string]string, backend storage.Backend) {
+	var olds []string
+	for old := range targets {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+
+	owners := snapshotOwners(backend)
+	contents := backend.ReadMetadataBatch(olds)
+	renamed := make(map[string][]byte)
+	for _, old := range olds {
+		log.Verbose("%s: renaming to %s", old, targets[old])
+		// A record may have been left for the new name by a run of bk
+		// that didn't finish saving a snapshot with it.
+		if c := owners[old]; c != "" && owners[targets[old]] != c {
+			renamed[ownerName(c, targets[old])] = []byte(c + "\n")
+		}
+		renamed[targets[old]] = contents[old]
+	}
+	backend.WriteMetadataBatch(renamed)
+	backend.SyncWrites()
+
+	pinned := pinnedSnapshots(backend)
+	var pins, unpins []string
+	for _, old := range olds {
+		if pinned[old] {
+			pins = append(pins, targets[old])
+			unpins = append(unpins, old)
+		}
+	}
+	if len(pins) > 0 {
+		setPinned(backend, pins, true)
+	}
+	renameSignatures(targets, backend)
+
+	for _, old := range olds {
+		backend.DeleteMetadata(old)
+		if c := owners[old]; c != "" {
+			backend.DeleteMetadata(ownerName(c, old))
+		}
+	}
+	if len(unpins) > 0 {
+		setPinned(backend, unpins, false)
+	}
+	backend.SyncWrites()
+}
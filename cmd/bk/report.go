@@ -0,0 +1,287 @@
+// cmd/bk/report.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Reporting the results of backup and savebits runs to monitoring systems.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runSummary records what happened during a single backup or savebits
+// run.
+type runSummary struct {
+	// "backup" or "bits".
+	Type string `json:"type"`
+	// The name given by the user and the full name (with the timestamp) of
+	// the stored backup.
+	Name     string        `json:"name"`
+	FullName string        `json:"full_name"`
+	Success  bool          `json:"success"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Stats    storage.Stats `json:"stats"`
+	Errors   int           `json:"errors"`
+	// Files that were modified while they were being backed up.
+	ModifiedFiles []string `json:"modified_files,omitempty"`
+	// For backups, the number of regular files found, how many of them
+	// were new or changed and so were read, and the bytes read from them.
+	Files        int   `json:"files"`
+	NewFiles     int   `json:"new_files"`
+	ChangedFiles int   `json:"changed_files"`
+	BytesRead    int64 `json:"bytes_read"`
+	// For failed runs, the fatal error message, if any.
+	Message string `json:"message,omitempty"`
+}
+
+// runReporter handles the command-line flags related to reporting the
+// results of a run and then sends the reports at the end of it.
+type runReporter struct {
+	metricsFile, summaryFile, notifyURL, notifyFailURL *string
+	summary                                            runSummary
+	// May be nil if the run fails before the storage backend is opened.
+	backend storage.Backend
+}
+
+func addRunReporterFlags(flags *flag.FlagSet) *runReporter {
+	return &runReporter{
+		metricsFile: flags.String("metrics-file", "",
+			"file to write Prometheus metrics about the run to"),
+		summaryFile: flags.String("summary-file", "",
+			"file to write a JSON summary of the run to"),
+		notifyURL: flags.String("notify-url", os.Getenv("BK_NOTIFY_URL"),
+			"URL to POST a JSON summary of the run to"),
+		notifyFailURL: flags.String("notify-fail-url", os.Getenv("BK_NOTIFY_FAIL_URL"),
+			"URL to POST a JSON summary of failed runs to (default: --notify-url)"),
+	}
+}
+
+// Begin should be called at the start of the run; from then on, if the
+// run fails with a fatal error, reports will still be sent.
+func (r *runReporter) Begin(typ, name, fullName string, start time.Time) {
+	r.summary = runSummary{Type: typ, Name: name, FullName: fullName, Start: start}
+	log.AddFatalHook(func(msg string) {
+		r.summary.Message = strings.TrimSpace(msg)
+		r.finish(false)
+		r.report()
+	})
+}
+
+// End should be called after a run completes; along with sending the
+// reports, it stores the run's summary in the repository for "bk
+// history".
+func (r *runReporter) End() {
+	r.finish(log.NErrors == 0)
+	if r.backend != nil {
+		saveSummary(r.summary, r.backend)
+	}
+	r.report()
+}
+
+// finish fills in the parts of the summary that are known once the run
+// is over.
+func (r *runReporter) finish(success bool) {
+	s := &r.summary
+	s.Success = success
+	s.Duration = time.Since(s.Start)
+	s.Errors = log.NErrors
+	if r.backend != nil {
+		s.Stats = r.backend.Stats()
+	}
+}
+
+func (r *runReporter) report() {
+	s := &r.summary
+	success := s.Success
+	if *r.metricsFile != "" {
+		writeMetricsFile(*r.metricsFile, *s)
+	}
+	if *r.summaryFile != "" {
+		writeSummaryFile(*r.summaryFile, *s)
+	}
+	url := *r.notifyURL
+	if !success && *r.notifyFailURL != "" {
+		url = *r.notifyFailURL
+	}
+	if url != "" {
+		notify(url, *s)
+	}
+	if e := config.Email; e != nil &&
+		(e.When == "always" || (e.When == "success") == success) {
+		sendEmail(e, *s)
+	}
+}
+
+// DedupRatio returns the ratio of bytes that were processed to bytes that
+// actually needed to be uploaded; it thus reflects the benefits of both
+// deduplication and compression.
+func (s runSummary) DedupRatio() float64 {
+	if s.Stats.BytesStored == 0 {
+		return 0
+	}
+	return float64(s.Stats.BytesWritten) / float64(s.Stats.BytesStored)
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Webhooks
+
+// notify POSTs the summary as JSON to the given URL. Failures to deliver
+// the notification are reported as warnings, rather than errors, so that
+// they don't change the outcome of the run.
+func notify(url string, s runSummary) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		log.Warning("%s: %s", url, err)
+		return
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Warning("%s: %s", url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Warning("%s: %s", url, resp.Status)
+	} else {
+		log.Verbose("%s: sent notification", url)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Summary files
+
+// writeSummaryFile writes the summary to the given file as JSON, in the
+// same form that's sent to --notify-url, for scripts and monitoring
+// agents that run bk and then read the file.
+func writeSummaryFile(path string, s runSummary) {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Error("%s: %s", path, err)
+		return
+	}
+	writeFileAtomically(path, append(b, '\n'))
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Email
+
+func sendEmail(e *EmailConfig, s runSummary) {
+	status := "succeeded"
+	if !s.Success {
+		status = "FAILED"
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", e.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&body, "Subject: bk %s %s: %s\r\n", s.Type, s.Name, status)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "\r\n")
+	fmt.Fprintf(&body, "Name: %s\r\n", s.FullName)
+	fmt.Fprintf(&body, "Status: %s\r\n", status)
+	if s.Message != "" {
+		fmt.Fprintf(&body, "Message: %s\r\n", s.Message)
+	}
+	if host, err := os.Hostname(); err == nil {
+		fmt.Fprintf(&body, "Host: %s\r\n", host)
+	}
+	fmt.Fprintf(&body, "Started: %s\r\n", s.Start.Format(time.RFC1123))
+	fmt.Fprintf(&body, "Duration: %s\r\n", s.Duration.Round(time.Second))
+	fmt.Fprintf(&body, "Errors: %d\r\n", s.Errors)
+	if len(s.ModifiedFiles) > 0 {
+		fmt.Fprintf(&body, "Files modified during backup: %d\r\n", len(s.ModifiedFiles))
+		for _, f := range s.ModifiedFiles {
+			fmt.Fprintf(&body, "  %s\r\n", f)
+		}
+	}
+	fmt.Fprintf(&body, "Processed: %s in %d chunks\r\n",
+		u.FmtBytes(s.Stats.BytesWritten), s.Stats.ChunksWritten)
+	fmt.Fprintf(&body, "Uploaded: %s in %d chunks\r\n",
+		u.FmtBytes(s.Stats.BytesStored), s.Stats.ChunksStored)
+
+	var auth smtp.Auth
+	if e.Username != "" {
+		host, _, err := net.SplitHostPort(e.Server)
+		if err != nil {
+			log.Warning("%s: %s", e.Server, err)
+			return
+		}
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+	if err := smtp.SendMail(e.Server, auth, e.From, e.To, body.Bytes()); err != nil {
+		log.Warning("%s: unable to send email: %s", e.Server, err)
+	} else {
+		log.Verbose("%s: sent notification email", e.Server)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Prometheus metrics
+
+// writeMetricsFile writes the given summary to the given file using the
+// Prometheus text exposition format, suitable for node_exporter's
+// textfile collector. The file is written atomically so that the collector
+// never sees a partial file.
+func writeMetricsFile(path string, s runSummary) {
+	var buf bytes.Buffer
+	labels := fmt.Sprintf(`{type="%s",name="%s"}`, s.Type, promEscape(s.Name))
+	metric := func(name, help string, value interface{}) {
+		fmt.Fprintf(&buf, "# HELP bk_%s %s\n", name, help)
+		fmt.Fprintf(&buf, "# TYPE bk_%s gauge\n", name)
+		fmt.Fprintf(&buf, "bk_%s%s %v\n", name, labels, value)
+	}
+
+	success := 0
+	if s.Success {
+		success = 1
+	}
+	metric("last_run_success", "Whether the last run completed without errors.", success)
+	metric("last_run_timestamp_seconds", "Time the last run started.", s.Start.Unix())
+	metric("last_run_duration_seconds", "Duration of the last run.", s.Duration.Seconds())
+	metric("last_run_bytes_processed", "Bytes passed to storage during the last run.",
+		s.Stats.BytesWritten)
+	metric("last_run_bytes_uploaded", "Bytes added to storage during the last run.",
+		s.Stats.BytesStored)
+	metric("last_run_dedup_ratio", "Ratio of bytes processed to bytes uploaded.",
+		s.DedupRatio())
+	metric("last_run_errors", "Number of errors reported during the last run.", s.Errors)
+	metric("last_run_modified_files", "Number of files modified while being backed up.",
+		len(s.ModifiedFiles))
+
+	writeFileAtomically(path, buf.Bytes())
+}
+
+// writeFileAtomically writes the given contents to a temporary file and
+// then renames it to the given path, so that readers never see a partial
+// file. Errors are reported but aren't fatal.
+func writeFileAtomically(path string, contents []byte) {
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmpPath, contents, 0644); err != nil {
+		log.Error("%s: %s", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		log.Error("%s: %s", path, err)
+	}
+}
+
+func promEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,226 @@
+// cmd/bk/scrub.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Verifying the repository's blobs a bit at a time.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	u "github.com/mmp/bk/util"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// "bk scrub" reads and verifies blobs in order of their hashes for a
+// limited time, recording where it stopped in the metadata named
+// scrubName so that the next run carries on from there. Once it reaches
+// the last blob, the pass is complete and the following run starts over
+// with the first. Blobs are read from the base backend, which verifies
+// that the hash of each one's stored data matches (and repairs it, if it
+// can); there's no need to decrypt or decompress them, so the passphrase
+// isn't needed. Blobs added during a pass with hashes before the cursor
+// are left for the next one.
+const scrubName = "scrub.txt"
+
+// scrubState is the JSON-encoded contents of the scrubName metadata.
+type scrubState struct {
+	// Hash of the last blob verified in the current pass; empty if a
+	// new pass is to be started.
+	Cursor string `json:"cursor"`
+	// When the current pass started and the number of blobs and stored
+	// bytes it has verified so far.
+	PassStarted time.Time `json:"pass_started"`
+	Blobs       int64     `json:"blobs"`
+	Bytes       int64     `json:"bytes"`
+	// When the last complete pass started and finished; zero if there
+	// hasn't been one.
+	LastPassStarted  time.Time `json:"last_pass_started"`
+	LastPassFinished time.Time `json:"last_pass_finished"`
+}
+
+// reset returns the state for starting a new pass, which only keeps the
+// record of the last complete one.
+func (s scrubState) reset() scrubState {
+	return scrubState{LastPassStarted: s.LastPassStarted, LastPassFinished: s.LastPassFinished}
+}
+
+func readScrubState(backend storage.Backend) scrubState {
+	var s scrubState
+	if backend.MetadataExists(scrubName) {
+		if err := json.Unmarshal(backend.ReadMetadata(scrubName), &s); err != nil {
+			log.Warning("%s: %s; starting a new pass", scrubName, err)
+			return scrubState{}
+		}
+	}
+	return s
+}
+
+func writeScrubState(backend storage.Backend, s scrubState) {
+	b, err := json.Marshal(s)
+	log.CheckError(err)
+	if backend.MetadataExists(scrubName) {
+		backend.DeleteMetadata(scrubName)
+	}
+	backend.WriteMetadata(scrubName, append(b, '\n'))
+	backend.SyncWrites()
+}
+
+// scrubBlob reads the blob with the given hash, returning its stored
+// size.
+func scrubBlob(backend storage.Backend, hash storage.Hash) (int64, error) {
+	r, err := backend.Read(hash)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func scrub(args []string) {
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk scrub [--time duration] [--jobs n] [--status] [--restart]\n")
+	}
+	limit := flags.Duration("time", 30*time.Minute, "how long to spend verifying blobs")
+	jobs := flags.Int("jobs", 16, "number of blobs to verify concurrently")
+	status := flags.Bool("status", false, "report the progress of the current pass without verifying anything")
+	restart := flags.Bool("restart", false, "start a new pass rather than continuing the current one")
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+	if *limit <= 0 || *jobs < 1 {
+		Error("--time and --jobs must be positive\n")
+	}
+
+	backend := getBaseBackend()
+	if !backend.MetadataExists("readme_bk.txt") {
+		Error("%s: destination hasn't been initialized. Run 'bk init'.\n", backend.String())
+	}
+	checkFormat(backend)
+	useRepositoryHash(backend)
+
+	var hashes []storage.Hash
+	for h := range backend.Hashes() {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+
+	state := readScrubState(backend)
+	if *restart {
+		state = state.reset()
+	}
+	var cursor storage.Hash
+	if state.Cursor != "" {
+		b, err := hex.DecodeString(state.Cursor)
+		if err != nil || len(b) != len(cursor) {
+			log.Warning("%s: invalid cursor; starting a new pass", state.Cursor)
+			state = state.reset()
+		} else {
+			copy(cursor[:], b)
+		}
+	}
+	// Index of the first blob to verify.
+	start := 0
+	if state.Cursor != "" {
+		start = sort.Search(len(hashes), func(i int) bool {
+			return bytes.Compare(hashes[i][:], cursor[:]) > 0
+		})
+	}
+
+	if *status {
+		printScrubStatus(state, start, len(hashes))
+		return
+	}
+
+	begin := time.Now()
+	if state.Cursor == "" {
+		state.PassStarted = begin.UTC()
+	}
+	deadline := begin.Add(*limit)
+	var mu sync.Mutex
+	var blobs, stored int64
+	hashChan := make(chan storage.Hash, *jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < *jobs; i++ {
+		wg.Add(1)
+		go func() {
+			for h := range hashChan {
+				n, err := scrubBlob(backend, h)
+				if err != nil {
+					log.Error("%s: %s", h, err)
+				}
+				mu.Lock()
+				blobs++
+				stored += n
+				mu.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+
+	// All of the blobs that have been sent to the workers have been
+	// verified once they've finished, so the cursor is the last one sent.
+	progress := &u.ProgressReporter{Msg: "Verified blobs", Total: int64(len(hashes) - start)}
+	next := start
+	for ; next < len(hashes) && time.Now().Before(deadline); next++ {
+		hashChan <- hashes[next]
+		progress.Add(1)
+	}
+	close(hashChan)
+	wg.Wait()
+	progress.Finish()
+
+	state.Blobs += blobs
+	state.Bytes += stored
+	if next == len(hashes) {
+		log.Print("completed a pass over %d blobs (%s) started %s", state.Blobs,
+			u.FmtBytes(state.Bytes), state.PassStarted.Local().Format(time.RFC1123))
+		state = scrubState{LastPassStarted: state.PassStarted,
+			LastPassFinished: time.Now().UTC()}
+	} else if next > 0 {
+		state.Cursor = hashes[next-1].String()
+	}
+	writeScrubState(backend, state)
+
+	log.Print("verified %d blobs (%s) in %s", blobs, u.FmtBytes(stored),
+		time.Since(begin).Round(time.Second))
+	if state.Cursor != "" {
+		printScrubStatus(state, next, len(hashes))
+	}
+	backend.LogStats()
+}
+
+// printScrubStatus reports the progress of the pass described by the
+// given state, where done blobs of the total have been verified.
+func printScrubStatus(s scrubState, done, total int) {
+	if s.Cursor == "" {
+		fmt.Printf("Current pass: not started\n")
+	} else {
+		fmt.Printf("Current pass: started %s; %d of %d blobs (%.1f%%) verified\n",
+			s.PassStarted.Local().Format(time.RFC1123), done, total,
+			100*float64(done)/float64(total))
+	}
+	if s.LastPassFinished.IsZero() {
+		fmt.Printf("Last pass:    none\n")
+	} else {
+		fmt.Printf("Last pass:    started %s, finished %s\n",
+			s.LastPassStarted.Local().Format(time.RFC1123),
+			s.LastPassFinished.Local().Format(time.RFC1123))
+	}
+}
@@ -0,0 +1,319 @@
+// cmd/bk/selftest.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Checking that this build of bk works correctly on this platform.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mmp/bk/backup"
+	"github.com/mmp/bk/storage"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// "bk selftest" runs each of the selfTests in turn. They use known test
+// vectors where the results are fixed (hashes, how data is split into
+// chunks, decompression, and the ciphers used for encryption) and round
+// trips through the storage layers otherwise, finishing with a backup and
+// restore of a small directory tree using a repository in memory; no
+// repository needs to be given. Some failures in the storage layers are
+// fatal errors there, in which case bk exits before the remaining tests
+// are run.
+type selfTest struct {
+	name string
+	run  func() error
+}
+
+var selfTests = []selfTest{
+	{"hash", selfTestHash},
+	{"chunker", selfTestChunker},
+	{"compression", selfTestCompression},
+	{"encryption", selfTestEncryption},
+	{"repository", selfTestRepository},
+}
+
+// selfTestData returns n bytes of pseudo-random data that are the same on
+// all platforms, generated with xorshift64*.
+func selfTestData(n int) []byte {
+	b := make([]byte, n)
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := 0; i < n; i += 8 {
+		x ^= x >> 12
+		x ^= x << 25
+		x ^= x >> 27
+		var v [8]byte
+		binary.LittleEndian.PutUint64(v[:], x*0x2545f4914f6cdd1d)
+		copy(b[i:], v[:])
+	}
+	return b
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	log.CheckError(err)
+	return b
+}
+
+func selfTestHash() error {
+	// Each algorithm's hash of "abc", from the published test vectors.
+	vectors := map[string]string{
+		"shake256": "483366601360a8771c6863080cc4114d8db44530f8f1e1ee4f94ea37e78b5739",
+		"sha256":   "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		"blake3":   "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+	}
+	defer storage.SetHashAlgorithm(storage.DefaultHashAlgorithm)
+
+	data := selfTestData(100000)
+	for _, name := range storage.HashAlgorithms() {
+		if err := storage.SetHashAlgorithm(name); err != nil {
+			return err
+		}
+		want, ok := vectors[name]
+		if !ok {
+			return fmt.Errorf("%s: no test vector", name)
+		}
+		if h := storage.HashBytes([]byte("abc")); h.String() != want {
+			return fmt.Errorf("%s: got %s for \"abc\"; expected %s", name, h, want)
+		}
+
+		// Hashing incrementally, in pieces of varying sizes, must give
+		// the same result.
+		hasher := storage.NewHasher()
+		for i, n := 0, 1; i < len(data); i, n = i+n, 2*n+1 {
+			if i+n > len(data) {
+				n = len(data) - i
+			}
+			hasher.Write(data[i : i+n])
+		}
+		if hasher.Sum() != storage.HashBytes(data) {
+			return fmt.Errorf("%s: incremental hash doesn't match", name)
+		}
+	}
+	return nil
+}
+
+func selfTestChunker() error {
+	// The number of chunks that selfTestData(1<<20) is split into with 13
+	// split bits and the SHA-256 hash of their lengths, each encoded as a
+	// little-endian uint32. If the chunker's behavior changes, new backups
+	// won't deduplicate against old ones.
+	const wantChunks = 124
+	const wantLengths = "50e09b7f9eb28d61a5ee0660c44ddbfba8147e23b86a14fc4cdebc312a9ca157"
+
+	data := selfTestData(1 << 20)
+	hs := storage.NewHashSplitter(13)
+	r := bytes.NewReader(data)
+	var joined []byte
+	lengths := sha256.New()
+	chunks := 0
+	for {
+		chunk := hs.SplitFromReader(r)
+		if len(chunk) == 0 {
+			break
+		}
+		joined = append(joined, chunk...)
+		binary.Write(lengths, binary.LittleEndian, uint32(len(chunk)))
+		chunks++
+		hs.Reset()
+	}
+
+	if !bytes.Equal(joined, data) {
+		return errors.New("chunks don't match the original data")
+	}
+	if got := hex.EncodeToString(lengths.Sum(nil)); chunks != wantChunks || got != wantLengths {
+		return fmt.Errorf("got %d chunks with lengths hash %s; expected %d with %s",
+			chunks, got, wantChunks, wantLengths)
+	}
+	return nil
+}
+
+func selfTestCompression() error {
+	// gzip -n of "bk compression self-test\n", as stored by the compressed
+	// backend, with a leading 1 to indicate that it's compressed.
+	const plain = "bk compression self-test\n"
+	stored := mustHex("011f8b08000000000000034bca5648cecf2d284a2d2ececccf53284ecd49d3" +
+		"2d492d2ee102002f92d65319000000")
+
+	mem := storage.NewMemory()
+	backend := storage.NewCompressed(mem)
+	got, err := readBlob(mem.Write(stored), backend)
+	if err != nil {
+		return err
+	}
+	if string(got) != plain {
+		return fmt.Errorf("decompressed test vector to %q; expected %q", got, plain)
+	}
+
+	// Round trips of data that compresses well and data that doesn't.
+	for _, data := range [][]byte{bytes.Repeat([]byte("bk "), 10000), selfTestData(10000)} {
+		h := backend.Write(data)
+		if got, err := readBlob(h, backend); err != nil {
+			return err
+		} else if !bytes.Equal(got, data) {
+			return errors.New("data read doesn't match data written")
+		}
+	}
+	return nil
+}
+
+func selfTestEncryption() error {
+	// CFB-AES256 from NIST SP 800-38A, F.3.17.
+	block, err := aes.NewCipher(mustHex("603deb1015ca71be2b73aef0857d7781" +
+		"1f352c073b6108d72d9810a30914dff4"))
+	if err != nil {
+		return err
+	}
+	ct := make([]byte, aes.BlockSize)
+	cipher.NewCFBEncrypter(block, mustHex("000102030405060708090a0b0c0d0e0f")).XORKeyStream(ct,
+		mustHex("6bc1bee22e409f96e93d7e117393172a"))
+	if want := "dc7e84bfda79164b7ecd8486985d3860"; hex.EncodeToString(ct) != want {
+		return fmt.Errorf("AES-CFB: got %x; expected %s", ct, want)
+	}
+
+	// PBKDF2-HMAC-SHA256 from RFC 7914, section 11.
+	dk := pbkdf2.Key([]byte("passwd"), []byte("salt"), 1, 64, sha256.New)
+	if want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"; hex.EncodeToString(dk) != want {
+		return fmt.Errorf("PBKDF2: got %x; expected %s", dk, want)
+	}
+
+	// A round trip through the encrypted backend, reopening it with the
+	// passphrase as would be done by a later run of bk.
+	const passphrase = "bk self-test"
+	mem := storage.NewMemory()
+	backend := storage.NewEncrypted(mem, passphrase)
+	data := selfTestData(10000)
+	h := backend.Write(data)
+	backend.WriteMetadata("selftest", []byte("metadata"))
+	backend.SyncWrites()
+
+	if stored, err := readBlob(h, mem); err != nil {
+		return err
+	} else if bytes.Contains(stored, data[:64]) {
+		return errors.New("stored data isn't encrypted")
+	}
+	backend = storage.NewEncrypted(mem, passphrase)
+	if got, err := readBlob(h, backend); err != nil {
+		return err
+	} else if !bytes.Equal(got, data) {
+		return errors.New("decrypted data doesn't match data written")
+	}
+	if got := backend.ReadMetadata("selftest"); string(got) != "metadata" {
+		return fmt.Errorf("read metadata %q; expected \"metadata\"", got)
+	}
+	if h2 := backend.Write(data); h2 != h {
+		return errors.New("data written again wasn't deduplicated")
+	}
+	return nil
+}
+
+func selfTestRepository() error {
+	tmp, err := ioutil.TempDir("", "bk-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// A small tree with empty and multi-chunk files and a nested directory.
+	src := filepath.Join(tmp, "src")
+	files := map[string][]byte{
+		"empty":             nil,
+		"small":             []byte("bk self-test\n"),
+		"large":             selfTestData(1 << 20),
+		"dir/same-as-large": selfTestData(1 << 20),
+		"dir/sub/file":      bytes.Repeat([]byte("bk "), 100000),
+	}
+	for name, contents := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			return err
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink("small", filepath.Join(src, "link")); err != nil {
+			return err
+		}
+	}
+
+	backend := storage.NewCompressed(storage.NewEncrypted(storage.NewMemory(), "bk self-test"))
+	result, err := backup.Backup(context.Background(), src, backend,
+		backup.BackupOptions{SplitBits: 13, StreamDirEntries: true})
+	if err != nil {
+		return err
+	}
+	backend.SyncWrites()
+
+	r, err := backup.NewBackupReader(result.Hash, backend)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(tmp, "dst")
+	if res, err := r.Restore(context.Background(), "/", dst, backup.RestoreOptions{Jobs: 4}); err != nil {
+		return err
+	} else if len(res.Errors) > 0 {
+		return res.Errors[0]
+	}
+	for _, dir := range []string{src, dst} {
+		var diffs []string
+		err := r.Compare("/", dir, true, nil, func(kind byte, path, detail string) {
+			diffs = append(diffs, fmt.Sprintf("%c %s %s", kind, path, detail))
+		})
+		if err != nil {
+			return err
+		}
+		if len(diffs) > 0 {
+			return fmt.Errorf("%s doesn't match the backup: %v", dir, diffs)
+		}
+	}
+	return nil
+}
+
+func selftest(args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	flags.Usage = func() {
+		Error("usage: bk selftest\n")
+	}
+	err := flags.Parse(args)
+	if err == flag.ErrHelp || flags.NArg() != 0 {
+		flags.Usage()
+	} else if err != nil {
+		Error("%s\n", err)
+	}
+
+	fmt.Printf("bk self-test: %s/%s, %s\n", runtime.GOOS, runtime.GOARCH, runtime.Version())
+	failed := 0
+	for _, t := range selfTests {
+		start := time.Now()
+		if err := t.run(); err != nil {
+			fmt.Printf("%-12s FAILED: %s\n", t.name, err)
+			failed++
+		} else {
+			fmt.Printf("%-12s ok (%s)\n", t.name, time.Since(start).Round(time.Millisecond))
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d tests failed; this build of bk shouldn't be trusted with data\n",
+			failed, len(selfTests))
+		os.Exit(1)
+	}
+	fmt.Printf("All %d tests passed\n", len(selfTests))
+}
@@ -0,0 +1,134 @@
+// cmd/bk/signature.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Signing backups with an external command, such as gpg.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mmp/bk/storage"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// If the configuration file gives a signing command, "bk backup" signs a
+// message giving the new backup's full metadata name and the hash of its
+// BackupRoot and stores the signature in metadata named with
+// signaturePrefix followed by the backup's metadata name. Since the name
+// is included, a signature can't be used for a different backup, even
+// one with the same contents. Verifying the signature thus confirms that
+// the backup with that name is one that the holder of the signing key
+// made.
+const signaturePrefix = "signature-"
+
+// signatureMessage returns the message that's signed for the backup with
+// the given full metadata name and root hash.
+func signatureMessage(name string, hash storage.Hash) []byte {
+	return []byte(fmt.Sprintf("bk backup %s %s\n", name, hash))
+}
+
+// signBackup runs the signing command for the given backup, which must
+// already have been saved, and stores the signature, replacing any
+// existing one. If no signing command is configured, it does nothing.
+func signBackup(name string, hash storage.Hash, backend storage.Backend) error {
+	if config.Signing == nil || config.Signing.Sign == "" {
+		return nil
+	}
+	cmd := shellCommand(config.Signing.Sign)
+	cmd.Stdin = bytes.NewReader(signatureMessage(name, hash))
+	cmd.Stderr = os.Stderr
+	sig, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%s: %s", config.Signing.Sign, err)
+	}
+	if len(sig) == 0 {
+		return fmt.Errorf("%s: no signature printed", config.Signing.Sign)
+	}
+
+	if old := signaturePrefix + name; backend.MetadataExists(old) {
+		return backend.ReplaceMetadata(old, backend.ReadMetadata(old), sig)
+	}
+	return backend.CreateMetadata(signaturePrefix+name, sig)
+}
+
+// updateSignature signs the given backup, which has just been saved,
+// possibly replacing an earlier one with the same name. If it can't be
+// signed, any signature of the one it replaced is removed, since it's no
+// longer valid.
+func updateSignature(name string, hash storage.Hash, backend storage.Backend) {
+	err := signBackup(name, hash, backend)
+	if err != nil {
+		log.Error("%s: couldn't sign backup: %s", strings.TrimPrefix(name, "backup-"), err)
+	}
+	if (err != nil || config.Signing == nil || config.Signing.Sign == "") &&
+		backend.MetadataExists(signaturePrefix+name) {
+		backend.DeleteMetadata(signaturePrefix + name)
+	}
+}
+
+// verifySignature verifies the signature of the backup with the given
+// full metadata name and root hash with the configured verification
+// command.
+func verifySignature(name string, hash storage.Hash, backend storage.Backend) error {
+	if config.Signing == nil || config.Signing.Verify == "" {
+		return errors.New("no \"verify\" command for signatures is given in the " +
+			"configuration file")
+	}
+	if !backend.MetadataExists(signaturePrefix + name) {
+		return errors.New("backup isn't signed")
+	}
+
+	f, err := ioutil.TempFile("", "bk-signature")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(backend.ReadMetadata(signaturePrefix + name))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd := shellCommand(config.Signing.Verify)
+	cmd.Env = append(os.Environ(), "BK_SIGNATURE="+f.Name())
+	cmd.Stdin = bytes.NewReader(signatureMessage(name, hash))
+	out, err := cmd.CombinedOutput()
+	log.Verbose("%s: %s", config.Signing.Verify, strings.TrimSpace(string(out)))
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %s: %s", err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// renameSignatures updates the signatures of the renamed backups given by
+// the map from their old full metadata names to their new ones, which
+// must already have been written. The new names are signed if a signing
+// command is configured; otherwise, the old signatures are removed, since
+// they're no longer valid.
+func renameSignatures(targets map[string]string, backend storage.Backend) {
+	for old, new := range targets {
+		if !strings.HasPrefix(old, "backup-") ||
+			!backend.MetadataExists(signaturePrefix+old) {
+			continue
+		}
+		if config.Signing != nil && config.Signing.Sign != "" {
+			// Any old signature for the new name, left from a backup that
+			// had it and was renamed or removed, is replaced.
+			if err := signBackup(new, lookupHash(new, backend), backend); err != nil {
+				log.Error("%s: %s", new, err)
+			}
+		} else {
+			log.Warning("%s: no signing command is configured; the renamed backup "+
+				"is no longer signed", strings.TrimPrefix(new, "backup-"))
+		}
+		backend.DeleteMetadata(signaturePrefix + old)
+	}
+}
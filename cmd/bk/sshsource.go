@@ -0,0 +1,150 @@
+// cmd/bk/sshsource.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Backing up files from other machines over SSH.
+
+import (
+	"fmt"
+	"github.com/mmp/bk/backup"
+	"github.com/pkg/sftp"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// isRemoteSource reports whether the given directory to back up is a URL
+// for another machine, rather than a local path.
+func isRemoteSource(dir string) bool {
+	return strings.HasPrefix(dir, "ssh://")
+}
+
+// sshSource is a FileSource that reads files from another machine using
+// SFTP. The connection is made by running the system's ssh command, so the
+// user's SSH configuration, keys, and agent are all used as usual; the
+// machine being backed up only needs to run an SSH server with SFTP
+// enabled and never has access to the repository.
+type sshSource struct {
+	cmd    *exec.Cmd
+	client *sftp.Client
+}
+
+// parseSSHSource parses a URL of the form ssh://[user@]host[:port]/path.
+// For consistency with scp, ssh://[user@]host:/path is accepted as well.
+// It returns the arguments to pass to ssh and the path on the remote
+// machine.
+func parseSSHSource(source string) (args []string, dir string, err error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" || u.Path == "" {
+		return nil, "", fmt.Errorf("%s: expected ssh://[user@]host[:port]/path", source)
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	return append(args, host), u.Path, nil
+}
+
+// newSSHSource connects to the machine given by the URL, returning a
+// FileSource for it and the path to back up there.
+func newSSHSource(source string) (*sshSource, string, error) {
+	args, dir, err := parseSSHSource(source)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// "-s sftp" runs the SFTP subsystem rather than a command.
+	cmd := exec.Command("ssh", append(args, "-s", "sftp")...)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	log.Verbose("running %s", strings.Join(cmd.Args, " "))
+	if err := cmd.Start(); err != nil {
+		return nil, "", err
+	}
+
+	client, err := sftp.NewClientPipe(r, w)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, "", fmt.Errorf("%s: %s", source, err)
+	}
+	return &sshSource{cmd: cmd, client: client}, dir, nil
+}
+
+// Close closes the connection.
+func (s *sshSource) Close() error {
+	err := s.client.Close()
+	if werr := s.cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func (s *sshSource) Stat(p string) (os.FileInfo, error) {
+	fi, err := s.client.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{fi}, nil
+}
+
+func (s *sshSource) ReadDir(p string) ([]os.FileInfo, error) {
+	fis, err := s.client.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	for i, fi := range fis {
+		fis[i] = remoteFileInfo{fi}
+	}
+	// SFTP servers return entries in whatever order they like.
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (s *sshSource) Readlink(p string) (string, error) {
+	return s.client.ReadLink(p)
+}
+
+func (s *sshSource) Open(p string) (backup.SourceFile, error) {
+	f, err := s.client.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *sshSource) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// remoteFileInfo reports the ownership of files on the remote machine.
+// SFTP only provides numeric ids; looking them up on this machine would
+// give the wrong names, so the names are left empty.
+type remoteFileInfo struct {
+	os.FileInfo
+}
+
+func (fi remoteFileInfo) fileOwner() *backup.FileOwner {
+	if st, ok := fi.Sys().(*sftp.FileStat); ok {
+		return &backup.FileOwner{Uid: int(st.UID), Gid: int(st.GID)}
+	}
+	return nil
+}
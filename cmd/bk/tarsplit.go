@@ -0,0 +1,159 @@
+// cmd/bk/tarsplit.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Finding the file boundaries in tar archives given to savebits, so that
+// the data is split into chunks at them.
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+const tarBlockSize = 512
+
+// tarBoundaryReader is a storage.ChunkBoundaryReader that reports the
+// start of each entry in a tar archive as a boundary. Without them, adding
+// or removing a file in an archive that's saved repeatedly may change how
+// everything after it is split, since the rolling checksum doesn't
+// necessarily resynchronize before the next file starts; splitting at
+// entry boundaries ensures that unchanged files are always stored as the
+// same chunks. If the data isn't a tar archive, no boundaries are reported
+// and it's split as usual.
+type tarBoundaryReader struct {
+	r      *bufio.Reader
+	offset int64
+	// Offset of the next entry's header, or -1 if the data isn't a tar
+	// archive or its end has been reached.
+	next int64
+	// Offset of the header that starts the most recent entry. With
+	// extended headers (e.g., for long names), this is the offset of the
+	// first of them.
+	boundary int64
+	// Whether the previous header was an extended header that applies to
+	// the following entry.
+	extended bool
+}
+
+func newTarBoundaryReader(r io.Reader) *tarBoundaryReader {
+	return &tarBoundaryReader{r: bufio.NewReader(r), boundary: -1}
+}
+
+func (t *tarBoundaryReader) ReadByte() (byte, error) {
+	t.sync()
+	b, err := t.r.ReadByte()
+	if err == nil {
+		t.offset++
+	}
+	return b, err
+}
+
+func (t *tarBoundaryReader) Read(buf []byte) (int, error) {
+	t.sync()
+	if t.next > t.offset && int64(len(buf)) > t.next-t.offset {
+		// Stop at the next header so that it's parsed.
+		buf = buf[:t.next-t.offset]
+	}
+	n, err := t.r.Read(buf)
+	t.offset += int64(n)
+	return n, err
+}
+
+func (t *tarBoundaryReader) AtBoundary() bool {
+	t.sync()
+	return t.offset == t.boundary
+}
+
+// sync parses the header of the next entry when the reader reaches it.
+func (t *tarBoundaryReader) sync() {
+	if t.next < 0 || t.offset != t.next {
+		return
+	}
+
+	h, err := t.r.Peek(tarBlockSize)
+	if err != nil {
+		t.next = -1
+		return
+	}
+	if bytes.Count(h, []byte{0}) == tarBlockSize {
+		// The archive ends with zero-filled blocks.
+		t.next = -1
+		return
+	}
+	size, ok := parseTarHeader(h)
+	if !ok {
+		if t.offset > 0 {
+			log.Verbose("invalid tar header at offset %d; no longer splitting "+
+				"at file boundaries", t.offset)
+		}
+		t.next = -1
+		return
+	}
+	if t.offset == 0 {
+		log.Verbose("input is a tar archive; splitting at file boundaries")
+	}
+
+	if !t.extended {
+		t.boundary = t.offset
+	}
+	switch h[156] {
+	case 'x', 'g', 'L', 'K':
+		// pax and GNU extended headers describe the entry that follows.
+		t.extended = true
+	default:
+		t.extended = false
+	}
+	t.next = t.offset + tarBlockSize + (size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+}
+
+// parseTarHeader checks that the given block is a valid ustar or GNU tar
+// header and returns the size of the entry's data if so.
+func parseTarHeader(h []byte) (int64, bool) {
+	if !bytes.Equal(h[257:262], []byte("ustar")) {
+		return 0, false
+	}
+
+	// The checksum is computed with the checksum field itself filled with
+	// spaces.
+	checksum, ok := parseTarOctal(h[148:156])
+	if !ok {
+		return 0, false
+	}
+	var sum int64
+	for i, b := range h {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += int64(b)
+	}
+	if sum != checksum {
+		return 0, false
+	}
+
+	field := h[124:136]
+	if field[0]&0x80 != 0 {
+		// Large sizes are stored in base-256.
+		size := int64(field[0] & 0x7f)
+		for _, b := range field[1:] {
+			if size >= 1<<55 {
+				return 0, false
+			}
+			size = size<<8 | int64(b)
+		}
+		return size, true
+	}
+	return parseTarOctal(field)
+}
+
+func parseTarOctal(field []byte) (int64, bool) {
+	s := string(bytes.Trim(field, " \x00"))
+	if s == "" {
+		return 0, true
+	}
+	v, err := strconv.ParseInt(s, 8, 64)
+	return v, err == nil && v >= 0
+}
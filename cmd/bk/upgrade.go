@@ -0,0 +1,98 @@
+// cmd/bk/upgrade.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+import (
+	"github.com/mmp/bk/storage"
+)
+
+// migrations maps from a repository format version to a function that
+// updates a repository from that version to the following one. Each
+// migration must leave the repository readable by the current version of
+// bk, even if it's interrupted.
+var migrations = map[int]func(backend storage.Backend){
+	1: func(backend storage.Backend) {
+		// Version 2 just adds the format version metadata, which
+		// upgradeRepository records after each migration.
+	},
+	2: func(backend storage.Backend) {
+		// Nothing to do; if no hash algorithm is recorded, the default
+		// is used, as was always the case before.
+	},
+	3: func(backend storage.Backend) {
+		// Nothing to do; padding can only be enabled for new
+		// repositories.
+	},
+	4: func(backend storage.Backend) {
+		// Nothing to do; directories in existing backups keep their
+		// original encoding, which is still supported.
+	},
+	5: func(backend storage.Backend) {
+		// Nothing to do; metadata authentication can only be enabled for
+		// new encrypted repositories, since encrypt.txt can't be
+		// rewritten safely.
+	},
+	6: func(backend storage.Backend) {
+		// Nothing to do; repositories without kdf.txt keep using the
+		// key derivation parameters they were created with.
+	},
+	7: func(backend storage.Backend) {
+		// Nothing to do; deltas can only be enabled for new repositories.
+	},
+	8: func(backend storage.Backend) {
+		// Nothing to do; changes are recorded for listings of buckets in
+		// Google Cloud Storage from now on.
+	},
+}
+
+// checkFormat makes sure that the given repository's format can be
+// handled. Older formats are fine; they just don't use the features that
+// later ones added.
+func checkFormat(backend storage.Backend) {
+	if v := storage.RepositoryFormat(backend); v > storage.FormatVersion {
+		Error("%s: repository format version %d is newer than the one "+
+			"supported by this version of bk (%d). Please update bk.\n",
+			backend.String(), v, storage.FormatVersion)
+	}
+}
+
+// useRepositoryHash sets the hash algorithm to the one that was used to
+// store data in the given repository.
+func useRepositoryHash(backend storage.Backend) {
+	if err := storage.SetHashAlgorithm(storage.RepositoryHashAlgorithm(backend)); err != nil {
+		Error("%s: %s\n", backend.String(), err)
+	}
+}
+
+// upgradeRepository applies all of the migrations necessary to bring the
+// repository up to the current format version.
+func upgradeRepository(backend storage.Backend) {
+	// Repositories created by older versions of bk don't have an
+	// identifier; one can be added without changing the format.
+	if storage.RepositoryID(backend) == "" {
+		log.Print("%s: recording a repository identifier.", backend.String())
+		storage.SetRepositoryID(backend)
+		backend.SyncWrites()
+	}
+
+	v := storage.RepositoryFormat(backend)
+	if v == storage.FormatVersion {
+		log.Print("%s: repository is already at format version %d.",
+			backend.String(), v)
+		return
+	}
+
+	for ; v < storage.FormatVersion; v++ {
+		log.Print("%s: upgrading from format version %d to %d.", backend.String(),
+			v, v+1)
+		migrations[v](backend)
+
+		// Make sure that all of the migration's work has landed before
+		// recording the new version.
+		backend.SyncWrites()
+		storage.SetRepositoryFormat(backend, v+1)
+		backend.SyncWrites()
+	}
+}
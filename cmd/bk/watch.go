@@ -0,0 +1,178 @@
+// cmd/bk/watch.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package main
+
+// Watching a directory for changes and backing it up automatically.
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/mmp/bk/backup"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WatchOptions controls when watchDir makes backups.
+type WatchOptions struct {
+	// A backup is made once there have been no changes for Quiet.
+	Quiet time.Duration
+	// If changes keep being made, a backup is made anyway once MaxDelay
+	// has passed since the first one that hasn't been backed up.
+	MaxDelay time.Duration
+	// Passed along to "bk backup".
+	SplitBits        uint
+	ExcludedPaths    []string
+	ExcludeIfPresent []string
+	ExcludeNoDump    bool
+}
+
+// watchDir backs up dir with the given name and then watches it for
+// changes, making a new backup after each batch of them. It only returns
+// if the watcher can't be started or stops.
+func watchDir(name, dir string, opts WatchOptions) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// Changes in the repository itself (if it's under dir) are ignored;
+	// otherwise every backup would cause another one.
+	repo := os.Getenv("BK_DIR")
+	if repo != "" {
+		repo, _ = filepath.Abs(repo)
+	}
+	ignored := func(path string) bool {
+		if abs, err := filepath.Abs(path); err == nil && repo != "" &&
+			(abs == repo || strings.HasPrefix(abs, repo+string(filepath.Separator))) {
+			return true
+		}
+		// So are snapshots made by "bk backup --snapshot", which it
+		// doesn't back up.
+		for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+			if elem == backup.SnapshotDirName {
+				return true
+			}
+		}
+		return backup.IsExcluded(path, opts.ExcludedPaths)
+	}
+
+	// Directories must be watched individually. New ones are added as
+	// they're created.
+	watch := func(root string) {
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				log.Warning("%s: %s", path, err)
+				return nil
+			}
+			if !fi.IsDir() {
+				return nil
+			}
+			if ignored(path) ||
+				(path != dir && backup.ExclusionMarker(nil, path, opts.ExcludeIfPresent) != "") {
+				return filepath.SkipDir
+			}
+			if err := w.Add(path); err != nil {
+				log.Warning("%s: unable to watch for changes: %s", path, err)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Warning("%s: %s", root, err)
+		}
+	}
+	watch(dir)
+
+	runWatchBackup(name, dir, opts)
+
+	// The time of the first and the most recent changes that haven't been
+	// backed up; zero if there are none.
+	var first, last time.Time
+	timer := time.NewTimer(opts.Quiet)
+	timer.Stop()
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return fmt.Errorf("%s: watcher stopped", dir)
+			}
+			if ignored(e.Name) {
+				continue
+			}
+			log.Debug("%s: %s", e.Name, e.Op)
+			if e.Op&fsnotify.Create != 0 {
+				if fi, err := os.Lstat(e.Name); err == nil && fi.IsDir() {
+					watch(e.Name)
+				}
+			}
+			now := time.Now()
+			if first.IsZero() {
+				first = now
+			}
+			last = now
+			// Wait until things have been quiet for a while, but not past
+			// the maximum delay.
+			wait := opts.Quiet
+			if d := first.Add(opts.MaxDelay).Sub(now); d < wait {
+				wait = d
+			}
+			timer.Stop()
+			timer.Reset(wait)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return fmt.Errorf("%s: watcher stopped", dir)
+			}
+			// Changes may have been missed (e.g., if the event queue
+			// overflowed), so back up right away rather than waiting for
+			// the next one.
+			log.Warning("%s: %s; making a backup in case changes were missed", dir, err)
+			timer.Stop()
+			first, last = time.Time{}, time.Time{}
+			runWatchBackup(name, dir, opts)
+		case <-timer.C:
+			if first.IsZero() {
+				continue
+			}
+			log.Verbose("%s: changes since %s; last at %s", dir,
+				first.Format(time.Stamp), last.Format(time.Stamp))
+			first, last = time.Time{}, time.Time{}
+			runWatchBackup(name, dir, opts)
+		}
+	}
+}
+
+// runWatchBackup runs "bk backup" to back up the directory. It's done in a
+// separate process so that any fatal errors during it don't end the
+// watch; errors are reported and the next backup is attempted when there
+// are further changes.
+func runWatchBackup(name, dir string, opts WatchOptions) {
+	exe, err := os.Executable()
+	log.CheckError(err)
+	args := []string{"backup", "--split-bits", strconv.Itoa(int(opts.SplitBits))}
+	for _, e := range opts.ExcludedPaths {
+		args = append(args, "--exclude", e)
+	}
+	for _, m := range opts.ExcludeIfPresent {
+		args = append(args, "--exclude-if-present", m)
+	}
+	if opts.ExcludeNoDump {
+		args = append(args, "--exclude-nodump")
+	}
+	args = append(args, name, dir)
+
+	// Backup names only have a resolution of a second, so make sure that
+	// this one won't collide with the previous one.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Error("%s: backup failed: %s", dir, err)
+	}
+}
@@ -0,0 +1,363 @@
+// storage/cached.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CacheOptions specifies the sizes and location of the caches used by the
+// Backend returned by NewCached.
+type CacheOptions struct {
+	// Maximum number of bytes of chunk data to keep in memory.
+	MemoryBytes int64
+	// If non-empty, chunks are also cached in files in this directory, up
+	// to a total of DiskBytes.
+	Dir       string
+	DiskBytes int64
+	// Number of chunks that may be read concurrently in response to calls
+	// to Prefetch; if zero, Prefetch does nothing.
+	PrefetchJobs int
+}
+
+// Prefetcher is implemented by Backends that can read chunks in the
+// background before they're needed.
+type Prefetcher interface {
+	// Prefetch starts reading the chunk with the given hash so that a
+	// later call to Read for it returns quickly. It doesn't block; if
+	// too many chunks are already waiting to be prefetched, it does
+	// nothing.
+	Prefetch(hash Hash)
+}
+
+// Maximum number of chunks waiting to be prefetched.
+const maxPendingPrefetches = 1024
+
+// cached implements the storage.Backend interface. It keeps the contents
+// of recently-read chunks in memory and (optionally) on disk so that
+// chunks that are read repeatedly don't need to be fetched, decrypted, and
+// decompressed each time.
+type cached struct {
+	// Everything other than Read is handled by the underlying Backend.
+	Backend
+	opts CacheOptions
+
+	// mu protects all of the following.
+	mu sync.Mutex
+	// The cached chunks, with the most recently used at the front.
+	lru     *list.List
+	entries map[Hash]*list.Element
+	// Total size of the chunks in lru.
+	memoryBytes int64
+	// Total size of the files in the cache directory.
+	diskBytes int64
+	// Chunks that are being read from the underlying Backend, mapped to
+	// channels that are closed once they're done, so that chunks aren't
+	// read multiple times concurrently.
+	pending map[Hash]chan struct{}
+	// Statistics.
+	memoryHits, diskHits, misses, prefetches int64
+
+	prefetchQueue chan Hash
+	startWorkers  sync.Once
+}
+
+type cacheEntry struct {
+	hash  Hash
+	chunk []byte
+}
+
+// NewCached returns a storage.Backend that caches the chunks read from
+// the given one. It's most effective at the top of the stack of Backends,
+// so that the cached chunks have already been decrypted and decompressed,
+// but the on-disk cache then holds unencrypted data; for encrypted
+// repositories, it can be used below the encrypted Backend instead.
+func NewCached(backend Backend, opts CacheOptions) Backend {
+	c := &cached{Backend: backend, opts: opts, lru: list.New(),
+		entries:       make(map[Hash]*list.Element),
+		pending:       make(map[Hash]chan struct{}),
+		prefetchQueue: make(chan Hash, maxPendingPrefetches)}
+	if opts.Dir != "" {
+		log.CheckError(os.MkdirAll(opts.Dir, 0700))
+		c.diskBytes = c.diskUsage()
+		c.trimDisk()
+	}
+	return c
+}
+
+func (c *cached) String() string {
+	return "cached " + c.Backend.String()
+}
+
+func (c *cached) WriteUncompressed(chunk []byte) Hash {
+	return writeUncompressed(c.Backend, chunk)
+}
+
+func (c *cached) LogStats() {
+	c.mu.Lock()
+	if n := c.memoryHits + c.diskHits + c.misses; n > 0 && c.opts.MemoryBytes == 0 {
+		log.Print("chunk cache: %d / %d reads found on disk", c.diskHits, n)
+	} else if n > 0 {
+		log.Print("chunk cache: %d / %d reads found in memory, %d on disk; "+
+			"%d chunks prefetched", c.memoryHits, n, c.diskHits, c.prefetches)
+	}
+	c.mu.Unlock()
+	c.Backend.LogStats()
+}
+
+func (c *cached) Read(hash Hash) (io.ReadCloser, error) {
+	for {
+		c.mu.Lock()
+		if e, ok := c.entries[hash]; ok {
+			c.lru.MoveToFront(e)
+			c.memoryHits++
+			c.mu.Unlock()
+			return ioutil.NopCloser(bytes.NewReader(e.Value.(*cacheEntry).chunk)), nil
+		}
+		done, ok := c.pending[hash]
+		if !ok {
+			break
+		}
+		// Wait for the chunk to be read rather than reading it again. If
+		// that failed, or the chunk couldn't be cached, it's read below
+		// after trying again.
+		c.mu.Unlock()
+		<-done
+	}
+	done := make(chan struct{})
+	c.pending[hash] = done
+	c.mu.Unlock()
+
+	chunk, rest, err := c.fetch(hash, done)
+	if err != nil {
+		return nil, err
+	}
+	if rest != nil {
+		return readerAndCloser{io.MultiReader(bytes.NewReader(chunk), rest), rest}, nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(chunk)), nil
+}
+
+// fetch returns the given chunk from the on-disk cache or the underlying
+// Backend and adds it to the caches. It must be called after adding the
+// given channel to c.pending; the channel is removed and closed once it's
+// done. Chunks too large to read into memory aren't cached; for them, the
+// start of the chunk is returned along with the reader for the rest of
+// it, as with readChunk.
+func (c *cached) fetch(hash Hash, done chan struct{}) ([]byte, io.ReadCloser, error) {
+	chunk, rest, err := c.read(hash)
+	if err == nil && rest == nil {
+		c.add(hash, chunk)
+	}
+	c.mu.Lock()
+	delete(c.pending, hash)
+	c.mu.Unlock()
+	close(done)
+	return chunk, rest, err
+}
+
+func (c *cached) read(hash Hash) ([]byte, io.ReadCloser, error) {
+	if chunk, err := c.readDisk(hash); err == nil {
+		c.mu.Lock()
+		c.diskHits++
+		c.mu.Unlock()
+		return chunk, nil, nil
+	}
+
+	r, err := c.Backend.Read(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunk, rest, err := readChunk(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+	if rest == nil {
+		c.writeDisk(hash, chunk)
+	}
+	return chunk, rest, nil
+}
+
+func (c *cached) Prefetch(hash Hash) {
+	if c.opts.PrefetchJobs == 0 {
+		return
+	}
+	c.startWorkers.Do(func() {
+		for i := 0; i < c.opts.PrefetchJobs; i++ {
+			go c.prefetchWorker()
+		}
+	})
+	select {
+	case c.prefetchQueue <- hash:
+	default:
+	}
+}
+
+func (c *cached) prefetchWorker() {
+	for hash := range c.prefetchQueue {
+		c.mu.Lock()
+		_, cached := c.entries[hash]
+		_, pending := c.pending[hash]
+		if cached || pending {
+			c.mu.Unlock()
+			continue
+		}
+		done := make(chan struct{})
+		c.pending[hash] = done
+		c.prefetches++
+		c.mu.Unlock()
+
+		// Errors are left to be reported when the chunk is actually
+		// read.
+		if _, rest, err := c.fetch(hash, done); err != nil {
+			log.Debug("%s: prefetch failed: %s", hash, err)
+		} else if rest != nil {
+			rest.Close()
+		}
+	}
+}
+
+// add adds the given chunk to the in-memory cache, evicting the least
+// recently used ones as needed to stay under the limit.
+func (c *cached) add(hash Hash, chunk []byte) {
+	// Don't let a single large chunk flush everything else.
+	if int64(len(chunk)) > c.opts.MemoryBytes/8 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[hash]; ok {
+		// Another goroutine read it concurrently.
+		return
+	}
+	c.entries[hash] = c.lru.PushFront(&cacheEntry{hash, chunk})
+	c.memoryBytes += int64(len(chunk))
+	for c.memoryBytes > c.opts.MemoryBytes {
+		e := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, e.hash)
+		c.memoryBytes -= int64(len(e.chunk))
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////
+// On-disk cache
+
+func (c *cached) diskPath(hash Hash) string {
+	return filepath.Join(c.opts.Dir, hash.String())
+}
+
+func (c *cached) readDisk(hash Hash) ([]byte, error) {
+	if c.opts.Dir == "" {
+		return nil, os.ErrNotExist
+	}
+	path := c.diskPath(hash)
+	chunk, err := ioutil.ReadFile(path)
+	if err == nil {
+		// The modification time is used to find the least recently used
+		// files when the cache is trimmed.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	return chunk, err
+}
+
+// writeDisk adds the chunk to the on-disk cache. Errors aren't fatal,
+// since the cache is only an optimization.
+func (c *cached) writeDisk(hash Hash, chunk []byte) {
+	if c.opts.Dir == "" || int64(len(chunk)) > c.opts.DiskBytes/8 {
+		return
+	}
+	// Write to a temporary file first so that an incomplete one is never
+	// used.
+	path := c.diskPath(hash)
+	f, err := ioutil.TempFile(c.opts.Dir, hash.String()+".tmp")
+	if err == nil {
+		_, err = f.Write(chunk)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		log.Warning("%s: unable to cache chunk: %s", path, err)
+		return
+	}
+
+	c.mu.Lock()
+	c.diskBytes += int64(len(chunk))
+	over := c.diskBytes > c.opts.DiskBytes
+	c.mu.Unlock()
+	if over {
+		c.trimDisk()
+	}
+}
+
+// diskUsage returns the total size of the files in the cache directory.
+func (c *cached) diskUsage() int64 {
+	var total int64
+	fis, err := ioutil.ReadDir(c.opts.Dir)
+	log.CheckError(err)
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			total += fi.Size()
+		}
+	}
+	return total
+}
+
+// trimDisk removes the least recently used files from the cache directory
+// until it's 90% full, so that it isn't trimmed again after each chunk is
+// added.
+func (c *cached) trimDisk() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.diskBytes <= c.opts.DiskBytes {
+		return
+	}
+
+	fis, err := ioutil.ReadDir(c.opts.Dir)
+	if err != nil {
+		log.Warning("%s: %s", c.opts.Dir, err)
+		return
+	}
+	// Subdirectories are used for other cached data; leave them be.
+	var files []os.FileInfo
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			files = append(files, fi)
+		}
+	}
+	fis = files
+	sort.Slice(fis, func(i, j int) bool { return fis[i].ModTime().Before(fis[j].ModTime()) })
+	c.diskBytes = 0
+	for _, fi := range fis {
+		c.diskBytes += fi.Size()
+	}
+	for _, fi := range fis {
+		if c.diskBytes <= c.opts.DiskBytes/10*9 {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.opts.Dir, fi.Name())); err == nil {
+			c.diskBytes -= fi.Size()
+		}
+	}
+}
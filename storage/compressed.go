@@ -21,9 +21,15 @@ import (
 // to the provided data before passing it along to another backend for
 // storage.
 type compressed struct {
-	backend                              Backend
+	backend Backend
+	// mu protects the statistics, so that Write can be called
+	// concurrently.
+	mu                                   sync.Mutex
 	bytesSaved, bytesProcessed           int64
 	compressedChunks, uncompressedChunks int
+	// Chunks that weren't compressed because their contents already
+	// were; they're included in uncompressedChunks.
+	skippedChunks int
 }
 
 // NewCompressed returns a new storage.Backend that applies gzip compression
@@ -46,11 +52,24 @@ func (c *compressed) LogStats() {
 			u.FmtBytes(c.bytesSaved), u.FmtBytes(c.bytesProcessed),
 			100.*float64(c.bytesSaved)/float64(c.bytesProcessed))
 	}
+	if c.skippedChunks > 0 {
+		log.Print("skipped compressing %d chunks of already-compressed data",
+			c.skippedChunks)
+	}
 	c.backend.LogStats()
 }
 
-func (c *compressed) Fsck() {
-	c.backend.Fsck()
+func (c *compressed) Stats() Stats {
+	s := c.backend.Stats()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.ChunksWritten = int64(c.compressedChunks + c.uncompressedChunks)
+	s.BytesWritten = c.bytesProcessed
+	return s
+}
+
+func (c *compressed) Fsck(opts FsckOptions) {
+	c.backend.Fsck(opts)
 }
 
 // Reusing gzip writers gives a huge benefit; an almost 40% reduction in
@@ -62,6 +81,10 @@ var writerPool = sync.Pool{
 }
 
 func (c *compressed) Write(chunk []byte) Hash {
+	if IsCompressedFormat(chunk) {
+		return c.WriteUncompressed(chunk)
+	}
+
 	// Compress the input to a buffer.
 	var compressed bytes.Buffer
 
@@ -75,25 +98,104 @@ func (c *compressed) Write(chunk []byte) Hash {
 	err = w.Close()
 	log.CheckError(err)
 
-	c.bytesProcessed += int64(len(chunk))
-
 	// Is the compressed buffer smaller than the input?
 	var stored []byte
-	if compressed.Len() < len(chunk) {
+	isCompressed := compressed.Len() < len(chunk)
+	if isCompressed {
 		// Yes; write out a 1 byte to indicate that the rest of the chunk
 		// is indeed compressed and then save the compressed bytes.
 		stored = append([]byte{1}, compressed.Bytes()...)
-		c.compressedChunks++
 	} else {
 		// No; write a 0 to indicate that the data is uncompressed before
 		// storing the original chunk.
 		stored = append([]byte{0}, chunk...)
+	}
+
+	c.mu.Lock()
+	c.bytesProcessed += int64(len(chunk))
+	if isCompressed {
+		c.compressedChunks++
+	} else {
 		c.uncompressedChunks++
 	}
 	c.bytesSaved += int64(len(stored))
+	c.mu.Unlock()
+
 	return c.backend.Write(stored)
 }
 
+// WriteUncompressed stores the chunk as Write does when compressing it
+// doesn't make it smaller, without spending the time to try.
+func (c *compressed) WriteUncompressed(chunk []byte) Hash {
+	c.mu.Lock()
+	c.bytesProcessed += int64(len(chunk))
+	c.uncompressedChunks++
+	c.skippedChunks++
+	c.bytesSaved += int64(len(chunk) + 1)
+	c.mu.Unlock()
+
+	return c.backend.Write(append([]byte{0}, chunk...))
+}
+
+// WriteBlobStream compresses the chunk as it's read, spooling both it and
+// its compressed version, since which one is stored isn't known until all
+// of it has been read.
+func (c *compressed) WriteBlobStream(r io.Reader) (Hash, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return Hash{}, err
+	}
+	r = io.MultiReader(bytes.NewReader(head[:n]), r)
+	if IsCompressedFormat(head[:n]) {
+		cr := &countingReader{r: r}
+		h, err := c.backend.WriteBlobStream(io.MultiReader(bytes.NewReader([]byte{0}), cr))
+		c.mu.Lock()
+		c.bytesProcessed += cr.n
+		c.uncompressedChunks++
+		c.skippedChunks++
+		c.bytesSaved += cr.n + 1
+		c.mu.Unlock()
+		return h, err
+	}
+
+	plain, comp := newSpool(), newSpool()
+	defer plain.Close()
+	defer comp.Close()
+	_, err = plain.Write([]byte{0})
+	log.CheckError(err)
+	_, err = comp.Write([]byte{1})
+	log.CheckError(err)
+
+	w := writerPool.Get().(*gzip.Writer)
+	w.Reset(comp)
+	defer writerPool.Put(w)
+
+	if _, err := io.Copy(w, io.TeeReader(r, plain)); err != nil {
+		return Hash{}, err
+	}
+	log.CheckError(w.Close())
+
+	// As in Write, the compressed version is only stored if it's smaller.
+	stored := plain
+	isCompressed := comp.size < plain.size
+	if isCompressed {
+		stored = comp
+	}
+
+	c.mu.Lock()
+	c.bytesProcessed += plain.size - 1
+	if isCompressed {
+		c.compressedChunks++
+	} else {
+		c.uncompressedChunks++
+	}
+	c.bytesSaved += stored.size
+	c.mu.Unlock()
+
+	return c.backend.WriteBlobStream(stored)
+}
+
 func (c *compressed) SyncWrites() {
 	c.backend.SyncWrites()
 }
@@ -106,6 +208,10 @@ func (c *compressed) Hashes() map[Hash]struct{} {
 	return c.backend.Hashes()
 }
 
+func (c *compressed) BlobSize(hash Hash) (int64, error) {
+	return c.backend.BlobSize(hash)
+}
+
 // Reusing readers gives a smaller benefit than writers, but still ~15%.
 var readerPool = sync.Pool{
 	New: func() interface{} {
@@ -120,18 +226,26 @@ var readerPool = sync.Pool{
 }
 
 func (c *compressed) Read(hash Hash) (io.ReadCloser, error) {
-	r, err := c.backend.Read(hash)
+	return c.decompress(c.backend.Read(hash))
+}
+
+func (c *compressed) ReadBlobStream(hash Hash) (io.ReadCloser, error) {
+	return c.decompress(c.backend.ReadBlobStream(hash))
+}
+
+// decompress returns a reader for the chunk stored in the given one, as
+// returned by the underlying Backend's Read or ReadBlobStream method.
+func (c *compressed) decompress(r io.ReadCloser, err error) (io.ReadCloser, error) {
 	if err != nil {
 		return r, err
 	}
 
 	// Read the first byte to see if it's compressed or not.
 	var b [1]byte
-	n, err := r.Read(b[:])
-	if err != nil {
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		r.Close()
 		return nil, err
 	}
-	log.Check(n == 1)
 
 	if b[0] == 1 {
 		// Compressed: make a gzip reader.
@@ -167,6 +281,14 @@ func (c *compressed) WriteMetadata(name string, data []byte) {
 	c.backend.WriteMetadata(name, data)
 }
 
+func (c *compressed) CreateMetadata(name string, data []byte) error {
+	return c.backend.CreateMetadata(name, data)
+}
+
+func (c *compressed) ReplaceMetadata(name string, old, data []byte) error {
+	return c.backend.ReplaceMetadata(name, old, data)
+}
+
 func (c *compressed) ReadMetadata(name string) []byte {
 	return c.backend.ReadMetadata(name)
 }
@@ -175,6 +297,103 @@ func (c *compressed) MetadataExists(name string) bool {
 	return c.backend.MetadataExists(name)
 }
 
+func (c *compressed) WriteMetadataBatch(metadata map[string][]byte) {
+	c.backend.WriteMetadataBatch(metadata)
+}
+
+func (c *compressed) ReadMetadataBatch(names []string) map[string][]byte {
+	return c.backend.ReadMetadataBatch(names)
+}
+
+func (c *compressed) MetadataExistsBatch(names []string) map[string]bool {
+	return c.backend.MetadataExistsBatch(names)
+}
+
 func (c *compressed) ListMetadata() map[string]time.Time {
 	return c.backend.ListMetadata()
 }
+
+func (c *compressed) ForMetadata(prefix string,
+	f func(name string, created time.Time) error) error {
+	return c.backend.ForMetadata(prefix, f)
+}
+
+func (c *compressed) DeleteMetadata(name string) {
+	c.backend.DeleteMetadata(name)
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Already-compressed data
+
+// UncompressedWriter is implemented by Backends that can be told not to
+// try to compress a chunk, as is worthwhile for chunks of files whose
+// contents are known to be compressed already.
+type UncompressedWriter interface {
+	// WriteUncompressed is the same as Write, but the chunk is stored
+	// without compressing it.
+	WriteUncompressed(chunk []byte) Hash
+}
+
+// writeUncompressed stores the given chunk using the Backend's
+// WriteUncompressed method, if it has one, and Write otherwise.
+func writeUncompressed(backend Backend, chunk []byte) Hash {
+	if w, ok := backend.(UncompressedWriter); ok {
+		return w.WriteUncompressed(chunk)
+	}
+	return backend.Write(chunk)
+}
+
+// uncompressed implements the Backend interface, passing everything
+// through to the underlying Backend but calling WriteUncompressed for
+// chunks that are written.
+type uncompressed struct {
+	Backend
+}
+
+// NewUncompressed returns a Backend that stores the chunks written to it
+// in the given one without compressing them, if the given one supports
+// that. Only the first chunk of a file can be recognized as compressed
+// data by its contents, so this can be used to store the rest of them
+// the same way.
+func NewUncompressed(backend Backend) Backend {
+	return uncompressed{backend}
+}
+
+func (ub uncompressed) Write(chunk []byte) Hash {
+	return writeUncompressed(ub.Backend, chunk)
+}
+
+// Number of bytes at the start of data that IsCompressedFormat needs.
+const sniffLength = 16
+
+// Signatures at the start of the common file formats whose contents are
+// compressed: gzip, zstd, xz, bzip2, zip (which includes most document
+// and application packages), 7-Zip, JPEG, PNG, GIF, Matroska and WebM,
+// and PDF.
+var compressedSignatures = [][]byte{
+	{0x1f, 0x8b, 0x08},
+	{0x28, 0xb5, 0x2f, 0xfd},
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},
+	{'B', 'Z', 'h'},
+	{'P', 'K', 0x03, 0x04},
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},
+	{0xff, 0xd8, 0xff},
+	{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'},
+	{'G', 'I', 'F', '8'},
+	{0x1a, 0x45, 0xdf, 0xa3},
+	{'%', 'P', 'D', 'F', '-'},
+}
+
+// IsCompressedFormat reports whether the given data, which is generally
+// the start of a file or chunk, begins with the signature of a file
+// format whose contents are already compressed, so that compressing it
+// again would very likely be a waste of time. MP4, QuickTime, and HEIF
+// files, which are identified by an "ftyp" box, are recognized as well.
+func IsCompressedFormat(b []byte) bool {
+	for _, sig := range compressedSignatures {
+		if bytes.HasPrefix(b, sig) {
+			return true
+		}
+	}
+	return len(b) >= 8 && string(b[4:8]) == "ftyp"
+}
@@ -0,0 +1,668 @@
+// storage/delta.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	u "github.com/mmp/bk/util"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////
+// delta
+
+// delta implements the Backend interface. When a chunk that's similar to
+// one that's already stored comes in to Write (as happens when a large
+// file such as a mailbox, database, or disk image changes slightly
+// between backups, so that content-defined chunking finds new chunks that
+// mostly match old ones), it stores the differences from the existing
+// chunk rather than the chunk itself.
+//
+// Similar chunks are found using resemblance hashing: each chunk that's
+// stored in full is summarized by a few "super-features", each of which
+// is a hash of the maximum values of a couple of functions of the hashes
+// of all of the chunk's short windows. Chunks that share a super-feature
+// are very likely to have most of their contents in common. Only chunks
+// stored in full are used as bases, so reading a delta never requires
+// more than one additional chunk; as a file keeps changing, its deltas
+// grow until a chunk is cheaper to store in full, which then becomes the
+// base for later versions.
+//
+// Chunks stored in full are written unchanged to the underlying backend,
+// so repositories that use deltas can still share chunks with ones
+// written before they were enabled. The chunks that are stored as deltas
+// are instead recorded in logs that are written during SyncWrites, along
+// with the hashes of the contents and the super-features of all of the
+// chunks written, so that they can be found in later runs. (Like the
+// encrypted backend's logs, they're stored in blobs referenced by
+// metadata; see DeltaLogHashes.) Since older versions of bk would return
+// the stored deltas as chunks' contents, deltas are only used in
+// repositories created with them enabled; see SetRepositoryDelta.
+type delta struct {
+	backend Backend
+	// Information about the chunks written by this Backend, as read from
+	// the logs. It isn't read until it's first needed.
+	readLogsOnce sync.Once
+	// Maps from hashes of chunks' contents to the hashes they were
+	// stored with, for deduplication, and from the hashes of stored
+	// deltas to the chunks they apply to.
+	stored map[Hash]Hash
+	deltas map[Hash]deltaRecord
+	// Maps from super-features to chunks that were stored in full and
+	// have them. Chunks written during the current run aren't added
+	// until SyncWrites has ensured that they can be read.
+	similar map[uint64]Hash
+	// Chunks written during the current run; they're logged in
+	// SyncWrites.
+	newRecords []deltaRecord
+	// mu protects the maps, newRecords, and the statistics so that Write
+	// can be called concurrently.
+	mu sync.Mutex
+	// Statistics about the calls to Write.
+	chunksWritten, bytesWritten int64
+	deltaChunks                 int
+	deltaBytes, deltaSaved      int64
+}
+
+// deltaRecord is logged for each chunk written by the delta backend.
+type deltaRecord struct {
+	// The hash that the chunk is stored with and the hash of its
+	// contents.
+	Hash, Plain Hash
+	// If the chunk is stored as a delta, the hash of the chunk that it's
+	// a delta from; otherwise, zero.
+	Base Hash
+	// For chunks stored in full, their super-features.
+	Features [deltaSuperFeatures]uint64
+}
+
+const deltaLogPrefix = "deltas-"
+
+// Chunks smaller than this are always stored in full; they don't have
+// enough windows for their super-features to be reliable.
+const deltaMinSize = 1024
+
+// NewDelta returns a new storage.Backend that stores chunks that are
+// similar to ones already stored as deltas from them in the provided
+// underlying backend, which should be compressed, since the deltas
+// include the parts of chunks that have changed as is. Note: the contents
+// of metadata aren't affected.
+func NewDelta(backend Backend) Backend {
+	return &delta{backend: backend}
+}
+
+func (d *delta) String() string {
+	return "delta-encoded " + d.backend.String()
+}
+
+func (d *delta) LogStats() {
+	d.mu.Lock()
+	if d.deltaChunks > 0 {
+		log.Print("stored %d / %d chunks as deltas, %s instead of %s",
+			d.deltaChunks, d.chunksWritten, u.FmtBytes(d.deltaBytes),
+			u.FmtBytes(d.deltaBytes+d.deltaSaved))
+	}
+	d.mu.Unlock()
+	d.backend.LogStats()
+}
+
+func (d *delta) Stats() Stats {
+	s := d.backend.Stats()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s.ChunksWritten = d.chunksWritten
+	s.BytesWritten = d.bytesWritten
+	return s
+}
+
+// readLogs processes all of the logs written by earlier runs.
+func (d *delta) readLogs() {
+	d.stored = make(map[Hash]Hash)
+	d.deltas = make(map[Hash]deltaRecord)
+	d.similar = make(map[uint64]Hash)
+	for _, r := range readDeltaLogs(d.backend) {
+		d.addRecord(r)
+	}
+}
+
+// addRecord updates the maps with the given chunk; d.mu must be held if
+// other goroutines may be using them.
+func (d *delta) addRecord(r deltaRecord) {
+	d.stored[r.Plain] = r.Hash
+	if r.Base != (Hash{}) {
+		d.deltas[r.Hash] = r
+		return
+	}
+	for _, f := range r.Features {
+		if f != 0 {
+			d.similar[f] = r.Hash
+		}
+	}
+}
+
+// readDeltaLogs returns all of the records in the delta logs in the given
+// backend.
+func readDeltaLogs(backend Backend) []deltaRecord {
+	var names []string
+	backend.ForMetadata(deltaLogPrefix, func(name string, created time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+
+	var records []deltaRecord
+	for name, md := range backend.ReadMetadataBatch(names) {
+		mh := NewMerkleHash(md)
+		r := mh.NewReader(nil, backend)
+		var rs []deltaRecord
+		if err := gob.NewDecoder(r).Decode(&rs); err != nil {
+			log.Fatal("%s: %s", name, err)
+		}
+		log.CheckError(r.Close())
+		records = append(records, rs...)
+	}
+	return records
+}
+
+func (d *delta) Fsck(opts FsckOptions) {
+	d.readLogsOnce.Do(d.readLogs)
+	for h, r := range d.deltas {
+		if !d.backend.HashExists(r.Base) {
+			log.Error("%s: base chunk %s of delta is missing", h, r.Base)
+		}
+	}
+	d.backend.Fsck(opts)
+}
+
+func (d *delta) Write(chunk []byte) Hash {
+	d.mu.Lock()
+	d.chunksWritten++
+	d.bytesWritten += int64(len(chunk))
+	d.mu.Unlock()
+
+	if len(chunk) < deltaMinSize {
+		return d.backend.Write(chunk)
+	}
+	d.readLogsOnce.Do(d.readLogs)
+
+	plain := HashBytes(chunk)
+	features := superFeatures(chunk)
+	d.mu.Lock()
+	h, ok := d.stored[plain]
+	var base Hash
+	for _, f := range features {
+		if b, ok := d.similar[f]; ok {
+			base = b
+			break
+		}
+	}
+	d.mu.Unlock()
+	if ok {
+		return h
+	}
+
+	if base != (Hash{}) {
+		if enc, err := d.encode(base, chunk); err != nil {
+			log.Warning("%s: unable to read chunk to compute delta from: %s", base, err)
+		} else if len(enc) < len(chunk)/2 {
+			h := d.backend.Write(enc)
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.deltaChunks++
+			d.deltaBytes += int64(len(enc))
+			d.deltaSaved += int64(len(chunk) - len(enc))
+			return d.addNew(deltaRecord{Hash: h, Plain: plain, Base: base})
+		}
+	}
+
+	h = d.backend.Write(chunk)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.addNew(deltaRecord{Hash: h, Plain: plain, Features: features})
+}
+
+// WriteUncompressed passes chunks through; ones whose contents are
+// already compressed are too different after any change for deltas to be
+// worthwhile.
+func (d *delta) WriteUncompressed(chunk []byte) Hash {
+	d.mu.Lock()
+	d.chunksWritten++
+	d.bytesWritten += int64(len(chunk))
+	d.mu.Unlock()
+	return writeUncompressed(d.backend, chunk)
+}
+
+// addNew records a chunk that was stored during the current run,
+// returning the hash that references to it should use. d.mu must be held.
+func (d *delta) addNew(r deltaRecord) Hash {
+	if h, ok := d.stored[r.Plain]; ok {
+		// Another goroutine stored the same chunk concurrently.
+		return h
+	}
+	d.stored[r.Plain] = r.Hash
+	if r.Base != (Hash{}) {
+		d.deltas[r.Hash] = r
+	}
+	d.newRecords = append(d.newRecords, r)
+	return r.Hash
+}
+
+// encode returns the delta from the stored chunk with the given hash to
+// the given chunk.
+func (d *delta) encode(base Hash, chunk []byte) ([]byte, error) {
+	b, err := readAll(d.backend.Read(base))
+	if err != nil {
+		return nil, err
+	}
+	return encodeDelta(b, chunk), nil
+}
+
+func readAll(r io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// WriteBlobStream passes chunks through unchanged; chunks that are too
+// large to be held in memory aren't stored as deltas.
+func (d *delta) WriteBlobStream(r io.Reader) (Hash, error) {
+	cr := &countingReader{r: r}
+	h, err := d.backend.WriteBlobStream(cr)
+	d.mu.Lock()
+	d.chunksWritten++
+	d.bytesWritten += cr.n
+	d.mu.Unlock()
+	return h, err
+}
+
+// countingReader keeps track of how many bytes have been read from the
+// underlying io.Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(buf []byte) (int, error) {
+	n, err := c.r.Read(buf)
+	c.n += int64(n)
+	return n, err
+}
+
+func (d *delta) SyncWrites() {
+	d.backend.SyncWrites()
+
+	if len(d.newRecords) > 0 {
+		var buf bytes.Buffer
+		log.CheckError(gob.NewEncoder(&buf).Encode(d.newRecords))
+		hash := MerkleFromSingle(d.backend.Write(buf.Bytes()))
+		// As with the encrypted backend's logs, the name just needs to
+		// be unique.
+		name := deltaLogPrefix + hash.Hash.String()
+		d.backend.WriteMetadata(name, hash.Bytes())
+		d.backend.SyncWrites()
+
+		// Now that they're certain to be readable, the chunks written
+		// can be used as bases.
+		d.mu.Lock()
+		for _, r := range d.newRecords {
+			d.addRecord(r)
+		}
+		d.newRecords = nil
+		d.mu.Unlock()
+	}
+}
+
+func (d *delta) HashExists(hash Hash) bool {
+	return d.backend.HashExists(hash)
+}
+
+func (d *delta) Hashes() map[Hash]struct{} {
+	return d.backend.Hashes()
+}
+
+func (d *delta) BlobSize(hash Hash) (int64, error) {
+	return d.backend.BlobSize(hash)
+}
+
+func (d *delta) Read(hash Hash) (io.ReadCloser, error) {
+	d.readLogsOnce.Do(d.readLogs)
+	d.mu.Lock()
+	r, ok := d.deltas[hash]
+	d.mu.Unlock()
+	if !ok {
+		return d.backend.Read(hash)
+	}
+
+	enc, err := readAll(d.backend.Read(hash))
+	if err != nil {
+		return nil, err
+	}
+	base, err := readAll(d.backend.Read(r.Base))
+	if err != nil {
+		return nil, fmt.Errorf("%s: base chunk %s: %s", hash, r.Base, err)
+	}
+	chunk, err := applyDelta(base, enc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", hash, err)
+	}
+	if HashBytes(chunk) != r.Plain {
+		return nil, ErrHashMismatch
+	}
+	return ioutil.NopCloser(bytes.NewReader(chunk)), nil
+}
+
+// ReadBlobStream reads deltas in full, since a delta can't be applied until
+// all of it has been read; other chunks are streamed.
+func (d *delta) ReadBlobStream(hash Hash) (io.ReadCloser, error) {
+	d.readLogsOnce.Do(d.readLogs)
+	d.mu.Lock()
+	_, ok := d.deltas[hash]
+	d.mu.Unlock()
+	if ok {
+		return d.Read(hash)
+	}
+	return d.backend.ReadBlobStream(hash)
+}
+
+func (d *delta) WriteMetadata(name string, data []byte) {
+	d.backend.WriteMetadata(name, data)
+}
+
+func (d *delta) CreateMetadata(name string, data []byte) error {
+	return d.backend.CreateMetadata(name, data)
+}
+
+func (d *delta) ReplaceMetadata(name string, old, data []byte) error {
+	return d.backend.ReplaceMetadata(name, old, data)
+}
+
+func (d *delta) ReadMetadata(name string) []byte {
+	return d.backend.ReadMetadata(name)
+}
+
+func (d *delta) MetadataExists(name string) bool {
+	return d.backend.MetadataExists(name)
+}
+
+func (d *delta) WriteMetadataBatch(metadata map[string][]byte) {
+	d.backend.WriteMetadataBatch(metadata)
+}
+
+func (d *delta) ReadMetadataBatch(names []string) map[string][]byte {
+	return d.backend.ReadMetadataBatch(names)
+}
+
+func (d *delta) MetadataExistsBatch(names []string) map[string]bool {
+	return d.backend.MetadataExistsBatch(names)
+}
+
+func (d *delta) ListMetadata() map[string]time.Time {
+	return d.backend.ListMetadata()
+}
+
+func (d *delta) ForMetadata(prefix string,
+	f func(name string, created time.Time) error) error {
+	return d.backend.ForMetadata(prefix, f)
+}
+
+func (d *delta) DeleteMetadata(name string) {
+	d.backend.DeleteMetadata(name)
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+// DeltaBases returns a map from the hashes of the chunks in the given
+// Backend's repository that are stored as deltas to the hashes of the
+// chunks that they're deltas from. The latter are needed to read the
+// former, so they must be treated as being in use for as long as any of
+// their deltas are.
+func DeltaBases(backend Backend) map[Hash]Hash {
+	bases := make(map[Hash]Hash)
+	for _, r := range readDeltaLogs(backend) {
+		if r.Base != (Hash{}) {
+			bases[r.Hash] = r.Base
+		}
+	}
+	return bases
+}
+
+// DeltaLogHashes returns the hashes of the blobs that store the logs of
+// the delta backend in the given Backend's repository; as with
+// EncryptionLogHashes, they're only referenced by metadata.
+func DeltaLogHashes(backend Backend) []Hash {
+	var names []string
+	backend.ForMetadata(deltaLogPrefix, func(name string, created time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+	var hashes []Hash
+	for _, md := range backend.ReadMetadataBatch(names) {
+		hashes = append(hashes, NewMerkleHash(md).Hash)
+	}
+	return hashes
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Resemblance hashing
+
+const (
+	// Size of the windows that are hashed, both to find super-features
+	// and to find matches between chunks.
+	deltaWindow = 32
+	// Base of the polynomial rolling hash of windows.
+	deltaHashBase = 0x100000001b3
+	// Number of features computed for each chunk; pairs of them are
+	// combined into each super-feature.
+	deltaFeatures      = 6
+	deltaSuperFeatures = deltaFeatures / 2
+)
+
+// Multipliers and offsets of the linear functions of the windows' hashes
+// whose maximum values are the features; they're arbitrary, but changing
+// them would keep chunks from being found similar to ones already
+// stored.
+var deltaFeatureParams = [deltaFeatures][2]uint64{
+	{0x9e3779b97f4a7c15, 0x632be59bd9b4e019},
+	{0xbf58476d1ce4e5b9, 0x8cb92ba72f3d8dd7},
+	{0x94d049bb133111eb, 0xd6e8feb86659fd93},
+	{0xc2b2ae3d27d4eb4f, 0xa0761d6478bd642f},
+	{0x165667b19e3779f9, 0xe7037ed1a0b428db},
+	{0xd3a2646cab3487e3, 0x8ebc6af09c88c6e3},
+}
+
+// deltaHashPower is deltaHashBase^(deltaWindow-1), which is used to remove
+// bytes from the rolling hash.
+var deltaHashPower = func() uint64 {
+	p := uint64(1)
+	for i := 0; i < deltaWindow-1; i++ {
+		p *= deltaHashBase
+	}
+	return p
+}()
+
+// windowHash returns the rolling hash of the given window.
+func windowHash(w []byte) uint64 {
+	var h uint64
+	for _, c := range w {
+		h = h*deltaHashBase + uint64(c)
+	}
+	return h
+}
+
+// rollHash updates the hash of a window for sliding it ahead by a byte,
+// removing out and adding in.
+func rollHash(h uint64, out, in byte) uint64 {
+	return (h-uint64(out)*deltaHashPower)*deltaHashBase + uint64(in)
+}
+
+// superFeatures returns the super-features of the given chunk, which must
+// be at least deltaWindow bytes long. None of them are zero.
+func superFeatures(chunk []byte) [deltaSuperFeatures]uint64 {
+	var features [deltaFeatures]uint64
+	h := windowHash(chunk[:deltaWindow])
+	for i := 0; ; i++ {
+		for j, p := range deltaFeatureParams {
+			if v := h*p[0] + p[1]; v > features[j] {
+				features[j] = v
+			}
+		}
+		if i+deltaWindow == len(chunk) {
+			break
+		}
+		h = rollHash(h, chunk[i], chunk[i+deltaWindow])
+	}
+
+	var sf [deltaSuperFeatures]uint64
+	for i := range sf {
+		// Mix the pair of features together; the super-feature's index
+		// is included so that they're distinct.
+		v := features[2*i]*0x9e3779b97f4a7c15 ^ features[2*i+1] ^ uint64(i)
+		v ^= v >> 31
+		v *= 0xbf58476d1ce4e5b9
+		v ^= v >> 29
+		if v == 0 {
+			v = 1
+		}
+		sf[i] = v
+	}
+	return sf
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Delta encoding
+
+// A delta starts with a version byte and the length of the chunk it
+// encodes, as a uvarint; it's followed by a series of instructions, each
+// a one-byte opcode followed by uvarints: either the length and then the
+// bytes of a piece of the chunk that's stored literally, or the offset
+// and length of a piece of the base chunk to copy.
+const (
+	deltaVersion = 1
+	deltaLiteral = 0
+	deltaCopy    = 1
+)
+
+var errCorruptDelta = errors.New("corrupt delta")
+
+// encodeDelta returns a delta that turns base into chunk. The base is
+// indexed by the hashes of windows at regular offsets; every window of
+// the chunk is then looked up, and matches are extended as far as they
+// go in both directions.
+func encodeDelta(base, chunk []byte) []byte {
+	const step = deltaWindow / 2
+	index := make(map[uint64]int, len(base)/step)
+	for i := 0; i+deltaWindow <= len(base); i += step {
+		h := windowHash(base[i : i+deltaWindow])
+		if _, ok := index[h]; !ok {
+			index[h] = i
+		}
+	}
+
+	enc := []byte{deltaVersion}
+	enc = appendUvarint(enc, uint64(len(chunk)))
+	literal := func(b []byte) {
+		if len(b) > 0 {
+			enc = append(enc, deltaLiteral)
+			enc = appendUvarint(enc, uint64(len(b)))
+			enc = append(enc, b...)
+		}
+	}
+
+	// Bytes of the chunk from start to p haven't been encoded yet.
+	start, p := 0, 0
+	var h uint64
+	if len(chunk) >= deltaWindow {
+		h = windowHash(chunk[:deltaWindow])
+	}
+	for p+deltaWindow <= len(chunk) {
+		q, ok := index[h]
+		if ok && bytes.Equal(base[q:q+deltaWindow], chunk[p:p+deltaWindow]) {
+			for p > start && q > 0 && base[q-1] == chunk[p-1] {
+				p--
+				q--
+			}
+			n := deltaWindow
+			for p+n < len(chunk) && q+n < len(base) && base[q+n] == chunk[p+n] {
+				n++
+			}
+			literal(chunk[start:p])
+			enc = append(enc, deltaCopy)
+			enc = appendUvarint(enc, uint64(q))
+			enc = appendUvarint(enc, uint64(n))
+			p += n
+			start = p
+			if p+deltaWindow <= len(chunk) {
+				h = windowHash(chunk[p : p+deltaWindow])
+			}
+			continue
+		}
+		if p+deltaWindow < len(chunk) {
+			h = rollHash(h, chunk[p], chunk[p+deltaWindow])
+		}
+		p++
+	}
+	literal(chunk[start:])
+	return enc
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// applyDelta returns the chunk given by applying the given delta to base.
+func applyDelta(base, enc []byte) ([]byte, error) {
+	r := bytes.NewReader(enc)
+	if v, err := r.ReadByte(); err != nil || v != deltaVersion {
+		return nil, errCorruptDelta
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(len(enc))+uint64(len(base))*uint64(len(enc)) {
+		return nil, errCorruptDelta
+	}
+	chunk := make([]byte, 0, n)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errCorruptDelta
+		}
+		switch op {
+		case deltaLiteral:
+			l, err := binary.ReadUvarint(r)
+			if err != nil || l > uint64(r.Len()) {
+				return nil, errCorruptDelta
+			}
+			start := len(chunk)
+			chunk = append(chunk, make([]byte, l)...)
+			r.Read(chunk[start:])
+		case deltaCopy:
+			off, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, errCorruptDelta
+			}
+			l, err := binary.ReadUvarint(r)
+			if err != nil || off > uint64(len(base)) || l > uint64(len(base))-off {
+				return nil, errCorruptDelta
+			}
+			chunk = append(chunk, base[off:off+l]...)
+		default:
+			return nil, errCorruptDelta
+		}
+	}
+	if uint64(len(chunk)) != n {
+		return nil, errCorruptDelta
+	}
+	return chunk, nil
+}
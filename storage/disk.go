@@ -5,27 +5,55 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/mmp/bk/rdso"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 const maxDiskPackFileSize = 1 << 32
 
+// Unless fastSync is set, each file written by the disk backend is synced
+// to disk before it's renamed into place, and then the directory it's in
+// is synced, so that the file is certain to survive a crash or power loss
+// once the write has completed. Since pack files are written in full
+// before the index files that refer to them and all metadata is written
+// through the journal after the blobs it refers to have been, data that
+// SyncWrites has returned for stays readable. With fastSync, the
+// operating system decides when to write changes to disk, which is faster
+// but may leave recently written files missing or incomplete after a
+// crash.
+var fastSync bool
+
+// SetFastSync sets whether the disk backend skips syncing files and
+// directories to disk.
+func SetFastSync(fast bool) {
+	fastSync = fast
+}
+
 // disk implements the FileStorage interface to store data in a directory
-// in the local file system.
+// in the local file system. Each file is stored along with a Reed-Solomon
+// encoding of its contents (in a file with a ".rs" suffix) so that
+// corrupted parts of it can be reconstructed.
 type disk struct {
 	dir string
+	// Held while files are being repaired.
+	repairMu sync.Mutex
 }
 
 // NewDisk returns a new storage.Backend that stores data to the given
 // dir. This directory should be empty the first time NewDisk is
 // called with it.
 func NewDisk(dir string) Backend {
+	return newPackFileBackend(newDisk(dir), maxDiskPackFileSize)
+}
+
+func newDisk(dir string) *disk {
 	// Make sure that the backup directory exists and is in fact a directory.
 	stat, err := os.Stat(dir)
 	log.CheckError(err)
@@ -36,68 +64,226 @@ func NewDisk(dir string) Backend {
 	entries, err := ioutil.ReadDir(dir)
 	if len(entries) == 0 {
 		// Create the directories we'll need in the following
-		for _, d := range []string{"packs", "indices", "metadata"} {
+		for _, d := range []string{"packs", "indices", "metadata", "metadata-copies", journalDir} {
 			path := filepath.Join(dir, d)
 			log.CheckError(os.Mkdir(path, 0700))
 		}
 	} else {
-		// It should be just those three directories...
-		log.Check(len(entries) == 3,
+		// It should be just those four directories, or the first three of
+		// them for repositories created by older versions of bk, along
+		// with the journal, which older versions didn't have either.
+		n := len(entries)
+		for _, e := range entries {
+			if e.Name() == journalDir && e.IsDir() {
+				n--
+			}
+		}
+		log.Check(n == 3 || n == 4,
 			"%s: unexpected contents found in backup directory", dir)
+		for _, d := range []string{"metadata-copies", journalDir} {
+			path := filepath.Join(dir, d)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				log.CheckError(os.Mkdir(path, 0700))
+			}
+		}
 	}
 
-	return newPackFileBackend(&disk{dir}, maxDiskPackFileSize)
+	db := &disk{dir: dir}
+	if n := len(db.interruptedTransactions()); n > 0 {
+		log.Warning("%s: %d interrupted metadata transactions; run \"bk fsck\" to "+
+			"complete or roll them back", dir, n)
+	}
+	return db
 }
 
 func (db *disk) ForFiles(prefix string, f func(n string, created time.Time)) {
+	log.CheckError(db.forFiles(prefix, f))
+}
+
+// forFiles implements ForFiles, returning any errors rather than treating
+// them as fatal.
+func (db *disk) forFiles(prefix string, f func(n string, created time.Time)) error {
 	// Assume that the prefix specifies a directory; read its contents.
 	dir := filepath.Join(db.dir, prefix)
 	fileinfo, err := ioutil.ReadDir(dir)
-	log.CheckError(err)
+	if err != nil {
+		return err
+	}
 
 	for _, file := range fileinfo {
 		if strings.HasSuffix(file.Name(), ".rs") {
 			// Don't pass the Reed-Solomon files back.
 			continue
 		}
-		log.Check(!file.IsDir())
+		if file.IsDir() {
+			return fmt.Errorf("%s: unexpected directory", filepath.Join(dir, file.Name()))
+		}
 
 		f(filepath.Join(prefix, file.Name()), file.ModTime())
 	}
+	return nil
 }
 
 func (db *disk) String() string {
 	return "disk: " + db.dir
 }
 
-func (db *disk) Fsck() bool {
+func (db *disk) Fsck(opts FsckOptions) bool {
 	// Check the Reed-Solomon encoding of all of the (non-.rs) files.
 	log.Verbose("Checking Reed-Solomon codes of all files")
 	filepath.Walk(db.dir,
 		func(path string, info os.FileInfo, err error) error {
-			if !strings.HasSuffix(path, ".rs") {
-				r, err := os.Open(path)
-				if err != nil {
-					return err
+			if err == nil && info.IsDir() {
+				if path == filepath.Join(db.dir, journalDir) {
+					// Transactions are recovered separately.
+					return filepath.SkipDir
 				}
-				defer r.Close()
-				rsr, err := os.Open(path + ".rs")
-				if err != nil {
-					return err
+				return nil
+			}
+			if strings.HasSuffix(path, ".rs") {
+				return nil
+			}
+			// Subsets are chosen using the names of files relative to the
+			// repository, as FileStorage gives them to the pack backend.
+			name, err := filepath.Rel(db.dir, path)
+			log.CheckError(err)
+			if opts.FileInSubset(filepath.ToSlash(name)) {
+				if err := checkEncoding(path); err != nil {
+					if !opts.Repair {
+						log.Error("%s: %s", path, err)
+						return nil
+					}
+					log.Warning("%s: %s; repairing", path, err)
+					if err := db.Repair(name); err != nil {
+						log.Error("%s: unable to repair: %s", path, err)
+					} else {
+						log.Print("%s: repaired", path)
+					}
 				}
-				defer rsr.Close()
-
-				return rdso.Check(r, rsr, log)
 			}
 			return nil
 		})
 	return true
 }
 
+// checkEncoding checks the file at the given path against its
+// Reed-Solomon encoding.
+func checkEncoding(path string) error {
+	r, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rsr, err := os.Open(path + ".rs")
+	if err != nil {
+		return err
+	}
+	defer rsr.Close()
+
+	return rdso.Check(r, rsr, log)
+}
+
+// Repair uses the Reed-Solomon encoding of the given file to reconstruct
+// any corrupted parts of it, replacing both the file and its encoding
+// with the repaired versions. The originals are only replaced once the
+// repaired versions are known to be consistent.
+func (db *disk) Repair(name string) error {
+	db.repairMu.Lock()
+	defer db.repairMu.Unlock()
+
+	path := filepath.Join(db.dir, name)
+	tmpPath := path + ".tmp"
+	err := restoreEncoded(path, tmpPath)
+	if err == nil {
+		err = checkEncoding(tmpPath)
+	}
+	if err == nil {
+		// If this rename succeeds but the next one doesn't, the new
+		// encoding still matches the parts of the original file that
+		// weren't corrupted, so it can be repaired again later.
+		err = os.Rename(tmpPath+".rs", path+".rs")
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err == nil {
+		syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		os.Remove(tmpPath + ".rs")
+	}
+	return err
+}
+
+// restoreEncoded writes repaired versions of the file at the given path and
+// its Reed-Solomon encoding to tmpPath and tmpPath+".rs", respectively.
+func restoreEncoded(path, tmpPath string) error {
+	r, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	info, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	rsr, err := os.Open(path + ".rs")
+	if err != nil {
+		return err
+	}
+	defer rsr.Close()
+
+	w, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	rsw, err := os.Create(tmpPath + ".rs")
+	if err != nil {
+		w.Close()
+		return err
+	}
+	err = rdso.Restore(r, rsr, info.Size(), w, rsw, log)
+	for _, f := range []*os.File{w, rsw} {
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (db *disk) RemoveFile(name string) error {
+	path := filepath.Join(db.dir, name)
+	if err := os.Remove(path + ".rs"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(path)
+}
+
 func (db *disk) CreateFile(name string) RobustWriteCloser {
 	return newRobustDiskWriter(filepath.Join(db.dir, name))
 }
 
+// writeFile stores the contents of r as the named file with the same
+// guarantees as the writer returned by CreateFile, but returns any errors
+// rather than treating them as fatal. Nothing is left behind if it
+// fails.
+func (db *disk) writeFile(name string, r io.Reader) error {
+	w, err := createRobustWriter(filepath.Join(db.dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w.file, r); err != nil {
+		w.file.Close()
+		os.Remove(w.path + ".tmp")
+		return err
+	}
+	return w.close()
+}
+
 func (db *disk) ReadFile(name string, offset int64, length int64) ([]byte, error) {
 	f, err := os.Open(filepath.Join(db.dir, name))
 	if err != nil {
@@ -119,6 +305,35 @@ func (db *disk) ReadFile(name string, offset int64, length int64) ([]byte, error
 	return ioutil.ReadAll(f)
 }
 
+// OpenFile implements StreamingFileStorage.
+func (db *disk) OpenFile(name string, offset int64, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(db.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return f, nil
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &readerAndCloser{io.LimitReader(f, length), f}, nil
+}
+
+// Parameters of the Reed-Solomon encodings of files.
+const (
+	rsDataShards   = 17
+	rsParityShards = 3
+	rsHashRate     = 1024 * 1024
+)
+
+// CreateFileExclusive implements ExclusiveFileStorage with a transaction
+// that just creates the file.
+func (db *disk) CreateFileExclusive(name string, contents []byte) error {
+	return db.Commit(map[string][]byte{name: contents}, nil)
+}
+
 // robustWriter implements the io.WriteCloser interface to write a file on
 // disk. Its implementations of Write and Close never return errors; any
 // errors encountered are treated as fatal errors. It ensures that a
@@ -132,15 +347,26 @@ type robustWriter struct {
 }
 
 func newRobustDiskWriter(path string) RobustWriteCloser {
-	errorIfExists(path)
+	w, err := createRobustWriter(path)
+	log.CheckError(err)
+	return w
+}
 
+// createRobustWriter returns a robustWriter for the file at the given
+// path, which must not already exist.
+func createRobustWriter(path string) (*robustWriter, error) {
 	// Open a temporary file to hold the intermediate writes.
 	tmpPath := path + ".tmp"
-	errorIfExists(tmpPath)
+	for _, p := range []string{path, tmpPath} {
+		if _, err := os.Stat(p); err == nil {
+			return nil, &os.PathError{Op: "create", Path: p, Err: os.ErrExist}
+		}
+	}
 	f, err := os.Create(tmpPath)
-	log.CheckError(err)
-
-	return &robustWriter{f, path}
+	if err != nil {
+		return nil, err
+	}
+	return &robustWriter{f, path}, nil
 }
 
 func (w *robustWriter) Write(b []byte) {
@@ -149,38 +375,76 @@ func (w *robustWriter) Write(b []byte) {
 }
 
 func (w *robustWriter) Close() {
+	log.CheckError(w.close())
+}
+
+// close implements Close, returning any errors rather than treating them
+// as fatal. If it fails, the temporary files are removed.
+func (w *robustWriter) close() error {
+	tmpPath := w.path + ".tmp"
+	rsPath := w.path + ".rs"
+	rstmpPath := rsPath + ".tmp"
+	fail := func(err error) error {
+		w.file.Close()
+		os.Remove(tmpPath)
+		os.Remove(rstmpPath)
+		return err
+	}
+
 	// When it's time to close the writer, first make sure that all of the
 	// writes have landed on disk in the temporary file.
-	log.CheckError(w.file.Sync())
-	log.CheckError(w.file.Close())
+	if !fastSync {
+		if err := w.file.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := w.file.Close(); err != nil {
+		return fail(err)
+	}
 
 	// Next, compute the Reed-Solomon encoding for the file's contents.
-	tmpPath := w.path + ".tmp"
 	r, err := os.Open(tmpPath)
-	log.CheckError(err)
+	if err != nil {
+		return fail(err)
+	}
 	info, err := r.Stat()
-	log.CheckError(err)
+	if err != nil {
+		r.Close()
+		return fail(err)
+	}
 
 	// Write the encoding to a temporary file to be sure we don't have an
 	// incomplete one.
-	rsPath := w.path+".rs"
-	rstmpPath := rsPath + ".tmp"
 	rsw, err := os.Create(rstmpPath)
-	log.CheckError(err)
-
-	const nDataShards = 17
-	const nParityShards = 3
-	const hashRate = 1024 * 1024
-	err = rdso.Encode(r, info.Size(), rsw, nDataShards, nParityShards, hashRate)
-	log.CheckError(err)
-	log.CheckError(rsw.Sync())
-	log.CheckError(rsw.Close())
-	log.CheckError(os.Rename(rstmpPath, rsPath))
+	if err != nil {
+		r.Close()
+		return fail(err)
+	}
+	err = rdso.Encode(r, info.Size(), rsw, rsDataShards, rsParityShards, rsHashRate)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !fastSync {
+		err = rsw.Sync()
+	}
+	if cerr := rsw.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(rstmpPath, rsPath)
+	}
+	if err != nil {
+		return fail(err)
+	}
 
 	// Finally, rename the temporary file for the data (which we now know
 	// to be valid and complete) to the final filename that we wanted
-	// originally. Only once the rename has succeeded can we be sure that
-	// everything is safely on disk.
-	log.CheckError(r.Close())
-	log.CheckError(os.Rename(tmpPath, w.path))
+	// originally. Only once the rename has succeeded and been recorded
+	// in the directory can we be sure that everything is safely on disk.
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		os.Remove(rsPath)
+		return fail(err)
+	}
+	syncDir(filepath.Dir(w.path))
+	return nil
 }
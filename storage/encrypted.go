@@ -7,18 +7,23 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"golang.org/x/crypto/pbkdf2"
 	"io"
 	"io/ioutil"
+	"math/bits"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,11 +40,26 @@ type encrypted struct {
 	// encrypted versions of them, if we already have them stored.  Because
 	// we use a unique random new IV every time a new chunk comes in to
 	// Write(), we need to maintain this map explicitly in for
-	// deduplication to work.
-	toEncrypted map[Hash]Hash
+	// deduplication to work. It's only needed for writes, so it isn't
+	// populated until the first call to Write.
+	toEncrypted  map[Hash]Hash
+	readLogsOnce sync.Once
+	// Chunks that are being stored, which other calls to Write wait for
+	// rather than storing them again; see storedAs.
+	pending map[Hash]chan struct{}
 	// toEncryptedLog stores a log of the mappings added during the current
 	// run; it's serialized to disk in SyncWrites().
 	toEncryptedLog []encpair
+	// mu protects toEncrypted, toEncryptedLog, pending, and the statistics so
+	// that Write can be called concurrently.
+	mu sync.Mutex
+	// Statistics about the calls to Write.
+	chunksWritten, bytesWritten int64
+	// Whether chunks are padded before they're encrypted; see padChunk.
+	pad bool
+	// Key used to authenticate metadata; nil if the repository's metadata
+	// isn't authenticated.
+	macKey []byte
 }
 
 type encryptedKey struct {
@@ -47,44 +67,108 @@ type encryptedKey struct {
 	passphraseHash []byte
 	encryptedKey   []byte
 	encryptedKeyIV []byte
+	// Whether the repository's metadata is authenticated.
+	authenticated bool
 }
 
 const toEncryptedPrefix = "toencrypted-"
 
+// The canary is a known plaintext encrypted with the repository's key,
+// stored in the metadata named canaryName. The passphrase is confirmed
+// using encrypt.txt, but the key that it's used to decrypt has no check
+// of its own, so if encrypt.txt is damaged, chunks would be "decrypted"
+// to garbage; decrypting the canary when the repository is opened
+// catches that before any work is done. It's written when the repository
+// is created and, for repositories created before it was added, the next
+// time chunks are written.
+const canaryName = "encrypt-canary.txt"
+
+const canaryPlaintext = "bk encryption canary\n"
+
 const ivLength = aes.BlockSize
 
 // NewEncrypted returns a storage.Backend that applies AES encryption
 // to the chunk data stored in the underlying storage.Backend.
-// Note: metadata contents and the names of named hashes are not encrypted.
+// Note: metadata contents and the names of named hashes are not encrypted,
+// though metadata contents are authenticated in new repositories; see
+// verifyMetadata.
 func NewEncrypted(backend Backend, passphrase string) Backend {
 	eb := &encrypted{backend: backend,
-		toEncrypted: make(map[Hash]Hash)}
+		toEncrypted: make(map[Hash]Hash),
+		pending:     make(map[Hash]chan struct{}),
+		pad:         backend.MetadataExists(paddingName)}
 
+	var authenticated bool
 	if backend.MetadataExists("encrypt.txt") {
-		eb.key = getEncryptionKey(string(backend.ReadMetadata("encrypt.txt")),
-			passphrase)
+		enc := string(backend.ReadMetadata("encrypt.txt"))
+		eb.key, authenticated = getEncryptionKey(enc, passphrase,
+			encryptionKeyKDF(backend, enc, passphrase))
 	} else {
 		// Generate all of the values we need for encryption.
 		var ec encryptedKey
-		eb.key, ec = generateKey(passphrase)
+		eb.key, ec = generateKey(passphrase, RepositoryKDF(backend))
+		authenticated = ec.authenticated
 
 		// And store them, hex-encoded, as metadata in the underlying backend.
-		enc := fmt.Sprintf("%s\n", hex.EncodeToString(ec.salt))
-		enc += fmt.Sprintf("%s\n", hex.EncodeToString(ec.passphraseHash))
-		enc += fmt.Sprintf("%s\n", hex.EncodeToString(ec.encryptedKey))
-		enc += fmt.Sprintf("%s\n", hex.EncodeToString(ec.encryptedKeyIV))
-		eb.backend.WriteMetadata("encrypt.txt", []byte(enc))
-	}
-
-	// Process the contents of all of the log files that store pairs of
-	// (plaintext, encrypted) hashes to populate the toEncryted map.
-	for name := range backend.ListMetadata() {
-		if !strings.HasPrefix(name, toEncryptedPrefix) {
-			continue
+		eb.backend.WriteMetadata("encrypt.txt", []byte(ec.encode()))
+		eb.writeCanary()
+	}
+	if backend.MetadataExists(canaryName) {
+		if err := eb.checkCanary(); err != nil {
+			log.Fatal("%s", err)
 		}
+	}
+	if authenticated {
+		eb.macKey = metadataMACKey(eb.key, RepositoryHashAlgorithm(backend))
+		eb.checkMetadataKey()
+	}
+
+	return eb
+}
+
+// writeCanary stores the canary, encrypted with the repository's key.
+func (eb *encrypted) writeCanary() {
+	iv := getRandomBytes(ivLength)
+	enc := encryptBytes(eb.key, iv, []byte(canaryPlaintext))
+	eb.backend.WriteMetadata(canaryName, []byte(fmt.Sprintf("%s\n%s\n",
+		hex.EncodeToString(iv), hex.EncodeToString(enc))))
+}
+
+// checkCanary returns an error if the repository's key doesn't decrypt
+// the canary.
+func (eb *encrypted) checkCanary() error {
+	var ivHex, encHex string
+	if _, err := fmt.Sscanf(string(eb.backend.ReadMetadata(canaryName)), "%s\n%s",
+		&ivHex, &encHex); err != nil {
+		return fmt.Errorf("%s: %s", canaryName, err)
+	}
+	iv, err := hex.DecodeString(ivHex)
+	if err != nil || len(iv) != ivLength {
+		return fmt.Errorf("%s: invalid initialization vector", canaryName)
+	}
+	enc, err := hex.DecodeString(encHex)
+	if err != nil {
+		return fmt.Errorf("%s: %s", canaryName, err)
+	}
+	if string(decryptBytes(eb.key, iv, enc)) != canaryPlaintext {
+		return errors.New("the passphrase is correct, but the encryption key it " +
+			"decrypts doesn't decrypt the repository's canary; encrypt.txt may be damaged")
+	}
+	return nil
+}
+
+// readToEncryptedLogs processes the contents of all of the log files that
+// store pairs of (plaintext, encrypted) hashes to populate the toEncryted
+// map.
+func (eb *encrypted) readToEncryptedLogs() {
+	var names []string
+	eb.backend.ForMetadata(toEncryptedPrefix, func(name string, created time.Time) error {
+		names = append(names, name)
+		return nil
+	})
 
-		md := backend.ReadMetadata(name)
-		mh := DecodeMerkleHash(bytes.NewReader(md))
+	for name, md := range eb.backend.ReadMetadataBatch(names) {
+		mh := DecodeMerkleHash(bytes.NewReader(eb.checkedMetadata(name, md)))
 
 		r := mh.NewReader(nil, eb)
 		dec := gob.NewDecoder(r)
@@ -96,8 +180,6 @@ func NewEncrypted(backend Backend, passphrase string) Backend {
 		}
 		log.CheckError(r.Close())
 	}
-
-	return eb
 }
 
 func (eb *encrypted) String() string {
@@ -108,37 +190,144 @@ func (eb *encrypted) LogStats() {
 	eb.backend.LogStats()
 }
 
-func (eb *encrypted) Fsck() {
+func (eb *encrypted) Stats() Stats {
+	s := eb.backend.Stats()
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	s.ChunksWritten = eb.chunksWritten
+	s.BytesWritten = eb.bytesWritten
+	return s
+}
+
+func (eb *encrypted) Fsck(opts FsckOptions) {
 	// TODO? Validate the plaintext->encrypted hashes?  It's probably fine
 	// to assume that Reed-Solomon suffices for any integrtity issues for
 	// those..
-	eb.backend.Fsck()
+	eb.backend.Fsck(opts)
 }
 
 func (eb *encrypted) Write(data []byte) Hash {
+	eb.mu.Lock()
+	eb.chunksWritten++
+	eb.bytesWritten += int64(len(data))
+	eb.mu.Unlock()
+	return eb.write(data)
+}
+
+// write encrypts and stores the given chunk; unlike Write, it doesn't
+// count the chunk in the statistics that are reported.
+func (eb *encrypted) write(data []byte) Hash {
+	eb.readLogsOnce.Do(eb.readToEncryptedLogs)
+
 	// See if we've already stored these bytes; return the hash of
 	// their encrypted version if so.
 	hplain := HashBytes(data)
-	if henc, ok := eb.toEncrypted[hplain]; ok {
+	if henc, ok := eb.storedAs(hplain); ok {
 		return henc
 	}
 
 	// Generate a new random initialization vector and encrypt the data.
 	iv := getRandomBytes(ivLength)
+	if eb.pad {
+		data = padChunk(data)
+	}
 	enc := encryptBytes(eb.key, iv, data)
 	// In the chunk that's stored, first write out the IV, then the
 	// encrypted data.
 	henc := eb.backend.Write(append(iv, enc...))
 
+	return eb.addMapping(hplain, henc)
+}
+
+// storedAs returns the hash of the encrypted version of the chunk with the
+// given hash, if it's been stored. Otherwise, it records that the caller
+// is storing it; the caller must then call addMapping. Other calls for
+// the same chunk wait until then rather than storing another copy, as
+// they otherwise would when SplitAndStore stores identical chunks in
+// parallel.
+func (eb *encrypted) storedAs(hplain Hash) (Hash, bool) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	for {
+		if henc, ok := eb.toEncrypted[hplain]; ok {
+			return henc, true
+		}
+		done, ok := eb.pending[hplain]
+		if !ok {
+			break
+		}
+		eb.mu.Unlock()
+		<-done
+		eb.mu.Lock()
+	}
+	eb.pending[hplain] = make(chan struct{})
+	return Hash{}, false
+}
+
+// addMapping records that the chunk with the given hash has been stored
+// encrypted with the hash henc, returning the hash that references to it
+// should use.
+func (eb *encrypted) addMapping(hplain, henc Hash) Hash {
 	// Update the map and the log so that if we see these bytes again, we
 	// don't store them redundantly in the current and future runs,
 	// respectively.
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if done, ok := eb.pending[hplain]; ok {
+		delete(eb.pending, hplain)
+		close(done)
+	}
+	if h, ok := eb.toEncrypted[hplain]; ok {
+		// Another goroutine stored the same chunk concurrently; use its
+		// version so that all references are to the same one.
+		return h
+	}
 	eb.toEncrypted[hplain] = henc
 	eb.toEncryptedLog = append(eb.toEncryptedLog, encpair{hplain, henc})
 
 	return henc
 }
 
+// WriteBlobStream spools the chunk so that its hash is known before it's
+// stored (and, if chunks are padded, so is its length) and then encrypts
+// it as it's passed to the underlying Backend.
+func (eb *encrypted) WriteBlobStream(r io.Reader) (Hash, error) {
+	sp, err := asSpool(r)
+	if err != nil {
+		return Hash{}, err
+	}
+	defer sp.Close()
+
+	eb.mu.Lock()
+	eb.chunksWritten++
+	eb.bytesWritten += sp.size
+	eb.mu.Unlock()
+
+	eb.readLogsOnce.Do(eb.readToEncryptedLogs)
+	hplain := sp.Hash()
+	if henc, ok := eb.storedAs(hplain); ok {
+		return henc, nil
+	}
+
+	// The same layout as padChunk's, but without copying the data.
+	var plain io.Reader = sp
+	if eb.pad {
+		var b [binary.MaxVarintLen64]byte
+		header := b[:binary.PutUvarint(b[:], uint64(sp.size))]
+		n := int64(ivLength+len(header)) + sp.size
+		padding := int64(paddedSize(int(n))) - n
+		plain = io.MultiReader(bytes.NewReader(header), sp, io.LimitReader(zeros{}, padding))
+	}
+	iv := getRandomBytes(ivLength)
+	henc, err := eb.backend.WriteBlobStream(io.MultiReader(bytes.NewReader(iv),
+		makeEncryptingReader(eb.key, iv, plain)))
+	// The data comes from the spool, so there can't be an error reading
+	// it.
+	log.CheckError(err)
+
+	return eb.addMapping(hplain, henc), nil
+}
+
 func (eb *encrypted) SyncWrites() {
 	// Make sure all of the chunks are stored.
 	eb.backend.SyncWrites()
@@ -151,11 +340,15 @@ func (eb *encrypted) SyncWrites() {
 		log.CheckError(enc.Encode(eb.toEncryptedLog))
 
 		// Important: use eb, not eb.backend, so these are encrypted!
-		hash := MerkleFromSingle(eb.Write(buf.Bytes()))
+		hash := MerkleFromSingle(eb.write(buf.Bytes()))
 
 		// The name doesn't matter but does need to be unique.
 		name := toEncryptedPrefix + hash.Hash.String()
-		eb.backend.WriteMetadata(name, hash.Bytes())
+		eb.backend.WriteMetadata(name, eb.signMetadata(name, hash.Bytes()))
+
+		if !eb.backend.MetadataExists(canaryName) {
+			eb.writeCanary()
+		}
 
 		// Now have the backend do its thing and make sure that the metadata
 		// has also landed.
@@ -173,8 +366,21 @@ func (eb *encrypted) Hashes() map[Hash]struct{} {
 	return eb.backend.Hashes()
 }
 
+func (eb *encrypted) BlobSize(hash Hash) (int64, error) {
+	return eb.backend.BlobSize(hash)
+}
+
 func (eb *encrypted) Read(hash Hash) (io.ReadCloser, error) {
-	r, err := eb.backend.Read(hash)
+	return eb.decrypt(eb.backend.Read(hash))
+}
+
+func (eb *encrypted) ReadBlobStream(hash Hash) (io.ReadCloser, error) {
+	return eb.decrypt(eb.backend.ReadBlobStream(hash))
+}
+
+// decrypt returns a reader for the chunk stored in the given one, as
+// returned by the underlying Backend's Read or ReadBlobStream method.
+func (eb *encrypted) decrypt(r io.ReadCloser, err error) (io.ReadCloser, error) {
 	if err != nil {
 		return r, err
 	}
@@ -186,25 +392,253 @@ func (eb *encrypted) Read(hash Hash) (io.ReadCloser, error) {
 		return r, err
 	}
 	// With that, we can make a reader that will decrypt the rest of it.
-	return &readerAndCloser{makeDecryptingReader(eb.key, iv[:], r), r}, nil
+	dr := makeDecryptingReader(eb.key, iv[:], r)
+	if eb.pad {
+		br := bufio.NewReader(dr)
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		// The padding is read rather than ignored so that errors at the
+		// end of a stream aren't missed.
+		dr = &drainingReader{br, int64(n)}
+	}
+	return &readerAndCloser{dr, r}, nil
 }
 
 func (eb *encrypted) WriteMetadata(name string, data []byte) {
-	eb.backend.WriteMetadata(name, data)
+	eb.backend.WriteMetadata(name, eb.signMetadata(name, data))
+}
+
+func (eb *encrypted) CreateMetadata(name string, data []byte) error {
+	return eb.backend.CreateMetadata(name, eb.signMetadata(name, data))
+}
+
+func (eb *encrypted) ReplaceMetadata(name string, old, data []byte) error {
+	// The stored metadata includes its MAC, so it's what must be given to
+	// the underlying backend; comparing the authenticated contents to old
+	// ensures that it's what the caller read.
+	stored := eb.backend.ReadMetadata(name)
+	if data, err := eb.verifyMetadata(name, stored); err != nil {
+		return err
+	} else if !bytes.Equal(data, old) {
+		return ErrMetadataChanged
+	}
+	return eb.backend.ReplaceMetadata(name, stored, eb.signMetadata(name, data))
 }
 
 func (eb *encrypted) ReadMetadata(name string) []byte {
-	return eb.backend.ReadMetadata(name)
+	return eb.checkedMetadata(name, eb.backend.ReadMetadata(name))
 }
 
 func (eb *encrypted) MetadataExists(name string) bool {
 	return eb.backend.MetadataExists(name)
 }
 
+func (eb *encrypted) WriteMetadataBatch(metadata map[string][]byte) {
+	signed := make(map[string][]byte, len(metadata))
+	for name, data := range metadata {
+		signed[name] = eb.signMetadata(name, data)
+	}
+	eb.backend.WriteMetadataBatch(signed)
+}
+
+func (eb *encrypted) ReadMetadataBatch(names []string) map[string][]byte {
+	md := eb.backend.ReadMetadataBatch(names)
+	for name, b := range md {
+		md[name] = eb.checkedMetadata(name, b)
+	}
+	return md
+}
+
+func (eb *encrypted) MetadataExistsBatch(names []string) map[string]bool {
+	return eb.backend.MetadataExistsBatch(names)
+}
+
 func (eb *encrypted) ListMetadata() map[string]time.Time {
 	return eb.backend.ListMetadata()
 }
 
+func (eb *encrypted) ForMetadata(prefix string,
+	f func(name string, created time.Time) error) error {
+	return eb.backend.ForMetadata(prefix, f)
+}
+
+func (eb *encrypted) DeleteMetadata(name string) {
+	eb.backend.DeleteMetadata(name)
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Metadata authentication
+
+// In repositories created by current versions of bk, a MAC of the name and
+// contents of each piece of metadata is appended to its contents when
+// it's written and checked when it's read. Without it, anyone with write
+// access to the underlying storage could, for example, make "backup-foo"
+// refer to the root of another backup without that being noticed. (They
+// can still delete metadata, though.) The metadata that's written to the
+// underlying backend before the encryption key is available isn't
+// authenticated, including the repository identifier even when an upgrade
+// adds it later; nor is the canary, which is checked on its own. The hash
+// algorithm recorded in that metadata is covered by the key used for the
+// MACs; see metadataMACKey.
+//
+// Whether metadata is authenticated is recorded in encrypt.txt; so that
+// the record can't be removed to turn authentication off, the value stored
+// there to check the passphrase is computed differently when it's
+// present.
+
+// Included in encrypt.txt if the repository's metadata is authenticated.
+const authenticatedMetadataTag = "authenticated-metadata"
+
+// ErrMetadataAuthentication is returned by verifyMetadata if metadata's
+// MAC doesn't match its name and contents.
+var ErrMetadataAuthentication = errors.New("metadata authentication failed; " +
+	"it may have been modified by someone without the passphrase")
+
+// authenticates reports whether the metadata with the given name is
+// authenticated.
+func (eb *encrypted) authenticates(name string) bool {
+	return eb.macKey != nil && name != "encrypt.txt" && name != canaryName &&
+		name != kdfName && name != kdfRekeyName && name != hashAlgorithmName &&
+		name != paddingName && name != repositoryIDName &&
+		!strings.HasPrefix(name, formatPrefix)
+}
+
+// metadataMACKey returns the key used to authenticate metadata, given the
+// repository's encryption key and hash algorithm. hash.txt is written
+// before the encryption key is available, so it can't be authenticated
+// itself; instead, the algorithm is included in the key when it isn't the
+// default, so that if hash.txt is modified, no metadata can be
+// authenticated.
+func metadataMACKey(key []byte, hashAlgorithm string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("bk metadata authentication"))
+	if hashAlgorithm != DefaultHashAlgorithm {
+		mac.Write([]byte{0})
+		mac.Write([]byte(hashAlgorithm))
+	}
+	return mac.Sum(nil)
+}
+
+// errFoundMetadata stops checkMetadataKey's search.
+var errFoundMetadata = errors.New("found authenticated metadata")
+
+// checkMetadataKey authenticates one piece of the repository's metadata,
+// if it has any that's authenticated, so that a modified hash.txt is
+// caught when the repository is opened, before anything is stored using
+// the wrong hash algorithm.
+func (eb *encrypted) checkMetadataKey() {
+	var name string
+	eb.backend.ForMetadata("", func(n string, created time.Time) error {
+		if !eb.authenticates(n) {
+			return nil
+		}
+		name = n
+		return errFoundMetadata
+	})
+	if name == "" {
+		return
+	}
+	if _, err := eb.verifyMetadata(name, eb.backend.ReadMetadata(name)); err != nil {
+		log.Fatal("%s: %s (%s may have been modified)", name, err, hashAlgorithmName)
+	}
+}
+
+func (eb *encrypted) metadataMAC(name string, data []byte) []byte {
+	mac := hmac.New(sha256.New, eb.macKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// signMetadata returns the contents to store for the metadata with the
+// given name and contents.
+func (eb *encrypted) signMetadata(name string, data []byte) []byte {
+	if !eb.authenticates(name) {
+		return data
+	}
+	return append(append([]byte(nil), data...), eb.metadataMAC(name, data)...)
+}
+
+// verifyMetadata checks the MAC of the stored contents of the metadata
+// with the given name, returning its original contents.
+func (eb *encrypted) verifyMetadata(name string, stored []byte) ([]byte, error) {
+	if !eb.authenticates(name) {
+		return stored, nil
+	}
+	n := len(stored) - sha256.Size
+	if n < 0 || !hmac.Equal(stored[n:], eb.metadataMAC(name, stored[:n])) {
+		return nil, ErrMetadataAuthentication
+	}
+	return stored[:n], nil
+}
+
+// checkedMetadata is like verifyMetadata, but authentication failures are
+// fatal.
+func (eb *encrypted) checkedMetadata(name string, stored []byte) []byte {
+	data, err := eb.verifyMetadata(name, stored)
+	if err != nil {
+		log.Fatal("%s: %s", name, err)
+	}
+	return data
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+// EncryptionLogHashes returns the hashes of the blobs that store the logs
+// of the mappings from unencrypted to encrypted hashes in the given
+// Backend's repository. They're only referenced by metadata, so they
+// must be accounted for separately when determining which blobs are in
+// use. Each log is stored in a single blob.
+func EncryptionLogHashes(backend Backend) []Hash {
+	var names []string
+	backend.ForMetadata(toEncryptedPrefix, func(name string, created time.Time) error {
+		names = append(names, name)
+		return nil
+	})
+	var hashes []Hash
+	for _, md := range backend.ReadMetadataBatch(names) {
+		hashes = append(hashes, NewMerkleHash(md).Hash)
+	}
+	return hashes
+}
+
+///////////////////////////////////////////////////////////////////////////
+
+// padChunk prefixes the given chunk with its length and pads it with
+// zeros, so that the stored chunk, including its initialization vector, has
+// one of the sizes given by paddedSize. Otherwise, the sequence of chunk
+// sizes that a file is split into would be visible to anyone with access to
+// the storage, which could be used to determine whether a known file is
+// present.
+func padChunk(data []byte) []byte {
+	var b [binary.MaxVarintLen64]byte
+	header := b[:binary.PutUvarint(b[:], uint64(len(data)))]
+	n := ivLength + len(header) + len(data)
+	padded := make([]byte, paddedSize(n)-ivLength)
+	copy(padded, header)
+	copy(padded[len(header):], data)
+	return padded
+}
+
+// paddedSize returns the size that a stored chunk of n bytes is padded to,
+// using the Padmé scheme: sizes are rounded up so that only the top
+// O(log log n) bits of them may be nonzero. The overhead is at most 12%,
+// and less for larger chunks, while the number of distinct sizes is small
+// enough that they reveal little about the contents.
+func paddedSize(n int) int {
+	if n < 2 {
+		return n
+	}
+	e := bits.Len(uint(n)) - 1
+	s := bits.Len(uint(e))
+	mask := 1<<uint(e-s) - 1
+	return (n + mask) &^ mask
+}
+
 ///////////////////////////////////////////////////////////////////////////
 
 // Utility function to decode hex-encoded bytes; treats any encoding errors
@@ -267,16 +701,17 @@ func getRandomBytes(n int) []byte {
 
 // Create a new encryption key and encrypt it using the user-provided
 // passphrase.
-func generateKey(passphrase string) ([]byte, encryptedKey) {
-	// Derive a 64-byte hash from the passphrase using PBKDF2 with 65536
-	// rounds of SHA256.
+func generateKey(passphrase string, kdf KDFParams) ([]byte, encryptedKey) {
+	// Derive a 64-byte hash from the passphrase using the repository's
+	// key derivation function.
 	salt := getRandomBytes(32)
-	hash := pbkdf2.Key([]byte(passphrase), salt, 65536, 64, sha256.New)
+	hash := kdf.derive(passphrase, salt)
 	log.Check(len(hash) == 64)
 
 	// We'll store the first 32 bytes of the hash to use to confirm the
-	// correct passphrase is given on subsequent runs.
-	passHash := hash[:32]
+	// correct passphrase is given on subsequent runs. New repositories
+	// always authenticate their metadata.
+	passHash := passphraseCheck(hash[:32], true)
 	// And we'll use the remaining 32 bytes as a key to encrypt the actual
 	// encryption key. (These bytes are *not* stored).
 	keyEncryptKey := hash[32:]
@@ -284,41 +719,187 @@ func generateKey(passphrase string) ([]byte, encryptedKey) {
 	// Generate a random encryption key and encrypt it using the key
 	// derived from the passphrase.
 	key := getRandomBytes(32)
-	iv := getRandomBytes(ivLength)
+	return key, wrapKey(key, salt, passHash, keyEncryptKey, true)
+}
 
-	return key, encryptedKey{
+// wrapKey returns the encryptedKey that stores the given encryption key,
+// encrypted with keyEncryptKey.
+func wrapKey(key, salt, passHash, keyEncryptKey []byte, authenticated bool) encryptedKey {
+	iv := getRandomBytes(ivLength)
+	return encryptedKey{
 		salt:           salt,
 		passphraseHash: passHash,
 		encryptedKey:   encryptBytes(keyEncryptKey, iv, key),
 		encryptedKeyIV: iv,
+		authenticated:  authenticated,
+	}
+}
+
+// encode returns the contents of encrypt.txt for the key: its values,
+// hex-encoded.
+func (ec encryptedKey) encode() string {
+	enc := fmt.Sprintf("%s\n", hex.EncodeToString(ec.salt))
+	enc += fmt.Sprintf("%s\n", hex.EncodeToString(ec.passphraseHash))
+	enc += fmt.Sprintf("%s\n", hex.EncodeToString(ec.encryptedKey))
+	enc += fmt.Sprintf("%s\n", hex.EncodeToString(ec.encryptedKeyIV))
+	if ec.authenticated {
+		enc += authenticatedMetadataTag + "\n"
 	}
+	return enc
 }
 
-func getEncryptionKey(enc string, passphrase string) []byte {
+// passphraseCheck returns the value stored in encrypt.txt to confirm that
+// the correct passphrase was given, given the first half of the key
+// derived from it and whether metadata is authenticated.
+func passphraseCheck(derived []byte, authenticated bool) []byte {
+	if !authenticated {
+		return derived
+	}
+	mac := hmac.New(sha256.New, derived)
+	mac.Write([]byte(authenticatedMetadataTag))
+	return mac.Sum(nil)
+}
+
+// getEncryptionKey returns the encryption key given the contents of
+// encrypt.txt, the passphrase, and the repository's key derivation
+// parameters, along with whether the repository's metadata is
+// authenticated.
+func getEncryptionKey(enc string, passphrase string, kdf KDFParams) ([]byte, bool) {
+	ec := parseEncryptedKey(enc)
+	key, ok := ec.unwrap(passphrase, kdf)
+	if !ok {
+		log.Fatal("incorrect passphrase")
+	}
+	return key, ec.authenticated
+}
+
+// parseEncryptedKey parses the contents of encrypt.txt.
+func parseEncryptedKey(enc string) encryptedKey {
 	// Parse the various values from the encryption config file text.
 	var saltHex, passphraseHashHex, encKeyHex, encryptedKeyIVHex string
 	n, err := fmt.Sscanf(enc, "%s\n%s\n%s\n%s", &saltHex, &passphraseHashHex,
 		&encKeyHex, &encryptedKeyIVHex)
 	log.CheckError(err)
 	log.Check(n == 4)
+	fields := strings.Fields(enc)
+	authenticated := len(fields) == 5 && fields[4] == authenticatedMetadataTag
+	if len(fields) != 4 && !authenticated {
+		log.Fatal("encrypt.txt: unexpected contents")
+	}
+	return encryptedKey{
+		salt:           decodeHexString(saltHex),
+		passphraseHash: decodeHexString(passphraseHashHex),
+		encryptedKey:   decodeHexString(encKeyHex),
+		encryptedKeyIV: decodeHexString(encryptedKeyIVHex),
+		authenticated:  authenticated,
+	}
+}
 
-	// Run the salted passphrase through PBKDF2 to (slowly) generate a
-	// 64-byte derived key.
-	salt := decodeHexString(saltHex)
-	derivedKey := pbkdf2.Key([]byte(passphrase), salt, 65536, 64, sha256.New)
+// unwrap returns the encryption key, given the passphrase and the key
+// derivation parameters that were used to encrypt it. It reports false if
+// the passphrase (or the parameters) are incorrect.
+func (ec encryptedKey) unwrap(passphrase string, kdf KDFParams) ([]byte, bool) {
+	// Run the salted passphrase through the key derivation function to
+	// (slowly) generate a 64-byte derived key.
+	derivedKey := kdf.derive(passphrase, ec.salt)
 
 	// Make sure the first 32 bytes of the derived key match the bytes stored
 	// when we first generated the key; if they don't, the user gave us
 	// the wrong passphrase.
-	passphraseHash := decodeHexString(passphraseHashHex)
-	if !bytes.Equal(derivedKey[:32], passphraseHash) {
-		log.Fatal("incorrect passphrase")
+	if !hmac.Equal(passphraseCheck(derivedKey[:32], ec.authenticated), ec.passphraseHash) {
+		return nil, false
 	}
 
 	// Use the last 32 bytes of the derived key to decrypt the actual
 	// encryption key.
 	keyEncryptKey := derivedKey[32:]
-	encryptedKeyIV := decodeHexString(encryptedKeyIVHex)
-	encryptedKey := decodeHexString(encKeyHex)
-	return decryptBytes(keyEncryptKey, encryptedKeyIV, encryptedKey)
+	return decryptBytes(keyEncryptKey, ec.encryptedKeyIV, ec.encryptedKey), true
+}
+
+// While Rekey is replacing encrypt.txt and kdf.txt, the new key
+// derivation parameters are also recorded in the metadata named
+// kdfRekeyName, so that if it's interrupted between the two, the
+// parameters that encrypt.txt was encrypted with can still be found.
+const kdfRekeyName = "kdf-rekey.txt"
+
+// encryptionKeyKDF returns the key derivation parameters to use with the
+// given contents of the repository's encrypt.txt: normally the ones in
+// kdf.txt, but if a rekey was interrupted, they may be the new ones.
+func encryptionKeyKDF(backend Backend, enc, passphrase string) KDFParams {
+	kdf := RepositoryKDF(backend)
+	if !backend.MetadataExists(kdfRekeyName) {
+		return kdf
+	}
+	p, err := ParseKDFParams(string(backend.ReadMetadata(kdfRekeyName)))
+	if err != nil {
+		log.Warning("%s: %s", kdfRekeyName, err)
+		return kdf
+	}
+	if _, ok := parseEncryptedKey(enc).unwrap(passphrase, kdf); ok {
+		return kdf
+	}
+	return p
+}
+
+// Rekey re-encrypts the encryption key of the encrypted repository stored
+// in the given Backend (the one that's passed to NewEncrypted) with a key
+// derived from the passphrase using the given parameters, so that the
+// cost of guessing the passphrase can be raised. The encryption key
+// itself, and thus all of the stored data, is unchanged. If it's
+// interrupted, the repository can still be opened, and running it again
+// finishes the job.
+func Rekey(backend Backend, passphrase string, kdf KDFParams) error {
+	if err := kdf.Validate(); err != nil {
+		return err
+	}
+	if !backend.MetadataExists("encrypt.txt") {
+		return errors.New("repository isn't encrypted")
+	}
+	enc := backend.ReadMetadata("encrypt.txt")
+	old := encryptionKeyKDF(backend, string(enc), passphrase)
+	ec := parseEncryptedKey(string(enc))
+	key, ok := ec.unwrap(passphrase, old)
+	if !ok {
+		return errors.New("incorrect passphrase")
+	}
+	RequireFormat(backend, 7)
+
+	// Record the new parameters before encrypt.txt is replaced, in case
+	// the old ones are still in kdf.txt when the repository is next
+	// opened.
+	if backend.MetadataExists(kdfRekeyName) {
+		backend.DeleteMetadata(kdfRekeyName)
+		backend.SyncWrites()
+	}
+	if err := backend.CreateMetadata(kdfRekeyName, []byte(kdf.String()+"\n")); err != nil {
+		return err
+	}
+	backend.SyncWrites()
+
+	salt := getRandomBytes(32)
+	derivedKey := kdf.derive(passphrase, salt)
+	rekeyed := wrapKey(key, salt, passphraseCheck(derivedKey[:32], ec.authenticated),
+		derivedKey[32:], ec.authenticated)
+	if err := backend.ReplaceMetadata("encrypt.txt", enc, []byte(rekeyed.encode())); err != nil {
+		// Nothing has changed, so the new parameters aren't needed.
+		backend.DeleteMetadata(kdfRekeyName)
+		backend.SyncWrites()
+		return err
+	}
+	backend.SyncWrites()
+
+	var err error
+	if backend.MetadataExists(kdfName) {
+		err = backend.ReplaceMetadata(kdfName, backend.ReadMetadata(kdfName),
+			[]byte(kdf.String()+"\n"))
+	} else {
+		err = backend.CreateMetadata(kdfName, []byte(kdf.String()+"\n"))
+	}
+	if err != nil {
+		return err
+	}
+	backend.SyncWrites()
+	backend.DeleteMetadata(kdfRekeyName)
+	backend.SyncWrites()
+	return nil
 }
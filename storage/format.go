@@ -0,0 +1,151 @@
+// storage/format.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatVersion is the newest version of the repository format that this
+// version of bk can read. It should be incremented whenever a change is
+// made to the format that older versions of bk would misinterpret.
+// Repositories are only marked with a version once they use a feature that
+// it introduced (see RequireFormat), so that older versions of bk can keep
+// using the ones that don't.
+//
+// Version history:
+//   1: The original format; no version was recorded in the repository.
+//   2: The format version is recorded in the repository.
+//   3: The hash algorithm used for chunks may be selected when the
+//      repository is created; it's recorded in hash.txt.
+//   4: Chunks in encrypted repositories may be padded; if so, it's
+//      recorded in padding.txt.
+//   5: Directory entries may be stored as a stream of individually-encoded
+//      entries rather than a single slice.
+//   6: Metadata in encrypted repositories may be authenticated; if so, it's
+//      recorded in encrypt.txt.
+//   7: The key derivation function used for the passphrase in encrypted
+//      repositories and its parameters may be recorded in kdf.txt.
+//   8: Chunks may be stored as deltas from similar chunks; if so, it's
+//      recorded in delta.txt.
+//   9: Changes to the files in Google Cloud Storage buckets are recorded
+//      in changes/, so that listings of them can be cached.
+const FormatVersion = 9
+
+// The format version is stored in metadata named using this prefix and
+// the version number. Metadata can't be overwritten, so each upgrade adds
+// a new one; the largest version present gives the repository's format.
+const formatPrefix = "format-v"
+
+// RepositoryFormat returns the format version of the repository stored in
+// the given Backend.
+func RepositoryFormat(backend Backend) int {
+	version := 1
+	backend.ForMetadata(formatPrefix, func(name string, created time.Time) error {
+		v, err := strconv.Atoi(strings.TrimPrefix(name, formatPrefix))
+		if err != nil {
+			log.Warning("%s: unexpected format metadata name", name)
+		} else if v > version {
+			version = v
+		}
+		return nil
+	})
+	return version
+}
+
+// Name of the metadata that records the hash algorithm used for chunks.
+const hashAlgorithmName = "hash.txt"
+
+// RepositoryHashAlgorithm returns the name of the hash algorithm used for
+// the chunks stored in the repository.
+func RepositoryHashAlgorithm(backend Backend) string {
+	if !backend.MetadataExists(hashAlgorithmName) {
+		return DefaultHashAlgorithm
+	}
+	return strings.TrimSpace(string(backend.ReadMetadata(hashAlgorithmName)))
+}
+
+// SetRepositoryHashAlgorithm records the hash algorithm to be used for
+// chunks in a new repository.
+func SetRepositoryHashAlgorithm(backend Backend, name string) {
+	backend.WriteMetadata(hashAlgorithmName, []byte(name+"\n"))
+}
+
+// Name of the metadata that holds a randomly-generated identifier for the
+// repository. It's copied along with the rest of the metadata when a
+// repository is migrated or mirrored, so copies share it.
+const repositoryIDName = "repository-id.txt"
+
+// RepositoryID returns the identifier of the repository stored in the
+// given Backend, or an empty string if it doesn't have one, as
+// repositories created by older versions of bk don't until they're
+// upgraded.
+func RepositoryID(backend Backend) string {
+	if !backend.MetadataExists(repositoryIDName) {
+		return ""
+	}
+	return strings.TrimSpace(string(backend.ReadMetadata(repositoryIDName)))
+}
+
+// SetRepositoryID records a new identifier for the repository stored in
+// the given Backend.
+func SetRepositoryID(backend Backend) {
+	id := hex.EncodeToString(getRandomBytes(16))
+	backend.WriteMetadata(repositoryIDName, []byte(id+"\n"))
+}
+
+// SetRepositoryFormat records that the repository stored in the given
+// backend uses the given format version.
+func SetRepositoryFormat(backend Backend, version int) {
+	backend.WriteMetadata(fmt.Sprintf("%s%d", formatPrefix, version),
+		[]byte(fmt.Sprintf("%d\n", version)))
+}
+
+// RequireFormat records that the repository stored in the given backend
+// uses a feature introduced in the given format version, if its format is
+// older. It must be called before anything using the feature is written;
+// the version is synced to storage before it returns.
+func RequireFormat(backend Backend, version int) {
+	if RepositoryFormat(backend) >= version {
+		return
+	}
+	SetRepositoryFormat(backend, version)
+	backend.SyncWrites()
+}
+
+// Name of the metadata that records that chunks are padded before they're
+// encrypted.
+const paddingName = "padding.txt"
+
+// SetRepositoryPadding records that chunks in a new encrypted repository
+// should be padded to obscure their sizes. It must be called before
+// NewEncrypted is first called for the repository; chunks in existing
+// repositories can't be padded, since they don't record the padding's
+// size.
+func SetRepositoryPadding(backend Backend) {
+	backend.WriteMetadata(paddingName, []byte("padme\n"))
+}
+
+// Name of the metadata that records that chunks may be stored as deltas.
+const deltaName = "delta.txt"
+
+// SetRepositoryDelta records that chunks in a new repository may be
+// stored as deltas from similar ones, using the Backend returned by
+// NewDelta. Older versions of bk would return the deltas themselves as
+// chunks' contents, so it must be called before the repository's format
+// version is recorded.
+func SetRepositoryDelta(backend Backend) {
+	backend.WriteMetadata(deltaName, []byte("delta\n"))
+}
+
+// RepositoryDelta reports whether chunks in the repository stored in the
+// given Backend may be stored as deltas.
+func RepositoryDelta(backend Backend) bool {
+	return backend.MetadataExists(deltaName)
+}
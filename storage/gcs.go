@@ -7,12 +7,21 @@ package storage
 import (
 	"bytes"
 	gcs "cloud.google.com/go/storage"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -29,6 +38,12 @@ type gcsFileStorage struct {
 	ctx    context.Context
 	client *gcs.Client
 	bucket *gcs.BucketHandle
+	name   string
+	// If non-empty, listings of files are cached in this directory.
+	cacheDir string
+	// Whether the repository's format version is at least
+	// gcsListingFormat, as found when metadata/ was listed.
+	listingFormat bool
 }
 
 type GCSOptions struct {
@@ -40,10 +55,44 @@ type GCSOptions struct {
 	// zero -> unlimited
 	MaxUploadBytesPerSecond   int
 	MaxDownloadBytesPerSecond int
+
+	// If non-empty, listings of the bucket's files are cached in this
+	// directory; they're only listed again if they've changed.
+	CacheDir string
+}
+
+func init() {
+	Register("gs", openGCS)
+}
+
+var gcsOptions GCSOptions
+
+// ErrNoGCSProject is returned by Open for gs:// URLs if no project ID has
+// been given with SetGCSOptions.
+var ErrNoGCSProject = errors.New("no Google Cloud Storage project ID was given")
+
+// SetGCSOptions sets the options used by Open for gs:// URLs, which give
+// the bucket name; options.BucketName is ignored. It must be called before
+// Open is.
+func SetGCSOptions(options GCSOptions) {
+	gcsOptions = options
+}
+
+func openGCS(location string) (Backend, error) {
+	options := gcsOptions
+	if options.ProjectId == "" {
+		return nil, ErrNoGCSProject
+	}
+	options.BucketName = strings.TrimPrefix(location, "gs://")
+	return NewGCS(options), nil
 }
 
 func NewGCS(options GCSOptions) Backend {
-	g := &gcsFileStorage{ctx: context.Background()}
+	g := &gcsFileStorage{ctx: context.Background(), name: options.BucketName,
+		cacheDir: options.CacheDir}
+	if g.cacheDir != "" {
+		log.CheckError(os.MkdirAll(g.cacheDir, 0700))
+	}
 
 	var err error
 	g.client, err = gcs.NewClient(g.ctx)
@@ -75,15 +124,8 @@ func NewGCS(options GCSOptions) Backend {
 }
 
 func (g *gcsFileStorage) ForFiles(prefix string, f func(n string, created time.Time)) {
-	it := g.bucket.Objects(g.ctx, &gcs.Query{Prefix: prefix})
-	for {
-		obj, err := it.Next()
-		if err == iterator.Done {
-			return
-		}
-		log.CheckError(err)
-
-		f(obj.Name, obj.Created)
+	for _, file := range g.listFiles(prefix) {
+		f(file.Path, file.Created)
 	}
 }
 
@@ -93,7 +135,7 @@ func (g *gcsFileStorage) String() string {
 	return "gs://" + attrs.Name
 }
 
-func (g *gcsFileStorage) Fsck() bool {
+func (g *gcsFileStorage) Fsck(opts FsckOptions) bool {
 	// The Fsck implementation in packFileBackend reads all the blobs
 	// (twice :-( ), which can quickly get fairly expensive with GCS
 	// coldline storage. (~$5 for a 40GB backup, I believe).  Therefore,
@@ -128,15 +170,37 @@ func (g *gcsFileStorage) ReadFile(name string, offset, length int64) ([]byte, er
 		r.Close()
 		return err
 	})
+	if err == gcs.ErrObjectNotExist {
+		// Report it the same way as the disk backend does.
+		err = &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+	} else if err == nil && length > 0 && int64(len(b)) != length {
+		// Range requests that extend past the end of the object return
+		// what there is rather than failing; there's no point in retrying
+		// in that case.
+		err = ErrPrematureEndOfData
+	}
 	return b, err
 }
 
+func (g *gcsFileStorage) RemoveFile(name string) error {
+	err := retry(name, func() error {
+		return g.bucket.Object(name).Delete(g.ctx)
+	})
+	if err == gcs.ErrObjectNotExist {
+		err = &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	} else if err == nil {
+		g.recordChange(name)
+	}
+	return err
+}
+
 func retry(n string, f func() error) error {
 	const maxTries = 5
 	for tries := 0; ; tries++ {
 		err := f()
 
-		if err == nil || tries == maxTries {
+		// There's no point in retrying if the object doesn't exist.
+		if err == nil || err == gcs.ErrObjectNotExist || tries == maxTries {
 			return err
 		}
 
@@ -185,22 +249,97 @@ func (gw *gcsWriter) Write(b []byte) {
 
 func (gw *gcsWriter) Close() {
 	err := retry(gw.name, func() error {
-		return gw.g.upload(gw.name, gw.storageClass, gw.buf.Bytes())
+		return gw.g.upload(gw.name, gw.storageClass, gw.buf.Bytes(), gcs.Conditions{})
 	})
 	log.CheckError(err, "%s: %s", gw.name, err)
 }
 
 var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
 
-func (g *gcsFileStorage) upload(name string, storageClass string, buf []byte) error {
+// CreateFileExclusive implements ExclusiveFileStorage; the final copy
+// from the temporary object is made on the condition that the object
+// doesn't exist.
+func (g *gcsFileStorage) CreateFileExclusive(name string, contents []byte) error {
+	var exists error
+	err := retry(name, func() error {
+		err := g.upload(name, "regional", contents, gcs.Conditions{DoesNotExist: true})
+		if os.IsExist(err) {
+			// There's no point in retrying.
+			exists = err
+			return nil
+		}
+		return err
+	})
+	log.CheckError(err, "%s: %s", name, err)
+	return exists
+}
+
+// ReplaceFile implements ConditionalFileStorage; the final copy from the
+// temporary object is made on the condition that the object's generation
+// is still the one whose contents were checked.
+func (g *gcsFileStorage) ReplaceFile(name string, old, contents []byte) error {
+	var changed error
+	err := retry(name, func() error {
+		// The generation is found before the contents are read, so that
+		// if the object is replaced in between, the copy fails.
+		attrs, err := g.bucket.Object(name).Attrs(g.ctx)
+		if err == gcs.ErrObjectNotExist {
+			changed = errFileChanged
+			return nil
+		} else if err != nil {
+			return err
+		}
+		b, err := g.ReadFile(name, 0, 0)
+		if os.IsNotExist(err) || (err == nil && !bytes.Equal(b, old)) {
+			changed = errFileChanged
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = g.upload(name, "regional", contents,
+			gcs.Conditions{GenerationMatch: attrs.Generation})
+		if err == errFileChanged {
+			changed = err
+			return nil
+		}
+		return err
+	})
+	log.CheckError(err, "%s: %s", name, err)
+	return changed
+}
+
+// upload stores the given contents in the object with the given name,
+// subject to the given conditions. If DoesNotExist is set, an error for
+// which os.IsExist is true is returned if the object already exists,
+// including if it's created while the contents are being uploaded, and if
+// GenerationMatch is set, errFileChanged is returned if the object's
+// generation is different; without conditions, it's a fatal error if the
+// object exists. Once the object is stored, the change is recorded for the
+// listing cache.
+func (g *gcsFileStorage) upload(name string, storageClass string, buf []byte,
+	cond gcs.Conditions) error {
+	exclusive := cond.DoesNotExist
+	conditional := exclusive || cond.GenerationMatch != 0
+
 	// Make sure the files don't already exist. (Ideally would check this
 	// before Close, but this shouldn't happen in general...)
 	obj := g.bucket.Object(name)
-	if _, err := obj.Attrs(g.ctx); err == nil {
-		log.Fatal("%s: already exsits.", name)
+	if cond.GenerationMatch == 0 {
+		if _, err := obj.Attrs(g.ctx); err == nil {
+			if exclusive {
+				return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+			}
+			log.Fatal("%s: already exsits.", name)
+		}
 	}
 
 	tmpName := name + ".tmp"
+	if conditional {
+		// Other processes may be uploading the same object, so the
+		// temporary one is given a unique name outside of the object's
+		// directory, where it won't be listed.
+		tmpName = fmt.Sprintf("tmp/%s.%d", name, time.Now().UnixNano())
+	}
 	tmpObj := g.bucket.Object(tmpName)
 	if _, err := tmpObj.Attrs(g.ctx); err == nil {
 		log.Fatal("%s: already exsits.", tmpName)
@@ -239,11 +378,147 @@ func (g *gcsFileStorage) upload(name string, storageClass string, buf []byte) er
 	}
 
 	// Make the final object by copying from the temporary one.
+	if conditional {
+		obj = obj.If(cond)
+	}
 	copier := obj.CopierFrom(tmpObj)
 	copier.StorageClass = storageClass
 	// No idea why it insists this be set directly for the copier to work.
 	copier.ContentType = "application/octet-stream"
 
 	_, err := copier.Run(g.ctx)
+	if e, ok := err.(*googleapi.Error); ok && conditional && e.Code == http.StatusPreconditionFailed {
+		if !exclusive {
+			return errFileChanged
+		}
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	if err == nil {
+		g.recordChange(name)
+	}
 	return err
 }
+
+///////////////////////////////////////////////////////////////////////////
+// Listing cache
+
+// Listing a bucket with many objects is slow, and GCS doesn't provide a
+// way to find out whether the objects with a prefix have changed. Instead,
+// each change to the files in a directory is followed by writing the
+// directory's object in gcsChangesDir, so that a cached listing of the
+// directory is still current if that object's generation is the one it was
+// listed with. Older versions of bk don't write those objects, so cached
+// listings are only used once the repository's format version is at least
+// gcsListingFormat, which they can't modify.
+const gcsChangesDir = "changes/"
+
+const gcsListingFormat = 9
+
+// gcsListing is a listing of files that's cached locally, along with the
+// generation of the directory's changes object when it was made.
+type gcsListing struct {
+	Generation int64      `json:"generation"`
+	Files      []httpFile `json:"files"`
+}
+
+// changesObject returns the name of the object that's written after the
+// given file is changed, or an empty string if none is.
+func changesObject(name string) string {
+	i := strings.Index(name, "/")
+	if i <= 0 || name[:i+1] == gcsChangesDir || name[:i+1] == "tmp/" {
+		return ""
+	}
+	return gcsChangesDir + name[:i]
+}
+
+// recordChange writes the changes object for the given file, which has
+// just been created, replaced, or removed, so that cached listings of its
+// directory are no longer used.
+func (g *gcsFileStorage) recordChange(name string) {
+	obj := changesObject(name)
+	if obj == "" {
+		return
+	}
+	err := retry(obj, func() error {
+		w := g.bucket.Object(obj).NewWriter(g.ctx)
+		if _, err := w.Write([]byte(time.Now().String() + "\n")); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+	log.CheckError(err, "%s: %s", obj, err)
+}
+
+// listFiles returns the files whose names start with the given prefix,
+// using the cached listing if it's still current.
+func (g *gcsFileStorage) listFiles(prefix string) []httpFile {
+	obj := changesObject(prefix)
+	// Only listings of entire directories are cached.
+	if g.cacheDir == "" || obj == "" || strings.Index(prefix, "/") != len(prefix)-1 {
+		return g.list(prefix)
+	}
+
+	// The generation is found before the files are listed, so that if
+	// they change in between, the listing isn't used again.
+	attrs, err := g.bucket.Object(obj).Attrs(g.ctx)
+	if err == gcs.ErrObjectNotExist {
+		g.recordChange(prefix)
+		attrs, err = g.bucket.Object(obj).Attrs(g.ctx)
+	}
+	log.CheckError(err, "%s: %s", obj, err)
+
+	sum := sha256.Sum256([]byte("gs://" + g.name + "\x00" + prefix))
+	path := filepath.Join(g.cacheDir, hex.EncodeToString(sum[:]))
+	var cached gcsListing
+	// If the cached listing can't be read, the files are just listed
+	// again.
+	if b, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(b, &cached) == nil &&
+		cached.Generation == attrs.Generation {
+		if prefix == "metadata/" {
+			g.listingFormat = hasListingFormat(cached.Files)
+		}
+		if g.listingFormat {
+			log.Debug("%s: using cached listing", prefix)
+			return cached.Files
+		}
+	}
+
+	files := g.list(prefix)
+	if prefix == "metadata/" {
+		g.listingFormat = hasListingFormat(files)
+	}
+	cacheListing(path, gcsListing{Generation: attrs.Generation, Files: files})
+	return files
+}
+
+// hasListingFormat reports whether the given listing of metadata/ includes
+// a format version that's at least gcsListingFormat.
+func hasListingFormat(files []httpFile) bool {
+	for _, file := range files {
+		name := strings.TrimPrefix(file.Path, "metadata/")
+		if !strings.HasPrefix(name, formatPrefix) {
+			continue
+		}
+		if v, err := strconv.Atoi(strings.TrimPrefix(name, formatPrefix)); err == nil &&
+			v >= gcsListingFormat {
+			return true
+		}
+	}
+	return false
+}
+
+// list lists the files whose names start with the given prefix.
+func (g *gcsFileStorage) list(prefix string) []httpFile {
+	var files []httpFile
+	it := g.bucket.Objects(g.ctx, &gcs.Query{Prefix: prefix})
+	for {
+		obj, err := it.Next()
+		if err == iterator.Done {
+			return files
+		}
+		log.CheckError(err)
+
+		files = append(files, httpFile{Path: obj.Name, Created: obj.Created})
+	}
+}
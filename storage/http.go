@@ -0,0 +1,693 @@
+// storage/http.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// As with GCS, files are buffered in memory before they're uploaded so
+// that uploads can be retried.
+const maxHTTPPackSize = 256 * 1024 * 1024
+
+// The top-level directories of a repository; these are the only ones that
+// are served.
+var repositoryDirs = []string{"packs/", "indices/", "metadata/", metadataCopyDir}
+
+// Role specifies which operations an access token for a served repository
+// allows.
+type Role int
+
+const (
+	// Files may be read but not created or removed; for hosts that only
+	// restore.
+	RoleReadOnly Role = iota
+	// Files may be read and created, but existing ones can't be removed
+	// or overwritten. Backups can be added, but a client that's
+	// compromised can't destroy the ones already there.
+	RoleAppendOnly
+	// Any operation is allowed, including removing files, as is needed to
+	// delete or rename backups.
+	RoleAdmin
+)
+
+var roleNames = []string{"read-only", "append-only", "admin"}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// ParseRole returns the Role with the given name: "read-only",
+// "append-only", or "admin".
+func ParseRole(s string) (Role, error) {
+	for i, n := range roleNames {
+		if s == n {
+			return Role(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%s: unknown role; expected \"read-only\", \"append-only\", or \"admin\"", s)
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Client
+
+// httpFileStorage implements the FileStorage interface for a repository
+// that's served via HTTP by NewHTTPHandler.
+type httpFileStorage struct {
+	url   string
+	token string
+	// If non-empty, listings of files are cached in this directory.
+	cacheDir string
+}
+
+func init() {
+	Register("http", openHTTP)
+	Register("https", openHTTP)
+}
+
+// HTTPOptions specifies how the Backends that Open returns for http://
+// and https:// URLs access their repositories; the fields are passed to
+// NewHTTP.
+type HTTPOptions struct {
+	Token    string
+	CacheDir string
+}
+
+var httpOptions HTTPOptions
+
+// SetHTTPOptions sets the options used by Open for http:// and https://
+// URLs. It must be called before Open is.
+func SetHTTPOptions(options HTTPOptions) {
+	httpOptions = options
+}
+
+func openHTTP(location string) (Backend, error) {
+	return NewHTTP(location, httpOptions.Token, httpOptions.CacheDir), nil
+}
+
+// NewHTTP returns a Backend that stores data in the repository served at
+// the given URL, authenticating with the given access token, which may be
+// empty if the server doesn't require one. If cacheDir is non-empty, the
+// listings of the repository's files are cached there; they're only
+// downloaded again if the server reports that they've changed.
+func NewHTTP(url, token, cacheDir string) Backend {
+	h := &httpFileStorage{url: strings.TrimSuffix(url, "/"), token: token,
+		cacheDir: cacheDir}
+	if cacheDir != "" {
+		log.CheckError(os.MkdirAll(cacheDir, 0700))
+	}
+	return newPackFileBackend(h, maxHTTPPackSize)
+}
+
+func (h *httpFileStorage) String() string {
+	return h.url
+}
+
+// request performs an HTTP request for the given path on the server,
+// retrying if it fails for reasons other than the server's response. The
+// caller must close the body of the returned response.
+func (h *httpFileStorage) request(method, path string, header http.Header,
+	body []byte) (*http.Response, error) {
+	var resp *http.Response
+	err := retryHTTP(path, func() error {
+		req, err := http.NewRequest(method, h.url+"/v1/"+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if h.token != "" {
+			req.Header.Set("Authorization", "Bearer "+h.token)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		return err
+	})
+	return resp, err
+}
+
+func retryHTTP(n string, f func() error) error {
+	const maxTries = 5
+	for tries := 0; ; tries++ {
+		err := f()
+		if err == nil || tries == maxTries {
+			return err
+		}
+		log.Warning("%s: sleeping due to error %s", n, err.Error())
+		time.Sleep(time.Duration(100*(tries+1)) * time.Millisecond)
+	}
+}
+
+// responseError returns an error describing an unsuccessful response;
+// missing files are reported the same way as the disk backend does.
+func responseError(op, name string, resp *http.Response) error {
+	b, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case http.StatusConflict:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return ErrPrematureEndOfData
+	case http.StatusPreconditionFailed:
+		return errFileChanged
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+func (h *httpFileStorage) CreateFile(name string) RobustWriteCloser {
+	return &httpWriter{name: name, h: h}
+}
+
+// httpWriter implements RobustWriteCloser, buffering the file's contents
+// and uploading them in its Close method.
+type httpWriter struct {
+	buf  bytes.Buffer
+	name string
+	h    *httpFileStorage
+}
+
+func (hw *httpWriter) Write(b []byte) {
+	_, _ = hw.buf.Write(b)
+}
+
+func (hw *httpWriter) Close() {
+	if err := hw.h.put(hw.name, hw.buf.Bytes(), ""); err != nil {
+		log.Fatal("%s: %s", hw.name, err)
+	}
+}
+
+// CreateFileExclusive implements ExclusiveFileStorage; the server never
+// replaces existing files.
+func (h *httpFileStorage) CreateFileExclusive(name string, contents []byte) error {
+	err := h.put(name, contents, "")
+	if err != nil && !os.IsExist(err) {
+		log.Fatal("%s: %s", name, err)
+	}
+	return err
+}
+
+// ReplaceFile implements ConditionalFileStorage; the server only replaces
+// the file if the SHA-256 hash of its contents matches the If-Match
+// header.
+func (h *httpFileStorage) ReplaceFile(name string, old, contents []byte) error {
+	sum := sha256.Sum256(old)
+	err := h.put(name, contents, `"`+hex.EncodeToString(sum[:])+`"`)
+	if err != nil && err != errFileChanged {
+		log.Fatal("%s: %s", name, err)
+	}
+	return err
+}
+
+// put uploads the file with the given name and contents. If ifMatch isn't
+// empty, it replaces the existing file, which must have the given ETag.
+// The server maintains the redundant copies of metadata itself, so they're
+// never uploaded.
+func (h *httpFileStorage) put(name string, contents []byte, ifMatch string) error {
+	if strings.HasPrefix(name, metadataCopyDir) {
+		return nil
+	}
+	sum := sha256.Sum256(contents)
+	header := http.Header{"X-Bk-Sha256": []string{hex.EncodeToString(sum[:])}}
+	status, op := http.StatusCreated, "create"
+	if ifMatch != "" {
+		header.Set("If-Match", ifMatch)
+		status, op = http.StatusNoContent, "replace"
+	}
+	resp, err := h.request(http.MethodPut, "files/"+name, header, contents)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		return responseError(op, name, resp)
+	}
+	return nil
+}
+
+func (h *httpFileStorage) ReadFile(name string, offset, length int64) ([]byte, error) {
+	log.Debug("%s: starting http download, offset %d, length %d", name, offset, length)
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	resp, err := h.request(http.MethodGet, "files/"+name, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, responseError("read", name, resp)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err == nil && length > 0 && int64(len(b)) != length {
+		err = ErrPrematureEndOfData
+	}
+	return b, err
+}
+
+// httpFile is the JSON encoding of the files listed by the server.
+type httpFile struct {
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+}
+
+// httpListing is a listing of files that's cached locally, along with the
+// ETag the server provided for it.
+type httpListing struct {
+	ETag  string     `json:"etag"`
+	Files []httpFile `json:"files"`
+}
+
+func (h *httpFileStorage) ForFiles(prefix string, f func(n string, created time.Time)) {
+	var cached httpListing
+	var cachePath string
+	header := make(http.Header)
+	if h.cacheDir != "" {
+		sum := sha256.Sum256([]byte(h.url + "\x00" + prefix))
+		cachePath = filepath.Join(h.cacheDir, hex.EncodeToString(sum[:]))
+		// If the cached listing can't be read, it's just downloaded again.
+		if b, err := ioutil.ReadFile(cachePath); err == nil &&
+			json.Unmarshal(b, &cached) == nil {
+			header.Set("If-None-Match", cached.ETag)
+		}
+	}
+
+	resp, err := h.request(http.MethodGet, "files?prefix="+url.QueryEscape(prefix), header, nil)
+	log.CheckError(err)
+	defer resp.Body.Close()
+
+	files := cached.Files
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached.ETag != "":
+		log.Debug("%s: using cached listing", prefix)
+	case resp.StatusCode == http.StatusOK:
+		log.CheckError(json.NewDecoder(resp.Body).Decode(&files))
+		if etag := resp.Header.Get("ETag"); cachePath != "" && etag != "" {
+			cacheListing(cachePath, httpListing{ETag: etag, Files: files})
+		}
+	default:
+		log.Fatal("%s: %s", prefix, responseError("list", prefix, resp))
+	}
+	for _, file := range files {
+		f(file.Path, file.Created)
+	}
+}
+
+// cacheListing saves the given listing in the local cache. Errors aren't
+// fatal, since the cache is only an optimization.
+func cacheListing(path string, listing interface{}) {
+	b, err := json.Marshal(listing)
+	log.CheckError(err)
+	// Write to a temporary file first so that an incomplete one is never
+	// used.
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.Warning("%s: unable to cache listing: %s", path, err)
+		os.Remove(tmp)
+	}
+}
+
+func (h *httpFileStorage) RemoveFile(name string) error {
+	if strings.HasPrefix(name, metadataCopyDir) {
+		// As with put, the server removes them itself.
+		return nil
+	}
+	resp, err := h.request(http.MethodDelete, "files/"+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return responseError("remove", name, resp)
+	}
+	return nil
+}
+
+func (h *httpFileStorage) Fsck(opts FsckOptions) bool {
+	// The Reed-Solomon encodings of the files can only be checked on the
+	// server, by running "bk fsck" there.
+	return true
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Server
+
+var errPermission = errors.New("permission denied")
+
+// httpServer serves a repository on the local disk to httpFileStorage
+// clients.
+type httpServer struct {
+	disk *disk
+	// Maps access tokens to what they allow; if empty, no token is needed
+	// and all operations are allowed.
+	tokens map[string]HTTPToken
+
+	mu sync.Mutex
+	// Files that are currently being created.
+	creating map[string]bool
+}
+
+// HTTPToken describes what an access token for a repository served by
+// NewHTTPHandler allows.
+type HTTPToken struct {
+	Role Role
+	// If non-nil, metadata created with a token whose role isn't
+	// RoleAdmin is passed to CheckMetadata, along with its name, and it's
+	// only created if nil is returned. The contents are as they're
+	// stored, so in encrypted repositories whose metadata is
+	// authenticated, they end with its MAC.
+	CheckMetadata func(name string, contents []byte) error
+}
+
+// NewHTTPHandler returns an http.Handler that serves the repository in the
+// given directory so that it can be used via NewHTTP. tokens maps access
+// tokens to what they allow; if it's empty, no authentication is required
+// and all operations are allowed.
+func NewHTTPHandler(dir string, tokens map[string]HTTPToken) http.Handler {
+	return &httpServer{disk: newDisk(dir), tokens: tokens, creating: make(map[string]bool)}
+}
+
+// token returns what the request's access token allows.
+func (s *httpServer) token(r *http.Request) (HTTPToken, bool) {
+	if len(s.tokens) == 0 {
+		return HTTPToken{Role: RoleAdmin}, true
+	}
+	auth := r.Header.Get("Authorization")
+	for token, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) == 1 {
+			return t, true
+		}
+	}
+	return HTTPToken{}, false
+}
+
+// validFileName reports whether the given name refers to a file in the
+// repository that may be accessed by clients.
+func validFileName(name string) bool {
+	for _, d := range repositoryDirs {
+		base := strings.TrimPrefix(name, d)
+		if base != name {
+			return base != "" && !strings.ContainsAny(base, "/\\") &&
+				!strings.HasPrefix(base, ".") && !strings.HasSuffix(base, ".rs") &&
+				!strings.HasSuffix(base, ".tmp")
+		}
+	}
+	return false
+}
+
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := s.token(r)
+	role := token.Role
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	log.Verbose("%s %s from %s (%s)", r.Method, r.URL.Path, r.RemoteAddr, role)
+
+	var err error
+	if r.URL.Path == "/v1/files" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err = s.list(w, r, r.URL.Query().Get("prefix"))
+	} else if name := strings.TrimPrefix(r.URL.Path, "/v1/files/"); name != r.URL.Path {
+		if !validFileName(name) {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet:
+			err = s.read(w, r, name)
+		case strings.HasPrefix(name, metadataCopyDir) && role < RoleAdmin &&
+			(r.Method == http.MethodPut || r.Method == http.MethodDelete):
+			// The server maintains the redundant copies of metadata, so
+			// that clients can't make them differ from the metadata.
+			err = errPermission
+		case r.Method == http.MethodPut:
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+				// Replacing a file loses its old contents, just as
+				// removing it does.
+				if role < RoleAdmin {
+					err = errPermission
+				} else {
+					err = s.replace(w, r, name, ifMatch)
+				}
+			} else if role < RoleAppendOnly {
+				err = errPermission
+			} else if role < RoleAdmin {
+				err = s.create(w, r, name, token.CheckMetadata)
+			} else {
+				err = s.create(w, r, name, nil)
+			}
+		case r.Method == http.MethodDelete:
+			if role < RoleAdmin {
+				err = errPermission
+			} else {
+				err = s.remove(w, r, name)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case err == nil:
+	case err == errPermission:
+		http.Error(w, fmt.Sprintf("%s: not allowed for %s tokens", r.Method, role),
+			http.StatusForbidden)
+	case os.IsNotExist(err):
+		http.NotFound(w, r)
+	case os.IsExist(err):
+		http.Error(w, "file exists", http.StatusConflict)
+	case err == errFileChanged:
+		http.Error(w, "file has changed", http.StatusPreconditionFailed)
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		http.Error(w, "range extends past the end of the file",
+			http.StatusRequestedRangeNotSatisfiable)
+	default:
+		log.Warning("%s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// list sends the listing of the files in the given directory. An ETag
+// computed from the listing is included so that clients can cache it and
+// only download it again when it changes.
+func (s *httpServer) list(w http.ResponseWriter, r *http.Request, prefix string) error {
+	valid := false
+	for _, d := range repositoryDirs {
+		valid = valid || prefix == d
+	}
+	if !valid {
+		return &os.PathError{Op: "list", Path: prefix, Err: os.ErrNotExist}
+	}
+	files := []httpFile{}
+	err := s.disk.forFiles(prefix, func(n string, created time.Time) {
+		if !strings.HasSuffix(n, ".tmp") {
+			files = append(files, httpFile{Path: filepath.ToSlash(n), Created: created})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(b)
+	return err
+}
+
+func (s *httpServer) read(w http.ResponseWriter, r *http.Request, name string) error {
+	var offset, length int64
+	if rng := r.Header.Get("Range"); rng != "" {
+		var end int64
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &offset, &end); err != nil ||
+			end < offset {
+			http.Error(w, "invalid range", http.StatusBadRequest)
+			return nil
+		}
+		length = end - offset + 1
+	}
+	b, err := s.disk.ReadFile(name, offset, length)
+	if err != nil {
+		return err
+	}
+	if length > 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+length-1))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Warning("%s: %s", name, err)
+	}
+	return nil
+}
+
+// create stores the request's body as a new file. The body is first saved
+// to a temporary file and checked against the SHA-256 hash provided by the
+// client so that incomplete or corrupted uploads are never added to the
+// repository. If check is non-nil, metadata is only stored if it returns
+// nil for it, as with HTTPToken.CheckMetadata. The redundant copy of
+// metadata is then written as well.
+func (s *httpServer) create(w http.ResponseWriter, r *http.Request, name string,
+	check func(name string, contents []byte) error) error {
+	path := filepath.Join(s.disk.dir, filepath.FromSlash(name))
+	s.mu.Lock()
+	if _, err := os.Stat(path); err == nil || s.creating[name] {
+		s.mu.Unlock()
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	s.creating[name] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.creating, name)
+		s.mu.Unlock()
+	}()
+
+	tmp, err := ioutil.TempFile("", "bk-upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != r.Header.Get("X-Bk-Sha256") {
+		http.Error(w, "SHA-256 mismatch", http.StatusBadRequest)
+		return nil
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	base := strings.TrimPrefix(name, "metadata/")
+	var contents []byte
+	if base != name {
+		if contents, err = ioutil.ReadAll(tmp); err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(base, contents); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %s", base, err), http.StatusForbidden)
+				return nil
+			}
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if err := s.disk.writeFile(name, tmp); err != nil {
+		return err
+	}
+	if base != name {
+		if err := s.disk.writeFile(metadataCopyDir+base, bytes.NewReader(metadataCopy(contents))); err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// replace replaces the contents of an existing file with the request's
+// body if the SHA-256 hash of its current contents, quoted as an ETag,
+// matches ifMatch. The replacement, which includes metadata's redundant
+// copy, is made with a transaction, so that it's atomic with respect to
+// other clients and to local runs of bk.
+func (s *httpServer) replace(w http.ResponseWriter, r *http.Request, name,
+	ifMatch string) error {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != r.Header.Get("X-Bk-Sha256") {
+		http.Error(w, "SHA-256 mismatch", http.StatusBadRequest)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.creating[name] {
+		return errFileChanged
+	}
+	old, err := s.disk.ReadFile(name, 0, 0)
+	if os.IsNotExist(err) {
+		return errFileChanged
+	} else if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(old); `"`+hex.EncodeToString(sum[:])+`"` != ifMatch {
+		return errFileChanged
+	}
+	create, remove := map[string][]byte{name: b}, map[string][]byte{name: old}
+	if base := strings.TrimPrefix(name, "metadata/"); base != name {
+		create[metadataCopyDir+base] = metadataCopy(b)
+		remove[metadataCopyDir+base] = nil
+	}
+	if err := s.disk.Commit(create, remove); err != nil {
+		return err
+	}
+	log.Print("%s: replaced by %s", name, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// remove removes the given file. Metadata's redundant copy is removed
+// after it, even if the metadata itself is already missing, so that it
+// isn't still listed.
+func (s *httpServer) remove(w http.ResponseWriter, r *http.Request, name string) error {
+	err := s.disk.RemoveFile(name)
+	if base := strings.TrimPrefix(name, "metadata/"); base != name &&
+		(err == nil || os.IsNotExist(err)) {
+		if cerr := s.disk.RemoveFile(metadataCopyDir + base); cerr == nil {
+			err = nil
+		} else if !os.IsNotExist(cerr) {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Print("%s: removed by %s", name, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,330 @@
+// storage/journal.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+// A write-ahead journal that lets the disk backend make a group of
+// changes to files, such as writing a piece of metadata and its redundant
+// copy, atomically.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mmp/bk/rdso"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TransactionalFileStorage is implemented by FileStorage implementations
+// that can make a group of changes to files atomically.
+type TransactionalFileStorage interface {
+	// Commit removes the files named by the keys of remove and then
+	// creates the files in create with the given contents. Either all of
+	// the changes are made or none are: if a file in create already
+	// exists, an error for which os.IsExist is true is returned, and if a
+	// file in remove has a non-nil value and doesn't exist or has
+	// different contents, errFileChanged is; otherwise, files in remove
+	// that don't exist are ignored. Other errors are fatal. If bk is
+	// interrupted, the changes are completed or rolled back by
+	// RecoverTransactions.
+	Commit(create, remove map[string][]byte) error
+
+	// RecoverTransactions completes or rolls back any transactions that
+	// were interrupted.
+	RecoverTransactions()
+}
+
+var errFileChanged = errors.New("file has changed")
+
+// Each transaction is staged in its own directory in journalDir, named
+// with the time it was started and the process's id. The files to be
+// created are written there first, along with their Reed-Solomon
+// encodings, followed by the transaction's plan, which lists the files to
+// be created and removed. The files to be removed are then moved into its
+// directory, and the new files are hard-linked into place; both of those
+// fail if another process has got there first, in which case it's
+// rolled back. Finally, a file named "committed" is written, at which
+// point the transaction is complete, even if bk is interrupted before the
+// new files' encodings have been moved into place and the directory
+// removed.
+//
+// Recovery rolls back transactions that weren't committed and completes
+// the ones that were. Other processes may be committing transactions at
+// the same time, so while a transaction is in progress, the process
+// committing it updates the modification time of its directory every
+// journalHeartbeat; only transactions whose directories haven't been
+// updated for journalStaleAge, which is long enough that the process
+// must have exited, are recovered.
+const journalDir = "journal"
+
+const (
+	journalHeartbeat = 5 * time.Second
+	journalStaleAge  = time.Minute
+)
+
+// transaction is the JSON-encoded plan of a transaction. The i'th file
+// in Create is staged in its directory as "create-i", and the i'th file
+// in Remove is moved there as "remove-i".
+type transaction struct {
+	Create []string `json:"create"`
+	Remove []string `json:"remove"`
+
+	db  *disk
+	dir string
+}
+
+func (t *transaction) staged(kind string, i int) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%s-%d", kind, i))
+}
+
+func (t *transaction) path(name string) string {
+	return filepath.Join(t.db.dir, name)
+}
+
+func (db *disk) Commit(create, remove map[string][]byte) error {
+	id := fmt.Sprintf("%d-%d", time.Now().UnixNano(), os.Getpid())
+	t := &transaction{db: db, dir: filepath.Join(db.dir, journalDir, id)}
+	for name := range create {
+		t.Create = append(t.Create, name)
+	}
+	for name := range remove {
+		t.Remove = append(t.Remove, name)
+	}
+	for _, name := range t.Create {
+		_, removed := remove[name]
+		if _, err := os.Stat(t.path(name)); err == nil && !removed {
+			return &os.PathError{Op: "create", Path: t.path(name), Err: os.ErrExist}
+		}
+	}
+
+	log.CheckError(os.Mkdir(t.dir, 0700))
+	defer t.heartbeat()()
+	for i, name := range t.Create {
+		writeSynced(t.staged("create", i), create[name])
+		rs := &bytes.Buffer{}
+		log.CheckError(rdso.Encode(bytes.NewReader(create[name]), int64(len(create[name])), rs,
+			rsDataShards, rsParityShards, rsHashRate))
+		writeSynced(t.staged("create", i)+".rs", rs.Bytes())
+	}
+	plan, err := json.Marshal(t)
+	log.CheckError(err)
+	writeSynced(filepath.Join(t.dir, "plan"), plan)
+	syncDir(t.dir)
+
+	if err := t.apply(remove); err != nil {
+		t.rollBack()
+		return err
+	}
+	t.syncDirs()
+	writeSynced(filepath.Join(t.dir, "committed"), nil)
+	syncDir(t.dir)
+	t.finish()
+	return nil
+}
+
+// heartbeat starts updating the modification time of the transaction's
+// directory every journalHeartbeat, so that other processes don't recover
+// it while it's in progress, and returns a function that stops it.
+func (t *transaction) heartbeat() func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(journalHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				// The directory is removed once the transaction is
+				// finished or rolled back, which may happen first.
+				if err := os.Chtimes(t.dir, now, now); err != nil && !os.IsNotExist(err) {
+					log.Warning("%s: %s", t.dir, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// apply moves the files to be removed into the transaction's directory,
+// checking their contents, and then links the new files into place.
+func (t *transaction) apply(remove map[string][]byte) error {
+	for i, name := range t.Remove {
+		err := os.Rename(t.path(name), t.staged("remove", i))
+		if os.IsNotExist(err) {
+			if remove[name] != nil {
+				return errFileChanged
+			}
+			continue
+		}
+		log.CheckError(err)
+		if err := os.Rename(t.path(name)+".rs", t.staged("remove", i)+".rs"); !os.IsNotExist(err) {
+			log.CheckError(err)
+		}
+		if remove[name] != nil {
+			b, err := ioutil.ReadFile(t.staged("remove", i))
+			log.CheckError(err)
+			if !bytes.Equal(b, remove[name]) {
+				return errFileChanged
+			}
+		}
+	}
+
+	for i, name := range t.Create {
+		err := os.Link(t.staged("create", i), t.path(name))
+		if os.IsExist(err) {
+			return err
+		} else if err != nil {
+			// Some filesystems don't support hard links; the file is
+			// renamed into place instead, which replaces any file that
+			// was created since it was checked for above.
+			log.Verbose("%s: %s; renaming instead", t.path(name), err)
+			log.CheckError(os.Rename(t.staged("create", i), t.path(name)))
+		}
+	}
+	return nil
+}
+
+// finish completes a committed transaction, moving the new files'
+// encodings into place (and linking the files themselves, if that was
+// interrupted) and removing its directory.
+func (t *transaction) finish() {
+	for i, name := range t.Create {
+		staged := t.staged("create", i)
+		if _, err := os.Stat(t.path(name)); os.IsNotExist(err) {
+			if _, err := os.Stat(staged); err == nil {
+				log.CheckError(os.Link(staged, t.path(name)))
+			}
+		}
+		if err := os.Rename(staged+".rs", t.path(name)+".rs"); !os.IsNotExist(err) {
+			log.CheckError(err)
+		}
+	}
+	// The encodings must be in place before the record of the
+	// transaction is removed.
+	t.syncDirs()
+	log.CheckError(os.RemoveAll(t.dir))
+}
+
+// syncDirs syncs the transaction's directory and the directories of the
+// files that it creates and removes.
+func (t *transaction) syncDirs() {
+	dirs := map[string]bool{t.dir: true}
+	for _, names := range [][]string{t.Create, t.Remove} {
+		for _, name := range names {
+			dirs[filepath.Dir(t.path(name))] = true
+		}
+	}
+	for dir := range dirs {
+		syncDir(dir)
+	}
+}
+
+// rollBack undoes the changes made by a transaction that wasn't
+// committed, removing the new files that it created and moving the ones
+// it removed back, and removes its directory.
+func (t *transaction) rollBack() {
+	for i, name := range t.Create {
+		staged, err := os.Stat(t.staged("create", i))
+		if os.IsNotExist(err) {
+			// It was renamed into place.
+			if _, err := os.Stat(t.path(name)); err == nil {
+				log.CheckError(os.Remove(t.path(name)))
+			}
+		} else if fi, err := os.Stat(t.path(name)); err == nil && os.SameFile(fi, staged) {
+			log.CheckError(os.Remove(t.path(name)))
+		}
+	}
+	for i, name := range t.Remove {
+		if _, err := os.Stat(t.staged("remove", i)); err != nil {
+			continue
+		}
+		if _, err := os.Stat(t.path(name)); os.IsNotExist(err) {
+			log.CheckError(os.Rename(t.staged("remove", i), t.path(name)))
+			if err := os.Rename(t.staged("remove", i)+".rs", t.path(name)+".rs"); !os.IsNotExist(err) {
+				log.CheckError(err)
+			}
+		}
+	}
+	log.CheckError(os.RemoveAll(t.dir))
+}
+
+// interruptedTransactions returns the directories of the transactions in
+// the journal that haven't been updated for journalStaleAge.
+func (db *disk) interruptedTransactions() []string {
+	entries, err := ioutil.ReadDir(filepath.Join(db.dir, journalDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	log.CheckError(err)
+	var dirs []string
+	for _, e := range entries {
+		if time.Since(e.ModTime()) >= journalStaleAge {
+			dirs = append(dirs, filepath.Join(db.dir, journalDir, e.Name()))
+		}
+	}
+	return dirs
+}
+
+func (db *disk) RecoverTransactions() {
+	for _, dir := range db.interruptedTransactions() {
+		t := &transaction{db: db, dir: dir}
+		plan, err := ioutil.ReadFile(filepath.Join(dir, "plan"))
+		if os.IsNotExist(err) {
+			// Nothing had been changed yet.
+			log.Print("%s: removing incomplete transaction", dir)
+			log.CheckError(os.RemoveAll(dir))
+			continue
+		}
+		log.CheckError(err)
+		if err := json.Unmarshal(plan, t); err != nil {
+			log.Error("%s: %s; leaving it for manual recovery", dir, err)
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "committed")); err == nil {
+			log.Print("%s: completing interrupted transaction that created %s",
+				dir, strings.Join(t.Create, ", "))
+			t.finish()
+		} else {
+			log.Print("%s: rolling back interrupted transaction that would have created %s",
+				dir, strings.Join(t.Create, ", "))
+			t.rollBack()
+		}
+	}
+}
+
+// writeSynced writes the given file and syncs it to disk, unless
+// fastSync is set.
+func writeSynced(path string, contents []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	log.CheckError(err)
+	_, err = f.Write(contents)
+	log.CheckError(err)
+	if !fastSync {
+		log.CheckError(f.Sync())
+	}
+	log.CheckError(f.Close())
+}
+
+// syncDir syncs the given directory, so that the files that have been
+// created in it and renamed into it are recorded on disk, unless fastSync
+// is set.
+func syncDir(path string) {
+	if fastSync {
+		return
+	}
+	d, err := os.Open(path)
+	log.CheckError(err)
+	defer d.Close()
+	// Not all platforms support syncing directories.
+	if err := d.Sync(); err != nil {
+		log.Debug("%s: %s", path, err)
+	}
+}
@@ -0,0 +1,208 @@
+// storage/kdf.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The key derivation function that encrypted repositories use to derive
+// the key that encrypts their encryption key from the passphrase, along
+// with its cost parameters, is recorded in the metadata named kdfName
+// when the repository is created. Repositories without it use
+// LegacyKDF, which is what all of them used before it was added. The
+// metadata isn't authenticated, since it's needed to derive the key;
+// changing it just makes the passphrase appear to be incorrect.
+const kdfName = "kdf.txt"
+
+// Supported key derivation functions.
+const (
+	KDFPBKDF2   = "pbkdf2-sha256"
+	KDFArgon2id = "argon2id"
+)
+
+// KDFParams specifies a key derivation function and its cost parameters.
+type KDFParams struct {
+	// KDFPBKDF2 or KDFArgon2id.
+	Algorithm string
+	// Number of iterations for PBKDF2; number of passes over memory for
+	// Argon2id.
+	Iterations int
+	// Argon2id only: the memory used, in KiB, and the number of threads.
+	Memory  int
+	Threads int
+}
+
+// LegacyKDF gives the parameters used by repositories that don't record
+// them.
+var LegacyKDF = KDFParams{Algorithm: KDFPBKDF2, Iterations: 65536}
+
+// Limits on the parameters accepted, so that damaged or malicious
+// metadata can't make opening a repository take forever or exhaust
+// memory.
+const (
+	maxKDFIterations = 1 << 30
+	maxKDFMemory     = 4 << 20 // 4 GiB
+	maxKDFThreads    = 255
+)
+
+// How long Calibrate aims for deriving a key to take.
+const kdfTargetDuration = 500 * time.Millisecond
+
+// Fewest iterations that Calibrate chooses for each algorithm, following
+// RFC 9106 and OWASP's recommendations, respectively.
+var minKDFIterations = map[string]int{KDFArgon2id: 3, KDFPBKDF2: 600000}
+
+// NewKDFParams returns the default parameters for the given algorithm,
+// other than the number of iterations, which is zero; see Calibrate.
+// Argon2id uses 64 MiB of memory and up to 4 threads.
+func NewKDFParams(algorithm string) (KDFParams, error) {
+	p := KDFParams{Algorithm: algorithm}
+	switch algorithm {
+	case KDFArgon2id:
+		p.Memory = 64 << 10
+		p.Threads = runtime.NumCPU()
+		if p.Threads > 4 {
+			p.Threads = 4
+		}
+	case KDFPBKDF2:
+	default:
+		return p, fmt.Errorf("%s: unknown key derivation function; expected %s or %s",
+			algorithm, KDFArgon2id, KDFPBKDF2)
+	}
+	return p, nil
+}
+
+// Calibrate returns the given parameters with the number of iterations
+// set so that deriving a key takes about half a second on this machine,
+// but no fewer than the algorithm's minimum. Slower machines opening the
+// repository will take proportionally longer.
+func (p KDFParams) Calibrate() KDFParams {
+	trial := p
+	trial.Iterations = 1
+	if p.Algorithm == KDFPBKDF2 {
+		trial.Iterations = 65536
+	}
+	start := time.Now()
+	trial.derive("calibration", make([]byte, 32))
+	elapsed := time.Since(start)
+
+	p.Iterations = minKDFIterations[p.Algorithm]
+	if elapsed > 0 {
+		n := int64(kdfTargetDuration) * int64(trial.Iterations) / int64(elapsed)
+		if n > int64(p.Iterations) {
+			p.Iterations = int(n)
+		}
+	}
+	if p.Iterations > maxKDFIterations {
+		p.Iterations = maxKDFIterations
+	}
+	return p
+}
+
+// Validate returns an error if the parameters are invalid.
+func (p KDFParams) Validate() error {
+	switch p.Algorithm {
+	case KDFPBKDF2:
+		if p.Memory != 0 || p.Threads != 0 {
+			return fmt.Errorf("%s: memory and threads can't be specified", p.Algorithm)
+		}
+	case KDFArgon2id:
+		if p.Memory < 8*p.Threads || p.Memory > maxKDFMemory {
+			return fmt.Errorf("%s: memory must be between %d KiB and %d KiB", p.Algorithm,
+				8*p.Threads, maxKDFMemory)
+		}
+		if p.Threads < 1 || p.Threads > maxKDFThreads {
+			return fmt.Errorf("%s: threads must be between 1 and %d", p.Algorithm, maxKDFThreads)
+		}
+	default:
+		return fmt.Errorf("%s: unknown key derivation function; expected %s or %s",
+			p.Algorithm, KDFArgon2id, KDFPBKDF2)
+	}
+	if p.Iterations < 1 || p.Iterations > maxKDFIterations {
+		return fmt.Errorf("%s: iterations must be between 1 and %d", p.Algorithm,
+			maxKDFIterations)
+	}
+	return nil
+}
+
+// String returns the parameters as they're recorded in the repository,
+// e.g. "argon2id iterations=3 memory=65536 threads=4".
+func (p KDFParams) String() string {
+	s := fmt.Sprintf("%s iterations=%d", p.Algorithm, p.Iterations)
+	if p.Algorithm == KDFArgon2id {
+		s += fmt.Sprintf(" memory=%d threads=%d", p.Memory, p.Threads)
+	}
+	return s
+}
+
+// ParseKDFParams parses parameters in the form returned by String.
+func ParseKDFParams(s string) (KDFParams, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return KDFParams{}, fmt.Errorf("%q: no key derivation function given", s)
+	}
+	p := KDFParams{Algorithm: fields[0]}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return KDFParams{}, fmt.Errorf("%s: expected name=value", f)
+		}
+		v, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return KDFParams{}, fmt.Errorf("%s: %s", f, err)
+		}
+		switch kv[0] {
+		case "iterations":
+			p.Iterations = v
+		case "memory":
+			p.Memory = v
+		case "threads":
+			p.Threads = v
+		default:
+			return KDFParams{}, fmt.Errorf("%s: unknown parameter", kv[0])
+		}
+	}
+	return p, p.Validate()
+}
+
+// derive returns the 64-byte key derived from the given passphrase and
+// salt.
+func (p KDFParams) derive(passphrase string, salt []byte) []byte {
+	if p.Algorithm == KDFArgon2id {
+		return argon2.IDKey([]byte(passphrase), salt, uint32(p.Iterations),
+			uint32(p.Memory), uint8(p.Threads), 64)
+	}
+	return pbkdf2.Key([]byte(passphrase), salt, p.Iterations, 64, sha256.New)
+}
+
+// RepositoryKDF returns the key derivation parameters used by the
+// encrypted repository stored in the given Backend. Invalid parameters
+// are a fatal error.
+func RepositoryKDF(backend Backend) KDFParams {
+	if !backend.MetadataExists(kdfName) {
+		return LegacyKDF
+	}
+	p, err := ParseKDFParams(string(backend.ReadMetadata(kdfName)))
+	if err != nil {
+		log.Fatal("%s: %s", kdfName, err)
+	}
+	return p
+}
+
+// SetRepositoryKDF records the key derivation parameters for a new
+// encrypted repository. Like SetRepositoryPadding, it must be called
+// before NewEncrypted is first called for the repository.
+func SetRepositoryKDF(backend Backend, p KDFParams) {
+	log.CheckError(p.Validate())
+	backend.WriteMetadata(kdfName, []byte(p.String()+"\n"))
+}
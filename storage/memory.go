@@ -8,6 +8,8 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,8 +19,12 @@ type metadata struct {
 }
 
 type memory struct {
+	// mu protects blobs and stats so that Write can be called
+	// concurrently.
+	mu    sync.Mutex
 	blobs map[Hash][]byte
 	meta  map[string]metadata
+	stats Stats
 }
 
 // Duplicate the provided byte slice.
@@ -46,25 +52,49 @@ func (m *memory) String() string {
 func (m *memory) LogStats() {
 }
 
-func (m *memory) Fsck() {
+func (m *memory) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+func (m *memory) Fsck(opts FsckOptions) {
 }
 
 func (m *memory) Write(data []byte) Hash {
 	hash := HashBytes(data)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.ChunksWritten++
+	m.stats.BytesWritten += int64(len(data))
 	// Blobs are stored in a map; only add the data if it isn't already
 	// there.
 	if _, ok := m.blobs[hash]; !ok {
 		m.blobs[hash] = dupe(data)
+		m.stats.ChunksStored++
+		m.stats.BytesStored += int64(len(data))
 	}
 	return hash
 }
 
+func (m *memory) WriteBlobStream(r io.Reader) (Hash, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Hash{}, err
+	}
+	return m.Write(data), nil
+}
+
 func (m *memory) HashExists(hash Hash) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	_, ok := m.blobs[hash]
 	return ok
 }
 
 func (m *memory) Hashes() map[Hash]struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	ret := make(map[Hash]struct{})
 	for h := range m.blobs {
 		var empty struct{}
@@ -73,17 +103,37 @@ func (m *memory) Hashes() map[Hash]struct{} {
 	return ret
 }
 
+func (m *memory) BlobSize(hash Hash) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.blobs[hash]
+	if !ok {
+		return 0, ErrHashNotFound
+	}
+	return int64(len(b)), nil
+}
+
 func (m *memory) SyncWrites() {
 }
 
 func (m *memory) Read(hash Hash) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if b, ok := m.blobs[hash]; !ok {
 		return nil, ErrHashNotFound
+	} else if HashBytes(b) != hash {
+		return nil, ErrHashMismatch
 	} else {
+		m.stats.NumReads++
+		m.stats.BytesRead += int64(len(b))
 		return ioutil.NopCloser(bytes.NewReader(b)), nil
 	}
 }
 
+func (m *memory) ReadBlobStream(hash Hash) (io.ReadCloser, error) {
+	return m.Read(hash)
+}
+
 func (m *memory) WriteMetadata(name string, data []byte) {
 	if _, ok := m.meta[name]; ok {
 		log.Fatal("metadata already exists")
@@ -91,6 +141,23 @@ func (m *memory) WriteMetadata(name string, data []byte) {
 	m.meta[name] = metadata{dupe(data), time.Now()}
 }
 
+func (m *memory) CreateMetadata(name string, data []byte) error {
+	if _, ok := m.meta[name]; ok {
+		return ErrMetadataExists
+	}
+	m.WriteMetadata(name, data)
+	return nil
+}
+
+func (m *memory) ReplaceMetadata(name string, old, data []byte) error {
+	if md, ok := m.meta[name]; !ok || !bytes.Equal(md.data, old) {
+		return ErrMetadataChanged
+	}
+	delete(m.meta, name)
+	m.WriteMetadata(name, data)
+	return nil
+}
+
 func (m *memory) ReadMetadata(name string) []byte {
 	md, ok := m.meta[name]
 	if !ok {
@@ -104,6 +171,35 @@ func (m *memory) MetadataExists(name string) bool {
 	return ok
 }
 
+func (m *memory) WriteMetadataBatch(metadata map[string][]byte) {
+	for name, data := range metadata {
+		m.WriteMetadata(name, data)
+	}
+}
+
+func (m *memory) ReadMetadataBatch(names []string) map[string][]byte {
+	md := make(map[string][]byte)
+	for _, name := range names {
+		md[name] = m.ReadMetadata(name)
+	}
+	return md
+}
+
+func (m *memory) MetadataExistsBatch(names []string) map[string]bool {
+	exists := make(map[string]bool)
+	for _, name := range names {
+		exists[name] = m.MetadataExists(name)
+	}
+	return exists
+}
+
+func (m *memory) DeleteMetadata(name string) {
+	if _, ok := m.meta[name]; !ok {
+		log.Fatal("metadata not found")
+	}
+	delete(m.meta, name)
+}
+
 func (m *memory) ListMetadata() map[string]time.Time {
 	md := make(map[string]time.Time)
 	for name, meta := range m.meta {
@@ -111,3 +207,14 @@ func (m *memory) ListMetadata() map[string]time.Time {
 	}
 	return md
 }
+
+func (m *memory) ForMetadata(prefix string, f func(name string, created time.Time) error) error {
+	for name, meta := range m.meta {
+		if strings.HasPrefix(name, prefix) {
+			if err := f(name, meta.created); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
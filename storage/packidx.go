@@ -7,12 +7,16 @@ package storage
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	u "github.com/mmp/bk/util"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -37,27 +41,32 @@ exists to do this currently.)
 // files, returning the bytes to append to the index and back files to
 // store the chunk.
 func PackBlob(h Hash, chunk []byte, packFileSize int64) (idx, pack []byte) {
-	idxAlloc := len(IdxMagic) + HashSize + 2*binary.MaxVarintLen64
-	packAlloc := len(BlobMagic) + binary.MaxVarintLen64 + len(chunk)
-	idx = make([]byte, idxAlloc)
-	pack = make([]byte, packAlloc)
-
-	// Pack file: magic number, data length, chunk
-	np := copy(pack, BlobMagic[:])
-	np += binary.PutVarint(pack[np:], int64(len(chunk)))
-	np += copy(pack[np:], chunk)
-	pack = pack[:np]
-
-	// Index file: magic number, hash, pack offset, pack read size
-	ni := copy(idx, IdxMagic[:])
-	ni += copy(idx[ni:], h[:])
-	ni += binary.PutVarint(idx[ni:], packFileSize)
-	ni += binary.PutVarint(idx[ni:], int64(len(pack)))
-	idx = idx[:ni]
-
+	pack = append(blobHeader(int64(len(chunk))), chunk...)
+	idx = indexEntry(h, packFileSize, int64(len(pack)))
 	return
 }
 
+// blobHeader returns the bytes that precede a chunk of the given length in
+// a pack file: the magic number and the data length.
+func blobHeader(length int64) []byte {
+	header := make([]byte, len(BlobMagic)+binary.MaxVarintLen64)
+	n := copy(header, BlobMagic[:])
+	n += binary.PutVarint(header[n:], length)
+	return header[:n]
+}
+
+// indexEntry returns the index file entry for the blob with the given hash
+// that's stored at the given offset in its pack file: the magic number,
+// hash, pack offset, and pack read size.
+func indexEntry(h Hash, offset, length int64) []byte {
+	idx := make([]byte, len(IdxMagic)+HashSize+2*binary.MaxVarintLen64)
+	n := copy(idx, IdxMagic[:])
+	n += copy(idx[n:], h[:])
+	n += binary.PutVarint(idx[n:], offset)
+	n += binary.PutVarint(idx[n:], length)
+	return idx[:n]
+}
+
 ///////////////////////////////////////////////////////////////////////////
 
 // ChunkIndex maintains an index from hashes to the locations of their blobs
@@ -160,6 +169,12 @@ func (c *ChunkIndex) Hashes() map[Hash]struct{} {
 	return m
 }
 
+// PackNames returns the names of all of the pack files that store blobs
+// in the index.
+func (c *ChunkIndex) PackNames() []string {
+	return c.idToName
+}
+
 // DecodeBlob takes a blob read from a pack file (as per the specs from a
 // BlobLocation) and returns the chunk stored in that blob.
 func DecodeBlob(blob []byte) ([]byte, error) {
@@ -236,7 +251,16 @@ type PackFileBackend struct {
 	start time.Time
 
 	metadataNames map[string]time.Time
-	chunkIndex    ChunkIndex
+
+	// The index files aren't read until chunks are first accessed, so
+	// that commands that only use metadata (e.g., listing backups) don't
+	// need to read all of them.
+	readIndicesOnce sync.Once
+
+	// indexMu protects chunkIndex and the state of the pack file that's
+	// currently being written, below.
+	indexMu    sync.RWMutex
+	chunkIndex ChunkIndex
 
 	// Names of the current pack and index files.
 	packName, idxName string
@@ -252,16 +276,18 @@ type PackFileBackend struct {
 	packSize    int64
 	maxPackSize int64
 
-	// A goroutine is launched to perform asynchronous writes. It reads
-	// file write requests from writeChan and lands them in storage in the
-	// order received.
+	// Goroutines are launched to perform asynchronous writes. They read
+	// file write requests from writeChan and land them in storage; each
+	// index file is only written after its pack file has landed.
 	writeChan chan fileWrite
 	wg        sync.WaitGroup
+	// Closed once the current pack file has landed.
+	packDone chan struct{}
 
 	// mu protects the statistics variables.
-	mu                    sync.Mutex
-	bytesSaved, bytesRead int64
-	numSaves, numReads    int
+	mu                                  sync.Mutex
+	bytesSaved, bytesRead, bytesWritten int64
+	numSaves, numReads, numWrites       int
 }
 
 // Represents a file to be written to in the storage system. The file's
@@ -270,8 +296,20 @@ type PackFileBackend struct {
 type fileWrite struct {
 	path string
 	ch   chan []byte
+	// If non-nil, the file isn't created until after this chan is
+	// closed.
+	after chan struct{}
+	// If non-nil, closed once the file has landed in storage.
+	done chan struct{}
 }
 
+// Maximum number of files that are written concurrently. With cloud
+// storage, files are uploaded when they're closed, so this lets new data
+// continue to be added to a pack file while earlier ones are still being
+// uploaded, rather than Write stalling until each upload finishes. Each
+// one may hold an entire pack file in memory, though.
+const maxConcurrentFileWrites = 4
+
 // RobustWriteCloser is like a io.WriteCloser, except it treats any errors
 // as fatal errors and thus doesn't have error return values. Write()
 // always writes all bytes given to it, and after a call to Close()
@@ -289,7 +327,10 @@ type FileStorage interface {
 
 	// ReadFile returns the contents of the given file. If length is zero, the
 	// whole file contents are returned; otherwise the segment starting at offset
-	// with given length is returned.
+	// with given length is returned. Chunks are read from pack files this
+	// way, so implementations should only fetch the requested segment
+	// (e.g., using a range request with cloud storage), and must return
+	// an error if the file ends before the segment does.
 	//
 	// TODO: it might be more idiomatic to return e.g. an io.ReadCloser,
 	// but between the GCS backend needing to be able to retry reads and
@@ -304,10 +345,45 @@ type FileStorage interface {
 
 	String() string
 
-	// Fsck checks the validity of the stored data.  The returned Boolean
-	// value indicates whether or not the caller should continue and
-	// perform its own checks on the contents of the data as well.
-	Fsck() bool
+	// Fsck checks the validity of the stored data, limiting itself to
+	// the subset of files given by opts.  The returned Boolean value
+	// indicates whether or not the caller should continue and perform its
+	// own checks on the contents of the data as well.
+	Fsck(opts FsckOptions) bool
+
+	// RemoveFile removes the given file. It's only used to replace
+	// damaged files with repaired versions.
+	RemoveFile(name string) error
+}
+
+// RepairableFileStorage is implemented by FileStorage implementations that
+// store redundant encodings of their files.
+type RepairableFileStorage interface {
+	// Repair reconstructs any corrupted parts of the given file, returning
+	// a non-nil error if it isn't able to.
+	Repair(name string) error
+}
+
+// ExclusiveFileStorage is implemented by FileStorage implementations that
+// can atomically create a file only if it doesn't already exist, even if
+// another process is trying to create it at the same time.
+type ExclusiveFileStorage interface {
+	// CreateFileExclusive creates a file with the given name and
+	// contents, returning an error for which os.IsExist is true if it
+	// already exists. As with CreateFile, other errors are fatal.
+	CreateFileExclusive(name string, contents []byte) error
+}
+
+// ConditionalFileStorage is implemented by FileStorage implementations
+// that can atomically replace a file only if it still has the contents
+// it's expected to, even if another process is trying to replace it at
+// the same time.
+type ConditionalFileStorage interface {
+	// ReplaceFile replaces the file with the given name, which must have
+	// the contents old, with contents. If it doesn't exist or has
+	// different contents, errFileChanged is returned and nothing is
+	// changed. Other errors are fatal.
+	ReplaceFile(name string, old, contents []byte) error
 }
 
 func newPackFileBackend(fs FileStorage, maxPackSize int64) Backend {
@@ -317,12 +393,17 @@ func newPackFileBackend(fs FileStorage, maxPackSize int64) Backend {
 		maxPackSize: maxPackSize,
 	}
 
-	// Get all of the the names of the metadata.
-	pb.metadataNames = make(map[string]time.Time)
-	pb.fs.ForFiles("metadata/", func(n string, created time.Time) {
-		pb.metadataNames[filepath.Base(n)] = created
-	})
+	pb.loadMetadataNames()
+
+	pb.launchWriter()
 
+	return pb
+}
+
+// readIndices reads all of the index files to find the locations of the
+// stored chunks. It must be called via loadIndices before chunkIndex is
+// used.
+func (pb *PackFileBackend) readIndices() {
 	// TODO: do in parallel?
 	log.Verbose("Starting to read indices.")
 	added := 0
@@ -346,21 +427,35 @@ func newPackFileBackend(fs FileStorage, maxPackSize int64) Backend {
 		}
 		added += nadd
 
+		pb.mu.Lock()
 		pb.numReads++
 		pb.bytesRead += int64(len(idx))
+		pb.mu.Unlock()
 	})
 	log.Verbose("Done reading indices: %d files, %s -> %d entries", pb.numReads,
 		u.FmtBytes(pb.bytesRead), added)
+}
 
-	pb.launchWriter()
-
-	return pb
+// loadIndices makes sure that the index files have been read.
+func (pb *PackFileBackend) loadIndices() {
+	pb.readIndicesOnce.Do(pb.readIndices)
 }
 
 func (pb *PackFileBackend) String() string {
 	return pb.fs.String()
 }
 
+// Close releases the resources used by the FileStorage, if it implements
+// io.Closer, as the one for helper programs does; writes must have been
+// synced first with SyncWrites. The PackFileBackend can't be used
+// afterward.
+func (pb *PackFileBackend) Close() error {
+	if c, ok := pb.fs.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func (pb *PackFileBackend) LogStats() {
 	delta := time.Now().Sub(pb.start)
 	if pb.numSaves > 0 {
@@ -379,16 +474,103 @@ func (pb *PackFileBackend) LogStats() {
 	}
 }
 
+func (pb *PackFileBackend) Stats() Stats {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return Stats{
+		ChunksWritten: int64(pb.numWrites),
+		BytesWritten:  pb.bytesWritten,
+		ChunksStored:  int64(pb.numSaves),
+		BytesStored:   pb.bytesSaved,
+		NumReads:      int64(pb.numReads),
+		BytesRead:     pb.bytesRead,
+	}
+}
+
 func (pb *PackFileBackend) Write(chunk []byte) Hash {
+	pb.loadIndices()
+	pb.mu.Lock()
+	pb.numWrites++
+	pb.bytesWritten += int64(len(chunk))
+	pb.mu.Unlock()
+
+	// Compute the hash before taking the lock so that multiple threads
+	// can do so in parallel.
 	hash := HashBytes(chunk)
+
+	pb.indexMu.Lock()
+	defer pb.indexMu.Unlock()
 	if _, err := pb.chunkIndex.Lookup(hash); err == nil {
 		log.Debug("%s: hash already stored", hash)
 		return hash
 	}
 
+	pb.reservePack(hash, int64(len(chunk)))
+	idx, pack := PackBlob(hash, chunk, pb.packSize)
+
+	// Send the pack file data on to the writer immediately.
+	pb.packChan <- pack
+	pb.addIndexEntry(hash, idx, int64(len(pack)))
+
+	return hash
+}
+
+// WriteBlobStream stores the chunk in the current pack file as it's read
+// back from the spool, in pieces. As with Write, indexMu is held while
+// it's stored, so other writes wait until it's done.
+func (pb *PackFileBackend) WriteBlobStream(r io.Reader) (Hash, error) {
+	sp, err := asSpool(r)
+	if err != nil {
+		return Hash{}, err
+	}
+	defer sp.Close()
+
+	pb.loadIndices()
+	pb.mu.Lock()
+	pb.numWrites++
+	pb.bytesWritten += sp.size
+	pb.mu.Unlock()
+
+	hash := sp.Hash()
+
+	pb.indexMu.Lock()
+	defer pb.indexMu.Unlock()
+	if _, err := pb.chunkIndex.Lookup(hash); err == nil {
+		log.Debug("%s: hash already stored", hash)
+		return hash, nil
+	}
+
+	pb.reservePack(hash, sp.size)
+	header := blobHeader(sp.size)
+	length := int64(len(header)) + sp.size
+	idx := indexEntry(hash, pb.packSize, length)
+
+	pb.packChan <- header
+	for {
+		// The writer holds on to each piece until it has been written, so
+		// they can't share a buffer.
+		piece := make([]byte, spoolPieceSize)
+		n, err := io.ReadFull(sp, piece)
+		if n > 0 {
+			pb.packChan <- piece[:n]
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		log.CheckError(err)
+	}
+	pb.addIndexEntry(hash, idx, length)
+
+	return hash, nil
+}
+
+// reservePack makes sure that there's a current pack file with room for a
+// chunk of the given length, starting a new one if needed. indexMu must
+// be held.
+func (pb *PackFileBackend) reservePack(hash Hash, length int64) {
 	// 16 bytes of slop in the second test to account for magic numbers and
 	// the encoded chunk length.
-	if pb.packName == "" || pb.packSize+int64(len(chunk))+16 > pb.maxPackSize {
+	if pb.packName == "" || pb.packSize+length+16 > pb.maxPackSize {
 		// Close out the current pack file (if there is one).
 		pb.closePack()
 
@@ -397,29 +579,30 @@ func (pb *PackFileBackend) Write(chunk []byte) Hash {
 		// storage, ergo no index/pack files can have it as a name.
 		pb.packName = "packs/" + hash.String() + ".pack"
 		pb.packChan = make(chan []byte, 1024)
-		pb.writeChan <- fileWrite{pb.packName, pb.packChan}
+		pb.packDone = make(chan struct{})
+		pb.writeChan <- fileWrite{path: pb.packName, ch: pb.packChan, done: pb.packDone}
 
 		pb.idxName = "indices/" + hash.String() + ".idx"
 		pb.packSize = 0
 	}
+}
 
-	idx, pack := PackBlob(hash, chunk, pb.packSize)
-
+// addIndexEntry records the location of a blob of the given length that
+// has been sent to the current pack file, with idx its index file entry.
+// indexMu must be held.
+func (pb *PackFileBackend) addIndexEntry(hash Hash, idx []byte, length int64) {
 	// Add to the index before incrementing pb.packSize!
-	pb.chunkIndex.AddSingle(hash, pb.packName, pb.packSize, int64(len(pack)))
-	pb.packSize += int64(len(pack))
+	pb.chunkIndex.AddSingle(hash, pb.packName, pb.packSize, length)
+	pb.packSize += length
 
-	// Save the index file addition in pb.idx for now, but send the pack
-	// file data on to the writer immediately.
+	// Save the index file addition in pb.idx for now; it's written once
+	// the pack file has been.
 	pb.idx = append(pb.idx, idx...)
-	pb.packChan <- pack
 
 	pb.mu.Lock()
 	pb.numSaves++
-	pb.bytesSaved += int64(len(idx) + len(pack))
+	pb.bytesSaved += int64(len(idx)) + length
 	pb.mu.Unlock()
-
-	return hash
 }
 
 func (pb *PackFileBackend) closePack() {
@@ -431,9 +614,10 @@ func (pb *PackFileBackend) closePack() {
 		// file has been successfully saved to storage.
 		log.Check(len(pb.idx) > 0)
 		idxChan := make(chan []byte, 1)
-		pb.writeChan <- fileWrite{pb.idxName, idxChan}
 		idxChan <- pb.idx
 		close(idxChan)
+		pb.writeChan <- fileWrite{path: pb.idxName, ch: idxChan, after: pb.packDone}
+		pb.packDone = nil
 
 		pb.packName = ""
 		pb.idxName = ""
@@ -449,8 +633,10 @@ func (pb *PackFileBackend) launchWriter() {
 	// chans.
 	pb.writeChan = make(chan fileWrite, 4)
 
-	pb.wg.Add(1)
-	go writeWorker(pb.fs, pb.writeChan, &pb.wg)
+	for i := 0; i < maxConcurrentFileWrites; i++ {
+		pb.wg.Add(1)
+		go writeWorker(pb.fs, pb.writeChan, &pb.wg)
+	}
 }
 
 func writeWorker(fs FileStorage, ch chan fileWrite, wg *sync.WaitGroup) {
@@ -463,6 +649,9 @@ func writeWorker(fs FileStorage, ch chan fileWrite, wg *sync.WaitGroup) {
 		}
 
 		// Got a new file to start writing to.
+		if item.after != nil {
+			<-item.after
+		}
 		w := fs.CreateFile(item.path)
 		for {
 			// Grab byte slices from the chan for that file and write them
@@ -471,6 +660,9 @@ func writeWorker(fs FileStorage, ch chan fileWrite, wg *sync.WaitGroup) {
 				w.Write(b)
 			} else {
 				w.Close()
+				if item.done != nil {
+					close(item.done)
+				}
 				// On to the next file.
 				break
 			}
@@ -482,7 +674,7 @@ func (pb *PackFileBackend) SyncWrites() {
 	// Wrap up the current pack file and save its index file.
 	pb.closePack()
 
-	// Close the chan and wait for the writer to exit, at which point all
+	// Close the chan and wait for the writers to exit, at which point all
 	// pending writes have landed in storage.
 	close(pb.writeChan)
 	pb.wg.Wait()
@@ -492,97 +684,424 @@ func (pb *PackFileBackend) SyncWrites() {
 }
 
 func (pb *PackFileBackend) Read(hash Hash) (io.ReadCloser, error) {
-	if loc, err := pb.chunkIndex.Lookup(hash); err != nil {
+	pb.loadIndices()
+	pb.indexMu.RLock()
+	loc, err := pb.chunkIndex.Lookup(hash)
+	pb.indexMu.RUnlock()
+
+	if err != nil {
 		return nil, err
-	} else {
-		blob, err := pb.fs.ReadFile(loc.PackName, loc.Offset, loc.Length)
-		if err != nil {
-			return nil, err
+	}
+
+	chunk, err := pb.readChunk(hash, loc)
+	if rfs, ok := pb.fs.(RepairableFileStorage); ok && err != nil {
+		// Try to fix the pack file and then give it another shot.
+		log.Warning("%s: %s: %s; attempting to repair %s", pb.fs, hash, err,
+			loc.PackName)
+		if rerr := rfs.Repair(loc.PackName); rerr != nil {
+			log.Warning("%s: unable to repair: %s", loc.PackName, rerr)
+		} else {
+			chunk, err = pb.readChunk(hash, loc)
+			if err == nil {
+				log.Print("%s: repaired", loc.PackName)
+			}
 		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(chunk)), nil
+}
 
-		pb.mu.Lock()
-		pb.numReads++
-		pb.bytesRead += loc.Length
-		pb.mu.Unlock()
+func (pb *PackFileBackend) ReadBlobStream(hash Hash) (io.ReadCloser, error) {
+	pb.loadIndices()
+	pb.indexMu.RLock()
+	loc, err := pb.chunkIndex.Lookup(hash)
+	pb.indexMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
 
-		chunk, err := DecodeBlob(blob)
-		if err != nil {
-			return nil, err
-		}
-		if HashBytes(chunk) != hash {
-			return nil, ErrHashMismatch
+	var r io.ReadCloser
+	if sfs, ok := pb.fs.(StreamingFileStorage); ok {
+		r, err = sfs.OpenFile(loc.PackName, loc.Offset, loc.Length)
+	} else {
+		var blob []byte
+		blob, err = pb.fs.ReadFile(loc.PackName, loc.Offset, loc.Length)
+		r = ioutil.NopCloser(bytes.NewReader(blob))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pb.mu.Lock()
+	pb.numReads++
+	pb.bytesRead += loc.Length
+	pb.mu.Unlock()
+
+	br := bufio.NewReader(r)
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if magic != BlobMagic {
+		r.Close()
+		return nil, ErrBlobMagicWrong
+	}
+	length, err := binary.ReadVarint(br)
+	if err != nil {
+		r.Close()
+		if err == io.EOF {
+			return nil, ErrPrematureEndOfData
 		}
+		return nil, err
+	}
+	return newVerifyingReader(&readerAndCloser{&drainingReader{br, length}, r}, hash), nil
+}
 
-		return ioutil.NopCloser(bytes.NewReader(chunk)), nil
+// readChunk reads the blob at the given location, returning its contents
+// if they have the given hash.
+func (pb *PackFileBackend) readChunk(hash Hash, loc BlobLocation) ([]byte, error) {
+	blob, err := pb.fs.ReadFile(loc.PackName, loc.Offset, loc.Length)
+	if err != nil {
+		return nil, err
 	}
+
+	pb.mu.Lock()
+	pb.numReads++
+	pb.bytesRead += loc.Length
+	pb.mu.Unlock()
+
+	chunk, err := DecodeBlob(blob)
+	if err != nil {
+		return nil, err
+	}
+	if HashBytes(chunk) != hash {
+		return nil, ErrHashMismatch
+	}
+	return chunk, nil
 }
 
 func (pb *PackFileBackend) HashExists(hash Hash) bool {
+	pb.loadIndices()
+	pb.indexMu.RLock()
+	defer pb.indexMu.RUnlock()
 	_, err := pb.chunkIndex.Lookup(hash)
 	return err == nil
 }
 
 func (pb *PackFileBackend) Hashes() map[Hash]struct{} {
+	pb.loadIndices()
+	pb.indexMu.RLock()
+	defer pb.indexMu.RUnlock()
 	return pb.chunkIndex.Hashes()
 }
 
-func (pb *PackFileBackend) Fsck() {
-	if pb.fs.Fsck() == false {
+func (pb *PackFileBackend) BlobSize(hash Hash) (int64, error) {
+	pb.loadIndices()
+	pb.indexMu.RLock()
+	defer pb.indexMu.RUnlock()
+	loc, err := pb.chunkIndex.Lookup(hash)
+	return loc.Length, err
+}
+
+func (pb *PackFileBackend) Fsck(opts FsckOptions) {
+	if tfs, ok := pb.fs.(TransactionalFileStorage); ok {
+		tfs.RecoverTransactions()
+		pb.loadMetadataNames()
+	}
+	pb.loadIndices()
+	if opts.MetadataOnly {
+		pb.fsckMetadata(opts.Repair)
+		pb.fsckIndex()
 		return
 	}
 
+	if pb.fs.Fsck(opts) == false {
+		return
+	}
+	pb.fsckMetadata(opts.Repair)
+
 	// Make sure each blob is available in a pack file and that its data's
 	// hash matches the stored hash.
 	allHashes := pb.chunkIndex.Hashes()
-	log.Verbose("Checking the availability and integrity of %d blobs.",
-		len(allHashes))
+	var hashes []Hash
 	for hash := range allHashes {
-		// Read() makes sure the hash matches the hash of the contents.
-		rc, err := pb.Read(hash)
-		if err != nil {
-			log.Error("%s: %s", hash, err)
-			continue
-		}
-
-		_, err = ioutil.ReadAll(rc)
-		if err != nil {
-			rc.Close()
-			log.Error("%s: %s", hash, err)
-			continue
-		}
-
-		if err = rc.Close(); err != nil {
-			log.Error("%s: %s", hash, err)
+		if opts.InSubset(hash) {
+			hashes = append(hashes, hash)
 		}
 	}
+	log.Verbose("Checking the availability and integrity of %d of %d blobs.",
+		len(hashes), len(allHashes))
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	progress := &u.ProgressReporter{Msg: "Checked blobs", Total: int64(len(hashes))}
+	hashChan := make(chan Hash, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			for hash := range hashChan {
+				pb.fsckBlob(hash)
+				progress.Add(1)
+			}
+			wg.Done()
+		}()
+	}
+	for _, hash := range hashes {
+		hashChan <- hash
+	}
+	close(hashChan)
+	wg.Wait()
+	progress.Finish()
 
 	// Go through all of the pack files and make sure all blobs are present
 	// in an index.
+	var packs []string
 	pb.fs.ForFiles("packs/", func(n string, created time.Time) {
 		if !strings.HasSuffix(n, ".pack") {
 			log.Warning("%s: non .pack file found in packs/ directory", n)
 			return
 		}
+		if opts.FileInSubset(n) {
+			packs = append(packs, n)
+		}
+	})
 
-		// It's slightly annoying to read the whole pack file into memory
-		// here, but they're not too huge. If this was a problem, we could
-		// implement an io.Reader that grabbed pieces of it in turn using
-		// the (start, length) arguments to ReadFile().
-		pack, err := pb.fs.ReadFile(n, 0, 0)
-		log.CheckError(err)
-		err = DecodePackFile(bytes.NewReader(pack), func(chunk []byte) {
-			hash := HashBytes(chunk)
-			if _, ok := allHashes[hash]; !ok {
-				log.Error("%s: hash found in pack file, but not in index", hash)
+	progress = &u.ProgressReporter{Msg: "Checked pack files", Total: int64(len(packs))}
+	packChan := make(chan string, jobs)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			for n := range packChan {
+				pb.fsckPack(n, allHashes)
+				progress.Add(1)
 			}
-		})
-		if err != nil {
-			log.Error("%s", err)
+			wg.Done()
+		}()
+	}
+	for _, n := range packs {
+		packChan <- n
+	}
+	close(packChan)
+	wg.Wait()
+	progress.Finish()
+}
+
+// fsckBlob reads the given blob, which verifies that its data's hash
+// matches the stored hash.
+func (pb *PackFileBackend) fsckBlob(hash Hash) {
+	rc, err := pb.Read(hash)
+	if err != nil {
+		log.Error("%s: %s", hash, err)
+		return
+	}
+
+	_, err = ioutil.ReadAll(rc)
+	if err != nil {
+		rc.Close()
+		log.Error("%s: %s", hash, err)
+		return
+	}
+
+	if err = rc.Close(); err != nil {
+		log.Error("%s: %s", hash, err)
+	}
+}
+
+// fsckPack makes sure that all of the blobs in the given pack file are
+// present in the index.
+func (pb *PackFileBackend) fsckPack(n string, allHashes map[Hash]struct{}) {
+	// It's slightly annoying to read the whole pack file into memory
+	// here, but they're not too huge. If this was a problem, we could
+	// implement an io.Reader that grabbed pieces of it in turn using
+	// the (start, length) arguments to ReadFile().
+	pack, err := pb.fs.ReadFile(n, 0, 0)
+	log.CheckError(err)
+	err = DecodePackFile(bytes.NewReader(pack), func(chunk []byte) {
+		hash := HashBytes(chunk)
+		if _, ok := allHashes[hash]; !ok {
+			log.Error("%s: hash found in pack file, but not in index", hash)
 		}
 	})
+	if err != nil {
+		log.Error("%s: %s", n, err)
+	}
+}
+
+// fsckIndex makes sure that all of the pack files that the index refers
+// to are present, without reading any of them.
+func (pb *PackFileBackend) fsckIndex() {
+	packs := make(map[string]bool)
+	pb.fs.ForFiles("packs/", func(n string, created time.Time) {
+		packs[n] = true
+	})
+
+	log.Verbose("Checking the availability of %d pack files.", len(packs))
+	for _, name := range pb.chunkIndex.PackNames() {
+		if !packs[name] {
+			log.Error("%s: pack file referenced by index not found", name)
+		}
+	}
+}
+
+// fsckMetadata checks that both copies of each metadata item are present
+// and consistent. If repair is true, missing and damaged copies are
+// replaced using the other one, and redundant copies are added for
+// metadata written by older versions of bk.
+func (pb *PackFileBackend) fsckMetadata(repair bool) {
+	log.Verbose("Checking %d metadata items.", len(pb.metadataNames))
+	var names []string
+	for name := range pb.metadataNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nUncopied := 0
+	for _, name := range names {
+		b, err := pb.fs.ReadFile("metadata/"+name, 0, 0)
+		c, cerr := pb.readMetadataCopy(name)
+		switch {
+		case err != nil && cerr != nil:
+			log.Error("%s: metadata is unreadable: %s; copy: %s", name, err, cerr)
+		case cerr == errNoMetadataCopy:
+			// Written by an older version of bk.
+			nUncopied++
+			if repair {
+				pb.writeMetadataCopy(name, b)
+			}
+		case cerr != nil:
+			if !repair {
+				log.Error("%s: redundant copy of metadata: %s", name, cerr)
+			} else {
+				log.Warning("%s: redundant copy of metadata: %s; replacing it", name,
+					cerr)
+				pb.removeFile(metadataCopyDir + name)
+				pb.writeMetadataCopy(name, b)
+			}
+		case err == nil && !bytes.Equal(b, c):
+			// As in ReadMetadata, the metadata is trusted over the copy.
+			if !repair {
+				log.Error("%s: metadata doesn't match its redundant copy", name)
+			} else {
+				log.Warning("%s: metadata doesn't match its redundant copy; "+
+					"replacing the copy", name)
+				pb.removeFile(metadataCopyDir + name)
+				pb.writeMetadataCopy(name, b)
+			}
+		case err != nil:
+			if !repair {
+				log.Error("%s: metadata: %s", name, err)
+			} else {
+				log.Warning("%s: metadata: %s; replacing it with the copy", name, err)
+				pb.removeFile("metadata/" + name)
+				w := pb.fs.CreateFile("metadata/" + name)
+				w.Write(c)
+				w.Close()
+			}
+		}
+	}
+	if nUncopied > 0 {
+		if repair {
+			log.Print("Added redundant copies of %d metadata items.", nUncopied)
+		} else {
+			log.Print("%d metadata items don't have redundant copies; run "+
+				"\"bk fsck --repair\" to add them.", nUncopied)
+		}
+	}
+}
+
+// removeFile removes the given file if it exists.
+func (pb *PackFileBackend) removeFile(name string) {
+	if err := pb.fs.RemoveFile(name); err != nil && !os.IsNotExist(err) {
+		log.Fatal("%s: %s", name, err)
+	}
+}
+
+// Each metadata item is also stored in metadataCopyDir, preceded by the
+// SHA-256 hash of its contents, so that a missing or damaged one can be
+// recovered. SHA-256 is always used, since the hash algorithm that the
+// repository uses is itself recorded in metadata.
+const metadataCopyDir = "metadata-copies/"
+
+var errNoMetadataCopy = errors.New("no redundant copy")
+
+// metadataCopy returns the contents of the redundant copy of metadata with
+// the given contents.
+func metadataCopy(contents []byte) []byte {
+	sum := sha256.Sum256(contents)
+	return append(sum[:], contents...)
+}
+
+func (pb *PackFileBackend) writeMetadataCopy(name string, contents []byte) {
+	w := pb.fs.CreateFile(metadataCopyDir + name)
+	w.Write(metadataCopy(contents))
+	w.Close()
+}
+
+// commitMetadata writes the metadata in create, along with its redundant
+// copies, and removes the metadata in remove and its copies, in a single
+// transaction; the values in remove are the metadata's expected contents
+// or nil, as with TransactionalFileStorage.Commit. It returns false if
+// the FileStorage doesn't support transactions, in which case nothing is
+// done.
+func (pb *PackFileBackend) commitMetadata(create, remove map[string][]byte) (bool, error) {
+	tfs, ok := pb.fs.(TransactionalFileStorage)
+	if !ok {
+		return false, nil
+	}
+	files := make(map[string][]byte)
+	for name, contents := range create {
+		files["metadata/"+name] = contents
+		files[metadataCopyDir+name] = metadataCopy(contents)
+	}
+	removed := make(map[string][]byte)
+	for name, contents := range remove {
+		removed["metadata/"+name] = contents
+		removed[metadataCopyDir+name] = nil
+	}
+	return true, tfs.Commit(files, removed)
+}
+
+// readMetadataCopy returns the contents of the redundant copy of the given
+// metadata, if it's present and intact.
+func (pb *PackFileBackend) readMetadataCopy(name string) ([]byte, error) {
+	b, err := pb.fs.ReadFile(metadataCopyDir+name, 0, 0)
+	if os.IsNotExist(err) {
+		return nil, errNoMetadataCopy
+	} else if err != nil {
+		return nil, err
+	}
+	if len(b) < sha256.Size {
+		return nil, ErrPrematureEndOfData
+	}
+	if sum := sha256.Sum256(b[sha256.Size:]); !bytes.Equal(sum[:], b[:sha256.Size]) {
+		return nil, ErrHashMismatch
+	}
+	return b[sha256.Size:], nil
 }
 
 func (pb *PackFileBackend) WriteMetadata(name string, contents []byte) {
+	pb.addMetadataName(name)
+	pb.writeMetadata(name, contents)
+}
+
+// loadMetadataNames gets all of the the names of the metadata, including
+// ones where only the redundant copy is still around.
+func (pb *PackFileBackend) loadMetadataNames() {
+	pb.metadataNames = make(map[string]time.Time)
+	pb.fs.ForFiles(metadataCopyDir, func(n string, created time.Time) {
+		pb.metadataNames[filepath.Base(n)] = created
+	})
+	pb.fs.ForFiles("metadata/", func(n string, created time.Time) {
+		pb.metadataNames[filepath.Base(n)] = created
+	})
+}
+
+func (pb *PackFileBackend) addMetadataName(name string) {
 	if _, ok := pb.metadataNames[name]; ok {
 		log.Fatal("%s: metadata already exists", name)
 	}
@@ -591,22 +1110,198 @@ func (pb *PackFileBackend) WriteMetadata(name string, contents []byte) {
 	// different, since time.Now() isn't necessarily the same time it lands
 	// on disk. Presumably that's fine.
 	pb.metadataNames[name] = time.Now()
+}
 
+func (pb *PackFileBackend) writeMetadata(name string, contents []byte) {
+	if ok, err := pb.commitMetadata(map[string][]byte{name: contents}, nil); ok {
+		log.CheckError(err, "%s: %s", name, err)
+		return
+	}
 	w := pb.fs.CreateFile("metadata/" + name)
 	w.Write(contents)
 	w.Close()
+	pb.writeMetadataCopy(name, contents)
+}
+
+func (pb *PackFileBackend) CreateMetadata(name string, contents []byte) error {
+	if _, ok := pb.metadataNames[name]; ok {
+		return ErrMetadataExists
+	}
+	if ok, err := pb.commitMetadata(map[string][]byte{name: contents}, nil); ok {
+		if os.IsExist(err) {
+			return ErrMetadataExists
+		}
+		log.CheckError(err)
+	} else if xfs, ok := pb.fs.(ExclusiveFileStorage); ok {
+		if err := xfs.CreateFileExclusive("metadata/"+name, contents); os.IsExist(err) {
+			return ErrMetadataExists
+		} else {
+			log.CheckError(err)
+		}
+		pb.writeMetadataCopy(name, contents)
+	} else {
+		// The best that can be done is to check for metadata that's been
+		// written since the backend was created.
+		for _, n := range []string{"metadata/" + name, metadataCopyDir + name} {
+			if _, err := pb.fs.ReadFile(n, 0, 0); err == nil {
+				return ErrMetadataExists
+			}
+		}
+		pb.writeMetadata(name, contents)
+	}
+	pb.metadataNames[name] = time.Now()
+	return nil
+}
+
+func (pb *PackFileBackend) ReplaceMetadata(name string, old, contents []byte) error {
+	ok, err := pb.commitMetadata(map[string][]byte{name: contents}, map[string][]byte{name: old})
+	if ok {
+		if err == errFileChanged {
+			return ErrMetadataChanged
+		} else if os.IsExist(err) {
+			return ErrMetadataExists
+		}
+		log.CheckError(err)
+		pb.metadataNames[name] = time.Now()
+		return nil
+	}
+
+	// Otherwise, the metadata itself is replaced conditionally; removing
+	// it and then creating it again would leave neither the old metadata
+	// nor the new one if bk was interrupted in between.
+	cfs, ok := pb.fs.(ConditionalFileStorage)
+	if !ok {
+		return ErrReplaceUnsupported
+	}
+	if err := cfs.ReplaceFile("metadata/"+name, old, contents); err == errFileChanged {
+		return ErrMetadataChanged
+	} else {
+		log.CheckError(err)
+	}
+	// The redundant copy only needs to match once the replacement has
+	// been made; if it's missing or out of date, it's written again.
+	copyName := metadataCopyDir + name
+	if err := cfs.ReplaceFile(copyName, metadataCopy(old), metadataCopy(contents)); err == errFileChanged {
+		if err := pb.fs.RemoveFile(copyName); err != nil && !os.IsNotExist(err) {
+			log.Fatal("%s: %s", copyName, err)
+		}
+		pb.writeMetadataCopy(name, contents)
+	} else {
+		log.CheckError(err)
+	}
+	pb.metadataNames[name] = time.Now()
+	return nil
+}
+
+// Maximum number of metadata files that are read or written concurrently
+// by ReadMetadataBatch and WriteMetadataBatch.
+const maxConcurrentMetadataOps = 16
+
+// forMetadataConcurrently calls the given function for each of the given
+// names, with up to maxConcurrentMetadataOps calls running at once, so
+// that the latency of each request to storage is overlapped with the
+// others.
+func forMetadataConcurrently(names []string, f func(name string)) {
+	sem := make(chan bool, maxConcurrentMetadataOps)
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		sem <- true
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+			f(name)
+		}(name)
+	}
+	wg.Wait()
+}
+
+func (pb *PackFileBackend) WriteMetadataBatch(metadata map[string][]byte) {
+	var names []string
+	for name := range metadata {
+		pb.addMetadataName(name)
+		names = append(names, name)
+	}
+	if ok, err := pb.commitMetadata(metadata, nil); ok {
+		log.CheckError(err)
+		return
+	}
+	forMetadataConcurrently(names, func(name string) {
+		pb.writeMetadata(name, metadata[name])
+	})
+}
+
+func (pb *PackFileBackend) ReadMetadataBatch(names []string) map[string][]byte {
+	var mu sync.Mutex
+	md := make(map[string][]byte)
+	forMetadataConcurrently(names, func(name string) {
+		b := pb.ReadMetadata(name)
+		mu.Lock()
+		md[name] = b
+		mu.Unlock()
+	})
+	return md
+}
+
+func (pb *PackFileBackend) MetadataExistsBatch(names []string) map[string]bool {
+	// The names of all of the metadata are already in memory, so there's
+	// nothing to coalesce.
+	exists := make(map[string]bool)
+	for _, name := range names {
+		exists[name] = pb.MetadataExists(name)
+	}
+	return exists
 }
 
 func (pb *PackFileBackend) ReadMetadata(name string) []byte {
 	b, err := pb.fs.ReadFile("metadata/"+name, 0, 0)
+	c, cerr := pb.readMetadataCopy(name)
+	if err != nil && cerr == nil {
+		log.Warning("%s: metadata is missing or damaged; using its redundant copy. "+
+			"Run \"bk fsck --repair\" to fix it.", name)
+		return c
+	}
 	log.CheckError(err)
+	if cerr == nil && !bytes.Equal(b, c) {
+		// Both are intact, so the copy was written separately with other
+		// contents; the metadata itself is used, and the mismatch is only
+		// reported.
+		log.Warning("%s: metadata doesn't match its redundant copy. Run \"bk fsck "+
+			"--repair\" to replace the copy.", name)
+	}
 	return b
 }
 
+func (pb *PackFileBackend) DeleteMetadata(name string) {
+	if _, ok := pb.metadataNames[name]; !ok {
+		log.Fatal("%s: metadata not found", name)
+	}
+	if ok, err := pb.commitMetadata(nil, map[string][]byte{name: nil}); ok {
+		log.CheckError(err)
+	} else {
+		// Remove the redundant copy last so that if this is interrupted,
+		// the metadata is still listed and can be deleted again.
+		pb.removeFile("metadata/" + name)
+		pb.removeFile(metadataCopyDir + name)
+	}
+	delete(pb.metadataNames, name)
+}
+
 func (pb *PackFileBackend) ListMetadata() map[string]time.Time {
 	return pb.metadataNames
 }
 
+func (pb *PackFileBackend) ForMetadata(prefix string,
+	f func(name string, created time.Time) error) error {
+	for name, created := range pb.metadataNames {
+		if strings.HasPrefix(name, prefix) {
+			if err := f(name, created); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (pb *PackFileBackend) MetadataExists(name string) bool {
 	_, ok := pb.metadataNames[name]
 	return ok
@@ -0,0 +1,286 @@
+// storage/plugin.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+// Storing files with an external helper program.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A plugin is a helper program that stores the repository's files, which
+// lets backends be written in any language. bk starts it with no
+// arguments (it inherits bk's environment, which can be used to configure
+// it) and makes requests on its standard input, one at a time, to which
+// it responds on its standard output; its standard error is passed
+// through. It should exit when its standard input is closed, which
+// happens when the Backend's Close method is called; a non-zero exit
+// status is reported as an error.
+//
+// Each request and response is a line of space-separated fields ending
+// with a newline. A request starts with the operation name and ends with
+// the name of the file, which is the rest of the line, as file names may
+// include spaces. Responses start with "ok", "notfound" if the file
+// doesn't exist, "exists" if it already does, or "error"; the rest of the
+// line after one of the last three is a message for the user. The
+// operations are:
+//
+//	hello <version>                 -> ok <version>
+//	create <length> <name>          -> ok
+//	read <offset> <length> <name>   -> ok <n>
+//	list <prefix>                   -> ok <count>
+//	remove <name>                   -> ok
+//
+// "hello" is sent first, with the protocol version, pluginVersion; the
+// helper responds with the version it implements, which must be the same.
+// "create" is followed by the file's contents, <length> bytes, and must
+// fail with "exists" if the file already exists; the file must not be
+// visible until all of its contents have been stored, and they must be
+// stored permanently once "ok" is sent. "read" returns <length> bytes of
+// the file starting at <offset>, or all of them after it if <length> is
+// 0, following the response line; fewer may be returned if the file ends
+// first. "list" is followed by <count> lines of the form "<time> <name>"
+// giving the files whose names start with <prefix> and their creation
+// times in seconds since the Unix epoch. Names use "/" as a separator,
+// e.g. "packs/pack-1234.pack".
+const pluginVersion = 1
+
+// As with GCS, files are buffered in memory before they're sent to the
+// helper.
+const maxPluginPackSize = 256 * 1024 * 1024
+
+func init() {
+	Register("plugin", func(location string) (Backend, error) {
+		return NewPlugin(strings.TrimPrefix(location, "plugin:"))
+	})
+}
+
+// pluginFileStorage implements the FileStorage interface using a helper
+// program.
+type pluginFileStorage struct {
+	path string
+	cmd  *exec.Cmd
+	// Held while a request is being made.
+	mu  sync.Mutex
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// NewPlugin returns a Backend that stores data using the helper program at
+// the given path, which is started immediately.
+func NewPlugin(path string) (Backend, error) {
+	p := &pluginFileStorage{path: path, cmd: exec.Command(path)}
+	p.cmd.Stderr = os.Stderr
+	in, err := p.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	p.in, p.out = in, bufio.NewReader(out)
+
+	fields, _, err := p.request(fmt.Sprintf("hello %d", pluginVersion), nil, 1, false)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if fields[0] != strconv.Itoa(pluginVersion) {
+		return nil, fmt.Errorf("%s: helper implements protocol version %s; expected %d",
+			path, fields[0], pluginVersion)
+	}
+	return newPackFileBackend(p, maxPluginPackSize), nil
+}
+
+func (p *pluginFileStorage) String() string {
+	return "plugin:" + p.path
+}
+
+// Close implements io.Closer, closing the helper's standard input and
+// waiting for it to exit.
+func (p *pluginFileStorage) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.in.Close(); err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+	if err := p.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+	return nil
+}
+
+// request sends the given request line followed by body, if it's
+// non-nil, and returns the nfields fields of the response line after
+// "ok". If readBody is true, the last field of the response gives the
+// length of the data that follows it, which is returned as well. Errors
+// reported by the helper are returned; problems communicating with it are
+// fatal.
+func (p *pluginFileStorage) request(line string, body []byte, nfields int,
+	readBody bool) ([]string, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := io.WriteString(p.in, line+"\n"); err != nil {
+		log.Fatal("%s: %s", p, err)
+	}
+	if body != nil {
+		if _, err := p.in.Write(body); err != nil {
+			log.Fatal("%s: %s", p, err)
+		}
+	}
+
+	resp, err := p.out.ReadString('\n')
+	if err != nil {
+		log.Fatal("%s: reading response to %q: %s", p, strings.Fields(line)[0], err)
+	}
+	fields := strings.SplitN(strings.TrimSuffix(resp, "\n"), " ", 2)
+	msg := ""
+	if len(fields) == 2 {
+		msg = fields[1]
+	}
+	switch fields[0] {
+	case "ok":
+	case "notfound":
+		return nil, nil, &os.PathError{Op: "plugin", Path: msg, Err: os.ErrNotExist}
+	case "exists":
+		return nil, nil, &os.PathError{Op: "plugin", Path: msg, Err: os.ErrExist}
+	case "error":
+		return nil, nil, errors.New(msg)
+	default:
+		log.Fatal("%s: unexpected response %q", p, resp)
+	}
+
+	fields = strings.Fields(msg)
+	if len(fields) != nfields {
+		log.Fatal("%s: unexpected response %q", p, resp)
+	}
+	if !readBody {
+		return fields, nil, nil
+	}
+	n, err := strconv.ParseInt(fields[nfields-1], 10, 64)
+	if err != nil || n < 0 {
+		log.Fatal("%s: unexpected response %q", p, resp)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(p.out, data); err != nil {
+		log.Fatal("%s: %s", p, err)
+	}
+	return fields, data, nil
+}
+
+func (p *pluginFileStorage) CreateFile(name string) RobustWriteCloser {
+	return &pluginWriter{name: name, p: p}
+}
+
+// pluginWriter implements RobustWriteCloser, buffering the file's
+// contents and sending them to the helper in its Close method.
+type pluginWriter struct {
+	buf  bytes.Buffer
+	name string
+	p    *pluginFileStorage
+}
+
+func (pw *pluginWriter) Write(b []byte) {
+	_, _ = pw.buf.Write(b)
+}
+
+func (pw *pluginWriter) Close() {
+	if err := pw.p.create(pw.name, pw.buf.Bytes()); err != nil {
+		log.Fatal("%s: %s", pw.name, err)
+	}
+}
+
+// CreateFileExclusive implements ExclusiveFileStorage; helpers never
+// replace existing files.
+func (p *pluginFileStorage) CreateFileExclusive(name string, contents []byte) error {
+	err := p.create(name, contents)
+	if err != nil && !os.IsExist(err) {
+		log.Fatal("%s: %s", name, err)
+	}
+	return err
+}
+
+func (p *pluginFileStorage) create(name string, contents []byte) error {
+	_, _, err := p.request(fmt.Sprintf("create %d %s", len(contents), name), contents, 0, false)
+	return err
+}
+
+func (p *pluginFileStorage) ReadFile(name string, offset, length int64) ([]byte, error) {
+	_, data, err := p.request(fmt.Sprintf("read %d %d %s", offset, length, name), nil, 1, true)
+	if err != nil {
+		return nil, err
+	}
+	if length > 0 && int64(len(data)) < length {
+		return nil, ErrPrematureEndOfData
+	}
+	return data, nil
+}
+
+func (p *pluginFileStorage) ForFiles(prefix string, f func(path string, created time.Time)) {
+	names, times := p.list(prefix)
+	for i := range names {
+		f(names[i], times[i])
+	}
+}
+
+// list returns the names of the files with the given prefix and their
+// creation times. The listing follows the response, so the lock is held
+// until it's been read.
+func (p *pluginFileStorage) list(prefix string) ([]string, []time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := io.WriteString(p.in, "list "+prefix+"\n"); err != nil {
+		log.Fatal("%s: %s", p, err)
+	}
+	line := func() string {
+		s, err := p.out.ReadString('\n')
+		if err != nil {
+			log.Fatal("%s: reading listing of %s: %s", p, prefix, err)
+		}
+		return strings.TrimSuffix(s, "\n")
+	}
+
+	resp := line()
+	var count int
+	if _, err := fmt.Sscanf(resp, "ok %d", &count); err != nil {
+		log.Fatal("%s: %s: unable to list files: %s", p, prefix, resp)
+	}
+	var names []string
+	var times []time.Time
+	for i := 0; i < count; i++ {
+		entry := line()
+		fields := strings.SplitN(entry, " ", 2)
+		t, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || len(fields) != 2 {
+			log.Fatal("%s: unexpected listing entry %q", p, entry)
+		}
+		names = append(names, fields[1])
+		times = append(times, time.Unix(t, 0))
+	}
+	return names, times
+}
+
+func (p *pluginFileStorage) Fsck(opts FsckOptions) bool {
+	return true
+}
+
+func (p *pluginFileStorage) RemoveFile(name string) error {
+	_, _, err := p.request("remove "+name, nil, 0, false)
+	return err
+}
@@ -0,0 +1,84 @@
+// storage/registry.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+// Finding the Backend for a repository given by a URL.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// BackendFactory returns the Backend for the repository at the given
+// location, a URL with the scheme that the factory was registered for,
+// e.g. "s3://bucket/path" or "plugin:/path/to/helper".
+type BackendFactory func(location string) (Backend, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]BackendFactory)
+)
+
+// Register makes the given factory available to Open for locations with
+// the given scheme, which is given without the ":". Packages that
+// implement backends typically call it from an init function, so that
+// programs that import them can use them. It panics if the scheme isn't
+// valid or has already been registered.
+func Register(scheme string, f BackendFactory) {
+	if f == nil {
+		panic("storage: Register factory is nil")
+	}
+	if !validScheme(scheme) {
+		panic(fmt.Sprintf("storage: %q: invalid scheme", scheme))
+	}
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, ok := factories[scheme]; ok {
+		panic(fmt.Sprintf("storage: Register called twice for %q", scheme))
+	}
+	factories[scheme] = f
+}
+
+// Open returns the Backend for the repository at the given location,
+// which is either a URL with a registered scheme or a path to a
+// directory in the local filesystem, which is opened with NewDisk.
+func Open(location string) (Backend, error) {
+	i := strings.Index(location, ":")
+	if i == -1 || !validScheme(location[:i]) {
+		return NewDisk(location), nil
+	}
+	scheme := location[:i]
+	factoriesMu.RLock()
+	f, ok := factories[scheme]
+	factoriesMu.RUnlock()
+	if ok {
+		return f(location)
+	}
+	if !strings.HasPrefix(location[i:], "://") {
+		// A path that happens to include a colon, e.g. on Windows,
+		// "C:\backups".
+		return NewDisk(location), nil
+	}
+	return nil, fmt.Errorf("%s: no storage backend is registered for the %q scheme",
+		location, scheme)
+}
+
+// validScheme reports whether the given string is a valid URL scheme, as
+// described in RFC 3986.
+func validScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -7,7 +7,11 @@ package storage
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
 )
 
 type MerkleHash struct {
@@ -41,15 +45,69 @@ func DecodeMerkleHash(r io.Reader) (sh MerkleHash) {
 }
 
 func (h *MerkleHash) NewReader(sem chan bool, backend Backend) io.ReadCloser {
+	return NewHashesReader(h.leafHashes(sem, backend), sem, backend)
+}
+
+// NewRangeReader returns an io.ReadCloser that supplies length bytes of
+// the data that the MerkleHash refers to, starting at the given offset.
+// If length is negative, all of the data after offset is returned. If
+// chunkSizes is non-nil, it must give the sizes of the chunks that the
+// data was split into (as can be found with SplitAndStoreChunks); then only
+// the chunks that overlap the range are read. Otherwise, all of the
+// chunks before the end of the range must be read to find it.
+func (h *MerkleHash) NewRangeReader(offset, length int64, chunkSizes []int64, sem chan bool,
+	backend Backend) (io.ReadCloser, error) {
+	hashes := h.leafHashes(sem, backend)
+	if chunkSizes != nil {
+		if len(chunkSizes) != len(hashes) {
+			return nil, fmt.Errorf("%d chunk sizes given for %d chunks",
+				len(chunkSizes), len(hashes))
+		}
+		// Skip the chunks that end before the range starts and drop the
+		// ones that start after it ends.
+		start := 0
+		for start < len(hashes) && offset >= chunkSizes[start] {
+			offset -= chunkSizes[start]
+			start++
+		}
+		end := start
+		for remaining := offset + length; end < len(hashes) && (length < 0 || remaining > 0); end++ {
+			remaining -= chunkSizes[end]
+		}
+		hashes = hashes[start:end]
+	}
+
+	r := NewHashesReader(hashes, sem, backend)
+	if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil && err != io.EOF {
+		r.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return r, nil
+	}
+	return rangeReader{io.LimitReader(r, length), r}, nil
+}
+
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// leafHashes returns the hashes of the chunks that store the data that
+// the MerkleHash refers to, reading the intermediate levels of the tree.
+func (h *MerkleHash) leafHashes(sem chan bool, backend Backend) []Hash {
 	hashes := []Hash{h.Hash}
 	for level := h.Level; level > 0; level-- {
 		r := NewHashesReader(hashes, sem, backend)
 		hashes = readHashes(r)
 		log.CheckError(r.Close())
 	}
-	return NewHashesReader(hashes, sem, backend)
+	return hashes
 }
 
+// Fsck makes sure that all of the blobs that make up the data that the
+// MerkleHash refers to are present in the backend. Only the blobs that
+// store hashes for the upper levels of the tree are read.
 func (h *MerkleHash) Fsck(backend Backend) {
 	hashes := []Hash{h.Hash}
 	for level := h.Level; level > 0; level-- {
@@ -62,6 +120,26 @@ func (h *MerkleHash) Fsck(backend Backend) {
 		hashes = readHashes(r)
 		log.CheckError(r.Close())
 	}
+	for _, hash := range hashes {
+		if !backend.HashExists(hash) {
+			log.Error("%s: hash not found in storage.", hash)
+		}
+	}
+}
+
+// AllHashes returns all of the hashes of the blobs that make up the data
+// that the MerkleHash refers to, including the ones that store the hashes
+// for the upper levels of the tree.
+func (h *MerkleHash) AllHashes(backend Backend) []Hash {
+	all := []Hash{h.Hash}
+	hashes := all
+	for level := h.Level; level > 0; level-- {
+		r := NewHashesReader(hashes, nil, backend)
+		hashes = readHashes(r)
+		log.CheckError(r.Close())
+		all = append(all, hashes...)
+	}
+	return all
 }
 
 func readHashes(r io.Reader) (hashes []Hash) {
@@ -82,6 +160,39 @@ func readHashes(r io.Reader) (hashes []Hash) {
 // of size (on average) 1<<splitBits.  Return the hash for the root of a Merkle
 // tree that identifies the data stored in the given storage backend.
 func SplitAndStore(r io.Reader, backend Backend, splitBits uint) MerkleHash {
+	return splitAndStore(r, backend, splitBits, nil)
+}
+
+// SplitAndStoreChunks is the same as SplitAndStore but also calls the given
+// function with a description of each of the chunks that the data is split
+// into, in order. It may be used to record their sizes, which allow
+// MerkleHash.NewRangeReader to only read the chunks that are needed.
+func SplitAndStoreChunks(r io.Reader, backend Backend, splitBits uint,
+	f func(chunk ChunkInfo)) MerkleHash {
+	return splitAndStore(r, backend, splitBits, f)
+}
+
+// ChunkInfo describes one of the chunks that SplitAndStoreChunks splits
+// data into.
+type ChunkInfo struct {
+	Size int64
+	// The chunk's contents, if it was small enough to be held in memory;
+	// otherwise, the hash of its contents.
+	data []byte
+	hash Hash
+}
+
+// Hash returns the hash of the chunk's contents, before any compression
+// or encryption. It may only be called before the function passed to
+// SplitAndStoreChunks returns.
+func (c ChunkInfo) Hash() Hash {
+	if int64(len(c.data)) == c.Size {
+		return HashBytes(c.data)
+	}
+	return c.hash
+}
+
+func splitAndStore(r io.Reader, backend Backend, splitBits uint, f func(chunk ChunkInfo)) MerkleHash {
 	// Wrap the reader with a buffered reader if it isn't buffered already
 	// (as is the case for, e.g. stdin).  This is required for decent
 	// performance in the the splitter code, which needs to process the
@@ -94,7 +205,14 @@ func SplitAndStore(r io.Reader, backend Backend, splitBits uint) MerkleHash {
 	// Put the bits from the reader in storage and get the hashes that
 	// reconstruct them.
 	hs := NewHashSplitter(splitBits)
-	hashes := splitAndStoreMerkleTree(br, backend, hs)
+	hashes := splitAndStoreMerkleTree(br, backend, hs, f)
+	if len(hashes) == 0 {
+		// Empty input is stored as a single empty chunk.
+		if f != nil {
+			f(ChunkInfo{})
+		}
+		hashes = []Hash{backend.Write([]byte{})}
+	}
 
 	// Now, continue to split and store the hash bytes until we're down to
 	// a single hash; that's the final identifier for the provided bits
@@ -112,20 +230,114 @@ func SplitAndStore(r io.Reader, backend Backend, splitBits uint) MerkleHash {
 		}
 
 		hs.Reset()
-		hashes = splitAndStoreMerkleTree(bytes.NewBuffer(buf), backend, hs)
+		hashes = splitAndStoreMerkleTree(bytes.NewBuffer(buf), backend, hs, nil)
 	}
 }
 
-func splitAndStoreMerkleTree(r io.ByteReader, backend Backend, hs *HashSplitter) (hashes []Hash) {
-	for {
-		// Get the next blob of data from the input stream.
-		blob := hs.SplitFromReader(r)
-		if len(blob) == 0 {
-			return // done
+// StoreParallelism gives the number of goroutines that SplitAndStore uses
+// to store chunks concurrently. Hashing chunks (and compressing and
+// encrypting them, with backends that do so) is much more expensive than
+// splitting the data, so doing that work in parallel prevents large files
+// from being limited by the performance of a single core.
+var StoreParallelism = runtime.NumCPU()
+
+// splitChunk is a chunk of the data being stored by
+// splitAndStoreMerkleTree. Chunks that are too large to hold in memory are
+// stored as they're split; they have a non-nil hash and no data.
+type splitChunk struct {
+	data []byte
+	hash *Hash
+}
+
+// splitAndStoreMerkleTree stores the chunks of the data from r and
+// returns their hashes. If f is non-nil, it's called with each chunk.
+func splitAndStoreMerkleTree(r io.ByteReader, backend Backend, hs *HashSplitter,
+	f func(chunk ChunkInfo)) []Hash {
+	// Get the next blob of data from the input stream. Ones that grow
+	// past maxSpoolMemory are passed to WriteBlobStream as the rest of
+	// them is split, which happens here so that the input is read in
+	// order.
+	nextBlob := func() (c splitChunk, ok bool) {
+		blob, more := hs.splitFromReader(r, maxSpoolMemory)
+		info := ChunkInfo{Size: int64(len(blob)), data: blob}
+		c.data = blob
+		if more {
+			cr := &chunkReader{r: r, hs: hs}
+			hasher := NewHasher()
+			h, err := backend.WriteBlobStream(io.TeeReader(io.MultiReader(bytes.NewReader(blob),
+				cr), hasher))
+			log.CheckError(err)
+			info = ChunkInfo{Size: int64(len(blob)) + cr.n, hash: hasher.Sum()}
+			c = splitChunk{hash: &h}
 		}
-		hashes = append(hashes, backend.Write(blob))
 		hs.Reset()
+		if f != nil && info.Size > 0 {
+			f(info)
+		}
+		return c, info.Size > 0
+	}
+	store := func(c splitChunk) Hash {
+		if c.hash != nil {
+			return *c.hash
+		}
+		return backend.Write(c.data)
+	}
+
+	blob, ok := nextBlob()
+	if !ok {
+		return nil
+	}
+	next, nextOk := nextBlob()
+	if !nextOk || StoreParallelism <= 1 {
+		// Don't bother with goroutines for inputs that are a single chunk,
+		// which is the common case for small files.
+		hashes := []Hash{store(blob)}
+		for ; nextOk; next, nextOk = nextBlob() {
+			hashes = append(hashes, store(next))
+		}
+		return hashes
+	}
+
+	// Otherwise, split the input here and have worker goroutines store
+	// the chunks. Each chunk is sent along with a pointer to the Hash to
+	// be filled in so that the hashes end up in the correct order.
+	type storeJob struct {
+		blob []byte
+		hash *Hash
+	}
+	jobs := make(chan storeJob, StoreParallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < StoreParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			for j := range jobs {
+				*j.hash = backend.Write(j.blob)
+			}
+			wg.Done()
+		}()
+	}
+
+	var results []*Hash
+	for ok {
+		if blob.hash != nil {
+			// It's already been stored.
+			results = append(results, blob.hash)
+		} else {
+			h := new(Hash)
+			results = append(results, h)
+			jobs <- storeJob{blob.data, h}
+		}
+		blob, ok = next, nextOk
+		next, nextOk = nextBlob()
+	}
+	close(jobs)
+	wg.Wait()
+
+	hashes := make([]Hash, len(results))
+	for i, h := range results {
+		hashes[i] = *h
 	}
+	return hashes
 }
 
 ///////////////////////////////////////////////////////////////////////////
@@ -184,8 +396,37 @@ func (hs *HashSplitter) SplitNow() bool {
 	return (digest & uint32(splitSize-1)) == uint32(splitSize-1)
 }
 
-func (hs *HashSplitter) SplitFromReader(reader io.ByteReader) (ret []byte) {
+// ChunkBoundaryReader is implemented by readers that know where the
+// logical units in their data start (e.g., the files in a tar archive).
+// Chunks always end at those boundaries, so that inserting or removing
+// one doesn't change how the data after it is split.
+type ChunkBoundaryReader interface {
+	io.ByteReader
+	// AtBoundary reports whether the next byte to be read starts a new
+	// logical unit.
+	AtBoundary() bool
+}
+
+// SplitFromReader returns the next chunk of data from reader, ending it
+// when the rolling checksum says to, at the end of the data, or, if reader
+// is a ChunkBoundaryReader, at the next boundary.
+func (hs *HashSplitter) SplitFromReader(reader io.ByteReader) []byte {
+	ret, _ := hs.splitFromReader(reader, -1)
+	return ret
+}
+
+// splitFromReader is like SplitFromReader, but if limit is non-negative it
+// stops after that many bytes, returning true if the chunk hasn't ended.
+// The rest of it can then be read with a chunkReader.
+func (hs *HashSplitter) splitFromReader(reader io.ByteReader, limit int) (ret []byte, more bool) {
+	br, _ := reader.(ChunkBoundaryReader)
 	for {
+		if br != nil && len(ret) > 0 && br.AtBoundary() {
+			return
+		}
+		if len(ret) == limit {
+			return ret, true
+		}
 		add, err := reader.ReadByte()
 		if err == io.EOF {
 			return
@@ -199,3 +440,38 @@ func (hs *HashSplitter) SplitFromReader(reader io.ByteReader) (ret []byte) {
 		}
 	}
 }
+
+// chunkReader supplies the rest of a chunk that splitFromReader stopped at
+// its limit, continuing to split the data with the same HashSplitter.
+type chunkReader struct {
+	r    io.ByteReader
+	hs   *HashSplitter
+	n    int64
+	done bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	br, _ := c.r.(ChunkBoundaryReader)
+	n := 0
+	for ; n < len(p) && !c.done; n++ {
+		if br != nil && br.AtBoundary() {
+			c.done = true
+			break
+		}
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			c.done = true
+			break
+		}
+		log.CheckError(err)
+
+		c.hs.AddByte(b)
+		p[n] = b
+		c.done = c.hs.SplitNow()
+	}
+	c.n += int64(n)
+	if n == 0 && c.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
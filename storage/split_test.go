@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"sync"
@@ -158,3 +159,229 @@ func testByteChange(t *testing.T, borig []byte, sb int, seed int64) {
 		t.Errorf("bits %d: Total of %d > 2 hashes", sb, totalExtra)
 	}
 }
+
+func TestSplitAndStoreParallel(t *testing.T) {
+	b := make([]byte, 4*1024*1024)
+	rand.Read(b)
+
+	saved := StoreParallelism
+	defer func() { StoreParallelism = saved }()
+
+	// The result should be the same regardless of how many goroutines are
+	// used to store the chunks.
+	StoreParallelism = 1
+	serialBackend := NewMemory()
+	serial := SplitAndStore(bytes.NewReader(b), serialBackend, 12)
+
+	StoreParallelism = 8
+	parallelBackend := NewMemory()
+	parallel := SplitAndStore(bytes.NewReader(b), parallelBackend, 12)
+
+	if serial != parallel {
+		t.Errorf("serial hash %+v != parallel hash %+v", serial, parallel)
+	}
+
+	r := parallel.NewReader(nil, parallelBackend)
+	rb, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if bytes.Compare(b, rb) != 0 {
+		t.Errorf("didn't get same bytes back")
+	}
+}
+
+func TestAllHashes(t *testing.T) {
+	b := make([]byte, 4*1024*1024)
+	rand.Read(b)
+
+	backend := NewMemory()
+	mh := SplitAndStore(bytes.NewReader(b), backend, 12)
+	if mh.Level == 0 {
+		t.Fatalf("expected a multi-level tree")
+	}
+
+	// Everything in the backend came from this SplitAndStore call, so
+	// AllHashes should return all of it.
+	all := mh.AllHashes(backend)
+	if len(all) != len(backend.Hashes()) {
+		t.Errorf("AllHashes returned %d hashes; backend has %d", len(all),
+			len(backend.Hashes()))
+	}
+	var size int64
+	for _, h := range all {
+		n, err := backend.BlobSize(h)
+		if err != nil {
+			t.Fatalf("%s: %v", h, err)
+		}
+		size += n
+	}
+	if size != backend.Stats().BytesStored {
+		t.Errorf("blob sizes sum to %d; %d stored", size,
+			backend.Stats().BytesStored)
+	}
+}
+
+// boundaryReader reports boundaries at fixed offsets.
+type boundaryReader struct {
+	r          *bytes.Reader
+	offset     int
+	boundaries map[int]bool
+}
+
+func (b *boundaryReader) ReadByte() (byte, error) {
+	c, err := b.r.ReadByte()
+	if err == nil {
+		b.offset++
+	}
+	return c, err
+}
+
+func (b *boundaryReader) AtBoundary() bool {
+	return b.boundaries[b.offset]
+}
+
+func TestSplitAtBoundaries(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	boundaries := map[int]bool{1000: true, 1001: true, 300000: true, 700000: true}
+
+	hs := NewHashSplitter(14)
+	r := &boundaryReader{r: bytes.NewReader(data), boundaries: boundaries}
+	var split []byte
+	ends := make(map[int]bool)
+	for {
+		chunk := hs.SplitFromReader(r)
+		if len(chunk) == 0 {
+			break
+		}
+		split = append(split, chunk...)
+		ends[len(split)] = true
+		hs.Reset()
+	}
+	if !bytes.Equal(split, data) {
+		t.Fatalf("split data doesn't match the original")
+	}
+	// Every boundary must end a chunk, though chunks may end elsewhere,
+	// too.
+	for b := range boundaries {
+		if !ends[b] {
+			t.Errorf("no chunk ended at boundary %d", b)
+		}
+	}
+}
+
+func TestRangeReader(t *testing.T) {
+	b := make([]byte, 4*1024*1024)
+	rand.Read(b)
+
+	backend := NewMemory()
+	var sizes []int64
+	mh := SplitAndStoreChunks(bytes.NewReader(b), backend, 12, func(chunk ChunkInfo) {
+		sizes = append(sizes, chunk.Size)
+	})
+	var total int64
+	for _, s := range sizes {
+		total += s
+	}
+	if total != int64(len(b)) {
+		t.Fatalf("chunk sizes sum to %d; expected %d", total, len(b))
+	}
+
+	ranges := [][2]int64{{0, 1}, {0, -1}, {12345, 100000}, {1000000, -1},
+		{int64(len(b)) - 10, 100}, {int64(len(b)), 10}, {sizes[0], sizes[1]}}
+	for _, rg := range ranges {
+		offset, length := rg[0], rg[1]
+		end := int64(len(b))
+		if length >= 0 && offset+length < end {
+			end = offset + length
+		}
+		if offset > end {
+			end = offset
+		}
+		expected := b[offset:end]
+
+		for _, cs := range [][]int64{sizes, nil} {
+			reads := backend.Stats().NumReads
+			r, err := mh.NewRangeReader(offset, length, cs, nil, backend)
+			if err != nil {
+				t.Fatalf("%d+%d: %v", offset, length, err)
+			}
+			rb, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%d+%d: read: %v", offset, length, err)
+			}
+			r.Close()
+			if !bytes.Equal(rb, expected) {
+				t.Errorf("%d+%d: got %d bytes that don't match the expected %d",
+					offset, length, len(rb), len(expected))
+			}
+			if cs != nil && length >= 0 && length < 200000 {
+				// Besides the tree's upper levels, only a few chunks
+				// should have been read.
+				if n := backend.Stats().NumReads - reads; n > int64(mh.Level)+60 {
+					t.Errorf("%d+%d: %d reads for a small range", offset, length, n)
+				}
+			}
+		}
+	}
+
+	if _, err := mh.NewRangeReader(0, 1, sizes[1:], nil, backend); err == nil {
+		t.Errorf("expected an error with the wrong number of chunk sizes")
+	}
+}
+
+func TestSplitAndStoreEmpty(t *testing.T) {
+	backend := NewMemory()
+	var sizes []int64
+	mh := SplitAndStoreChunks(bytes.NewReader(nil), backend, 12, func(chunk ChunkInfo) {
+		sizes = append(sizes, chunk.Size)
+	})
+	if len(sizes) != 1 || sizes[0] != 0 {
+		t.Errorf("expected a single empty chunk; got sizes %v", sizes)
+	}
+
+	r := mh.NewReader(nil, backend)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(b) != 0 {
+		t.Errorf("read %d bytes from empty data", len(b))
+	}
+}
+
+// Chunks that grow past maxSpoolMemory, as runs of zeros do, are streamed
+// to and from the backend rather than being held in memory.
+func TestSplitAndStoreLargeChunk(t *testing.T) {
+	b := make([]byte, 3*maxSpoolMemory)
+	rand.Read(b[:1024*1024])
+	rand.Read(b[len(b)-1024*1024:])
+
+	for _, backend := range []Backend{NewMemory(), NewCompressed(NewMemory())} {
+		var offset int64
+		large := false
+		mh := SplitAndStoreChunks(bytes.NewReader(b), backend, 12, func(chunk ChunkInfo) {
+			if chunk.Hash() != HashBytes(b[offset:offset+chunk.Size]) {
+				t.Errorf("chunk at %d: hash mismatch", offset)
+			}
+			offset += chunk.Size
+			large = large || chunk.Size > maxSpoolMemory
+		})
+		if offset != int64(len(b)) {
+			t.Errorf("chunk sizes sum to %d; expected %d", offset, len(b))
+		}
+		if !large {
+			t.Errorf("no chunks larger than %d bytes", maxSpoolMemory)
+		}
+
+		r := mh.NewReader(nil, backend)
+		rb, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !bytes.Equal(b, rb) {
+			t.Errorf("read %d bytes that differ from the %d stored", len(rb), len(b))
+		}
+	}
+}
@@ -5,13 +5,18 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	u "github.com/mmp/bk/util"
 	"golang.org/x/crypto/sha3"
+	"hash"
 	"io"
 	"io/ioutil"
-	"os"
+	"lukechampine.com/blake3"
+	"sort"
 	"time"
 )
 
@@ -21,6 +26,9 @@ var (
 	ErrIndexMagicWrong    = errors.New("index entry has incorrect magic number")
 	ErrBlobMagicWrong     = errors.New("blob has incorrect magic number")
 	ErrPrematureEndOfData = errors.New("premature end of data")
+	ErrMetadataExists     = errors.New("metadata already exists")
+	ErrMetadataChanged    = errors.New("metadata has changed")
+	ErrReplaceUnsupported = errors.New("metadata can't be replaced in this storage")
 )
 
 ///////////////////////////////////////////////////////////////////////////
@@ -39,7 +47,8 @@ func SetLogger(l *u.Logger) {
 // represent chunks of data.
 const HashSize = 32
 
-// Hash encodes a fixed-size secure hash of a collection of bytes.
+// Hash encodes a fixed-size secure hash of a collection of bytes, computed
+// with the repository's hash algorithm; see SetHashAlgorithm.
 type Hash [HashSize]byte
 
 func NewHash(b []byte) (h Hash) {
@@ -48,11 +57,92 @@ func NewHash(b []byte) (h Hash) {
 	return h
 }
 
-// HashBytes computes the SHAKE256 hash of the given byte slice.
+// DefaultHashAlgorithm is the name of the hash algorithm used by HashBytes
+// unless another one is selected with SetHashAlgorithm.
+const DefaultHashAlgorithm = "shake256"
+
+// hashAlgorithms maps from the names of the supported hash algorithms to
+// functions that compute them.
+var hashAlgorithms = map[string]func(b []byte) Hash{
+	"shake256": func(b []byte) (h Hash) {
+		sha3.ShakeSum256(h[:], b)
+		return
+	},
+	"sha256": func(b []byte) Hash { return sha256.Sum256(b) },
+	"blake3": func(b []byte) Hash { return blake3.Sum256(b) },
+}
+
+// hasherAlgorithms maps from the names of the supported hash algorithms
+// to functions that return a Hasher that computes them incrementally.
+var hasherAlgorithms = map[string]func() Hasher{
+	"shake256": func() Hasher { return shakeHasher{sha3.NewShake256()} },
+	"sha256":   func() Hasher { return stdHasher{sha256.New()} },
+	"blake3":   func() Hasher { return stdHasher{blake3.New(HashSize, nil)} },
+}
+
+var hashFunc = hashAlgorithms[DefaultHashAlgorithm]
+var newHasherFunc = hasherAlgorithms[DefaultHashAlgorithm]
+
+// SetHashAlgorithm selects the hash algorithm used by HashBytes. It must
+// be called before any chunks are stored or read; the repository's base
+// Backend may be created first so that RepositoryHashAlgorithm can find
+// the algorithm it uses. All of the data stored in a repository must use
+// the same algorithm.
+func SetHashAlgorithm(name string) error {
+	f, ok := hashAlgorithms[name]
+	if !ok {
+		return fmt.Errorf("%s: unknown hash algorithm", name)
+	}
+	hashFunc = f
+	newHasherFunc = hasherAlgorithms[name]
+	return nil
+}
+
+// HashAlgorithms returns the names of the supported hash algorithms.
+func HashAlgorithms() []string {
+	var names []string
+	for n := range hashAlgorithms {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HashBytes computes the hash of the given byte slice using the
+// algorithm given to SetHashAlgorithm (SHAKE256 by default).
 func HashBytes(b []byte) Hash {
-	var h Hash
-	sha3.ShakeSum256(h[:], b)
-	return h
+	return hashFunc(b)
+}
+
+// Hasher computes the hash of a stream of bytes; after all of them have
+// been written, Sum returns the same Hash that HashBytes would for them.
+type Hasher interface {
+	io.Writer
+	Sum() Hash
+}
+
+// NewHasher returns a Hasher that uses the algorithm given to
+// SetHashAlgorithm.
+func NewHasher() Hasher {
+	return newHasherFunc()
+}
+
+type shakeHasher struct {
+	sha3.ShakeHash
+}
+
+func (s shakeHasher) Sum() (h Hash) {
+	s.ShakeHash.Read(h[:])
+	return
+}
+
+type stdHasher struct {
+	hash.Hash
+}
+
+func (s stdHasher) Sum() (h Hash) {
+	copy(h[:], s.Hash.Sum(nil))
+	return
 }
 
 // String returns the given Hash as a hexidecimal-encoded string.
@@ -80,26 +170,50 @@ type Backend interface {
 	// during the course of its operation.
 	LogStats()
 
+	// Stats returns the statistics that the Backend has gathered during
+	// the course of its operation.
+	Stats() Stats
+
 	// Fsck checks the consistency of the data in the Backend and reports
 	// any problems found via the logger specified by SetLogger.
-	Fsck()
+	Fsck(opts FsckOptions)
 
 	// Write saves the provided chunk of data to storage, returning a Hash
 	// that uniquely identifies it. Any write errors are fatal and
-	// terminate the program.
+	// terminate the program. Write may be called concurrently from
+	// multiple goroutines, though not concurrently with SyncWrites.
 	Write(chunk []byte) Hash
 
 	// SyncWrites ensures that all chunks of data provided to Write have
-	// in fact reached permanent storage. Calls to Read may not find
-	// data stored by Write if SyncWrites hasn't been called after the
-	// call to Write.
+	// in fact reached permanent storage, where they'll survive a crash
+	// or loss of power (though see SetFastSync). Calls to Read may not
+	// find data stored by Write if SyncWrites hasn't been called after
+	// the call to Write.
 	SyncWrites()
 
 	// Read returns a io.ReadCloser that provides the chunk for the given
 	// hash. If the given hash doesn't exist in the backend, an error is
-	// returned.
+	// returned. Backends that store chunks themselves check that the
+	// hash of the chunk's contents matches the given hash and return
+	// ErrHashMismatch if it doesn't.
 	Read(hash Hash) (io.ReadCloser, error)
 
+	// WriteBlobStream is like Write, but it reads the chunk from the
+	// given io.Reader, so that large chunks don't need to be held in
+	// memory. Since a chunk's hash and size aren't known until all of it
+	// has been read, large chunks are spooled to a temporary file before
+	// they're stored. An error is returned if reading from r fails, in
+	// which case nothing is stored; other errors are fatal.
+	WriteBlobStream(r io.Reader) (Hash, error)
+
+	// ReadBlobStream is like Read, but the chunk is returned as it's read
+	// from storage rather than being read and checked in full first; if
+	// its hash doesn't match, the returned io.ReadCloser's Read method
+	// returns ErrHashMismatch instead of io.EOF at the end. Callers thus
+	// shouldn't trust any of the data until io.EOF has been returned.
+	// Unlike Read, damaged pack files aren't repaired.
+	ReadBlobStream(hash Hash) (io.ReadCloser, error)
+
 	// HashExists reports whether a blob of data with the given hash exists
 	// in the storage backend.
 	HashExists(hash Hash) bool
@@ -108,12 +222,35 @@ type Backend interface {
 	// storage backend.
 	Hashes() map[Hash]struct{}
 
+	// BlobSize returns the number of bytes of storage used by the blob
+	// with the given hash, after any compression and encryption. If the
+	// hash doesn't exist in the backend, an error is returned.
+	BlobSize(hash Hash) (int64, error)
+
 	// WriteMetadata saves the given data in the storage backend,
 	// associating it with the given name. It's mostly used for storing
 	// data that we don't want to run through the dedupe process and want
 	// to be able to easily access directly by name.
 	WriteMetadata(name string, data []byte)
 
+	// CreateMetadata is like WriteMetadata, except that it returns
+	// ErrMetadataExists, rather than failing, if there's already metadata
+	// with the given name, including metadata written by another process
+	// since the Backend was created. If the underlying storage supports
+	// it (see ExclusiveFileStorage), this is atomic, so that if two
+	// processes create metadata with the same name at the same time,
+	// exactly one of them succeeds.
+	CreateMetadata(name string, data []byte) error
+
+	// ReplaceMetadata replaces the existing metadata with the given name,
+	// which must have had the contents old when it was read, with data.
+	// If it has been changed or removed in storage since then (e.g., by
+	// another process replacing it as well), ErrMetadataChanged is
+	// returned and nothing is changed. The replacement is atomic; if the
+	// underlying storage can't do that (see ConditionalFileStorage),
+	// ErrReplaceUnsupported is returned instead.
+	ReplaceMetadata(name string, old, data []byte) error
+
 	// ReadMetadata returns the metadata for a given name that was stored
 	// with WriteMetadata.
 	ReadMetadata(name string) []byte
@@ -122,21 +259,95 @@ type Backend interface {
 	// present in the storage backend.
 	MetadataExists(name string) bool
 
+	// WriteMetadataBatch, ReadMetadataBatch, and MetadataExistsBatch are
+	// equivalent to calling WriteMetadata, ReadMetadata, or
+	// MetadataExists, respectively, for each of the given names, but they
+	// allow backends to coalesce or overlap the individual requests,
+	// which is much faster with cloud storage when there are many small
+	// pieces of metadata to handle.
+	WriteMetadataBatch(metadata map[string][]byte)
+	ReadMetadataBatch(names []string) map[string][]byte
+	MetadataExistsBatch(names []string) map[string]bool
+
 	// ListMetadata returns a map from all of the existing metadata
 	// to the time each one was created.
 	ListMetadata() map[string]time.Time
+
+	// ForMetadata calls the given function with the name and creation
+	// time of each piece of existing metadata whose name starts with the
+	// given prefix, in no particular order. Callers that only need some
+	// of the metadata can use it rather than going through all of
+	// ListMetadata, though Backends still keep the names of all of the
+	// metadata in memory. If f returns a non-nil error, ForMetadata stops
+	// and returns it. f must not write or delete metadata.
+	ForMetadata(prefix string, f func(name string, created time.Time) error) error
+
+	// DeleteMetadata removes the metadata with the given name. Metadata
+	// is otherwise never changed once it's been written; this is only
+	// for removing old names of metadata that has been renamed and the
+	// like, after the new versions have been written and synced.
+	DeleteMetadata(name string)
 }
 
-///////////////////////////////////////////////////////////////////////////
-// Some utility stuff
+// FsckOptions controls the checks performed by Backend.Fsck.
+type FsckOptions struct {
+	// If true, only the backend's indices and the existence of the files
+	// that store blobs are checked; blobs' contents aren't read and
+	// verified. This is much cheaper with cloud storage, where reads cost
+	// money.
+	MetadataOnly bool
+
+	// If SubsetCount is greater than one, the repository's data is
+	// divided into SubsetCount slices and only the contents of the
+	// SubsetIndex'th one (counting from 1) are read and verified. As long
+	// as the data stored doesn't change, checking each of the slices in
+	// turn covers all of it.
+	SubsetIndex, SubsetCount int
+
+	// Maximum number of blobs to read and verify concurrently; values
+	// less than one are taken to be one.
+	Jobs int
+
+	// If true, storage that keeps redundant encodings of its files (e.g.,
+	// the disk backend's Reed-Solomon codes) uses them to repair any
+	// corrupted files that are found rather than just reporting them.
+	Repair bool
+}
 
-func errorIfExists(path string) {
-	_, err := os.Stat(path)
-	if err == nil {
-		log.Fatal(path + ": file exists")
+// InSubset reports whether the item identified by the given hash is in the
+// subset of the data to be checked.
+func (opts FsckOptions) InSubset(hash Hash) bool {
+	if opts.SubsetCount <= 1 {
+		return true
 	}
+	return int(binary.BigEndian.Uint64(hash[:8])%uint64(opts.SubsetCount)) ==
+		opts.SubsetIndex-1
 }
 
+// FileInSubset reports whether the file with the given name is in the
+// subset of the data to be checked.
+func (opts FsckOptions) FileInSubset(name string) bool {
+	return opts.InSubset(HashBytes([]byte(name)))
+}
+
+// Stats summarizes the work done by a Backend. Backends that wrap other
+// Backends report the number of bytes and chunks that were passed to their
+// own Write method but take the rest from the underlying Backend, so the
+// stats of the outermost Backend give the overall picture.
+type Stats struct {
+	// Number of chunks and bytes passed to Write, including ones that
+	// were already present in storage.
+	ChunksWritten, BytesWritten int64
+	// Number of chunks and bytes that were actually added to storage,
+	// after deduplication, compression, and encryption.
+	ChunksStored, BytesStored int64
+	// Number of reads from storage and the total bytes read.
+	NumReads, BytesRead int64
+}
+
+///////////////////////////////////////////////////////////////////////////
+// Some utility stuff
+
 type readerAndCloser struct {
 	io.Reader
 	io.Closer
@@ -152,7 +363,7 @@ type readerAndCloser struct {
 func NewHashesReader(hashes []Hash, sem chan bool, backend Backend) io.ReadCloser {
 	// If it's just one hash, don't do anything fancy.
 	if len(hashes) == 1 {
-		r, err := backend.Read(hashes[0])
+		r, err := openChunk(backend, hashes[0])
 		log.CheckError(err, "%s: %s", hashes[0], err)
 		return r
 	}
@@ -165,7 +376,7 @@ func NewHashesReader(hashes []Hash, sem chan bool, backend Backend) io.ReadClose
 
 	cin := make(chan hashIndex, len(hashes))
 	r := &parallelReader{
-		m:        make(map[int][]byte),
+		m:        make(map[int]indexData),
 		maxIndex: len(hashes),
 		cout:     make(chan indexData, 4)}
 
@@ -191,10 +402,10 @@ func NewHashesReader(hashes []Hash, sem chan bool, backend Backend) io.ReadClose
 }
 
 type parallelReader struct {
-	// Hash indices to []bytes. The map stores bytes for hashes that we've
-	// gotten from the readers, including ones that we're not ready
+	// Hash indices to chunks' data. The map stores data for hashes that
+	// we've gotten from the readers, including ones that we're not ready
 	// to return yet since we don't have the predecessors yet.
-	m map[int][]byte
+	m map[int]indexData
 	// Hash index to return the bytes for before going to the next one.
 	index    int
 	maxIndex int
@@ -207,9 +418,14 @@ type hashIndex struct {
 	index int
 }
 
+// indexData holds a chunk that a preader has read. For chunks larger than
+// maxSpoolMemory, data only has the start of it and the rest is read from
+// rest.
 type indexData struct {
 	index int
+	hash  Hash
 	data  []byte
+	rest  io.ReadCloser
 }
 
 func preader(backend Backend, sem chan bool, cin chan hashIndex,
@@ -231,11 +447,10 @@ func preader(backend Backend, sem chan bool, cin chan hashIndex,
 			return
 		}
 
-		r, err := backend.Read(hi.hash)
-		log.CheckError(err)
-		data, err := ioutil.ReadAll(r)
-		log.CheckError(err)
-		log.CheckError(r.Close())
+		r, err := openChunk(backend, hi.hash)
+		log.CheckError(err, "%s: %s", hi.hash, err)
+		data, rest, err := readChunk(r)
+		log.CheckError(err, "%s: %s", hi.hash, err)
 
 		if sem != nil {
 			// Let someone else read.
@@ -243,7 +458,7 @@ func preader(backend Backend, sem chan bool, cin chan hashIndex,
 		}
 
 		// Send the result out on the result chan.
-		cout <- indexData{hi.index, data}
+		cout <- indexData{hi.index, hi.hash, data, rest}
 	}
 }
 
@@ -260,15 +475,29 @@ func (r *parallelReader) Read(buf []byte) (int, error) {
 		id := <-r.cout
 		// What we got may or may not be the one we're waiting for; record
 		// it in the map and go 'round again.
-		r.m[id.index] = id.data
+		r.m[id.index] = id
 		// Try again
 		return r.Read(buf)
+	} else if len(chunk.data) == 0 && chunk.rest != nil {
+		// The rest of a large chunk is read as it's needed.
+		n, err := chunk.rest.Read(buf)
+		if err == io.EOF {
+			err = chunk.rest.Close()
+			chunk.rest = nil
+			r.m[r.index] = chunk
+		}
+		log.CheckError(err, "%s: %s", chunk.hash, err)
+		if n == 0 {
+			return r.Read(buf)
+		}
+		return n, nil
 	} else {
 		// We have bytes for the current index; return some to the caller.
-		n := copy(buf, chunk)
-		if n < len(chunk) {
+		n := copy(buf, chunk.data)
+		if n < len(chunk.data) || chunk.rest != nil {
 			// More left for the next Read() call.
-			r.m[r.index] = chunk[n:]
+			chunk.data = chunk.data[n:]
+			r.m[r.index] = chunk
 		} else {
 			// Done with this index; move to the next.
 			delete(r.m, r.index)
@@ -5,12 +5,27 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	u "github.com/mmp/bk/util"
+	"golang.org/x/crypto/pbkdf2"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSimple(t *testing.T) {
@@ -92,6 +107,163 @@ func TestMetadata(t *testing.T) {
 	}
 }
 
+func TestMetadataBatch(t *testing.T) {
+	for _, backend := range getStorage(t) {
+		md := make(map[string][]byte)
+		var names []string
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("batch-%d", i)
+			md[name] = []byte(fmt.Sprintf("contents %d", i))
+			names = append(names, name)
+		}
+		backend.WriteMetadataBatch(md)
+		backend.SyncWrites()
+
+		exists := backend.MetadataExistsBatch(append(names, "missing"))
+		if len(exists) != len(names)+1 || exists["missing"] {
+			t.Errorf("%s: unexpected existence results %v", backend, exists)
+		}
+		contents := backend.ReadMetadataBatch(names)
+		for _, name := range names {
+			if !exists[name] {
+				t.Errorf("%s: %s: metadata not found", backend, name)
+			}
+			if b := contents[name]; !bytes.Equal(b, md[name]) {
+				t.Errorf("%s: %s: got %q, expected %q", backend, name, b, md[name])
+			}
+			if string(backend.ReadMetadata(name)) != string(md[name]) {
+				t.Errorf("%s: %s: unexpected metadata value", backend, name)
+			}
+		}
+	}
+}
+
+func TestDeleteMetadata(t *testing.T) {
+	for _, backend := range getStorage(t) {
+		backend.WriteMetadata("blurp", []byte("hello"))
+		backend.WriteMetadata("flurg", []byte("world"))
+		backend.SyncWrites()
+
+		backend.DeleteMetadata("blurp")
+		if backend.MetadataExists("blurp") {
+			t.Errorf("%s: deleted metadata still exists", backend)
+		}
+		if _, ok := backend.ListMetadata()["blurp"]; ok {
+			t.Errorf("%s: deleted metadata still listed", backend)
+		}
+		if string(backend.ReadMetadata("flurg")) != "world" {
+			t.Errorf("%s: unexpected metadata value", backend)
+		}
+
+		// It should be possible to reuse the name.
+		backend.WriteMetadata("blurp", []byte("again"))
+		if string(backend.ReadMetadata("blurp")) != "again" {
+			t.Errorf("%s: unexpected metadata value", backend)
+		}
+	}
+}
+
+func TestForMetadata(t *testing.T) {
+	for _, backend := range getStorage(t) {
+		for _, name := range []string{"for-a", "for-b", "other"} {
+			backend.WriteMetadata(name, []byte(name))
+		}
+		backend.SyncWrites()
+
+		found := make(map[string]bool)
+		err := backend.ForMetadata("for-", func(name string, created time.Time) error {
+			if time.Since(created) > time.Hour {
+				t.Errorf("%s: %s: unexpected creation time %s", backend, name, created)
+			}
+			found[name] = true
+			return nil
+		})
+		if err != nil || len(found) != 2 || !found["for-a"] || !found["for-b"] {
+			t.Errorf("%s: found %v (%v); expected for-a and for-b", backend, found, err)
+		}
+
+		calls := 0
+		stop := fmt.Errorf("stop")
+		err = backend.ForMetadata("", func(name string, created time.Time) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Errorf("%s: got %v after %d calls; expected iteration to stop", backend, err, calls)
+		}
+	}
+}
+
+func TestCreateMetadata(t *testing.T) {
+	for _, backend := range getStorage(t) {
+		if err := backend.CreateMetadata("blurp", []byte("hello")); err != nil {
+			t.Errorf("%s: %s", backend, err)
+		}
+		if err := backend.CreateMetadata("blurp", []byte("again")); err != ErrMetadataExists {
+			t.Errorf("%s: got %v creating existing metadata", backend, err)
+		}
+		if err := backend.ReplaceMetadata("blurp", []byte("wrong"), []byte("new")); err != ErrMetadataChanged {
+			t.Errorf("%s: got %v replacing with the wrong old contents", backend, err)
+		}
+		if err := backend.ReplaceMetadata("blurp", []byte("hello"), []byte("new")); err == ErrReplaceUnsupported {
+			// Helper programs can't replace files atomically.
+			if !strings.Contains(backend.String(), "plugin:") {
+				t.Errorf("%s: %s", backend, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %s", backend, err)
+		}
+		if string(backend.ReadMetadata("blurp")) != "new" {
+			t.Errorf("%s: unexpected metadata value", backend)
+		}
+	}
+
+	// Metadata created by another process since the backend was created
+	// must be noticed, both on disk and via HTTP.
+	dir, err := ioutil.TempDir("", "bktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := httptest.NewServer(NewHTTPHandler(dir, nil))
+	defer server.Close()
+	for i, open := range []func() Backend{
+		func() Backend { return NewDisk(dir) },
+		func() Backend { return NewHTTP(server.URL, "", "") },
+	} {
+		a, b := open(), open()
+		name := fmt.Sprintf("race-%d", i)
+		if err := a.CreateMetadata(name, []byte("a")); err != nil {
+			t.Errorf("%s: %s", a, err)
+		}
+		if err := b.CreateMetadata(name, []byte("b")); err != ErrMetadataExists {
+			t.Errorf("%s: got %v creating metadata created by another process", b, err)
+		}
+		if err := b.ReplaceMetadata(name, []byte("b"), []byte("c")); err != ErrMetadataChanged {
+			t.Errorf("%s: got %v replacing metadata with the wrong old contents", b, err)
+		}
+		if got := string(open().ReadMetadata(name)); got != "a" {
+			t.Errorf("%s: got %q; expected \"a\"", b, got)
+		}
+
+		// Only one of two replacements of the same contents succeeds.
+		if err := b.ReplaceMetadata(name, []byte("a"), []byte("c")); err != nil {
+			t.Errorf("%s: %s", b, err)
+		}
+		if err := a.ReplaceMetadata(name, []byte("a"), []byte("d")); err != ErrMetadataChanged {
+			t.Errorf("%s: got %v replacing metadata replaced by another process", a, err)
+		}
+		if got := string(open().ReadMetadata(name)); got != "c" {
+			t.Errorf("%s: got %q; expected \"c\"", b, got)
+		}
+		pb := open().(*PackFileBackend)
+		if got, err := pb.readMetadataCopy(name); err != nil || string(got) != "c" {
+			t.Errorf("%s: got copy %q (%v); expected \"c\"", b, got, err)
+		}
+	}
+}
+
 func TestMany(t *testing.T) {
 	for _, backend := range getStorage(t) {
 		// Write 200 items, where the i'th item is i bytes long, all having
@@ -187,7 +359,11 @@ func getStorage(t *testing.T) []Backend {
 
 	b = append(b, NewMemory())
 	b = append(b, NewCompressed(NewMemory()))
+	b = append(b, NewDelta(NewCompressed(NewMemory())))
 	b = append(b, NewEncrypted(NewMemory(), "foobar"))
+	padded := NewMemory()
+	SetRepositoryPadding(padded)
+	b = append(b, NewEncrypted(padded, "foobar"))
 
 	i := 0
 	getDir := func() string {
@@ -211,5 +387,1454 @@ func getStorage(t *testing.T) []Backend {
 	b = append(b, NewEncrypted(NewDisk(getDir()), "foobar"))
 	b = append(b, NewCompressed(NewEncrypted(NewDisk(getDir()), "foobar")))
 
+	server := httptest.NewServer(NewHTTPHandler(getDir(), nil))
+	b = append(b, NewCompressed(NewEncrypted(NewHTTP(server.URL, "", ""), "foobar")))
+
+	b = append(b, NewEncrypted(newTestPlugin(t, getDir()), "foobar"))
+
 	return b
 }
+
+// When the test binary is run with BK_TEST_PLUGIN_DIR set, it acts as a
+// plugin helper that stores files in that directory.
+func TestMain(m *testing.M) {
+	if dir := os.Getenv("BK_TEST_PLUGIN_DIR"); dir != "" {
+		servePlugin(dir)
+		// Tests of failing helpers give the exit status to use.
+		status, _ := strconv.Atoi(os.Getenv("BK_TEST_PLUGIN_EXIT"))
+		os.Exit(status)
+	}
+	os.Exit(m.Run())
+}
+
+func newTestPlugin(t *testing.T, dir string) Backend {
+	os.Setenv("BK_TEST_PLUGIN_DIR", dir)
+	defer os.Unsetenv("BK_TEST_PLUGIN_DIR")
+	p, err := NewPlugin(os.Args[0])
+	if err != nil {
+		t.Fatalf("plugin: %v", err)
+	}
+	return p
+}
+
+// Closing a plugin's Backend waits for the helper to exit and reports
+// failures.
+func TestPluginClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, status := range []string{"0", "3"} {
+		os.Setenv("BK_TEST_PLUGIN_EXIT", status)
+		backend := newTestPlugin(t, dir)
+		os.Unsetenv("BK_TEST_PLUGIN_EXIT")
+		backend.WriteMetadata("closing-"+status, []byte(status))
+		backend.SyncWrites()
+		err := backend.(io.Closer).Close()
+		if status == "0" && err != nil {
+			t.Errorf("%s: %v", backend, err)
+		} else if status != "0" && (err == nil || !strings.Contains(err.Error(), "exit status 3")) {
+			t.Errorf("%s: got %v closing a helper that failed", backend, err)
+		}
+	}
+}
+
+// servePlugin implements the plugin protocol on standard input and
+// output, storing files in the given directory.
+func servePlugin(dir string) {
+	in := bufio.NewReader(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+	respond := func(err error, format string, args ...interface{}) {
+		switch {
+		case os.IsNotExist(err):
+			fmt.Fprintf(out, "notfound %s\n", err)
+		case os.IsExist(err):
+			fmt.Fprintf(out, "exists %s\n", err)
+		case err != nil:
+			fmt.Fprintf(out, "error %s\n", err)
+		default:
+			fmt.Fprintf(out, "ok"+format+"\n", args...)
+		}
+	}
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		op := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 2)
+		switch op[0] {
+		case "hello":
+			respond(nil, " 1")
+		case "create":
+			f := strings.SplitN(op[1], " ", 2)
+			n, _ := strconv.Atoi(f[0])
+			b := make([]byte, n)
+			if _, err := io.ReadFull(in, b); err != nil {
+				return
+			}
+			path := filepath.Join(dir, f[1])
+			os.MkdirAll(filepath.Dir(path), 0700)
+			tmp := fmt.Sprintf("%s.tmp-%d", path, rand.Int63())
+			err := ioutil.WriteFile(tmp, b, 0600)
+			if err == nil {
+				err = os.Link(tmp, path)
+			}
+			os.Remove(tmp)
+			respond(err, "")
+		case "read":
+			f := strings.SplitN(op[1], " ", 3)
+			offset, _ := strconv.ParseInt(f[0], 10, 64)
+			length, _ := strconv.ParseInt(f[1], 10, 64)
+			b, err := ioutil.ReadFile(filepath.Join(dir, f[2]))
+			if err == nil && offset <= int64(len(b)) {
+				b = b[offset:]
+				if length > 0 && length < int64(len(b)) {
+					b = b[:length]
+				}
+			}
+			respond(err, " %d", len(b))
+			if err == nil {
+				out.Write(b)
+			}
+		case "list":
+			var entries []string
+			fileinfo, _ := ioutil.ReadDir(filepath.Join(dir, op[1]))
+			for _, fi := range fileinfo {
+				if !strings.Contains(fi.Name(), ".tmp-") {
+					entries = append(entries, fmt.Sprintf("%d %s%s", fi.ModTime().Unix(),
+						op[1], fi.Name()))
+				}
+			}
+			respond(nil, " %d", len(entries))
+			for _, e := range entries {
+				fmt.Fprintf(out, "%s\n", e)
+			}
+		case "remove":
+			respond(os.Remove(filepath.Join(dir, op[1])), "")
+		default:
+			respond(fmt.Errorf("%s: unknown operation", op[0]), "")
+		}
+		out.Flush()
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, backend := range getStorage(t) {
+		chunk := genRandom(4096)
+		backend.Write(chunk)
+		backend.Write(chunk)
+		backend.SyncWrites()
+
+		s := backend.Stats()
+		if s.ChunksWritten != 2 || s.BytesWritten != 2*4096 {
+			t.Errorf("%s: expected 2 chunks / %d bytes written, got %d / %d",
+				backend, 2*4096, s.ChunksWritten, s.BytesWritten)
+		}
+		// The encrypted backend also stores its log of hashes at
+		// SyncWrites() time, so there may be more than one chunk stored.
+		if s.ChunksStored < 1 || s.BytesStored < 4096 {
+			t.Errorf("%s: expected at least 1 chunk / 4096 bytes stored, got %d / %d",
+				backend, s.ChunksStored, s.BytesStored)
+		}
+		if s.BytesStored >= s.BytesWritten {
+			t.Errorf("%s: deduplication not reflected in stats: %d stored, %d written",
+				backend, s.BytesStored, s.BytesWritten)
+		}
+	}
+}
+
+func TestFsckMetadataOnly(t *testing.T) {
+	path := "/tmp/bk_storage_test-fsck"
+	os.RemoveAll(path)
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	defer os.RemoveAll(path)
+
+	saved := log
+	SetLogger(u.NewLogger(false, false))
+	defer SetLogger(saved)
+
+	backend := NewDisk(path)
+	for i := 0; i < 10; i++ {
+		backend.Write(genRandom(1000))
+	}
+	backend.SyncWrites()
+
+	backend.Fsck(FsckOptions{MetadataOnly: true})
+	if log.NErrors != 0 {
+		t.Errorf("%d errors from fsck of valid repository", log.NErrors)
+	}
+
+	// Remove the pack file; the index still refers to it, so fsck should
+	// report an error even without reading any blobs.
+	packs, err := filepath.Glob(filepath.Join(path, "packs", "*.pack"))
+	if err != nil || len(packs) == 0 {
+		t.Fatalf("no pack files found: %v", err)
+	}
+	if err := os.Remove(packs[0]); err != nil {
+		t.Fatalf("%s: %v", packs[0], err)
+	}
+
+	NewDisk(path).Fsck(FsckOptions{MetadataOnly: true})
+	if log.NErrors == 0 {
+		t.Errorf("missing pack file not detected")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	for _, backend := range getStorage(t) {
+		const count = 200
+		chunks := make([][]byte, count)
+		hashes := make([]Hash, count)
+		for i := range chunks {
+			// Include some duplicates to exercise deduplication.
+			if i%10 == 9 {
+				chunks[i] = chunks[i-1]
+			} else {
+				chunks[i] = genRandom(1 + rand.Intn(10000))
+			}
+		}
+
+		var wg sync.WaitGroup
+		for i := range chunks {
+			wg.Add(1)
+			go func(i int) {
+				hashes[i] = backend.Write(chunks[i])
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+		backend.SyncWrites()
+
+		for i, hash := range hashes {
+			r, err := backend.Read(hash)
+			if err != nil {
+				t.Fatalf("%s: %d: read: %v", backend, i, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s: %d: read all: %v", backend, i, err)
+			}
+			if bytes.Compare(b, chunks[i]) != 0 {
+				t.Errorf("%s: %d: didn't get same bytes back", backend, i)
+			}
+		}
+		if s := backend.Stats(); s.ChunksWritten != count {
+			t.Errorf("%s: expected %d chunks written, got %d", backend, count,
+				s.ChunksWritten)
+		}
+	}
+}
+
+func TestHasher(t *testing.T) {
+	defer SetHashAlgorithm(DefaultHashAlgorithm)
+
+	b := make([]byte, 100000)
+	rand.Read(b)
+	for _, alg := range HashAlgorithms() {
+		if err := SetHashAlgorithm(alg); err != nil {
+			t.Fatalf("%s: %s", alg, err)
+		}
+		h := NewHasher()
+		for i := 0; i < len(b); i += 777 {
+			end := i + 777
+			if end > len(b) {
+				end = len(b)
+			}
+			h.Write(b[i:end])
+		}
+		if h.Sum() != HashBytes(b) {
+			t.Errorf("%s: incremental hash doesn't match HashBytes", alg)
+		}
+	}
+}
+
+func TestReadHashMismatch(t *testing.T) {
+	m := NewMemory().(*memory)
+	hash := m.Write([]byte("hello, world"))
+	m.blobs[hash][0] ^= 1
+
+	if _, err := m.Read(hash); err != ErrHashMismatch {
+		t.Errorf("expected ErrHashMismatch reading corrupted blob, got %v", err)
+	}
+}
+
+func TestBlobStream(t *testing.T) {
+	chunks := [][]byte{genRandom(100), genRandom(maxSpoolMemory + 12345),
+		bytes.Repeat(genRandom(1000), 3*maxSpoolMemory/1000)}
+	for _, backend := range getStorage(t) {
+		var hashes []Hash
+		for _, chunk := range chunks {
+			hash, err := backend.WriteBlobStream(bytes.NewReader(chunk))
+			if err != nil {
+				t.Fatalf("%s: write stream: %v", backend, err)
+			}
+			// Chunks written both ways should be deduplicated.
+			if h := backend.Write(chunk); h != hash {
+				t.Errorf("%s: %d bytes: Write gave hash %s; WriteBlobStream %s",
+					backend, len(chunk), h, hash)
+			}
+			hashes = append(hashes, hash)
+		}
+		backend.SyncWrites()
+
+		for i, hash := range hashes {
+			for _, read := range []func(Hash) (io.ReadCloser, error){backend.Read,
+				backend.ReadBlobStream} {
+				r, err := read(hash)
+				if err != nil {
+					t.Fatalf("%s: read: %v", backend, err)
+				}
+				b, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Errorf("%s: read all: %v", backend, err)
+				} else if !bytes.Equal(b, chunks[i]) {
+					t.Errorf("%s: read %d bytes that don't match the %d written",
+						backend, len(b), len(chunks[i]))
+				}
+			}
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write(chunks[0])
+			pw.CloseWithError(fmt.Errorf("read failed"))
+		}()
+		if _, err := backend.WriteBlobStream(pr); err == nil {
+			t.Errorf("%s: expected error from failed read", backend)
+		}
+	}
+}
+
+func TestReadBlobStreamHashMismatch(t *testing.T) {
+	dir := "/tmp/bk_storage_test-stream"
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0700)
+	defer os.RemoveAll(dir)
+
+	chunk := genRandom(4096)
+	backend := NewDisk(dir)
+	hash := backend.Write(chunk)
+	backend.SyncWrites()
+
+	// Corrupt the last byte of the chunk but not its Reed-Solomon
+	// encoding.
+	packs, err := filepath.Glob(filepath.Join(dir, "packs", "*.pack"))
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("%v: expected a single pack file: %v", packs, err)
+	}
+	b, err := ioutil.ReadFile(packs[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	b[len(b)-1] ^= 1
+	if err := ioutil.WriteFile(packs[0], b, 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	r, err := NewDisk(dir).ReadBlobStream(hash)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err != ErrHashMismatch {
+		t.Errorf("expected ErrHashMismatch, got %v", err)
+	}
+}
+
+func TestDiskRepair(t *testing.T) {
+	dir := "/tmp/bk_storage_test-repair"
+	os.RemoveAll(dir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("%s: %v", dir, err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := NewDisk(dir)
+	data := make([]byte, 10000)
+	rand.Read(data)
+	hash := backend.Write(data)
+	backend.SyncWrites()
+
+	// Corrupt a byte in the middle of the pack file.
+	packs, err := filepath.Glob(filepath.Join(dir, "packs", "*.pack"))
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("expected a single pack file; got %v (%v)", packs, err)
+	}
+	pack, err := ioutil.ReadFile(packs[0])
+	if err != nil {
+		t.Fatalf("%s: %v", packs[0], err)
+	}
+	pack[len(pack)/2] ^= 0xff
+	if err := ioutil.WriteFile(packs[0], pack, 0600); err != nil {
+		t.Fatalf("%s: %v", packs[0], err)
+	}
+
+	// Reading the blob should repair the pack file.
+	r, err := backend.Read(hash)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read all: %v", err)
+	}
+	if bytes.Compare(data, b) != 0 {
+		t.Errorf("repaired blob doesn't match the original data")
+	}
+	if err := checkEncoding(packs[0]); err != nil {
+		t.Errorf("%s: still corrupt after repair: %v", packs[0], err)
+	}
+}
+
+// countingFileStorage records how many bytes are read from pack files.
+type countingFileStorage struct {
+	FileStorage
+	packBytesRead int64
+}
+
+func (c *countingFileStorage) ReadFile(name string, offset, length int64) ([]byte, error) {
+	b, err := c.FileStorage.ReadFile(name, offset, length)
+	if strings.HasPrefix(name, "packs/") {
+		c.packBytesRead += int64(len(b))
+	}
+	return b, err
+}
+
+func TestJournalRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := NewDisk(dir)
+	backend.WriteMetadata("name", []byte("old"))
+	db := newDisk(dir)
+
+	// Leave behind the state of a transaction replacing the metadata that
+	// was interrupted after the new file was linked into place, as if it
+	// was started long ago.
+	interrupt := func(committed bool) {
+		tdir := filepath.Join(dir, journalDir, "1-1")
+		tx := &transaction{Create: []string{"metadata/name"}, Remove: []string{"metadata/name"},
+			db: db, dir: tdir}
+		if err := os.Mkdir(tdir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		writeSynced(tx.staged("create", 0), []byte("new"))
+		plan, _ := json.Marshal(tx)
+		writeSynced(filepath.Join(tdir, "plan"), plan)
+		if err := os.Rename(tx.path("metadata/name"), tx.staged("remove", 0)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(tx.staged("create", 0), tx.path("metadata/name")); err != nil {
+			t.Fatal(err)
+		}
+		if committed {
+			writeSynced(filepath.Join(tdir, "committed"), nil)
+		}
+	}
+	// Transactions are only recovered once the process committing them
+	// has stopped updating them.
+	age := func(d time.Duration) {
+		tdir := filepath.Join(dir, journalDir, "1-1")
+		then := time.Now().Add(-d)
+		if err := os.Chtimes(tdir, then, then); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		committed bool
+		expected  string
+	}{{false, "old"}, {true, "new"}} {
+		interrupt(c.committed)
+		age(journalHeartbeat)
+		if n := len(db.interruptedTransactions()); n != 0 {
+			t.Errorf("found %d interrupted transactions in progress; expected 0", n)
+		}
+		age(journalStaleAge)
+		if n := len(db.interruptedTransactions()); n != 1 {
+			t.Errorf("found %d interrupted transactions; expected 1", n)
+		}
+		db.RecoverTransactions()
+		if n := len(db.interruptedTransactions()); n != 0 {
+			t.Errorf("%d interrupted transactions remain after recovery", n)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dir, "metadata", "name")); err != nil {
+			t.Error(err)
+		} else if string(b) != c.expected {
+			t.Errorf("committed %v: got %q after recovery; expected %q", c.committed, b, c.expected)
+		}
+	}
+}
+
+func TestPackReadsSegments(t *testing.T) {
+	dir := "/tmp/bk_storage_test-segments"
+	os.RemoveAll(dir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("%s: %v", dir, err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := NewDisk(dir)
+	var hashes []Hash
+	for i := 0; i < 20; i++ {
+		hashes = append(hashes, backend.Write(genRandom(10000)))
+	}
+	backend.SyncWrites()
+
+	// Reading a chunk should only read its segment of the pack file.
+	fs := &countingFileStorage{FileStorage: &disk{dir: dir}}
+	backend = newPackFileBackend(fs, maxDiskPackFileSize)
+	r, err := backend.Read(hashes[10])
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("read all: %v", err)
+	}
+	if fs.packBytesRead < 10000 || fs.packBytesRead > 11000 {
+		t.Errorf("read %d bytes from pack files for a 10000 byte chunk",
+			fs.packBytesRead)
+	}
+
+	// Segments that extend past the end of the file are an error.
+	packs, err := filepath.Glob(filepath.Join(dir, "packs", "*.pack"))
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("expected a single pack file; got %v (%v)", packs, err)
+	}
+	fi, err := os.Stat(packs[0])
+	if err != nil {
+		t.Fatalf("%s: %v", packs[0], err)
+	}
+	name := "packs/" + filepath.Base(packs[0])
+	if _, err := fs.ReadFile(name, fi.Size()-5, 10); err == nil {
+		t.Errorf("%s: no error reading past the end", name)
+	}
+}
+
+// stallingFileStorage blocks closing the first pack file written until
+// release is closed, like a slow upload to cloud storage.
+type stallingFileStorage struct {
+	FileStorage
+	release chan struct{}
+	once    sync.Once
+}
+
+type stallingWriter struct {
+	RobustWriteCloser
+	release chan struct{}
+}
+
+func (s *stallingFileStorage) CreateFile(name string) RobustWriteCloser {
+	w := s.FileStorage.CreateFile(name)
+	stall := false
+	if strings.HasPrefix(name, "packs/") {
+		s.once.Do(func() { stall = true })
+	}
+	if stall {
+		return &stallingWriter{w, s.release}
+	}
+	return w
+}
+
+func (w *stallingWriter) Close() {
+	<-w.release
+	w.RobustWriteCloser.Close()
+}
+
+func TestSlowPackWrite(t *testing.T) {
+	dir := "/tmp/bk_storage_test-slow"
+	os.RemoveAll(dir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("%s: %v", dir, err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := &stallingFileStorage{FileStorage: newDisk(dir),
+		release: make(chan struct{})}
+	backend := newPackFileBackend(fs, 15000)
+
+	// Writes should continue to make progress into later pack files while
+	// the first one is stalled.
+	var hashes []Hash
+	for i := 0; i < 20; i++ {
+		hashes = append(hashes, backend.Write(genRandom(10000)))
+	}
+
+	// The index file for the stalled pack shouldn't have been written.
+	idx := filepath.Join(dir, "indices", hashes[0].String()+".idx")
+	if _, err := os.Stat(idx); err == nil {
+		t.Errorf("%s: index file written before its pack file", idx)
+	}
+
+	close(fs.release)
+	backend.SyncWrites()
+	if _, err := os.Stat(idx); err != nil {
+		t.Errorf("%s: %v", idx, err)
+	}
+
+	backend = newPackFileBackend(&disk{dir: dir}, maxDiskPackFileSize)
+	for _, h := range hashes {
+		if _, err := backend.Read(h); err != nil {
+			t.Errorf("%s: %v", h, err)
+		}
+	}
+}
+
+func TestMetadataCopies(t *testing.T) {
+	dir := "/tmp/bk_storage_test-metadata"
+	os.RemoveAll(dir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("%s: %v", dir, err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := NewDisk(dir)
+	backend.WriteMetadata("lost", []byte("lost contents"))
+	backend.WriteMetadata("damaged", []byte("damaged contents"))
+	backend.SyncWrites()
+
+	// Remove one of the metadata files and change the other. Since the
+	// changed one can still be read, it's trusted over its copy.
+	for _, name := range []string{"lost", "lost.rs", "damaged.rs"} {
+		if err := os.Remove(filepath.Join(dir, "metadata", name)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	damaged := filepath.Join(dir, "metadata", "damaged")
+	if err := ioutil.WriteFile(damaged, []byte("xxxxxxx contents"), 0600); err != nil {
+		t.Fatalf("%s: %v", damaged, err)
+	}
+
+	check := func(backend Backend) {
+		for name, contents := range map[string]string{"lost": "lost contents",
+			"damaged": "xxxxxxx contents"} {
+			if !backend.MetadataExists(name) {
+				t.Errorf("%s: metadata not found", name)
+			} else if b := backend.ReadMetadata(name); string(b) != contents {
+				t.Errorf("%s: got %q, expected %q", name, b, contents)
+			}
+		}
+	}
+	backend = NewDisk(dir)
+	check(backend)
+
+	// After repair, the lost metadata should be back and the changed
+	// one's copy should match it.
+	backend.Fsck(FsckOptions{MetadataOnly: true, Repair: true})
+	for name, path := range map[string]string{"lost contents": "metadata/lost",
+		"xxxxxxx contents": metadataCopyDir + "damaged"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, path))
+		if strings.HasPrefix(path, metadataCopyDir) {
+			b = bytes.TrimPrefix(b, metadataCopy([]byte(name))[:sha256.Size])
+		}
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if string(b) != name {
+			t.Errorf("%s: unexpected contents %q after repair", path, b)
+		}
+	}
+	check(NewDisk(dir))
+}
+
+func TestHTTPRoles(t *testing.T) {
+	dir := "/tmp/bk_storage_test-http"
+	os.RemoveAll(dir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("%s: %v", dir, err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only admin tokens may create metadata that CheckMetadata rejects.
+	check := func(name string, contents []byte) error {
+		if strings.HasPrefix(name, "no-") && string(contents) == "contents" {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	tokens := map[string]HTTPToken{"r": {Role: RoleReadOnly},
+		"a": {Role: RoleAppendOnly, CheckMetadata: check},
+		"x": {Role: RoleAdmin, CheckMetadata: check}}
+	server := httptest.NewServer(NewHTTPHandler(dir, tokens))
+	defer server.Close()
+
+	backend := NewHTTP(server.URL, "a", "")
+	hash := backend.Write([]byte("hello, world"))
+	backend.WriteMetadata("foo", hash[:])
+	backend.SyncWrites()
+
+	// Read-only clients can see everything.
+	backend = NewHTTP(server.URL, "r", "")
+	if !backend.MetadataExists("foo") {
+		t.Fatalf("metadata not found by read-only client")
+	}
+	r, err := backend.Read(hash)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "hello, world" {
+		t.Errorf("read %q (%v)", b, err)
+	}
+
+	status := func(method, path, token string) int {
+		req, err := http.NewRequest(method, server.URL+"/v1/"+path,
+			strings.NewReader("contents"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Bk-Sha256",
+			"d1b2a59fbea7e20077af9f91b27e95e865061b270be03ff539ab3b73587882e8")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, c := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{"GET", "files/metadata/foo", "bad", http.StatusUnauthorized},
+		{"GET", "files/metadata/foo", "", http.StatusUnauthorized},
+		{"GET", "files/metadata/foo.rs", "x", http.StatusNotFound},
+		{"GET", "files/metadata/../../etc", "x", http.StatusNotFound},
+		{"PUT", "files/metadata/bar", "r", http.StatusForbidden},
+		{"PUT", "files/metadata/foo", "a", http.StatusConflict},
+		{"DELETE", "files/metadata/foo", "r", http.StatusForbidden},
+		{"DELETE", "files/metadata/foo", "a", http.StatusForbidden},
+		{"PUT", "files/metadata-copies/foo", "a", http.StatusForbidden},
+		{"DELETE", "files/metadata-copies/foo", "a", http.StatusForbidden},
+		{"PUT", "files/metadata/bar", "a", http.StatusCreated},
+		{"PUT", "files/metadata/no-bar", "a", http.StatusForbidden},
+		{"PUT", "files/metadata/no-bar", "x", http.StatusCreated},
+		{"DELETE", "files/metadata/foo", "x", http.StatusNoContent},
+	} {
+		if s := status(c.method, c.path, c.token); s != c.status {
+			t.Errorf("%s %s with token %q: got status %d, expected %d", c.method,
+				c.path, c.token, s, c.status)
+		}
+	}
+
+	// Replacing files loses their contents, so it requires an admin
+	// token.
+	appender := NewHTTP(server.URL, "a", "").(*PackFileBackend)
+	if err := appender.CreateMetadata("sig", []byte("old")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	sum := sha256.Sum256([]byte("old"))
+	if err := appender.fs.(*httpFileStorage).put("metadata/sig", []byte("new"),
+		`"`+hex.EncodeToString(sum[:])+`"`); err == nil {
+		t.Errorf("replace with append-only token succeeded")
+	}
+	admin := NewHTTP(server.URL, "x", "")
+	if err := admin.ReplaceMetadata("sig", []byte("old"), []byte("new")); err != nil {
+		t.Errorf("replace with admin token: %v", err)
+	}
+
+	// The server maintains the metadata copies itself.
+	for name, contents := range map[string]string{"bar": "contents", "sig": "new"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, metadataCopyDir+name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(b, metadataCopy([]byte(contents))) {
+			t.Errorf("%s: unexpected copy %q", name, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, metadataCopyDir+"foo")); !os.IsNotExist(err) {
+		t.Errorf("foo: copy not removed along with the metadata (%v)", err)
+	}
+
+	// Errors from the disk are reported to the client rather than ending
+	// the server.
+	if err := os.RemoveAll(filepath.Join(dir, "metadata")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "metadata"), nil, 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, c := range []struct{ method, path string }{
+		{"PUT", "files/metadata/baz"},
+		{"GET", "files?prefix=metadata/"},
+	} {
+		if s := status(c.method, c.path, "x"); s != http.StatusInternalServerError {
+			t.Errorf("%s %s: got status %d, expected %d", c.method, c.path, s,
+				http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestHTTPListingCache(t *testing.T) {
+	dir := "/tmp/bk_storage_test-http-listing"
+	cacheDir := dir + "-cache"
+	for _, d := range []string{dir, cacheDir} {
+		os.RemoveAll(d)
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatalf("%s: %v", d, err)
+		}
+		defer os.RemoveAll(d)
+	}
+
+	// Count the listings that the server sends in full and the ones it
+	// reports as unchanged.
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	handler := NewHTTPHandler(dir, nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/files" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		mu.Lock()
+		statuses[rec.Code]++
+		mu.Unlock()
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	defer server.Close()
+	// counts returns the number of full and unchanged listings sent since
+	// the last call.
+	counts := func() (full, unchanged int) {
+		mu.Lock()
+		defer mu.Unlock()
+		full, unchanged = statuses[http.StatusOK], statuses[http.StatusNotModified]
+		statuses = make(map[int]int)
+		return
+	}
+
+	backend := NewHTTP(server.URL, "", cacheDir)
+	if full, _ := counts(); full == 0 {
+		t.Errorf("no listings were sent to a client without cached ones")
+	}
+	backend.WriteMetadata("foo", []byte("foo"))
+	backend.SyncWrites()
+	// The listings that changed with the writes are sent in full to the
+	// next client.
+	NewHTTP(server.URL, "", cacheDir)
+	counts()
+
+	// Later clients should use the cached listings but still see changes.
+	backend = NewHTTP(server.URL, "", cacheDir)
+	if !backend.MetadataExists("foo") {
+		t.Errorf("foo: metadata not found")
+	}
+	if full, unchanged := counts(); full != 0 || unchanged == 0 {
+		t.Errorf("got %d full and %d unchanged listings with nothing changed; "+
+			"expected only unchanged ones", full, unchanged)
+	}
+	backend.WriteMetadata("bar", []byte("bar"))
+	backend.SyncWrites()
+	counts()
+
+	backend = NewHTTP(server.URL, "", cacheDir)
+	for _, name := range []string{"foo", "bar"} {
+		if !backend.MetadataExists(name) {
+			t.Errorf("%s: metadata not found", name)
+		}
+	}
+	if full, _ := counts(); full == 0 {
+		t.Errorf("changed listing wasn't sent again")
+	}
+}
+
+func TestRequireFormat(t *testing.T) {
+	m := NewMemory()
+	if v := RepositoryFormat(m); v != 1 {
+		t.Errorf("new repository at format %d, expected 1", v)
+	}
+	SetRepositoryFormat(m, 2)
+	RequireFormat(m, 5)
+	if v := RepositoryFormat(m); v != 5 {
+		t.Errorf("format %d after requiring 5", v)
+	}
+	// Requiring an older format leaves the repository's alone.
+	RequireFormat(m, 3)
+	if v := RepositoryFormat(m); v != 5 {
+		t.Errorf("format %d after requiring 3", v)
+	}
+	if m.MetadataExists(formatPrefix + "3") {
+		t.Errorf("format 3 recorded in a repository at format 5")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	for n := 0; n < 1<<20; n += 1 + n/64 {
+		p := paddedSize(n)
+		if p < n || float64(p) > 1.12*float64(n)+1 {
+			t.Errorf("%d: padded to %d", n, p)
+		}
+	}
+
+	m := NewMemory()
+	SetRepositoryPadding(m)
+	backend := NewEncrypted(m, "foobar")
+	sizes := make(map[int64]bool)
+	for n := 10000; n < 11000; n++ {
+		chunk := genRandom(n)
+		hash := backend.Write(chunk)
+		size, err := backend.BlobSize(hash)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		sizes[size] = true
+
+		r, err := backend.Read(hash)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, chunk) {
+			t.Errorf("%d: padded chunk not read back correctly (%v)", n, err)
+		}
+	}
+	// With 13 bits for the size, chunks of around 10k are padded to
+	// multiples of 128 bytes.
+	if len(sizes) > 10 {
+		t.Errorf("%d distinct sizes stored for 1000 chunks", len(sizes))
+	}
+}
+
+func TestDelta(t *testing.T) {
+	base := genRandom(64 * 1024)
+	for _, edit := range []func([]byte) []byte{
+		func(b []byte) []byte { b[1000] ^= 1; return b },
+		func(b []byte) []byte { return append(b[:5000], b[5100:]...) },
+		func(b []byte) []byte { return append(append(b[:2000:2000], genRandom(300)...), b[2000:]...) },
+		func(b []byte) []byte { return append(genRandom(100), b[:len(b)-100]...) },
+	} {
+		chunk := edit(append([]byte(nil), base...))
+		if d, err := applyDelta(base, encodeDelta(base, chunk)); err != nil || !bytes.Equal(d, chunk) {
+			t.Errorf("delta not applied correctly (%v)", err)
+		}
+	}
+	if _, err := applyDelta(base, []byte{deltaVersion, 10, deltaCopy, 0, 20}); err != errCorruptDelta {
+		t.Errorf("expected errCorruptDelta for delta of the wrong length, got %v", err)
+	}
+
+	m := NewMemory()
+	backend := NewDelta(NewCompressed(m))
+	backend.Write(base)
+	backend.SyncWrites()
+
+	modified := append([]byte(nil), base...)
+	copy(modified[30000:], genRandom(100))
+	before := backend.Stats().BytesStored
+	hash := backend.Write(modified)
+	if h := backend.Write(modified); h != hash {
+		t.Errorf("identical chunks stored with different hashes")
+	}
+	backend.SyncWrites()
+	if stored := backend.Stats().BytesStored - before; stored > 4096 {
+		t.Errorf("%d bytes stored for similar chunk", stored)
+	}
+
+	// The chunk should be readable by a new backend, using the log.
+	for _, b := range []Backend{backend, NewDelta(NewCompressed(m))} {
+		for _, read := range []func(Hash) (io.ReadCloser, error){b.Read, b.ReadBlobStream} {
+			r, err := read(hash)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if c, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(c, modified) {
+				t.Errorf("delta chunk not read back correctly (%v)", err)
+			}
+			r.Close()
+		}
+	}
+	if bases := DeltaBases(backend); len(bases) != 1 || !m.HashExists(bases[hash]) {
+		t.Errorf("expected a single delta base, got %v", bases)
+	}
+	if logs := DeltaLogHashes(backend); len(logs) != 2 {
+		t.Errorf("expected 2 delta logs, got %d", len(logs))
+	}
+}
+
+func TestCompressedFormats(t *testing.T) {
+	for _, c := range []struct {
+		data       string
+		compressed bool
+	}{
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", true},
+		{"\x1f\x8b\x08\x00", true},
+		{"\x00\x00\x00\x18ftypmp42", true},
+		{"%PDF-1.7\n", true},
+		{"hello, world", false},
+		{"\x1f", false},
+		{"", false},
+	} {
+		if IsCompressedFormat([]byte(c.data)) != c.compressed {
+			t.Errorf("%q: expected IsCompressedFormat to return %v", c.data, c.compressed)
+		}
+	}
+
+	// Compressible data that's written via NewUncompressed or that starts
+	// with a signature should be stored as is, but read back normally.
+	zeros := make([]byte, 65536)
+	jpeg := append([]byte("\xff\xd8\xff\xe0"), zeros...)
+	m := NewMemory()
+	backend := NewCached(NewDelta(NewCompressed(m)), CacheOptions{MemoryBytes: 1 << 20})
+	for _, c := range []struct {
+		chunk []byte
+		write func([]byte) Hash
+	}{
+		{jpeg, backend.Write},
+		{zeros, NewUncompressed(backend).Write},
+	} {
+		hash := c.write(c.chunk)
+		if n, err := m.BlobSize(hash); err != nil || n != int64(len(c.chunk)+1) {
+			t.Errorf("%d byte chunk stored in %d bytes (%v)", len(c.chunk), n, err)
+		}
+		r, err := backend.Read(hash)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, c.chunk) {
+			t.Errorf("uncompressed chunk not read back correctly (%v)", err)
+		}
+		r.Close()
+	}
+	if h, err := NewCompressed(m).WriteBlobStream(bytes.NewReader(jpeg)); err != nil {
+		t.Errorf("write stream: %v", err)
+	} else if n, _ := m.BlobSize(h); n != int64(len(jpeg)+1) {
+		t.Errorf("%d byte stream stored in %d bytes", len(jpeg), n)
+	}
+}
+
+func TestMetadataAuthentication(t *testing.T) {
+	m := NewMemory()
+	backend := NewEncrypted(m, "foobar")
+	backend.WriteMetadata("backup-a", []byte("root a"))
+	backend.WriteMetadataBatch(map[string][]byte{"backup-b": []byte("root b")})
+	backend.SyncWrites()
+
+	if b := backend.ReadMetadata("backup-a"); string(b) != "root a" {
+		t.Errorf("read %q, expected \"root a\"", b)
+	}
+	if b := backend.ReadMetadataBatch([]string{"backup-b"}); string(b["backup-b"]) != "root b" {
+		t.Errorf("batch read %q, expected \"root b\"", b["backup-b"])
+	}
+	if b := m.ReadMetadata("backup-a"); bytes.Equal(b, []byte("root a")) {
+		t.Errorf("metadata stored without a MAC")
+	}
+
+	// The repository's metadata is still authenticated when it's opened
+	// again.
+	eb := NewEncrypted(m, "foobar").(*encrypted)
+	if eb.macKey == nil {
+		t.Fatalf("metadata isn't authenticated after reopening")
+	}
+	if b, err := eb.verifyMetadata("backup-a", m.ReadMetadata("backup-a")); err != nil ||
+		string(b) != "root a" {
+		t.Errorf("verified %q (%v), expected \"root a\"", b, err)
+	}
+	// Other metadata's contents and modified contents are both rejected.
+	if _, err := eb.verifyMetadata("backup-a", m.ReadMetadata("backup-b")); err != ErrMetadataAuthentication {
+		t.Errorf("copied metadata: expected ErrMetadataAuthentication, got %v", err)
+	}
+	tampered := append([]byte(nil), m.ReadMetadata("backup-a")...)
+	tampered[0] ^= 1
+	if _, err := eb.verifyMetadata("backup-a", tampered); err != ErrMetadataAuthentication {
+		t.Errorf("modified metadata: expected ErrMetadataAuthentication, got %v", err)
+	}
+	if _, err := eb.verifyMetadata("backup-a", nil); err != ErrMetadataAuthentication {
+		t.Errorf("empty metadata: expected ErrMetadataAuthentication, got %v", err)
+	}
+	// If hash.txt were changed to select another algorithm, the MAC key
+	// would change with it.
+	other := &encrypted{backend: m, key: eb.key, macKey: metadataMACKey(eb.key, "sha256")}
+	if _, err := other.verifyMetadata("backup-a", m.ReadMetadata("backup-a")); err != ErrMetadataAuthentication {
+		t.Errorf("other hash algorithm: expected ErrMetadataAuthentication, got %v", err)
+	}
+
+	// The value that checks the passphrase depends on whether metadata is
+	// authenticated, so that removing the tag from encrypt.txt doesn't
+	// turn authentication off.
+	fields := strings.Fields(string(m.ReadMetadata("encrypt.txt")))
+	if len(fields) != 5 || fields[4] != authenticatedMetadataTag {
+		t.Fatalf("unexpected encrypt.txt contents: %q", fields)
+	}
+	derived := pbkdf2.Key([]byte("foobar"), decodeHexString(fields[0]), 65536, 64, sha256.New)
+	check := decodeHexString(fields[1])
+	if !bytes.Equal(passphraseCheck(derived[:32], true), check) ||
+		bytes.Equal(passphraseCheck(derived[:32], false), check) {
+		t.Errorf("passphrase check doesn't depend on metadata authentication")
+	}
+}
+
+func TestKDF(t *testing.T) {
+	for _, s := range []string{"argon2id iterations=3 memory=65536 threads=4",
+		"pbkdf2-sha256 iterations=600000"} {
+		p, err := ParseKDFParams(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+		} else if p.String() != s {
+			t.Errorf("%s: parsed to %+v, formatted as %q", s, p, p.String())
+		}
+	}
+	for _, s := range []string{"", "scrypt iterations=1", "argon2id iterations=0 memory=64 threads=1",
+		"argon2id iterations=1 memory=1 threads=1", "argon2id iterations=1 memory=64 threads=0",
+		"argon2id iterations=1 memory=8388608 threads=1", "pbkdf2-sha256 iterations=1 memory=64",
+		"pbkdf2-sha256 iterations", "pbkdf2-sha256 rounds=10"} {
+		if _, err := ParseKDFParams(s); err == nil {
+			t.Errorf("%q: invalid parameters accepted", s)
+		}
+	}
+
+	if p := RepositoryKDF(NewMemory()); p != LegacyKDF {
+		t.Errorf("got %+v for a repository without %s", p, kdfName)
+	}
+
+	// A repository with its own parameters can be reopened, and they
+	// determine the derived key.
+	params := KDFParams{Algorithm: KDFArgon2id, Iterations: 1, Memory: 64, Threads: 1}
+	m := NewMemory()
+	SetRepositoryKDF(m, params)
+	backend := NewEncrypted(m, "foobar")
+	hash := backend.Write([]byte("chunk"))
+	backend.SyncWrites()
+	if p := RepositoryKDF(m); p != params {
+		t.Errorf("recorded %+v, expected %+v", p, params)
+	}
+	r, err := NewEncrypted(m, "foobar").Read(hash)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "chunk" {
+		t.Errorf("read %q (%v), expected \"chunk\"", b, err)
+	}
+
+	salt := []byte("salt")
+	other := params
+	other.Iterations++
+	if bytes.Equal(params.derive("foobar", salt), other.derive("foobar", salt)) ||
+		bytes.Equal(params.derive("foobar", salt), LegacyKDF.derive("foobar", salt)) {
+		t.Errorf("different parameters derived the same key")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	readChunk := func(m Backend, hash Hash) {
+		t.Helper()
+		r, err := NewEncrypted(m, "foobar").Read(hash)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || string(b) != "chunk" {
+			t.Errorf("read %q (%v), expected \"chunk\"", b, err)
+		}
+	}
+
+	// Start with a repository that doesn't record its parameters.
+	m := NewMemory()
+	hash := NewEncrypted(m, "foobar").Write([]byte("chunk"))
+	m.SyncWrites()
+
+	params := KDFParams{Algorithm: KDFArgon2id, Iterations: 1, Memory: 64, Threads: 1}
+	if err := Rekey(m, "wrong", params); err == nil {
+		t.Errorf("rekeyed with the wrong passphrase")
+	}
+	if err := Rekey(m, "foobar", params); err != nil {
+		t.Fatalf("rekey: %v", err)
+	}
+	if p := RepositoryKDF(m); p != params {
+		t.Errorf("recorded %+v, expected %+v", p, params)
+	}
+	if m.MetadataExists(kdfRekeyName) {
+		t.Errorf("%s left behind", kdfRekeyName)
+	}
+	if v := RepositoryFormat(m); v < 7 {
+		t.Errorf("format version %d after rekey, expected at least 7", v)
+	}
+	readChunk(m, hash)
+
+	// If a rekey is interrupted after encrypt.txt is replaced, the new
+	// parameters are used until it's run again.
+	other := params
+	other.Iterations++
+	enc := m.ReadMetadata("encrypt.txt")
+	if err := Rekey(m, "foobar", other); err != nil {
+		t.Fatalf("rekey: %v", err)
+	}
+	m.DeleteMetadata(kdfName)
+	SetRepositoryKDF(m, params)
+	m.WriteMetadata(kdfRekeyName, []byte(other.String()+"\n"))
+	readChunk(m, hash)
+	if err := Rekey(m, "foobar", params); err != nil {
+		t.Fatalf("rekey: %v", err)
+	}
+	readChunk(m, hash)
+	if p := RepositoryKDF(m); p != params {
+		t.Errorf("recorded %+v, expected %+v", p, params)
+	}
+
+	// Likewise if it's interrupted before.
+	m.WriteMetadata(kdfRekeyName, []byte(other.String()+"\n"))
+	readChunk(m, hash)
+	if bytes.Equal(enc, m.ReadMetadata("encrypt.txt")) {
+		t.Errorf("encrypt.txt wasn't changed by rekeying")
+	}
+}
+
+func TestEncryptedConcurrentWrites(t *testing.T) {
+	m := NewMemory().(*memory)
+	backend := NewEncrypted(m, "foobar")
+	nblobs := len(m.blobs)
+
+	// Identical chunks that are written concurrently should only be
+	// stored once.
+	chunk := []byte("the same chunk")
+	var wg sync.WaitGroup
+	hashes := make([]Hash, 16)
+	for i := range hashes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hashes[i] = backend.Write(chunk)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, h := range hashes {
+		if h != hashes[0] {
+			t.Errorf("write %d returned %s, expected %s", i, h, hashes[0])
+		}
+	}
+	if n := len(m.blobs) - nblobs; n != 1 {
+		t.Errorf("%d blobs stored, expected 1", n)
+	}
+	backend.SyncWrites()
+}
+
+func TestEncryptionCanary(t *testing.T) {
+	m := NewMemory()
+	eb := NewEncrypted(m, "foobar").(*encrypted)
+	if !m.MetadataExists(canaryName) {
+		t.Fatalf("canary not written for a new repository")
+	}
+	if err := eb.checkCanary(); err != nil {
+		t.Errorf("%s", err)
+	}
+	key := eb.key
+	eb.key = append([]byte(nil), key...)
+	eb.key[0] ^= 1
+	if err := eb.checkCanary(); err == nil {
+		t.Errorf("canary decrypted with the wrong key")
+	}
+	eb.key = key
+
+	// Repositories without one get one once chunks are written.
+	m.DeleteMetadata(canaryName)
+	backend := NewEncrypted(m, "foobar")
+	backend.SyncWrites()
+	if m.MetadataExists(canaryName) {
+		t.Errorf("canary written without any chunks being written")
+	}
+	backend.Write([]byte("chunk"))
+	backend.SyncWrites()
+	if !m.MetadataExists(canaryName) {
+		t.Fatalf("canary not written for an existing repository")
+	}
+	if err := NewEncrypted(m, "foobar").(*encrypted).checkCanary(); err != nil {
+		t.Errorf("%s", err)
+	}
+}
+
+// corruptingBackend returns the wrong data for all chunks.
+type corruptingBackend struct {
+	Backend
+}
+
+func (c corruptingBackend) Read(hash Hash) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("garbage")), nil
+}
+
+func TestVerified(t *testing.T) {
+	m := NewMemory()
+	hash := m.Write([]byte("hello, world"))
+
+	r, err := NewVerified(m).Read(hash)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "hello, world" {
+		t.Errorf("read %q (%v)", b, err)
+	}
+
+	if _, err := NewVerified(corruptingBackend{m}).Read(hash); err != ErrHashMismatch {
+		t.Errorf("expected ErrHashMismatch, got %v", err)
+	}
+}
+
+// countingBackend records how many chunks are read from it.
+type countingBackend struct {
+	Backend
+	mu    sync.Mutex
+	reads int
+}
+
+func (c *countingBackend) Read(hash Hash) (io.ReadCloser, error) {
+	c.mu.Lock()
+	c.reads++
+	c.mu.Unlock()
+	return c.Backend.Read(hash)
+}
+
+func TestCached(t *testing.T) {
+	dir := "/tmp/bk_storage_test-cache"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	mem := &countingBackend{Backend: NewMemory()}
+	var hashes []Hash
+	var chunks [][]byte
+	for i := 0; i < 20; i++ {
+		chunks = append(chunks, genRandom(1000))
+		hashes = append(hashes, mem.Write(chunks[i]))
+	}
+	read := func(b Backend, i int) {
+		r, err := b.Read(hashes[i])
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, chunks[i]) {
+			t.Errorf("%d: incorrect data read (%v)", i, err)
+		}
+	}
+
+	// Room for 10 chunks in memory; all of them fit on disk.
+	opts := CacheOptions{MemoryBytes: 10000, Dir: dir, DiskBytes: 100000}
+	c := NewCached(mem, opts)
+	for i := 0; i < 20; i++ {
+		read(c, i)
+		read(c, i)
+	}
+	if mem.reads != 20 {
+		t.Errorf("%d reads from backend; expected 20", mem.reads)
+	}
+
+	// The first ones have been evicted from memory but are still on disk.
+	read(c, 0)
+	if mem.reads != 20 {
+		t.Errorf("%d reads from backend after reading from disk cache", mem.reads)
+	}
+
+	// A new cache starts with the chunks on disk.
+	c = NewCached(mem, opts)
+	for i := 0; i < 20; i++ {
+		read(c, i)
+	}
+	if mem.reads != 20 {
+		t.Errorf("%d reads from backend with existing disk cache", mem.reads)
+	}
+
+	// Shrinking the disk cache evicts files.
+	opts.DiskBytes = 5000
+	NewCached(mem, opts)
+	if n := c.(*cached).diskUsage(); n > 5000 {
+		t.Errorf("disk cache holds %d bytes after trimming", n)
+	}
+}
+
+// With an encrypted repository, the disk cache can be used below the
+// encryption so that it doesn't hold the chunks' contents.
+func TestCachedEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := &countingBackend{Backend: NewMemory()}
+	opts := CacheOptions{Dir: dir, DiskBytes: 100000}
+	chunk := bytes.Repeat([]byte("secret "), 100)
+	hash := NewEncrypted(NewCached(mem, opts), "foobar").Write(chunk)
+	for i := 0; i < 2; i++ {
+		eb := NewEncrypted(NewCached(mem, opts), "foobar")
+		r, err := eb.Read(hash)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, chunk) {
+			t.Errorf("incorrect data read (%v)", err)
+		}
+	}
+	if mem.reads != 1 {
+		t.Errorf("%d reads from backend; expected 1", mem.reads)
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil || len(fis) != 1 {
+		t.Fatalf("expected one cached chunk, got %d (%v)", len(fis), err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, fis[0].Name())); err != nil {
+		t.Errorf("%v", err)
+	} else if bytes.Contains(b, []byte("secret")) {
+		t.Errorf("cached chunk isn't encrypted")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	mem := &countingBackend{Backend: NewMemory()}
+	var hashes []Hash
+	for i := 0; i < 100; i++ {
+		hashes = append(hashes, mem.Write(genRandom(1000)))
+	}
+
+	c := NewCached(mem, CacheOptions{MemoryBytes: 1 << 20, PrefetchJobs: 4})
+	for _, h := range hashes {
+		c.(Prefetcher).Prefetch(h)
+	}
+	for _, h := range hashes {
+		r, err := c.Read(h)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || HashBytes(b) != h {
+			t.Errorf("%s: incorrect data read (%v)", h, err)
+		}
+	}
+	// Each chunk should have been read once, either when it was
+	// prefetched or when it was read if it hadn't been yet.
+	if mem.reads != len(hashes) {
+		t.Errorf("%d reads from backend; expected %d", mem.reads, len(hashes))
+	}
+}
+
+func TestRegister(t *testing.T) {
+	mem := NewMemory()
+	var opened string
+	Register("test-mem", func(location string) (Backend, error) {
+		opened = location
+		return mem, nil
+	})
+
+	if b, err := Open("test-mem://repo"); err != nil || b != mem {
+		t.Errorf("test-mem://repo: got %v, %v; expected the registered backend", b, err)
+	} else if opened != "test-mem://repo" {
+		t.Errorf("factory called with %q", opened)
+	}
+	if _, err := Open("unregistered://repo"); err == nil {
+		t.Errorf("unregistered://repo: expected an error")
+	}
+
+	for _, scheme := range []string{"test-mem", "", "1abc", "a/b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%q: Register didn't panic", scheme)
+				}
+			}()
+			Register(scheme, func(string) (Backend, error) { return mem, nil })
+		}()
+	}
+}
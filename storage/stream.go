@@ -0,0 +1,228 @@
+// storage/stream.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+// Support for passing chunks through Backends' WriteBlobStream and
+// ReadBlobStream methods without holding all of their data in memory.
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// StreamingFileStorage is implemented by FileStorage implementations that
+// can return the contents of a file incrementally, so that large blobs
+// don't need to be read into memory all at once.
+type StreamingFileStorage interface {
+	// OpenFile returns an io.ReadCloser for the segment of the given file
+	// specified as for ReadFile.
+	OpenFile(name string, offset int64, length int64) (io.ReadCloser, error)
+}
+
+// Chunks passed to WriteBlobStream are kept in memory up to this size;
+// larger ones are spooled to a temporary file.
+const maxSpoolMemory = 8 * 1024 * 1024
+
+// openChunk returns an io.ReadCloser for the given chunk. Chunks stored in
+// more than maxSpoolMemory bytes are read with ReadBlobStream, so that
+// they're never held in memory; others are read with Read, which repairs
+// damaged pack files.
+func openChunk(backend Backend, hash Hash) (io.ReadCloser, error) {
+	if size, err := backend.BlobSize(hash); err == nil && size > maxSpoolMemory {
+		return backend.ReadBlobStream(hash)
+	}
+	return backend.Read(hash)
+}
+
+// readChunk reads the chunk that r supplies and closes r. Chunks larger
+// than maxSpoolMemory (which may be much smaller in storage, if they
+// compress well) aren't read in full; for them, the start of the chunk is
+// returned along with r, which the rest of it must then be read from.
+func readChunk(r io.ReadCloser) ([]byte, io.ReadCloser, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSpoolMemory+1))
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	if len(data) > maxSpoolMemory {
+		return data, r, nil
+	}
+	return data, nil, r.Close()
+}
+
+// Size of the pieces in which spooled chunks are sent to pack files.
+const spoolPieceSize = 1024 * 1024
+
+// spool accumulates the data written to it, computing its hash and size,
+// so that Backends can learn them before they store it. Once all of the
+// data has been written, it can be read back once; Close must then be
+// called to remove its temporary file, if it has one.
+type spool struct {
+	hasher Hasher
+	hash   *Hash
+	size   int64
+	buf    bytes.Buffer
+	// Non-nil once more than maxSpoolMemory bytes have been written.
+	file *os.File
+	// Set when reading starts.
+	r io.Reader
+}
+
+func newSpool() *spool {
+	return &spool{hasher: NewHasher()}
+}
+
+// asSpool returns r if it's a spool that a Backend above this one has
+// already filled; otherwise it returns a new spool with everything read
+// from r.
+func asSpool(r io.Reader) (*spool, error) {
+	if s, ok := r.(*spool); ok && s.r == nil {
+		return s, nil
+	}
+	s := newSpool()
+	if _, err := io.Copy(s, r); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	log.Check(s.r == nil && s.hash == nil)
+	if s.file == nil && int64(s.buf.Len()+len(b)) > maxSpoolMemory {
+		f, err := ioutil.TempFile("", "bk-chunk")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		if _, err := f.Write(s.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(b)
+	} else {
+		n, err = s.buf.Write(b)
+	}
+	s.hasher.Write(b[:n])
+	s.size += int64(n)
+	return n, err
+}
+
+// Hash returns the hash of the data written to the spool; no more may be
+// written after it's called.
+func (s *spool) Hash() Hash {
+	if s.hash == nil {
+		h := s.hasher.Sum()
+		s.hash = &h
+	}
+	return *s.hash
+}
+
+// Read returns the data that was written to the spool.
+func (s *spool) Read(b []byte) (int, error) {
+	if s.r == nil {
+		if s.file != nil {
+			if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+			s.r = s.file
+		} else {
+			s.r = &s.buf
+		}
+	}
+	return s.r.Read(b)
+}
+
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if rerr := os.Remove(s.file.Name()); err == nil {
+		err = rerr
+	}
+	s.file = nil
+	return err
+}
+
+// verifyingReader returns the chunk read from r, returning ErrHashMismatch
+// rather than io.EOF at the end if its hash isn't the expected one.
+type verifyingReader struct {
+	r      io.Reader
+	c      io.Closer
+	hasher Hasher
+	hash   Hash
+	// Set once r has returned io.EOF.
+	err error
+}
+
+func newVerifyingReader(r io.ReadCloser, hash Hash) io.ReadCloser {
+	return &verifyingReader{r: r, c: r, hasher: NewHasher(), hash: hash}
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(b)
+	v.hasher.Write(b[:n])
+	if err == io.EOF {
+		v.err = io.EOF
+		if v.hasher.Sum() != v.hash {
+			v.err = ErrHashMismatch
+		}
+		err = v.err
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.c.Close()
+}
+
+// drainingReader returns the first n bytes read from r. After those, it
+// reads and discards the rest of r, so that errors reported at its end,
+// such as ErrHashMismatch from a verifyingReader, aren't missed.
+type drainingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (d *drainingReader) Read(b []byte) (int, error) {
+	if d.n <= 0 {
+		if _, err := io.Copy(ioutil.Discard, d.r); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(b)) > d.n {
+		b = b[:d.n]
+	}
+	n, err := d.r.Read(b)
+	d.n -= int64(n)
+	if err == io.EOF && d.n > 0 {
+		err = ErrPrematureEndOfData
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// zeros is an io.Reader that returns an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
@@ -0,0 +1,58 @@
+// storage/verified.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// verified implements the storage.Backend interface. It passes everything
+// through to the underlying Backend, but checks the hash of each chunk
+// that's read.
+type verified struct {
+	// Everything other than Read and ReadBlobStream is handled by the
+	// underlying Backend.
+	Backend
+}
+
+// NewVerified returns a storage.Backend that recomputes the hash of each
+// chunk that's read from the given backend and returns ErrHashMismatch if
+// it doesn't match. Backends that store chunks already check their hashes
+// as they read them; this is an additional check that doesn't depend on
+// their doing so correctly.
+func NewVerified(backend Backend) Backend {
+	return &verified{backend}
+}
+
+func (v *verified) String() string {
+	return "verified " + v.Backend.String()
+}
+
+func (v *verified) Read(hash Hash) (io.ReadCloser, error) {
+	r, err := v.Backend.Read(hash)
+	if err != nil {
+		return r, err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if HashBytes(b) != hash {
+		return nil, ErrHashMismatch
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (v *verified) ReadBlobStream(hash Hash) (io.ReadCloser, error) {
+	r, err := v.Backend.ReadBlobStream(hash)
+	if err != nil {
+		return r, err
+	}
+	return newVerifyingReader(r, hash), nil
+}
@@ -17,12 +17,30 @@ import (
 // Logger provides a simple logging system with a few different log levels;
 // debugging and verbose output may both be suppressed independently.
 type Logger struct {
-	NErrors int
-	mu      sync.Mutex
-	debug   io.Writer
-	verbose io.Writer
-	warning io.Writer
-	err     io.Writer
+	NErrors    int
+	mu         sync.Mutex
+	debug      io.Writer
+	verbose    io.Writer
+	warning    io.Writer
+	err        io.Writer
+	fatalHooks []func(msg string)
+	inFatal    bool
+	// If true, warnings and errors are printed in color.
+	color bool
+	// If non-nil, messages are sent to the system log instead.
+	sys syslogWriter
+}
+
+// syslogWriter has the methods of *syslog.Writer that are used to send
+// messages to the system log with the priority for each log level; see
+// EnableSyslog.
+type syslogWriter interface {
+	Crit(m string) error
+	Err(m string) error
+	Warning(m string) error
+	Notice(m string) error
+	Info(m string) error
+	Debug(m string) error
 }
 
 func NewLogger(verbose, debug bool) *Logger {
@@ -38,8 +56,88 @@ func NewLogger(verbose, debug bool) *Logger {
 	return l
 }
 
+// SetColor sets whether warnings and errors are printed in color; it
+// should only be enabled when they're going to a terminal.
+func (l *Logger) SetColor(color bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.color = color
+}
+
+// paint returns the given message with the given ANSI color, if colors
+// are enabled. The trailing newline is left uncolored.
+func (l *Logger) paint(s, color string) string {
+	if !l.color {
+		return s
+	}
+	return "\x1b[" + color + "m" + strings.TrimSuffix(s, "\n") + "\x1b[0m\n"
+}
+
+const (
+	warningColor = "33"
+	errorColor   = "31"
+)
+
+// emit prints the given message to w, in the given color if it's
+// non-empty, or, if the system log is enabled, sends it there using the
+// given method, which determines its priority. l.mu must be held.
+func (l *Logger) emit(w io.Writer, msg, color string,
+	send func(syslogWriter, string) error) {
+	if l.sys != nil {
+		send(l.sys, strings.TrimSuffix(msg, "\n"))
+		return
+	}
+	if color != "" {
+		msg = l.paint(msg, color)
+	}
+	fmt.Fprint(w, msg)
+}
+
+// AddFatalHook registers a function that is called with the error message
+// when a fatal error is reported via Fatal, Check, or CheckError, just
+// before the program exits.
+func (l *Logger) AddFatalHook(f func(msg string)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fatalHooks = append(l.fatalHooks, f)
+}
+
+// runFatalHooks must be called without l.mu held, since the hooks may
+// themselves log messages. Hooks are only run once, even if one of them
+// reports a fatal error.
+func (l *Logger) runFatalHooks(msg string) {
+	l.mu.Lock()
+	if l.inFatal {
+		l.mu.Unlock()
+		return
+	}
+	l.inFatal = true
+	hooks := l.fatalHooks
+	l.mu.Unlock()
+
+	for _, h := range hooks {
+		h(msg)
+	}
+}
+
+// RunFatalHooks runs the functions registered with AddFatalHook, for
+// fatal errors that are reported without using Fatal.
+func (l *Logger) RunFatalHooks(msg string) {
+	if l != nil {
+		l.runFatalHooks(msg)
+	}
+}
+
 func (l *Logger) Print(f string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "%s", format(f, args...))
+	msg := format(f, args...)
+	if l == nil {
+		fmt.Fprint(os.Stderr, msg)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.emit(os.Stderr, msg, "", syslogWriter.Notice)
 }
 
 func (l *Logger) Debug(f string, args ...interface{}) {
@@ -53,7 +151,7 @@ func (l *Logger) Debug(f string, args ...interface{}) {
 	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	fmt.Fprint(l.debug, format(f, args...))
+	l.emit(l.debug, format(f, args...), "", syslogWriter.Debug)
 }
 
 func (l *Logger) Verbose(f string, args ...interface{}) {
@@ -67,7 +165,7 @@ func (l *Logger) Verbose(f string, args ...interface{}) {
 	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	fmt.Fprint(l.verbose, format(f, args...))
+	l.emit(l.verbose, format(f, args...), "", syslogWriter.Info)
 }
 
 func (l *Logger) Warning(f string, args ...interface{}) {
@@ -78,7 +176,7 @@ func (l *Logger) Warning(f string, args ...interface{}) {
 
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	fmt.Fprint(l.warning, format(f, args...))
+	l.emit(l.warning, format(f, args...), warningColor, syslogWriter.Warning)
 }
 
 func (l *Logger) Error(f string, args ...interface{}) {
@@ -90,7 +188,7 @@ func (l *Logger) Error(f string, args ...interface{}) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	l.NErrors++
-	fmt.Fprint(l.err, format(f, args...))
+	l.emit(l.err, format(f, args...), errorColor, syslogWriter.Err)
 }
 
 func (l *Logger) Fatal(f string, args ...interface{}) {
@@ -99,10 +197,12 @@ func (l *Logger) Fatal(f string, args ...interface{}) {
 		return
 	}
 
+	msg := format(f, args...)
 	l.mu.Lock()
-	defer l.mu.Unlock()
 	l.NErrors++
-	fmt.Fprint(l.err, format(f, args...))
+	l.emit(l.err, msg, errorColor, syslogWriter.Crit)
+	l.mu.Unlock()
+	l.runFatalHooks(msg)
 	os.Exit(1)
 }
 
@@ -115,21 +215,22 @@ func (l *Logger) Check(v bool, msg ...interface{}) {
 		return
 	}
 
-	var w io.Writer
-	if l != nil {
-		l.mu.Lock()
-		defer l.mu.Unlock()
-		l.NErrors++
-		w = l.err
+	var s string
+	if len(msg) == 0 {
+		s = format("Check failed\n")
 	} else {
-		w = os.Stderr
+		f := msg[0].(string)
+		s = format(f, msg[1:]...)
 	}
 
-	if len(msg) == 0 {
-		fmt.Fprint(w, format("Check failed\n"))
+	if l != nil {
+		l.mu.Lock()
+		l.NErrors++
+		l.emit(l.err, s, errorColor, syslogWriter.Crit)
+		l.mu.Unlock()
+		l.runFatalHooks(s)
 	} else {
-		f := msg[0].(string)
-		fmt.Fprint(w, format(f, msg[1:]...))
+		fmt.Fprint(os.Stderr, s)
 	}
 	os.Exit(1)
 }
@@ -141,21 +242,22 @@ func (l *Logger) CheckError(err error, msg ...interface{}) {
 		return
 	}
 
-	var w io.Writer
-	if l != nil {
-		l.mu.Lock()
-		defer l.mu.Unlock()
-		l.NErrors++
-		w = l.err
+	var s string
+	if len(msg) == 0 {
+		s = format("Error: %+v\n", err)
 	} else {
-		w = os.Stderr
+		f := msg[0].(string)
+		s = format(f, msg[1:]...)
 	}
 
-	if len(msg) == 0 {
-		fmt.Fprint(w, format("Error: %+v\n", err))
+	if l != nil {
+		l.mu.Lock()
+		l.NErrors++
+		l.emit(l.err, s, errorColor, syslogWriter.Crit)
+		l.mu.Unlock()
+		l.runFatalHooks(s)
 	} else {
-		f := msg[0].(string)
-		fmt.Fprint(w, format(f, msg[1:]...))
+		fmt.Fprint(os.Stderr, s)
 	}
 	panic(err)
 	os.Exit(1)
@@ -0,0 +1,35 @@
+// util/syslog.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package util
+
+import (
+	"log"
+	"log/syslog"
+)
+
+// EnableSyslog causes messages to be sent to the system log (and so to
+// the journal on systems with systemd) with the given tag, rather than
+// being printed to standard error. Fatal errors are logged with critical
+// priority and errors and warnings with theirs; messages from Print are
+// notices, while verbose and debugging output is logged with info and
+// debug priority, respectively.
+func (l *Logger) EnableSyslog(tag string) error {
+	w, err := syslog.New(syslog.LOG_USER|syslog.LOG_INFO, tag)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.sys = w
+	l.mu.Unlock()
+
+	// Progress reports are printed with the standard log package; send
+	// them along as well. The system log records the time itself.
+	log.SetOutput(w)
+	log.SetFlags(0)
+	return nil
+}
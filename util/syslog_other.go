@@ -0,0 +1,16 @@
+// util/syslog_other.go
+// Copyright(c) 2017 Matt Pharr
+// BSD licensed; see LICENSE for details.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package util
+
+import "errors"
+
+// EnableSyslog always fails, since there's no system log on this
+// platform.
+func (l *Logger) EnableSyslog(tag string) error {
+	return errors.New("the system log isn't supported on this platform")
+}
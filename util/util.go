@@ -8,6 +8,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -61,6 +65,60 @@ func (r *ReportingReader) Close() error {
 	return nil
 }
 
+///////////////////////////////////////////////////////////////////////////
+// ProgressReporter
+
+// ProgressReporter keeps track of how many items have been processed and
+// periodically logs the count and the rate of processing them. If Total
+// is non-zero, progress is reported relative to it.  Its methods may be
+// called concurrently.
+type ProgressReporter struct {
+	Msg               string
+	Total             int64
+	mu                sync.Mutex
+	start, lastReport time.Time
+	done              int64
+}
+
+const progressInterval = 10 * time.Second
+
+// Add records that n more items have been processed.
+func (p *ProgressReporter) Add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.start.IsZero() {
+		p.start = now
+		p.lastReport = now
+	}
+	p.done += n
+	if now.Sub(p.lastReport) >= progressInterval {
+		p.report("")
+		p.lastReport = now
+	}
+}
+
+// Finish logs the final count.
+func (p *ProgressReporter) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+	p.report("Finished. ")
+}
+
+func (p *ProgressReporter) report(prefix string) {
+	perSec := float64(p.done) / time.Now().Sub(p.start).Seconds()
+	if p.Total > 0 {
+		log.Printf("%s%s %d / %d (%.1f%%) [%.1f/s]", prefix, p.Msg, p.done, p.Total,
+			100*float64(p.done)/float64(p.Total), perSec)
+	} else {
+		log.Printf("%s%s %d [%.1f/s]", prefix, p.Msg, p.done, perSec)
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////
 // Utility Functions
 
@@ -79,3 +137,32 @@ func FmtBytes(n int64) string {
 		return fmt.Sprintf("%d B", n)
 	}
 }
+
+// ParseBytes parses a size like "500GB", "1.5 TiB", or "1000000". Units
+// with an "i" are powers of 1024, as printed by FmtBytes; the others are
+// powers of 1000.
+func ParseBytes(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"kiB", 1 << 10}, {"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"TiB", 1 << 40}, {"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"TB", 1e12}, {"B", 1},
+	}
+	num, scale := strings.TrimSpace(s), 1.
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, scale = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.scale
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%s: invalid size", s)
+	}
+	if v*scale >= math.MaxInt64 {
+		return 0, fmt.Errorf("%s: size is too large", s)
+	}
+	return int64(v * scale), nil
+}